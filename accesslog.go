@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// accessLog receives one JSON line per finished request or session: a
+	// file path or "stdout" (lines prefixed with "ACCESS ").
+	accessLog = getEnv("ACCESS_LOG", "")
+
+	accessOut *jsonlWriter
+
+	bytesTotal = newCounter("wsproxy_bytes_total",
+		"Bytes relayed per route and direction (up: client to backend), counted when sessions end.", "route", "direction")
+)
+
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	Session    uint64    `json:"session"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Route      string    `json:"route"`
+	Client     string    `json:"client"`
+	Identity   string    `json:"identity,omitempty"`
+	Method     string    `json:"method"`
+	Status     int       `json:"status"`
+	Upgraded   bool      `json:"upgraded"`
+	DurationMS int64     `json:"duration_ms"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+}
+
+func setupAccessLog() error {
+	w, err := openJSONL(accessLog, "ACCESS ")
+	if err != nil {
+		return fmt.Errorf("ACCESS_LOG: %w", err)
+	}
+	accessOut = w
+	return nil
+}
+
+// finish accounts for the session once the proxy is done with it; for
+// upgraded sessions that is when the tunnel has closed.
+func (s *session) finish(r *http.Request) {
+	if s.mirror != nil {
+		s.mirror.stop()
+	}
+	up, down := s.bytesUp.Load(), s.bytesDown.Load()
+	bytesTotal.add(float64(up), s.route, "up")
+	bytesTotal.add(float64(down), s.route, "down")
+	s.rt.scale.bytes.Add(up + down)
+	if s.identity != "" {
+		usage.record(s.identity, up, down)
+	}
+	reports.session(s, up, down)
+
+	status := int(s.status.Load())
+	if s.conn != nil {
+		if status == 0 {
+			status = http.StatusSwitchingProtocols
+		}
+		sessionDuration.observe(time.Since(s.started).Seconds(), s.route)
+	}
+	accessOut.write(accessEntry{
+		Time:       time.Now().UTC(),
+		Session:    s.id,
+		RequestID:  s.requestID,
+		Route:      s.route,
+		Client:     s.remote,
+		Identity:   s.identity,
+		Method:     r.Method,
+		Status:     status,
+		Upgraded:   s.conn != nil,
+		DurationMS: time.Since(s.started).Milliseconds(),
+		BytesUp:    up,
+		BytesDown:  down,
+	})
+}
+
+// countingReader counts bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
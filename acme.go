@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// With ACME_DOMAINS, certificates for those names are obtained from an ACME
+// CA (Let's Encrypt by default) and renewed 30 days before they expire.
+// The CA validates a name by connecting to it on port 443 (tls-alpn-01),
+// so a proxy listener must be reachable there, unless ACME_DNS_HOOK is
+// set: then the hook publishes a TXT record instead (dns-01), which works
+// behind a CDN or NAT and for wildcard names.
+var (
+	acmeDomainsSpec = getEnv("ACME_DOMAINS", "")
+	acmeEmail       = getEnv("ACME_EMAIL", "")
+	acmeDirectory   = getEnv("ACME_DIRECTORY_URL", acme.LetsEncryptURL)
+	// acmeCacheDir keeps the account key and certificates across restarts,
+	// so they are not requested again, which the CA rate-limits.
+	acmeCacheDir = getEnv("ACME_CACHE_DIR", "acme-cache")
+	// acmeDNSHook is a shell command run with ACME_ACTION "present" to
+	// publish ACME_RECORD_NAME as a TXT record holding ACME_RECORD_VALUE,
+	// returning once it is visible, and with "cleanup" to remove it.
+	acmeDNSHook               = getEnv("ACME_DNS_HOOK", "")
+	acmeDNSHookTimeoutSeconds = getEnvAsInt("ACME_DNS_HOOK_TIMEOUT_SECONDS", 300)
+
+	acmeDomains []string
+	acmeMgr     *acmeManager
+)
+
+const (
+	acmeALPNProto   = acme.ALPNProto
+	acmeRenewBefore = 30 * 24 * time.Hour
+	acmeRenewCheck  = 12 * time.Hour
+)
+
+type acmeManager struct {
+	client *acme.Client
+
+	registerMu sync.Mutex
+	registered bool
+
+	certs map[string]*acmeCert
+
+	challengeMu sync.Mutex
+	challenges  map[string]*tls.Certificate // tls-alpn-01 certificates by name
+}
+
+type acmeCert struct {
+	domain string
+	mu     sync.Mutex // held while obtaining
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+func newACMEManager() (*acmeManager, error) {
+	for _, d := range acmeDomains {
+		if strings.Count(d, "*") > 1 || (strings.Contains(d, "*") && !strings.HasPrefix(d, "*.")) {
+			return nil, fmt.Errorf("ACME_DOMAINS: invalid name %s", d)
+		}
+		if strings.HasPrefix(d, "*.") && acmeDNSHook == "" {
+			return nil, fmt.Errorf("ACME_DOMAINS: wildcard %s needs ACME_DNS_HOOK", d)
+		}
+	}
+	if err := os.MkdirAll(acmeCacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("ACME_CACHE_DIR: %w", err)
+	}
+	key, err := acmeAccountKey()
+	if err != nil {
+		return nil, err
+	}
+	m := &acmeManager{
+		client:     &acme.Client{Key: key, DirectoryURL: acmeDirectory, UserAgent: "auto-scale-ws-proxy"},
+		certs:      make(map[string]*acmeCert),
+		challenges: make(map[string]*tls.Certificate),
+	}
+	for _, d := range acmeDomains {
+		c := &acmeCert{domain: d}
+		if cert, err := readCachedCert(d); err == nil {
+			c.cert.Store(cert)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Ignoring the cached certificate", "domain", d, "file", cachedCertPath(d), "error", err)
+		}
+		m.certs[d] = c
+	}
+	return m, nil
+}
+
+// getCertificate answers tls-alpn-01 challenges and otherwise serves the
+// certificate for the name the client asked for, obtaining it first if
+// there is none yet. Clients that send no name get the first domain's.
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		m.challengeMu.Lock()
+		cert := m.challenges[name]
+		m.challengeMu.Unlock()
+		if cert == nil {
+			return nil, fmt.Errorf("no ACME challenge pending for %q", name)
+		}
+		return cert, nil
+	}
+	c := m.lookup(name)
+	if c == nil {
+		return nil, fmt.Errorf("no certificate for %q", name)
+	}
+	if cert := c.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	if err := m.obtain(c); err != nil {
+		slog.Error("Failed to obtain a certificate", "domain", c.domain, "server_name", name, "error", err)
+		return nil, err
+	}
+	return c.cert.Load(), nil
+}
+
+// lookup finds the domain serving name, exactly or by a wildcard.
+func (m *acmeManager) lookup(name string) *acmeCert {
+	if name == "" {
+		return m.certs[acmeDomains[0]]
+	}
+	if c := m.certs[name]; c != nil {
+		return c
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		return m.certs["*."+rest]
+	}
+	return nil
+}
+
+// acmeRenewer obtains missing certificates and renews expiring ones.
+func acmeRenewer() {
+	if acmeMgr == nil {
+		return
+	}
+	tick := clk.NewTicker(acmeRenewCheck)
+	defer tick.Stop()
+	for {
+		for _, d := range acmeDomains {
+			c := acmeMgr.certs[d]
+			if cert := c.cert.Load(); cert != nil && clk.Now().Before(cert.Leaf.NotAfter.Add(-acmeRenewBefore)) {
+				continue
+			}
+			if err := acmeMgr.obtain(c); err != nil {
+				slog.Error("Failed to obtain a certificate", "domain", d, "error", err)
+			}
+		}
+		<-tick.C()
+	}
+}
+
+// obtain requests a certificate for c unless another call just did.
+func (m *acmeManager) obtain(c *acmeCert) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cert := c.cert.Load(); cert != nil && clk.Now().Before(cert.Leaf.NotAfter.Add(-acmeRenewBefore)) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	started := time.Now()
+	cert, err := m.order(ctx, c.domain)
+	if err != nil {
+		return err
+	}
+	if err := writeCachedCert(c.domain, cert); err != nil {
+		slog.Error("Failed to cache the certificate", "domain", c.domain, "file", cachedCertPath(c.domain), "error", err)
+	}
+	c.cert.Store(cert)
+	slog.Info("Obtained a certificate", "domain", c.domain, "duration_ms", time.Since(started).Milliseconds(), "not_after", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (m *acmeManager) register(ctx context.Context) error {
+	m.registerMu.Lock()
+	defer m.registerMu.Unlock()
+	if m.registered {
+		return nil
+	}
+	acct := &acme.Account{}
+	if acmeEmail != "" {
+		acct.Contact = []string{"mailto:" + acmeEmail}
+	}
+	if _, err := m.client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("registering with %s: %w", acmeDirectory, err)
+	}
+	m.registered = true
+	return nil
+}
+
+// order runs one ACME order for domain and returns the certificate.
+func (m *acmeManager) order(ctx context.Context, domain string) (*tls.Certificate, error) {
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+	o, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range o.AuthzURLs {
+		if err := m.authorize(ctx, u, strings.TrimPrefix(domain, "*.")); err != nil {
+			return nil, err
+		}
+	}
+	if o, err = m.client.WaitOrder(ctx, o.URI); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	return newACMECert(der, key)
+}
+
+// authorize completes the authorization at url for name with tls-alpn-01,
+// or with dns-01 through ACME_DNS_HOOK.
+func (m *acmeManager) authorize(ctx context.Context, url, name string) error {
+	z, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	typ := "tls-alpn-01"
+	if acmeDNSHook != "" {
+		typ = "dns-01"
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == typ {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s offers no %s challenge for %s", acmeDirectory, typ, name)
+	}
+	if typ == "dns-01" {
+		value, err := m.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		record := "_acme-challenge." + name
+		if err := runACMEDNSHook("present", name, record, value); err != nil {
+			return err
+		}
+		defer runACMEDNSHook("cleanup", name, record, value)
+	} else {
+		cert, err := m.client.TLSALPN01ChallengeCert(chal.Token, name)
+		if err != nil {
+			return err
+		}
+		m.challengeMu.Lock()
+		m.challenges[name] = &cert
+		m.challengeMu.Unlock()
+		defer func() {
+			m.challengeMu.Lock()
+			delete(m.challenges, name)
+			m.challengeMu.Unlock()
+		}()
+	}
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// runACMEDNSHook runs ACME_DNS_HOOK for action ("present" or "cleanup").
+func runACMEDNSHook(action, domain, record, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(acmeDNSHookTimeoutSeconds)*time.Second)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", acmeDNSHook)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", acmeDNSHook)
+	}
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(),
+		"ACME_ACTION="+action,
+		"ACME_DOMAIN="+domain,
+		"ACME_RECORD_NAME="+record,
+		"ACME_RECORD_VALUE="+value,
+	)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %ds", acmeDNSHookTimeoutSeconds)
+	}
+	if err != nil {
+		err = fmt.Errorf("ACME DNS hook %s for %s failed: %w: %s", action, domain, err, strings.TrimSpace(string(out)))
+		if action == "cleanup" {
+			slog.Error("Failed to remove the ACME challenge record", "domain", domain, "record", record, "error", err)
+		}
+		return err
+	}
+	return nil
+}
+
+func newACMECert(der [][]byte, key crypto.Signer) (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// acmeAccountKey loads the account key from ACME_CACHE_DIR, creating it on
+// first use.
+func acmeAccountKey() (crypto.Signer, error) {
+	path := filepath.Join(acmeCacheDir, "account.key")
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// cachedCertPath names the file a domain's key and chain are kept in.
+func cachedCertPath(domain string) string {
+	return filepath.Join(acmeCacheDir, strings.ReplaceAll(domain, "*", "_")+".pem")
+}
+
+func readCachedCert(domain string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(cachedCertPath(domain))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", cert.PrivateKey)
+	}
+	return newACMECert(cert.Certificate, key)
+}
+
+func writeCachedCert(domain string, cert *tls.Certificate) error {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	for _, der := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	tmp := cachedCertPath(domain) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cachedCertPath(domain))
+}
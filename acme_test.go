@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestACMELookupWildcard(t *testing.T) {
+	defer func(d []string) { acmeDomains = d }(acmeDomains)
+	acmeDomains = []string{"example.com", "*.example.com"}
+	m := &acmeManager{certs: map[string]*acmeCert{}}
+	for _, d := range acmeDomains {
+		m.certs[d] = &acmeCert{domain: d}
+	}
+	for name, want := range map[string]string{
+		"":                "example.com",
+		"example.com":     "example.com",
+		"a.example.com":   "*.example.com",
+		"a.b.example.com": "",
+		"example.org":     "",
+	} {
+		got := ""
+		if c := m.lookup(name); c != nil {
+			got = c.domain
+		}
+		if got != want {
+			t.Errorf("lookup(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestACMEWildcardNeedsDNSHook(t *testing.T) {
+	defer func(d []string, hook, dir string) { acmeDomains, acmeDNSHook, acmeCacheDir = d, hook, dir }(acmeDomains, acmeDNSHook, acmeCacheDir)
+	acmeCacheDir = t.TempDir()
+	acmeDomains, acmeDNSHook = []string{"*.example.com"}, ""
+	if _, err := newACMEManager(); err == nil || !strings.Contains(err.Error(), "ACME_DNS_HOOK") {
+		t.Fatalf("wildcard without ACME_DNS_HOOK = %v", err)
+	}
+	acmeDomains = []string{"a.*.example.com"}
+	if _, err := newACMEManager(); err == nil {
+		t.Fatal("a wildcard in the middle of a name was accepted")
+	}
+}
+
+func TestACMEDNSHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook below is a POSIX shell command")
+	}
+	defer func(hook string) { acmeDNSHook = hook }(acmeDNSHook)
+	out := filepath.Join(t.TempDir(), "hook")
+	acmeDNSHook = `echo "$ACME_ACTION $ACME_DOMAIN $ACME_RECORD_NAME $ACME_RECORD_VALUE" >> ` + out
+
+	for _, action := range []string{"present", "cleanup"} {
+		if err := runACMEDNSHook(action, "example.com", "_acme-challenge.example.com", "v4lue"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "present example.com _acme-challenge.example.com v4lue\ncleanup example.com _acme-challenge.example.com v4lue\n"
+	if string(b) != want {
+		t.Fatalf("hook ran with\n%s\nwant\n%s", b, want)
+	}
+
+	acmeDNSHook = "echo no such zone; exit 3"
+	if err := runACMEDNSHook("present", "example.com", "_acme-challenge.example.com", "v"); err == nil || !strings.Contains(err.Error(), "no such zone") {
+		t.Fatalf("failing hook = %v, want its output in the error", err)
+	}
+}
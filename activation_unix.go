@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// activatedListener returns the socket systemd passed for the listener
+// called name under socket activation: the one whose FileDescriptorName=
+// matches, or the only socket for the "main" listener if it is unnamed.
+func activatedListener(name string) (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil, nil
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		fdName := ""
+		if i < len(names) {
+			fdName = names[i]
+		}
+		unnamed := n == 1 && (fdName == "" || fdName == "unknown")
+		if fdName != name && !(unnamed && name == "main") {
+			continue
+		}
+		f := os.NewFile(uintptr(3+i), name)
+		defer f.Close()
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("socket-activated %s listener: %w", name, err)
+		}
+		return ln, nil
+	}
+	return nil, nil
+}
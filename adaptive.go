@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+var (
+	// adaptiveInactivity stretches a target's inactivity window to cover the
+	// gaps after which its clients usually come back, so a backend is not
+	// scaled down just before the next reconnect.
+	adaptiveInactivity    = getEnvAsBool("ADAPTIVE_INACTIVITY", false)
+	adaptiveMaxMinutes    = getEnvAsInt("ADAPTIVE_INACTIVITY_MAX_MINUTES", 240)
+	adaptivePercentile    = getEnvAsInt("ADAPTIVE_INACTIVITY_PERCENTILE", 90)
+	adaptiveMinSamples    = getEnvAsInt("ADAPTIVE_INACTIVITY_MIN_SAMPLES", 10)
+	adaptiveMinGap        = time.Minute // shorter gaps are ordinary churn, not idle periods
+	adaptiveMaxGapSamples = 100
+
+	inactivityWindow = newGauge("wsproxy_inactivity_window_seconds",
+		"Effective inactivity window before scale-down.", "target")
+)
+
+// acquire notes a session opening on t.
+func (t *scaleTarget) acquire() {
+	t.mu.Lock()
+	t.open++
+	t.mu.Unlock()
+}
+
+// release notes a session on t ending.
+func (t *scaleTarget) release() {
+	t.mu.Lock()
+	t.open--
+	t.lastRelease = clk.Now()
+	t.mu.Unlock()
+}
+
+// idleSince returns when t last saw activity: its last request or, with
+// INACTIVITY_COUNT_SESSIONS, the end of its last session. busy is set while
+// sessions are open here or on the HA peer, so t is not idle at all.
+func (t *scaleTarget) idleSince() (since time.Time, busy bool) {
+	t.mu.Lock()
+	since = t.lastRequestTime
+	if inactivityCountSessions {
+		busy = t.open > 0
+		if t.lastRelease.After(since) {
+			since = t.lastRelease
+		}
+	}
+	t.mu.Unlock()
+	if inactivityCountSessions && haPeerURL != "" && ha.peerSessions(t) > 0 {
+		busy = true
+	}
+	return since, busy
+}
+
+// noteGap records how long t had been quiet when a new request arrived.
+// Callers hold t.mu.
+func (t *scaleTarget) noteGap(now time.Time) {
+	if !adaptiveInactivity || t.open > 0 || t.lastRelease.IsZero() {
+		return
+	}
+	quiet := t.lastRelease
+	if t.lastRequestTime.After(quiet) {
+		quiet = t.lastRequestTime
+	}
+	gap := now.Sub(quiet)
+	// Gaps longer than the cap are real idle periods the window should
+	// not try to bridge.
+	if gap < adaptiveMinGap || gap > time.Duration(adaptiveMaxMinutes)*time.Minute {
+		return
+	}
+	t.gaps = append(t.gaps, gap)
+	if len(t.gaps) > adaptiveMaxGapSamples {
+		t.gaps = t.gaps[len(t.gaps)-adaptiveMaxGapSamples:]
+	}
+}
+
+// window returns the inactivity window for t: base, or the learned
+// reconnect gap if that is longer and enough gaps have been seen.
+func (t *scaleTarget) window(base time.Duration) time.Duration {
+	w := base
+	if adaptiveInactivity {
+		t.mu.Lock()
+		gaps := append([]time.Duration(nil), t.gaps...)
+		t.mu.Unlock()
+		if len(gaps) >= adaptiveMinSamples {
+			sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+			learned := gaps[(len(gaps)-1)*adaptivePercentile/100].Round(time.Minute) + time.Minute
+			if max := time.Duration(adaptiveMaxMinutes) * time.Minute; learned > max {
+				learned = max
+			}
+			if learned > w {
+				w = learned
+			}
+		}
+	}
+
+	t.mu.Lock()
+	changed := w != t.lastWindow && t.lastWindow != 0
+	t.lastWindow = w
+	t.mu.Unlock()
+	if changed {
+		slog.Info("Inactivity window changed", "deployment", t.String(), "window_minutes", w.Minutes())
+	}
+	inactivityWindow.set(w.Seconds(), t.String())
+	return w
+}
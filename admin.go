@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+)
+
+var (
+	// adminAddr is a separate listener for operational endpoints; it is
+	// disabled unless set so nothing extra is exposed by default.
+	adminAddr = getEnv("ADMIN_ADDR", "")
+
+	adminMux = http.NewServeMux()
+)
+
+// registerAdmin sets up the handlers served on admin listeners.
+func registerAdmin() {
+	adminMux.HandleFunc("/metrics", requireAdmin(handleMetrics))
+	adminMux.HandleFunc("/admin/grafana-dashboard.json", requireAdmin(handleGrafanaDashboard))
+	adminMux.HandleFunc("/admin/bans", requireAdmin(handleBans))
+	adminMux.HandleFunc("/admin/wake-tokens", requireAdmin(handleWakeTokens))
+	adminMux.HandleFunc("/admin/wake", requireAdmin(handleWake))
+	adminMux.HandleFunc("/admin/usage", requireAdmin(handleUsage))
+	adminMux.HandleFunc("/admin/savings", requireAdmin(handleSavings))
+	adminMux.HandleFunc("/admin/connections", requireAdmin(handleConnections))
+	adminMux.HandleFunc("/admin/connections/", requireAdmin(handleConnections))
+	adminMux.HandleFunc("/admin/status", requireAdmin(handleStatus))
+	adminMux.HandleFunc("/admin/maintenance", requireAdmin(handleMaintenance))
+	adminMux.HandleFunc("/admin/scale", requireAdmin(handleScale))
+	adminMux.HandleFunc("/admin/drain", requireAdmin(handleDrain))
+	adminMux.HandleFunc("/admin/ha", requireAdmin(handleHA))
+	adminMux.HandleFunc("/admin/ha/heartbeat", requireAdmin(handleHAHeartbeat))
+	adminMux.HandleFunc("/admin/config/validate", requireAdmin(handleConfigCheck))
+	adminMux.HandleFunc("/admin/config/diff", requireAdmin(handleConfigCheck))
+	// forward-auth is called by reverse proxies on every request and
+	// /healthz and /readyz by probes, so they stay unauthenticated.
+	adminMux.HandleFunc("/forward-auth", handleForwardAuth)
+	adminMux.HandleFunc("/healthz", handleHealthz)
+	adminMux.HandleFunc("/readyz", handleReadyz)
+	if oidc != nil {
+		adminMux.HandleFunc(oidc.callback.Path, oidc.handleCallback)
+	}
+
+}
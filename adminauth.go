@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+var (
+	// adminToken is a static bearer token for the admin endpoints.
+	adminToken = newSecret("ADMIN_TOKEN")
+)
+
+// requireAdmin guards an admin handler with ADMIN_TOKEN and/or OIDC. With
+// neither configured the admin listener may still be read, as it is meant
+// to be bound to a private address, but nothing on it can be changed.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken.get() == "" && oidc == nil {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "admin changes need ADMIN_TOKEN or OIDC_ISSUER to be set", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+			return
+		}
+		if user, ok := adminAuthorized(r); ok {
+			h(w, r.WithContext(context.WithValue(r.Context(), adminUserKey{}, user)))
+			return
+		}
+		if oidc != nil && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			oidc.startLogin(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+}
+
+// adminAuthorized accepts ADMIN_TOKEN or an ID token from the OIDC provider
+// as a bearer token, or an OIDC session cookie, and returns who it is.
+func adminAuthorized(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if want := adminToken.get(); want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+			return "admin-token", true
+		}
+		if oidc != nil {
+			if c, err := oidc.verify(token, ""); err == nil {
+				return c.user(), true
+			}
+		}
+		return "", false
+	}
+	if oidc != nil {
+		return oidc.session(r)
+	}
+	return "", false
+}
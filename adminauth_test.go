@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminWithoutCredentials(t *testing.T) {
+	saved := adminToken.get()
+	adminToken.set("")
+	defer adminToken.set(saved)
+
+	h := requireAdmin(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		method string
+		status int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodPost, http.StatusForbidden},
+		{http.MethodPut, http.StatusForbidden},
+		{http.MethodDelete, http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(tc.method, "/admin/scale", nil))
+		if w.Code != tc.status {
+			t.Errorf("%s without ADMIN_TOKEN or OIDC: %d, want %d", tc.method, w.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// drainState is set through /admin/drain to take the proxy out of service
+// without stopping it, e.g. before its node is serviced: new clients are
+// turned away and the health endpoint fails, while open sessions go on
+// until they end or the optional deadline closes them.
+type drainState struct {
+	mu       sync.Mutex
+	since    time.Time // zero when not draining
+	deadline time.Time // when remaining sessions are closed, if set
+	stop     chan struct{}
+}
+
+var adminDrain = &drainState{}
+
+func (d *drainState) active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.since.IsZero()
+}
+
+// serveDraining answers a new client while the proxy drains with 503 and
+// the going_away close code, and reports whether it did.
+func serveDraining(w http.ResponseWriter, r *http.Request) bool {
+	if !adminDrain.active() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter()))
+	rejectUpgrade(w, r, "going_away", http.StatusServiceUnavailable)
+	return true
+}
+
+type drainStatus struct {
+	Draining bool       `json:"draining"`
+	Since    *time.Time `json:"since,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+	Sessions int        `json:"sessions"`
+}
+
+func (d *drainState) status() drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := drainStatus{Draining: !d.since.IsZero(), Sessions: sessions.count()}
+	if st.Draining {
+		since := d.since.UTC()
+		st.Since = &since
+	}
+	if !d.deadline.IsZero() {
+		deadline := d.deadline.UTC()
+		st.Deadline = &deadline
+	}
+	return st
+}
+
+// handleDrain is the admin API for draining: GET reports it, POST starts it,
+// closing the sessions still open after ?timeout_seconds=N if given, and
+// DELETE ends it.
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	user := adminUser(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		timeout := 0
+		if v := r.URL.Query().Get("timeout_seconds"); v != "" {
+			var err error
+			if timeout, err = strconv.Atoi(v); err != nil || timeout < 0 {
+				http.Error(w, "timeout_seconds must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+		}
+		adminDrain.start(user, time.Duration(timeout)*time.Second)
+		audit(user, "drain", "proxy", map[string]interface{}{"timeout_seconds": timeout}, nil)
+	case http.MethodDelete:
+		if !adminDrain.end(user) {
+			http.Error(w, "not draining", http.StatusNotFound)
+			return
+		}
+		audit(user, "drain_end", "proxy", nil, nil)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminDrain.status())
+}
+
+// start drains every route on behalf of user, closing the sessions left
+// after timeout if it is positive.
+func (d *drainState) start(user string, timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.since.IsZero() {
+		d.since = clk.Now()
+	}
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+	d.deadline = time.Time{}
+	slog.Info("Draining", "admin", user, "sessions", sessions.count(), "timeout_seconds", int(timeout.Seconds()))
+	if timeout <= 0 {
+		return
+	}
+	d.deadline = clk.Now().Add(timeout)
+	stop := make(chan struct{})
+	d.stop = stop
+	go func() {
+		deadline := clk.NewTimer(timeout)
+		defer deadline.Stop()
+		select {
+		case <-deadline.C():
+		case <-stop:
+			return
+		}
+		if n := sessions.closeAll("going_away"); n > 0 {
+			slog.Info("Closed sessions still open after draining", "admin", user, "sessions", n)
+		}
+	}()
+}
+
+// end stops draining for user and reports whether the proxy was.
+func (d *drainState) end(user string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.since.IsZero() {
+		return false
+	}
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+	d.since, d.deadline = time.Time{}, time.Time{}
+	slog.Info("No longer draining", "admin", user)
+	return true
+}
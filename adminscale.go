@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// scaleOverrideMinutes is how long a deployment scaled through
+	// /admin/scale is left alone by the inactivity, schedule, load and
+	// decision webhook scalers.
+	scaleOverrideMinutes = getEnvAsInt("SCALE_OVERRIDE_MINUTES", 60)
+)
+
+// overridden reports whether an operator has set t's replicas recently.
+func (t *scaleTarget) overridden() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return clk.Now().Before(t.overrideUntil)
+}
+
+// routeTargetParam returns the deployment of the route named by r's "route"
+// parameter, which may be left out when all routes scale the same one.
+func routeTargetParam(r *http.Request) *scaleTarget {
+	table := routing.Load()
+	if name := r.URL.Query().Get("route"); name != "" {
+		if rt := table.byName(name); rt != nil {
+			return rt.scale
+		}
+		return nil
+	}
+	var t *scaleTarget
+	for _, rt := range table.routes {
+		if t != nil && rt.scale != t {
+			return nil
+		}
+		t = rt.scale
+	}
+	return t
+}
+
+// targetRoutes names the routes scaling t, for the log.
+func targetRoutes(t *scaleTarget) string {
+	var names []string
+	for _, rt := range routing.Load().routes {
+		if rt.scale == t {
+			names = append(names, rt.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// handleScale is the admin API for manual scaling: POST ?replicas=N&route=...
+// scales the route's deployment and holds it there for
+// SCALE_OVERRIDE_MINUTES (or ?minutes=N), and DELETE ?route=... hands it
+// back to the automatic scalers. A client finding the backend down still
+// wakes it; put the route into maintenance to keep clients out.
+func handleScale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	t := routeTargetParam(r)
+	if t == nil {
+		msg := "unknown route"
+		if r.URL.Query().Get("route") == "" {
+			msg = "route is required when routes scale different deployments"
+		}
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	user := adminUser(r.Context())
+	lg := slog.With("admin", user, "route", targetRoutes(t), "deployment", t.String())
+	switch r.Method {
+	case http.MethodPost:
+		replicas, err := strconv.Atoi(r.URL.Query().Get("replicas"))
+		if err != nil || replicas < 0 {
+			http.Error(w, "replicas must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		minutes := scaleOverrideMinutes
+		if v := r.URL.Query().Get("minutes"); v != "" {
+			if minutes, err = strconv.Atoi(v); err != nil || minutes < 0 {
+				http.Error(w, "minutes must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+		}
+		if replicas == 0 {
+			if n := sessions.closeTarget(t, "scale_down"); n > 0 {
+				lg.Info("Closed open sessions before scaling down", "sessions", n)
+			}
+		}
+		err = scaleDeployment(t, replicas, "admin")
+		audit(user, "scale", t.String(), map[string]interface{}{"replicas": replicas, "minutes": minutes}, err)
+		if err != nil {
+			lg.Error("Manual scaling failed", "replicas", replicas, "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		until := clk.Now().Add(time.Duration(minutes) * time.Minute)
+		t.mu.Lock()
+		t.overrideUntil = until
+		t.overSince = time.Time{}
+		t.mu.Unlock()
+		lg.Info("Scaled by hand", "replicas", boundReplicas(replicas), "until", until.Format(time.RFC3339))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(targetStatusOf(t))
+	case http.MethodDelete:
+		t.mu.Lock()
+		held := clk.Now().Before(t.overrideUntil)
+		t.overrideUntil = time.Time{}
+		t.mu.Unlock()
+		if !held {
+			http.Error(w, "not scaled by hand", http.StatusNotFound)
+			return
+		}
+		audit(user, "scale_release", t.String(), nil, nil)
+		lg.Info("Handed back to automatic scaling")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+var (
+	// anomalyZScore flags a route's connection rate or bandwidth when it is
+	// this many standard deviations from its moving average; 0 disables
+	// detection.
+	anomalyZScore          = getEnvAsInt("ANOMALY_Z_SCORE", 0)
+	anomalyIntervalSeconds = getEnvAsInt("ANOMALY_INTERVAL_SECONDS", 60)
+
+	sessionsTotal = newCounter("wsproxy_sessions_total",
+		"Requests and sessions started per route.", "route")
+)
+
+const (
+	// anomalyAlpha weighs each new interval in the moving average, so the
+	// baseline reflects roughly the last 20 intervals.
+	anomalyAlpha = 0.1
+	// anomalyWarmup is how many intervals are seen before alerting.
+	anomalyWarmup = 30
+)
+
+// ewma tracks the exponentially weighted mean and variance of one series
+// and whether it is currently anomalous, so each episode alerts once.
+type ewma struct {
+	n         int
+	mean, vr  float64
+	anomalous bool
+}
+
+// update folds v into the average and returns its z-score against the
+// previous baseline.
+func (e *ewma) update(v float64) float64 {
+	z := 0.0
+	if sd := math.Sqrt(e.vr); e.n > 0 && sd > 0 {
+		z = (v - e.mean) / sd
+	}
+	if e.n == 0 {
+		e.mean = v
+	} else {
+		d := v - e.mean
+		e.mean += anomalyAlpha * d
+		e.vr = (1 - anomalyAlpha) * (e.vr + anomalyAlpha*d*d)
+	}
+	e.n++
+	return z
+}
+
+type routeTraffic struct {
+	conns, bytes float64 // running totals at the last interval
+	connRate     ewma
+	bandwidth    ewma
+}
+
+func setupAnomalyDetection() error {
+	if anomalyZScore <= 0 {
+		return nil
+	}
+	if anomalyIntervalSeconds <= 0 {
+		return fmt.Errorf("ANOMALY_INTERVAL_SECONDS must be positive")
+	}
+	slog.Info("Anomaly detection enabled", "z_score", anomalyZScore, "interval_seconds", anomalyIntervalSeconds)
+	go detectAnomalies()
+	return nil
+}
+
+func detectAnomalies() {
+	interval := time.Duration(anomalyIntervalSeconds) * time.Second
+	state := make(map[string]*routeTraffic)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		conns, bytes := trafficTotals()
+		for _, rt := range routing.Load().routes {
+			st, ok := state[rt.Name]
+			if !ok {
+				state[rt.Name] = &routeTraffic{conns: conns[rt.Name], bytes: bytes[rt.Name]}
+				continue
+			}
+			perMinute := time.Minute.Seconds() / interval.Seconds()
+			checkAnomaly(rt.Name, "connection rate", "connections/min", &st.connRate, (conns[rt.Name]-st.conns)*perMinute)
+			checkAnomaly(rt.Name, "bandwidth", "bytes/s", &st.bandwidth, (bytes[rt.Name]-st.bytes)/interval.Seconds())
+			st.conns, st.bytes = conns[rt.Name], bytes[rt.Name]
+		}
+	}
+}
+
+// checkAnomaly alerts when v is a spike, or silence on a route that
+// normally has steady traffic.
+func checkAnomaly(route, what, unit string, e *ewma, v float64) {
+	mean := e.mean
+	z := e.update(v)
+	if e.n <= anomalyWarmup {
+		return
+	}
+	th := float64(anomalyZScore)
+	spike, silence := z > th, v == 0 && z < -th
+	if !spike && !silence {
+		e.anomalous = false
+		return
+	}
+	if e.anomalous {
+		return
+	}
+	e.anomalous = true
+	kind := "spike"
+	if silence {
+		kind = "silence"
+	}
+	notify("traffic_anomaly", fmt.Sprintf("Route %s: %s %s, %.1f %s against a usual %.1f", route, what, kind, v, unit, mean),
+		map[string]interface{}{"route": route, "metric": what, "kind": kind, "value": v, "mean": mean, "z_score": z})
+}
+
+// trafficTotals returns sessions started and bytes relayed per route so
+// far, including bytes of sessions that are still open.
+func trafficTotals() (conns, bytes map[string]float64) {
+	conns, bytes = make(map[string]float64), make(map[string]float64)
+	for _, s := range snapshotMetrics() {
+		switch s.name {
+		case "wsproxy_sessions_total":
+			conns[s.values[0]] += s.value
+		case "wsproxy_bytes_total":
+			bytes[s.values[0]] += s.value
+		}
+	}
+	for _, s := range sessions.list() {
+		bytes[s.route] += float64(s.bytesUp.Load() + s.bytesDown.Load())
+	}
+	return conns, bytes
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var (
+	// auditLog receives one JSON line per scale call and admin mutation:
+	// a file path (opened append-only) or "stdout", where lines are
+	// prefixed with "AUDIT " to separate them from operational logs.
+	auditLog = getEnv("AUDIT_LOG", "")
+
+	auditOut *jsonlWriter
+)
+
+type auditEntry struct {
+	Time   time.Time              `json:"time"`
+	Actor  string                 `json:"actor"`
+	Action string                 `json:"action"`
+	Target string                 `json:"target,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	Result string                 `json:"result"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+func setupAudit() error {
+	w, err := openJSONL(auditLog, "AUDIT ")
+	if err != nil {
+		return fmt.Errorf("AUDIT_LOG: %w", err)
+	}
+	auditOut = w
+	return nil
+}
+
+// audit records an action by actor; err nil means it succeeded.
+func audit(actor, action, target string, params map[string]interface{}, err error) {
+	if auditOut == nil {
+		return
+	}
+	e := auditEntry{Time: time.Now().UTC(), Actor: actor, Action: action, Target: target, Params: params, Result: "ok"}
+	if err != nil {
+		e.Result, e.Error = "error", err.Error()
+	}
+	auditOut.write(e)
+}
+
+type adminUserKey struct{}
+
+// adminUser returns who made an admin request, as set by requireAdmin.
+func adminUser(ctx context.Context) string {
+	if u, ok := ctx.Value(adminUserKey{}).(string); ok {
+		return u
+	}
+	return "anonymous"
+}
@@ -1,23 +1,27 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"crypto/tls"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"auto_scale/scaler"
 )
 
 var (
 	listenAddr        = getEnv("LISTEN_ADDR", ":8080")
+	listenNetwork     = getEnv("LISTEN_NETWORK", "tcp") // "tcp4" or "tcp6" for a single family
+	listenInterface   = getEnv("LISTEN_INTERFACE", "")
 	secretPath        = getEnv("SECRET_PATH", "/vmessws")
 	backendPath	   	  = getEnv("BACKEND_PATH", "/ws")
 	backendTargetURL  = getEnv("BACKEND_URL", "http://127.0.0.1:3001")
@@ -25,97 +29,461 @@ var (
 	kubeNamespace     = getEnv("NAMESPACE", "test")
 	deploymentName    = getEnv("DEPLOYMENT_NAME", "t2")
 	inactivityMinutes = getEnvAsInt("INACTIVITY_MINUTES", 60)
+	// inactivityCountSessions keeps a deployment from counting as idle while
+	// sessions to it are open, timing inactivity from the last one's end.
+	inactivityCountSessions    = getEnvAsBool("INACTIVITY_COUNT_SESSIONS", true)
 	ReplicaUpdateIntervalHours = getEnvAsInt("REPLICA_UPDATE_INTERVAL_HOURS", 24) // in hours
 	backendHealthCheckInterval = getEnvAsInt("BACKEND_HEALTH_CHECK_INTERVAL", 10) // in minutes
 
-	lastScaledReplicas int = -1 // -1 means unknown/uninitialized
-
-	lastRequestTime time.Time
-	lastScaleRequestTime time.Time
-	lastBackEndTime time.Time
-	mu              sync.Mutex
 	httpClient      = &http.Client{Timeout: 5 * time.Second}
+
+	targetsMu sync.Mutex
+	targets   = make(map[string]*scaleTarget)
 )
 
+// scaleTarget is a deployment the proxy scales; routes pointing at the same
+// namespace and deployment share one.
+type scaleTarget struct {
+	namespace  string
+	deployment string
+	endpoint   string // Kubernetes API of another cluster, if not KUBE_CLUSTER_ENDPOINT
+	token      string // for endpoint
+
+	mu                   sync.Mutex
+	lastRequestTime      time.Time
+	lastScaledReplicas   int // -1 means unknown/uninitialized
+	lastScaleRequestTime time.Time
+	lastScaleCause       string    // cause of the last successful scale
+	overrideUntil        time.Time // until when /admin/scale holds the replicas
+	lastScaleUp          time.Time // when it was last scaled up, for the cooldowns
+	lastScaleDown        time.Time // and down
+	wakeCause            string    // cause of a scale-up whose backend is not ready yet
+	wakeStarted          time.Time // when that scale-up was requested
+
+	open         int             // sessions in flight
+	lastRelease  time.Time       // when the last session ended
+	gaps         []time.Duration // recent quiet periods ended by a new request
+	lastWindow   time.Duration   // inactivity window last used by the watcher
+	lastStepDown time.Time       // when SCALE_DOWN_STEP_MINUTES last removed a replica
+	lastDecision time.Time       // when the decision webhook last chose the replicas
+	overSince    time.Time       // since when it has had more replicas than its sessions need
+	bytes        atomic.Int64    // traffic of finished sessions
+
+	queued        int             // clients waiting for a cold start
+	queue         []*queuedClient // those not yet released, in arrival order
+	polling       bool            // whether a readiness poll is under way
+	queueMu       sync.Mutex      // serializes queue-driven scale-ups
+	queueReplicas int             // replicas started for the current queue
+
+	scaler scaler.Scaler // what scales it; so far always a kubeScaler
+
+	calls flightGroup
+}
+
+func (t *scaleTarget) String() string {
+	if t.endpoint != "" {
+		if u, err := url.Parse(t.endpoint); err == nil {
+			return t.namespace + "/" + t.deployment + "@" + u.Host
+		}
+	}
+	return t.namespace + "/" + t.deployment
+}
+
+// targetFor returns the shared scaleTarget for a deployment, creating it.
+func targetFor(endpoint, token, namespace, deployment string) *scaleTarget {
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	key := endpoint + " " + namespace + "/" + deployment
+	t, ok := targets[key]
+	if !ok {
+		t = &scaleTarget{
+			namespace:          namespace,
+			deployment:         deployment,
+			endpoint:           endpoint,
+			token:              token,
+			lastRequestTime:    clk.Now(),
+			lastScaledReplicas: -1,
+		}
+		t.scaler = kubeScaler{t}
+		targets[key] = t
+	}
+	// A reloaded config may carry a new token for the same cluster.
+	t.mu.Lock()
+	t.token = token
+	t.mu.Unlock()
+	return t
+}
+
 func main() {
-	log.Printf("Smart WebSocket Proxy with Kubernetes auto-scaler starting [%s%s]...\n", listenAddr, secretPath)
-	log.Printf("Backend URL: %s on %s path\n", backendTargetURL, backendPath)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "manifests":
+			os.Exit(runManifests(os.Args[2:]))
+		case "service":
+			os.Exit(runServiceCommand(os.Args[2:]))
+		case "healthcheck":
+			os.Exit(runHealthcheck(os.Args[2:]))
+		case "fakekube":
+			os.Exit(runFakeKube(os.Args[2:]))
+		case "dev":
+			os.Exit(runDev(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		case "loadgen":
+			os.Exit(runLoadgen(os.Args[2:]))
+		case "echo":
+			os.Exit(runEcho(os.Args[2:]))
+		}
+	}
+	startService()
+	if err := setupLogging(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := preflight(); err != nil {
+		fatal("Cannot start", err)
+	}
 
-	lastRequestTime = time.Now()
-	lastScaleRequestTime = time.Time{}
-	lastBackEndTime = time.Time{}
+	slog.Info("Smart WebSocket Proxy with Kubernetes auto-scaler starting", "addr", listenAddr)
 
-	go inactivityWatcher()
+	if err := setupAudit(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupAccessLog(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupStatsd(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupInflux(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupAnomalyDetection(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupReports(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupCost(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupDecisionWebhook(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupPlugins(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupSecrets(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupOutboundProxies(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupKubeconfig(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupKubeRecording(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupKubeTokenSecret(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupSessions(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupRoutes(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupRouteCRD(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupShutdownBackend(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupCloseCodes(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupTrustedProxies(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupDecoy(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupPayloadSampling(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupGeoIP(); err != nil {
+		fatal("Cannot start", err)
+	}
 
-	http.HandleFunc(secretPath, handleWebSocketProxy)
+	if err := setupOIDC(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupScaleHooks(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupHA(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupReplicaBounds(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupQueue(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupTLS(); err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := setupBackendTLS(); err != nil {
+		fatal("Cannot start", err)
+	}
 
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	http.HandleFunc("/", handleWebSocketProxy)
+	if healthPath != "" {
+		http.HandleFunc(healthPath, func(w http.ResponseWriter, r *http.Request) {
+			w, done := compressed(w, r)
+			defer done()
+			handleHealthz(w, r)
+		})
+	}
+	if readyPath != "" {
+		http.HandleFunc(readyPath, func(w http.ResponseWriter, r *http.Request) {
+			w, done := compressed(w, r)
+			defer done()
+			handleReadyz(w, r)
+		})
+	}
+	if wakeHookPath != "" {
+		http.HandleFunc(wakeHookPath, handleWakeHook)
+	}
+	registerAdmin()
+	if err := startListeners(); err != nil {
+		fatal("Cannot start", err)
+	}
+	go inactivityWatcher()
+	go scheduleWatcher()
+	go keepWarmWatcher()
+	go loadWatcher()
+	go regionProber()
+	go acmeRenewer()
+	setupUpgrades()
+	setupShutdown()
+	serving()
+	// Listeners, and stop or upgrade handling, run in the background.
+	select {}
 }
 func handleWebSocketProxy(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	lastRequestTime = time.Now()
-	mu.Unlock()
-
-	if !isBackendUp() {
-		log.Println("Backend is down. Scaling up via Kubernetes...")
-		if err := scaleDeployment(1); err != nil {
-			http.Error(w, "Failed to scale backend up", http.StatusInternalServerError)
+	ip := clientIP(r)
+	lg := slog.With("request_id", requestID(r), "client", ip)
+	if bans.banned(ip) {
+		refuse(w, r)
+		return
+	}
+	rt := routing.Load().match(r)
+	identity := ""
+	if rt == nil && strings.HasPrefix(r.URL.Path, wakeTokenPath) {
+		rt, identity = wakeTokens.redeem(r, ip)
+	}
+	if rt != nil && !listenerAllows(r, rt) {
+		rt = nil
+	}
+	if rt == nil {
+		serveDecoy(w, r)
+		return
+	}
+	lg = lg.With("route", rt.Name)
+	if !geoAllowed(rt, ip) {
+		refuse(w, r)
+		return
+	}
+	tsUser, err := tailnetClient(r)
+	if err != nil {
+		lg.Warn("Tailscale whois failed", "error", err)
+		refuse(w, r)
+		return
+	}
+	if !rt.allowsTailnetUser(tsUser) {
+		refuse(w, r)
+		return
+	}
+	if tsUser != nil {
+		identity = tsUser.Login
+	}
+	if serveMaintenance(w, r, rt) || serveDraining(w, r) {
+		return
+	}
+	if rt.Kind == "websocket" && !isValidUpgrade(r) {
+		bans.strike(ip, "malformed upgrades")
+		if decoy != nil {
+			serveDecoy(w, r)
+			return
+		}
+	}
+	if rt.CORS != nil && !rt.CORS.check(w, r) {
+		return
+	}
+	if rt.BasicAuth != nil {
+		user, ok := rt.BasicAuth.check(w, r)
+		if !ok {
+			bans.strike(ip, "auth failures")
 			return
 		}
-		time.Sleep(10 * time.Second)
+		identity = user
 	}
 
-	target, err := url.Parse(backendTargetURL)
-	if err != nil {
-		http.Error(w, "Invalid backend URL", http.StatusInternalServerError)
+	recordActivity(rt)
+
+	if rt.Chaos.failRequest(w, rt) {
 		return
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	// Customize the Transport to skip TLS verification
-	proxy.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+	for !isBackendUp(rt) {
+		lg.Info("Backend is down, scaling up via Kubernetes", "deployment", rt.scale.String())
+		markBackendCold(rt)
+		rt.Chaos.delayScale(rt)
+		if err := scaleDeployment(rt.scale, rt.scale.wakeReplicas(), "traffic"); err != nil {
+			lg.Error("Failed to scale backend up", "deployment", rt.scale.String(), "error", err)
+			if next := failover(rt); next != nil {
+				rt = next
+				recordActivity(rt)
+				continue
+			}
+			if errors.Is(err, errCooldown) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(rt.scale.cooldown(rt.scale.wakeReplicas()).Seconds())+1))
+				rejectUpgrade(w, r, "not_ready", http.StatusServiceUnavailable)
+				return
+			}
+			rejectUpgrade(w, r, "scale_failed", http.StatusInternalServerError)
+			return
+		}
+		held, ok := rt.scale.enqueue(rt)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter()))
+			rejectUpgrade(w, r, "queue_full", http.StatusServiceUnavailable)
+			return
+		}
+		err := held.wait(r)
+		rt.scale.dequeue(held)
+		if err != nil {
+			lg.Warn("Backend did not become ready", "deployment", rt.scale.String(), "error", err)
+			w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter()))
+			rejectUpgrade(w, r, "not_ready", http.StatusServiceUnavailable)
+			return
+		}
+		break
 	}
 
-	// Fix WebSocket upgrade headers
-	director := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		director(req)
-		req.URL.Path = backendPath // Change to the backend's actual WebSocket path
-		req.Header.Set("Connection", "Upgrade")
-		req.Header.Set("Upgrade", "websocket")
-		req.Host = target.Host // Ensure the Host is set to backend's host
+	stripUntrustedClientHeaders(r)
+	setTailscaleHeaders(r, tsUser)
+
+	target := rt.backendTarget()
+	if target == nil {
+		lg.Warn("No endpoints discovered")
+		rejectUpgrade(w, r, "scale_failed", http.StatusServiceUnavailable)
+		return
 	}
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		return nil
+	if rt.Kind == "connect" {
+		s := newSession(r, rt)
+		s.identity = identity
+		rt.scale.acquire()
+		defer rt.scale.release()
+		serveConnect(w, r, rt, target, s)
+		s.finish(r)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), proxyRequestKey{}, &proxyRequest{
+		target: target,
+		host:   rt.backendHost(r, target),
+		hctx:   newHeaderContext(r, rt),
+		origin: r.Header.Get("Origin"),
+		lg:     lg,
+	}))
+	s := newSession(r, rt)
+	s.identity = identity
+	rt.scale.acquire()
+	defer rt.scale.release()
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = countingReader{r.Body, &s.bytesUp}
 	}
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Println("Proxy error:", err)
-		http.Error(w, "Proxy error", http.StatusBadGateway)
+	rt.Chaos.delayBackend(rt)
+	sw := s.responseWriter(w)
+	if rt.Kind == "http" {
+		var done func()
+		sw, done = compressed(sw, r)
+		defer done()
 	}
-	proxy.ServeHTTP(w, r)
+	rt.reverseProxy().ServeHTTP(sw, s.attach(r))
+	s.finish(r)
 }
 
+// recordActivity notes traffic on rt for the inactivity watcher.
+func recordActivity(rt *route) {
+	rt.scale.mu.Lock()
+	now := clk.Now()
+	rt.scale.noteGap(now)
+	rt.scale.lastRequestTime = now
+	rt.scale.mu.Unlock()
+}
 
-func isBackendUp() bool {
-	if time.Since(lastBackEndTime) < time.Minute* time.Duration(backendHealthCheckInterval) {
+func isBackendUp(rt *route) bool {
+	rt.mu.Lock()
+	lastHealthy := rt.lastHealthy
+	rt.mu.Unlock()
+	if clk.Since(lastHealthy) < time.Minute*time.Duration(backendHealthCheckInterval) {
 		// log.Println("Using cached backend status")
 		return true
 	}
-	req, err := http.NewRequest("GET", backendTargetURL, nil)
+	// Requests arriving while a check runs wait for its result.
+	return rt.checks.do("health", func() error {
+		if checkBackend(rt) {
+			return nil
+		}
+		return errBackendDown
+	}) == nil
+}
+
+func checkBackend(rt *route) bool {
+	target := rt.backendTarget()
+	if target == nil {
+		return false
+	}
+	started := time.Now()
+	preset := healthPresets[rt.Protocol]
+	if preset.probe != nil {
+		if err := preset.probe(rt, target); err != nil {
+			slog.Warn("Backend is down", "route", rt.Name, "check", rt.Protocol, "error", err)
+			return false
+		}
+		return backendReady(rt, time.Since(started))
+	}
+	if preset.check == nil {
+		conn, err := backendDialer.dialTimeout(backendDialAddr(target), 5*time.Second)
+		if err != nil {
+			slog.Warn("Health check failed", "route", rt.Name, "error", err)
+			return false
+		}
+		conn.Close()
+		return backendReady(rt, time.Since(started))
+	}
+
+	req, err := http.NewRequest("GET", target.String(), nil)
 	if err != nil {
-		log.Println("Failed to create health check request:", err)
+		slog.Error("Failed to create health check request", "route", rt.Name, "error", err)
 		return false
 	}
 
 	// Important: vmess path must match exactly
-	req.URL.Path = backendPath
+	req.URL.Path = rt.BackendPath
 
 	// Avoid redirects
 	client := &http.Client{
 		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext:       backendDialer.DialContext,
+			TLSClientConfig:   rt.backendTLSConfig(target.Hostname()),
+			DisableKeepAlives: true,
+		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
@@ -123,98 +491,231 @@ func isBackendUp() bool {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Health check failed:", err)
+		slog.Warn("Health check failed", "route", rt.Name, "error", err)
 		return false
 	}
 	defer resp.Body.Close()
-	lastBackEndTime = time.Now()
 
-	switch resp.StatusCode {
-	case http.StatusBadRequest:
-		// 400 Bad Request means it's responding as expected for WebSocket — backend is up
-		return true
-	case http.StatusNotFound:
-		// 404 means backend isn't serving the vmess path yet
-		log.Println("Backend is down (404 received)")
-		return false
-	default:
-		log.Printf("Unexpected status code from backend health check: %d\n", resp.StatusCode)
+	if err := preset.check(resp.StatusCode); err != nil {
+		slog.Warn("Backend is down", "route", rt.Name, "check", rt.Protocol, "error", err)
 		return false
 	}
+	return backendReady(rt, time.Since(started))
+}
 
+// backendReady marks rt's backend healthy once it answered a health check
+// in rtt, unless the ready_log pattern has yet to show up in its pods' logs.
+func backendReady(rt *route, rtt time.Duration) bool {
+	recordRTT(rt, rtt)
+	if p := rt.ReadyLog; p != nil {
+		if err := p.check(rt.scale); err != nil {
+			slog.Info("Backend is not ready", "route", rt.Name, "error", err)
+			return false
+		}
+	}
+	markBackendHealthy(rt)
+	return true
 }
 
+func markBackendHealthy(rt *route) {
+	rt.mu.Lock()
+	rt.lastHealthy = clk.Now()
+	cold := rt.coldSince
+	rt.coldSince = time.Time{}
+	rt.mu.Unlock()
+	if !cold.IsZero() {
+		coldStart.observe(clk.Since(cold).Seconds(), rt.Name)
+		reports.coldStart(clk.Since(cold).Seconds())
+	}
 
-func scaleDeployment(replicas int) error {
-	log.Printf("Deployment tried scaled to %d replicas\n", replicas)
-	// mu.Lock()
-	// if lastScaledReplicas == replicas and it was less than a day since update, we don't need to scale again
-	if (lastScaledReplicas == replicas && time.Since(lastScaleRequestTime) < time.Duration(ReplicaUpdateIntervalHours)*time.Hour) {
-		log.Printf("Scale unchanged: already at %d replicas\n", replicas)
-		// mu.Unlock()
-		return nil
+	t := rt.scale
+	t.mu.Lock()
+	cause, started := t.wakeCause, t.wakeStarted
+	t.wakeCause, t.wakeStarted = "", time.Time{}
+	t.mu.Unlock()
+	if cause != "" {
+		scaleReadySeconds.observe(time.Since(started).Seconds(), t.String(), cause)
 	}
-	// mu.Unlock()
-	log.Printf("Deployment scaled to %d replicas\n", replicas)
-	token := os.Getenv("KUBE_CLUSTER_TOKEN")
-	if token == "" {
-		return fmt.Errorf("KUBE_CLUSTER_TOKEN not set")
+}
+
+func scaleDirection(replicas int) string {
+	if replicas == 0 {
+		return "down"
 	}
+	return "up"
+}
 
-	scaleURL := fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/deployments/%s/scale", kubeClusterAPI, kubeNamespace, deploymentName)
-	scaleBody := map[string]interface{}{
-		"kind":       "Scale",
-		"apiVersion": "autoscaling/v1",
-		"metadata": map[string]string{
-			"name": deploymentName,
-		},
-		"spec": map[string]int{
-			"replicas": replicas,
-		},
+// markBackendCold starts timing a cold start of rt, polling the backend so
+// the time it becomes ready is known even if no further requests arrive.
+func markBackendCold(rt *route) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if !rt.coldSince.IsZero() {
+		return
 	}
-	bodyBytes, _ := json.Marshal(scaleBody)
+	rt.coldSince = clk.Now()
+	go func() {
+		for i := 0; i < 600; i++ {
+			if isBackendUp(rt) {
+				return
+			}
+			clk.Sleep(time.Second)
+		}
+		// Give up without a sample rather than time a later cold start
+		// from now.
+		rt.mu.Lock()
+		rt.coldSince = time.Time{}
+		rt.mu.Unlock()
+	}()
+}
 
-	req, err := http.NewRequest(http.MethodPut, scaleURL, bytes.NewReader(bodyBytes))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// backendDialAddr returns host:port for u, filling in the scheme's default port.
+func backendDialAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
 	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer " + token)
-	req.Header.Set("Accept", "application/json")
+// scaleDeployment sets t's replica count; cause says why, for the audit log
+// and scale metrics, e.g. "traffic" when a request woke the backend or
+// "inactivity". Concurrent calls for the same count share one API request.
+func scaleDeployment(t *scaleTarget, replicas int, cause string) error {
+	replicas = boundReplicas(replicas)
+	lg := slog.With("deployment", t.String(), "replicas", replicas, "cause", cause)
+	lg.Debug("Scaling deployment")
+	t.mu.Lock()
+	// if lastScaledReplicas == replicas and it was less than a day since update, we don't need to scale again
+	if t.lastScaledReplicas == replicas && clk.Since(t.lastScaleRequestTime) < time.Duration(ReplicaUpdateIntervalHours)*time.Hour {
+		lg.Debug("Scale unchanged")
+		t.mu.Unlock()
+		return nil
+	}
+	up := replicas > t.lastScaledReplicas
+	t.mu.Unlock()
+	if up && maintenance.blocksScaleUp(t) {
+		lg.Info("Not scaling up: in maintenance")
+		return errMaintenance
+	}
+	if cause != "admin" && cause != "shutdown" {
+		if wait := t.cooldown(replicas); wait > 0 {
+			lg.Info("Not scaling: in cooldown", "wait_seconds", int(wait.Seconds()))
+			return errCooldown
+		}
+	}
+	return t.calls.do(strconv.Itoa(replicas), func() error {
+		return putScale(t, replicas, cause)
+	})
+}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("K8s API call failed: %w", err)
+func putScale(t *scaleTarget, replicas int, cause string) (err error) {
+	started := time.Now()
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		scaleAPISeconds.observe(time.Since(started).Seconds(), t.String(), cause, result)
+		scaleOps.inc(t.String(), cause, scaleDirection(replicas), result)
+		audit("proxy", "scale", t.String(), map[string]interface{}{"replicas": replicas, "cause": cause}, err)
+	}()
+
+	t.mu.Lock()
+	event := scaleEvent{target: t, replicas: replicas, previous: t.lastScaledReplicas, cause: cause}
+	t.mu.Unlock()
+	direction := "up"
+	if replicas == 0 || replicas < event.previous {
+		direction = "down"
 	}
-	defer resp.Body.Close()
+	if err := runScaleHook("before_"+direction, event); err != nil && scaleHookFailure == "abort" {
+		return fmt.Errorf("before_%s hook: %w", direction, err)
+	}
+	defer func() {
+		event.err = err
+		go runScaleHook("after_"+direction, event)
+	}()
 
-	if resp.StatusCode >= 300 {
-		respData, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("K8s API returned %d: %s", resp.StatusCode, string(respData))
+	if err := t.scaler.Scale(replicas); err != nil {
+		return err
 	}
 
-	log.Printf("Deployment scaled to %d replicas\n", replicas)
-	lastScaleRequestTime = time.Now()
-	lastBackEndTime = time.Time{} // reset backend health check time
-	lastScaledReplicas = replicas
+	slog.Info("Deployment scaled", "deployment", t.String(), "replicas", replicas, "previous", event.previous, "cause", cause, "duration_ms", time.Since(started).Milliseconds())
+	t.mu.Lock()
+	t.lastScaleRequestTime = clk.Now()
+	t.lastScaledReplicas = replicas
+	t.lastScaleCause = cause
+	if direction == "up" {
+		// Refreshing the same count is no scale-up and keeps the dwell.
+		if replicas > event.previous {
+			t.lastScaleUp = clk.Now()
+		}
+	} else {
+		t.lastScaleDown = clk.Now()
+	}
+	t.wakeCause, t.wakeStarted = "", time.Time{}
+	if replicas > 0 {
+		t.wakeCause, t.wakeStarted = cause, started
+	}
+	t.mu.Unlock()
+	reports.scaled(t, replicas)
+	resetBackendHealth(t)
 	return nil
 }
 
+// inactivityWatcher checks every five minutes for targets to scale down.
 func inactivityWatcher() {
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := clk.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		mu.Lock()
-		if time.Since(lastRequestTime) >= time.Duration(inactivityMinutes)*time.Minute {
-			log.Println("No traffic for a while. Scaling down deployment...")
-			if err := scaleDeployment(0); err != nil {
-				log.Println("Error scaling down deployment:", err)
-				return
+	for range ticker.C() {
+		if isActive() {
+			checkInactivity()
+		}
+	}
+}
+
+// checkInactivity scales each target down once none of its routes has
+// seen traffic for the route's inactivity window; a target shared by several
+// routes uses the longest window.
+func checkInactivity() {
+	windows := make(map[*scaleTarget]time.Duration)
+	for _, rt := range routing.Load().routes {
+		if d := time.Duration(rt.InactivityMinutes) * time.Minute; d > windows[rt.scale] {
+			windows[rt.scale] = d
+		}
+	}
+	floors := scheduleFloors(clk.Now())
+	for t, window := range windows {
+		if t.decided() || t.overridden() {
+			continue
+		}
+		window = t.window(window)
+		since, busy := t.idleSince()
+		idle := clk.Since(since)
+		floor := floors[t]
+		if busy || idle < window {
+			t.stepDown(floor)
+			continue
+		}
+		if pluginVetoesScaleDown(t, idle) {
+			continue
+		}
+		if t.cooldown(floor) > 0 {
+			continue
+		}
+		lg := slog.With("deployment", t.String(), "replicas", floor, "cause", "inactivity")
+		lg.Info("No traffic for a while, scaling down", "idle_seconds", int(idle.Seconds()))
+		if floor == 0 {
+			if n := sessions.closeTarget(t, "scale_down"); n > 0 {
+				lg.Info("Closed open sessions before scaling down", "sessions", n)
 			}
 		}
-		mu.Unlock()
+		if err := scaleDeployment(t, floor, "inactivity"); err != nil {
+			lg.Error("Error scaling down deployment", "error", err)
+		}
 	}
 }
 
@@ -225,6 +726,16 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvAsBool(key string, fallback bool) bool {
+	if v := os.Getenv(key); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
 func getEnvAsInt(key string, fallback int) int {
 	if v := os.Getenv(key); v != "" {
 		i, err := strconv.Atoi(v)
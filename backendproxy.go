@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Each route keeps one reverse proxy, and one transport per TLS server name
+// it reaches its backend under, for as long as the route table it belongs
+// to is in use. Plain HTTP requests reuse idle backend connections instead
+// of dialling every time; what differs between requests (the endpoint
+// discovery picked, the Host header, header templates) travels in the
+// request context.
+var (
+	backendMaxIdleConns    = getEnvAsInt("BACKEND_MAX_IDLE_CONNS", 64) // per backend endpoint
+	backendIdleConnSeconds = getEnvAsInt("BACKEND_IDLE_CONN_SECONDS", 90)
+)
+
+// proxyRequest is what the route's reverse proxy needs to know about one
+// request.
+type proxyRequest struct {
+	target *url.URL
+	host   string
+	hctx   *headerContext
+	origin string
+	lg     *slog.Logger
+}
+
+type proxyRequestKey struct{}
+
+func proxyRequestFrom(ctx context.Context) *proxyRequest {
+	p, _ := ctx.Value(proxyRequestKey{}).(*proxyRequest)
+	return p
+}
+
+// reverseProxy returns rt's reverse proxy, building it on first use.
+func (rt *route) reverseProxy() *httputil.ReverseProxy {
+	rt.proxyOnce.Do(func() {
+		rt.proxy = &httputil.ReverseProxy{
+			Director:       rt.direct,
+			Transport:      &routeTransport{rt: rt, byName: make(map[string]*http.Transport)},
+			ModifyResponse: rt.modifyResponse,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				proxyRequestFrom(r.Context()).lg.Warn("Proxy error", "error", err)
+				http.Error(w, "Proxy error", http.StatusBadGateway)
+			},
+		}
+	})
+	return rt.proxy
+}
+
+// direct points req at the backend, as NewSingleHostReverseProxy would
+// for the request's target, on the route's backend path.
+func (rt *route) direct(req *http.Request) {
+	p := proxyRequestFrom(req.Context())
+	req.URL.Scheme = p.target.Scheme
+	req.URL.Host = p.target.Host
+	req.URL.Path, req.URL.RawPath = rt.BackendPath, ""
+	if p.target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = p.target.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = p.target.RawQuery + "&" + req.URL.RawQuery
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Keep the transport from adding its own.
+		req.Header.Set("User-Agent", "")
+	}
+	if rt.Kind == "websocket" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+	}
+	req.Host = p.host
+	if rt.Headers != nil {
+		rt.Headers.Request.apply(req.Header, p.hctx)
+	}
+	pluginHeaders(rt, req.Header)
+}
+
+func (rt *route) modifyResponse(resp *http.Response) error {
+	p := proxyRequestFrom(resp.Request.Context())
+	if rt.Headers != nil {
+		rt.Headers.Response.apply(resp.Header, p.hctx)
+	}
+	if p.origin != "" && rt.CORS != nil && rt.CORS.allows(p.origin) {
+		rt.CORS.setHeaders(resp.Header, p.origin)
+	}
+	return tapUpgradeResponse(resp)
+}
+
+// maxRouteTransports bounds the server names a route keeps transports for,
+// as with host_header "original" they come from clients.
+const maxRouteTransports = 64
+
+// routeTransport sends a route's requests through a transport per TLS
+// server name, the backend's or the Host sent to SNI-routed backends, which
+// choose by server name as well as Host: a request sent with another Host
+// must not reuse a connection negotiated for the first, and the name is
+// what the certificate is verified against.
+type routeTransport struct {
+	rt *route
+
+	mu     sync.Mutex
+	byName map[string]*http.Transport
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name := req.URL.Hostname()
+	if p := proxyRequestFrom(req.Context()); p != nil && p.host != p.target.Host {
+		name = p.host
+		if h, _, err := net.SplitHostPort(p.host); err == nil {
+			name = h
+		}
+	}
+	t.mu.Lock()
+	tr := t.byName[name]
+	if tr == nil {
+		tr = t.rt.newBackendTransport(name)
+		if len(t.byName) < maxRouteTransports {
+			t.byName[name] = tr
+		} else {
+			tr.DisableKeepAlives = true
+		}
+	}
+	t.mu.Unlock()
+	return tr.RoundTrip(req)
+}
+
+func (rt *route) newBackendTransport(serverName string) *http.Transport {
+	return &http.Transport{
+		DialContext:           backendDialer.DialContext,
+		TLSClientConfig:       rt.backendTLSConfig(serverName),
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConnsPerHost:   backendMaxIdleConns,
+		IdleConnTimeout:       time.Duration(backendIdleConnSeconds) * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
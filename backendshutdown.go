@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var (
+	// shutdownBackend decides what happens to the scaled deployments when
+	// the proxy stops: "keep" leaves them as they are, "scale_down" scales
+	// them to zero, and "marker" records the last activity on each
+	// deployment so the next proxy instance resumes its inactivity timer
+	// instead of starting over.
+	shutdownBackend = getEnv("SHUTDOWN_BACKEND", "keep")
+)
+
+// pendingAnnotation holds the marker left on a deployment by SHUTDOWN_BACKEND=marker.
+const pendingAnnotation = "autoscale.aalaei.github.io/pending"
+
+type pendingMarker struct {
+	LastActivity time.Time `json:"last_activity"`
+	Replicas     int       `json:"replicas"` // -1 if unknown
+	Written      time.Time `json:"written"`
+}
+
+func setupShutdownBackend() error {
+	switch shutdownBackend {
+	case "keep", "scale_down":
+		return nil
+	case "marker":
+		for _, t := range routeTargets() {
+			if err := resumeFromMarker(t); err != nil {
+				slog.Error("Failed to read pending marker", "deployment", t.String(), "error", err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("SHUTDOWN_BACKEND: unknown value %q", shutdownBackend)
+}
+
+// routeTargets returns the deployments scaled by the current routes.
+func routeTargets() []*scaleTarget {
+	seen := make(map[*scaleTarget]bool)
+	var list []*scaleTarget
+	for _, rt := range routing.Load().routes {
+		if !seen[rt.scale] {
+			seen[rt.scale] = true
+			list = append(list, rt.scale)
+		}
+	}
+	return list
+}
+
+// shutdownBackends applies SHUTDOWN_BACKEND; it runs once sessions have
+// drained on stop, but not on in-place upgrades, where a new process
+// carries on.
+func shutdownBackends() {
+	for _, t := range routeTargets() {
+		switch shutdownBackend {
+		case "scale_down":
+			if err := scaleDeployment(t, 0, "shutdown"); err != nil {
+				slog.Error("Failed to scale down on shutdown", "deployment", t.String(), "replicas", 0, "cause", "shutdown", "error", err)
+			}
+		case "marker":
+			if err := writeMarker(t); err != nil {
+				slog.Error("Failed to leave pending marker", "deployment", t.String(), "error", err)
+			}
+		}
+	}
+}
+
+func writeMarker(t *scaleTarget) error {
+	t.mu.Lock()
+	m := pendingMarker{LastActivity: t.lastRequestTime.UTC(), Replicas: t.lastScaledReplicas, Written: time.Now().UTC()}
+	t.mu.Unlock()
+	value, _ := json.Marshal(m)
+	if err := annotateDeployment(t, string(value)); err != nil {
+		return err
+	}
+	slog.Info("Left pending marker", "deployment", t.String(), "last_activity", m.LastActivity.Format(time.RFC3339))
+	return nil
+}
+
+// resumeFromMarker takes over the last activity time recorded by the
+// previous instance and removes the marker.
+func resumeFromMarker(t *scaleTarget) error {
+	req, err := t.kubeRequest(http.MethodGet, fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", t.namespace, t.deployment), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("K8s API returned %d: %s", resp.StatusCode, msg)
+	}
+	var dep struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&dep); err != nil {
+		return err
+	}
+	value, ok := dep.Metadata.Annotations[pendingAnnotation]
+	if !ok {
+		return nil
+	}
+	var m pendingMarker
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return fmt.Errorf("invalid marker: %w", err)
+	}
+	t.mu.Lock()
+	if m.LastActivity.Before(t.lastRequestTime) {
+		t.lastRequestTime = m.LastActivity
+	}
+	t.mu.Unlock()
+	slog.Info("Resuming from pending marker", "deployment", t.String(), "last_activity", m.LastActivity.Format(time.RFC3339))
+	return annotateDeployment(t, "")
+}
+
+// annotateDeployment sets the pending marker on t's deployment, or removes
+// it if value is empty.
+func annotateDeployment(t *scaleTarget, value string) error {
+	var v interface{}
+	if value != "" {
+		v = value
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{pendingAnnotation: v}},
+	})
+	req, err := t.kubeRequest(http.MethodPatch, fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", t.namespace, t.deployment), bytes.NewReader(patch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("K8s API returned %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
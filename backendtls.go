@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Backends speaking TLS are not verified by default, as they are usually
+// reached by pod or service address with a self-signed certificate.
+// BACKEND_CA_FILE turns verification on against that CA (and the system
+// roots); BACKEND_TLS_SKIP_VERIFY=false does so against the system roots
+// alone. BACKEND_TLS_CERT_FILE and BACKEND_TLS_KEY_FILE present a client
+// certificate to backends that require mTLS. The files are re-read as they
+// change, like the listener's.
+var (
+	backendCAFile        = getEnv("BACKEND_CA_FILE", "")
+	backendTLSSkipVerify = getEnvAsBool("BACKEND_TLS_SKIP_VERIFY", backendCAFile == "")
+	backendTLSCertFile   = getEnv("BACKEND_TLS_CERT_FILE", "")
+	backendTLSKeyFile    = getEnv("BACKEND_TLS_KEY_FILE", "")
+
+	backendCA         *cachedFile
+	backendClientCert *keyPairFiles
+)
+
+func setupBackendTLS() error {
+	if (backendTLSCertFile == "") != (backendTLSKeyFile == "") {
+		return fmt.Errorf("BACKEND_TLS_CERT_FILE and BACKEND_TLS_KEY_FILE must be set together")
+	}
+	if backendCAFile != "" {
+		backendCA = &cachedFile{path: backendCAFile}
+		ca, err := backendCA.get()
+		if err != nil {
+			return fmt.Errorf("BACKEND_CA_FILE: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return fmt.Errorf("BACKEND_CA_FILE: no PEM certificates in %s", backendCAFile)
+		}
+	}
+	if backendTLSCertFile != "" {
+		backendClientCert = &keyPairFiles{cert: backendTLSCertFile, key: backendTLSKeyFile}
+		if err := backendClientCert.load(); err != nil {
+			return fmt.Errorf("backend client certificate: %w", err)
+		}
+	}
+	return nil
+}
+
+// backendTLSConfig returns the TLS settings for connections to rt's
+// backend under serverName: the certificate is verified unless
+// BACKEND_TLS_SKIP_VERIFY is set, and with pins configured one of the
+// presented certificates must also match a pin. The name is checked here
+// rather than taken from the handshake, which leaves it out for addresses.
+func (rt *route) backendTLSConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		// The chain is verified by VerifyConnection, so that a rotated
+		// BACKEND_CA_FILE is picked up.
+		InsecureSkipVerify: true,
+	}
+	if backendClientCert != nil {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return backendClientCert.get(nil)
+		}
+	}
+	if backendTLSSkipVerify && len(rt.pins) == 0 {
+		return cfg
+	}
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if !backendTLSSkipVerify {
+			if err := verifyBackendChain(cs, serverName); err != nil {
+				return err
+			}
+		}
+		if len(rt.pins) == 0 {
+			return nil
+		}
+		for _, cert := range cs.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range rt.pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+		return errors.New("backend certificate does not match any SPKI pin")
+	}
+	return cfg
+}
+
+func verifyBackendChain(cs tls.ConnectionState, serverName string) error {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if backendCA != nil {
+		if ca, err := backendCA.get(); err == nil {
+			roots.AppendCertsFromPEM(ca)
+		}
+	}
+	opts := x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
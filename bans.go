@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// banThreshold is the number of strikes within banFindSeconds that gets
+	// a client banned; 0 disables automatic bans.
+	banThreshold   = getEnvAsInt("BAN_THRESHOLD", 0)
+	banFindSeconds = getEnvAsInt("BAN_FIND_SECONDS", 600)
+	banSeconds     = getEnvAsInt("BAN_SECONDS", 600)
+	banMaxSeconds  = getEnvAsInt("BAN_MAX_SECONDS", 86400)
+	// banMaxEntries caps the clients remembered, so a flood from many
+	// addresses can't grow the list without bound.
+	banMaxEntries = getEnvAsInt("BAN_MAX_ENTRIES", 100000)
+
+	bans = &banList{m: make(map[string]*banEntry)}
+)
+
+// banList tracks misbehaving clients fail2ban-style: strikes (failed auth,
+// malformed upgrades, rate-limit violations) within a window lead to a ban
+// that doubles in length each time the client is banned again.
+type banList struct {
+	mu        sync.Mutex
+	m         map[string]*banEntry
+	lastPrune time.Time
+}
+
+type banEntry struct {
+	IP      string      `json:"ip"`
+	Until   time.Time   `json:"until,omitempty"`
+	Reason  string      `json:"reason,omitempty"`
+	Bans    int         `json:"bans"` // times banned so far, drives escalation
+	Strikes []time.Time `json:"-"`
+}
+
+func (b *banList) banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.m[ip]
+	return ok && clk.Now().Before(e.Until)
+}
+
+// strike records misbehaviour by ip and bans it once it reaches the
+// threshold.
+func (b *banList) strike(ip, reason string) {
+	if banThreshold <= 0 || ip == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := clk.Now()
+	e, ok := b.m[ip]
+	if !ok {
+		// Pruning walks the whole list, so it is done at most once a
+		// minute, or a second while the list is full.
+		since := now.Sub(b.lastPrune)
+		if since > time.Minute || len(b.m) >= banMaxEntries && since > time.Second {
+			b.prune(now)
+		}
+		if len(b.m) >= banMaxEntries && !b.evict(now) {
+			return
+		}
+		e = b.entry(ip)
+	}
+	if now.Before(e.Until) {
+		return
+	}
+	window := now.Add(-time.Duration(banFindSeconds) * time.Second)
+	kept := e.Strikes[:0]
+	for _, t := range e.Strikes {
+		if t.After(window) {
+			kept = append(kept, t)
+		}
+	}
+	e.Strikes = append(kept, now)
+	if len(e.Strikes) < banThreshold {
+		return
+	}
+
+	d := time.Duration(banSeconds) * time.Second
+	longest := time.Duration(banMaxSeconds) * time.Second
+	for i := 0; i < e.Bans && d < longest; i++ {
+		d *= 2
+	}
+	if d > longest {
+		d = longest
+	}
+	e.Bans++
+	e.Until = now.Add(d)
+	e.Reason = reason
+	e.Strikes = nil
+	slog.Warn("Banned client", "client", ip, "seconds", int(d.Seconds()), "reason", reason)
+}
+
+// entry returns the entry for ip, creating it. b.mu must be held.
+func (b *banList) entry(ip string) *banEntry {
+	e, ok := b.m[ip]
+	if !ok {
+		e = &banEntry{IP: ip}
+		b.m[ip] = e
+	}
+	return e
+}
+
+func (b *banList) set(ip string, d time.Duration, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.entry(ip)
+	e.Until = clk.Now().Add(d)
+	e.Reason = reason
+}
+
+func (b *banList) remove(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.m[ip]
+	delete(b.m, ip)
+	return ok
+}
+
+// active returns the current bans.
+func (b *banList) active() []banEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := clk.Now()
+	b.prune(now)
+	list := []banEntry{}
+	for _, e := range b.m {
+		if now.Before(e.Until) {
+			list = append(list, *e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// prune drops entries that have nothing left to remember. b.mu must be
+// held.
+func (b *banList) prune(now time.Time) {
+	b.lastPrune = now
+	window := now.Add(-time.Duration(banFindSeconds) * time.Second)
+	// Expired bans are kept for a while so a returning offender still
+	// gets a longer ban.
+	escalation := time.Duration(banMaxSeconds) * time.Second
+	for ip, e := range b.m {
+		if now.Before(e.Until) {
+			continue
+		}
+		recent := len(e.Strikes) > 0 && e.Strikes[len(e.Strikes)-1].After(window)
+		if !recent && now.Sub(e.Until) > escalation {
+			delete(b.m, ip)
+		}
+	}
+}
+
+// evict makes room in a full list by forgetting a client that is not
+// banned, reporting whether there was one. b.mu must be held.
+func (b *banList) evict(now time.Time) bool {
+	for ip, e := range b.m {
+		if !now.Before(e.Until) {
+			delete(b.m, ip)
+			return true
+		}
+	}
+	return false
+}
+
+// handleBans is the admin API for the ban list: GET lists active bans,
+// POST {"ip": "...", "seconds": N, "reason": "..."} adds one and
+// DELETE ?ip=... lifts one.
+func handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bans.active())
+	case http.MethodPost:
+		var req struct {
+			IP      string `json:"ip"`
+			Seconds int    `json:"seconds"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addr, err := netip.ParseAddr(req.IP)
+		if err != nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		if req.Seconds <= 0 {
+			req.Seconds = banMaxSeconds
+		}
+		if req.Reason == "" {
+			req.Reason = "manual"
+		}
+		bans.set(addr.Unmap().String(), time.Duration(req.Seconds)*time.Second, req.Reason)
+		audit(adminUser(r.Context()), "ban", addr.Unmap().String(), map[string]interface{}{"seconds": req.Seconds, "reason": req.Reason}, nil)
+		slog.Info("Banned client via admin API", "admin", adminUser(r.Context()), "client", addr.Unmap().String(), "seconds", req.Seconds, "reason", req.Reason)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if !bans.remove(ip) {
+			http.Error(w, "not banned", http.StatusNotFound)
+			return
+		}
+		audit(adminUser(r.Context()), "unban", ip, nil, nil)
+		slog.Info("Lifted ban via admin API", "admin", adminUser(r.Context()), "client", ip)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
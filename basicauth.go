@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth protects a route with HTTP Basic credentials. Users maps names
+// to bcrypt hashes, e.g. from `htpasswd -nbB user password`.
+type basicAuth struct {
+	Realm string            `json:"realm,omitempty"`
+	Users map[string]string `json:"users"`
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+func (a *basicAuth) validate() error {
+	if len(a.Users) == 0 {
+		return fmt.Errorf("basic_auth has no users")
+	}
+	names := make([]string, 0, len(a.Users))
+	for name := range a.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := bcrypt.Cost([]byte(a.Users[name])); err != nil {
+			return fmt.Errorf("basic_auth user %q: %w", name, err)
+		}
+	}
+	if a.Realm == "" {
+		a.Realm = "Restricted"
+	}
+	return nil
+}
+
+// allows reports whether r carries valid credentials. Unknown users are
+// checked against a dummy hash so they take as long as wrong passwords.
+func (a *basicAuth) allows(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := a.Users[user]
+	if !known {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// check answers 401 (407 for CONNECT, which authenticates with
+// Proxy-Authorization) and returns false unless r is authorized, else the
+// user name. The credentials are meant for the proxy and are not passed to
+// the backend.
+func (a *basicAuth) check(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method == http.MethodConnect {
+		pr := proxyAuthRequest(r)
+		if !a.allows(pr) {
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.Realm))
+			http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+			return "", false
+		}
+		user, _, _ := pr.BasicAuth()
+		r.Header.Del("Proxy-Authorization")
+		return user, true
+	}
+	if !a.allows(r) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.Realm))
+		rejectUpgrade(w, r, "auth_failed", http.StatusUnauthorized)
+		return "", false
+	}
+	user, _, _ := r.BasicAuth()
+	r.Header.Del("Authorization")
+	return user, true
+}
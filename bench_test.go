@@ -0,0 +1,112 @@
+package main
+
+// Benchmarks for the request path. Run with e.g.
+//
+//	go test -run '^$' -bench BenchmarkReverseProxy -cpu 8
+//
+// "per-request" builds a reverse proxy and transport for every request, as
+// the handler used to, for comparison with the route's long-lived one.
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func benchBackend(b *testing.B) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			io.WriteString(w, "ok")
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		conn.Close()
+	}))
+	b.Cleanup(srv.Close)
+	return srv
+}
+
+func benchProxies(b *testing.B, kind string) map[string]http.Handler {
+	backend := benchBackend(b)
+	target, _ := url.Parse(backend.URL)
+	rt := &route{Name: "bench", Path: "/ws", Kind: kind, BackendURL: backend.URL, BackendPath: "/ws", target: target}
+	return map[string]http.Handler{
+		"pooled": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), proxyRequestKey{}, &proxyRequest{target: target, host: target.Host, lg: slog.Default()}))
+			rt.reverseProxy().ServeHTTP(w, r)
+		}),
+		"per-request": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			tr := &http.Transport{DialContext: backendDialer.DialContext, TLSClientConfig: rt.backendTLSConfig(target.Hostname())}
+			proxy.Transport = tr
+			proxy.ServeHTTP(w, r)
+			// Idle connections of a discarded transport are never reused.
+			tr.CloseIdleConnections()
+		}),
+	}
+}
+
+func BenchmarkReverseProxyUpgrade(b *testing.B) {
+	for name, h := range benchProxies(b, "websocket") {
+		b.Run(name, func(b *testing.B) {
+			front := httptest.NewServer(h)
+			defer front.Close()
+			addr := front.Listener.Addr().String()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: bench\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+						"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+					resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+					if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+						b.Errorf("upgrade failed: %v %v", resp, err)
+						conn.Close()
+						return
+					}
+					conn.Close()
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReverseProxyHTTP(b *testing.B) {
+	for name, h := range benchProxies(b, "http") {
+		b.Run(name, func(b *testing.B) {
+			front := httptest.NewServer(h)
+			defer front.Close()
+			client := front.Client()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Get(front.URL + "/events")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		})
+	}
+}
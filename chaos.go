@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+var chaosInjected = newCounter("wsproxy_chaos_injected_total",
+	"Faults injected by route chaos settings.", "route", "fault")
+
+// chaosPolicy injects faults into a route so clients' reconnect logic and
+// alerting can be exercised. Rates are probabilities between 0 and 1.
+type chaosPolicy struct {
+	// ErrorRate answers this share of requests with 502 instead of
+	// proxying them.
+	ErrorRate float64 `json:"error_rate,omitempty"`
+	// ScaleDelayMS holds back scale-ups, as a slow API server would.
+	ScaleDelayMS int `json:"scale_delay_ms,omitempty"`
+	// DropFrameRate silently drops this share of whole data frames in
+	// either direction (frame mode only).
+	DropFrameRate float64 `json:"drop_frame_rate,omitempty"`
+	// BackendDelayMS delays the handshake and every chunk the backend
+	// sends, as a slow backend would.
+	BackendDelayMS int `json:"backend_delay_ms,omitempty"`
+}
+
+func (p *chaosPolicy) validate() error {
+	for _, rate := range []float64{p.ErrorRate, p.DropFrameRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("chaos rate %v is not between 0 and 1", rate)
+		}
+	}
+	if p.ScaleDelayMS < 0 || p.BackendDelayMS < 0 {
+		return fmt.Errorf("chaos delays must not be negative")
+	}
+	if p.DropFrameRate > 0 && !frameMode() {
+		return fmt.Errorf("chaos drop_frame_rate needs PROXY_MODE=frame")
+	}
+	return nil
+}
+
+// failRequest answers r with an injected error if the dice say so.
+func (p *chaosPolicy) failRequest(w http.ResponseWriter, rt *route) bool {
+	if p == nil || p.ErrorRate == 0 || rand.Float64() >= p.ErrorRate {
+		return false
+	}
+	chaosInjected.inc(rt.Name, "error")
+	http.Error(w, "Proxy error", http.StatusBadGateway)
+	return true
+}
+
+func (p *chaosPolicy) delayScale(rt *route) {
+	if p == nil || p.ScaleDelayMS == 0 {
+		return
+	}
+	chaosInjected.inc(rt.Name, "scale_delay")
+	time.Sleep(time.Duration(p.ScaleDelayMS) * time.Millisecond)
+}
+
+func (p *chaosPolicy) delayBackend(rt *route) {
+	if p == nil || p.BackendDelayMS == 0 {
+		return
+	}
+	chaosInjected.inc(rt.Name, "backend_delay")
+	time.Sleep(time.Duration(p.BackendDelayMS) * time.Millisecond)
+}
+
+// dropFrame reports whether the relayed chunk b, if it is exactly one
+// data frame, should be dropped.
+func (p *chaosPolicy) dropFrame(rt *route, b []byte) bool {
+	if p == nil || p.DropFrameRate == 0 || !wholeDataFrame(b) || rand.Float64() >= p.DropFrameRate {
+		return false
+	}
+	chaosInjected.inc(rt.Name, "drop_frame")
+	return true
+}
+
+// wholeDataFrame reports whether b is exactly one complete, unfragmented
+// text or binary frame, which can be dropped without corrupting the stream.
+func wholeDataFrame(b []byte) bool {
+	if len(b) < 2 {
+		return false
+	}
+	if op := b[0] & 0x0f; b[0]&0x80 == 0 || (op != opText && op != opBinary) {
+		return false
+	}
+	size := wsHeaderSize(b)
+	if len(b) < size {
+		return false
+	}
+	length := uint64(b[1] & 0x7f)
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(b[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(b[2:10])
+	}
+	return uint64(len(b)-size) == length
+}
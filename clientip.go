@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var (
+	// trustedProxiesSpec lists the CIDRs of CDNs and load balancers allowed
+	// to report the client address in headers. "cloudflare" and "private"
+	// expand to Cloudflare's published ranges and the private networks.
+	trustedProxiesSpec = getEnv("TRUSTED_PROXIES", "")
+
+	trustedProxies []netip.Prefix
+)
+
+var cidrAliases = map[string][]string{
+	"cloudflare": {
+		"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+		"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+		"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+		"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+		"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+		"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+	},
+	"private": {
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8",
+		"fc00::/7", "::1/128",
+	},
+}
+
+// clientIPHeaders carry the client address as reported by a trusted proxy,
+// in order of preference. They are stripped from untrusted requests.
+var clientIPHeaders = []string{"CF-Connecting-IP", "True-Client-IP", "X-Forwarded-For", "X-Real-IP"}
+
+func setupTrustedProxies() error {
+	if trustedProxiesSpec == "" {
+		return nil
+	}
+	var err error
+	trustedProxies, err = parseCIDRList(trustedProxiesSpec, cidrAliases)
+	if err != nil {
+		return fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	slog.Info("Trusting client address headers", "networks", len(trustedProxies))
+	return nil
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs, bare addresses and
+// aliases.
+func parseCIDRList(spec string, aliases map[string][]string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		expanded := []string{entry}
+		if alias, ok := aliases[strings.ToLower(entry)]; ok {
+			expanded = alias
+		}
+		for _, e := range expanded {
+			p, err := parsePrefix(e)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	return len(trustedProxies) > 0 && prefixesContain(trustedProxies, remoteAddr(r))
+}
+
+// clientIP returns the address of the client behind r, taking the headers of
+// trusted proxies into account.
+func clientIP(r *http.Request) string {
+	peer := remoteAddr(r)
+	if !fromTrustedProxy(r) {
+		return peer.String()
+	}
+	for _, name := range clientIPHeaders {
+		v := r.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		if name == "X-Forwarded-For" {
+			// Walk from the nearest hop outwards and stop at the first
+			// address not belonging to a trusted proxy.
+			hops := strings.Split(strings.Join(r.Header.Values(name), ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				addr, err := parseHeaderAddr(hops[i])
+				if err != nil {
+					break
+				}
+				if i == 0 || !prefixesContain(trustedProxies, addr) {
+					return addr.Unmap().String()
+				}
+			}
+			continue
+		}
+		if addr, err := parseHeaderAddr(v); err == nil {
+			return addr.Unmap().String()
+		}
+	}
+	return peer.String()
+}
+
+// parseHeaderAddr parses a client address as proxies write it: a bare
+// address, or with a port, where IPv6 addresses are bracketed
+// ("[2001:db8::1]:443"); brackets without a port are accepted too.
+func parseHeaderAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr, nil
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr(), nil
+	}
+	return netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// stripUntrustedClientHeaders removes client address headers that were not
+// set by a trusted proxy, so backends can't be fooled by spoofed values.
+func stripUntrustedClientHeaders(r *http.Request) {
+	if len(trustedProxies) == 0 || fromTrustedProxy(r) {
+		return
+	}
+	for _, name := range clientIPHeaders {
+		r.Header.Del(name)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "time"
+
+// clk is the time source for scaling decisions (inactivity tracking, the
+// replica update interval and other cooldowns, the cached backend health)
+// and for the other timers: bans, wake tokens, rate limits, OIDC key
+// refreshes and sessions, and session timeouts. Latency metrics, socket
+// deadlines and the expiry of ID tokens keep using wall time.
+var clk clock = realClock{}
+
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	NewTicker(d time.Duration) ticker
+	NewTimer(d time.Duration) timer
+	// AfterFunc calls f in its own goroutine after d; the timer's C is nil.
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// timer is like a ticker but fires only once.
+type timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                  { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)           { time.Sleep(d) }
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop()               { t.t.Stop() }
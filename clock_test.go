@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when told to. Advance fires the tickers and wakes
+// the sleepers that came due, in time order.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending Sleep or timer (period 0) or a ticker. An
+// AfterFunc timer has f, which is called instead of sending on c.
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+	f      func()
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	w := &fakeWaiter{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	<-w.c
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return &fakeTicker{c, w}
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return &fakeTicker{c, w}
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), f: f}
+	c.waiters = append(c.waiters, w)
+	return &fakeTicker{c, w}
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+		if len(c.waiters) == 0 || c.waiters[0].at.After(end) {
+			break
+		}
+		w := c.waiters[0]
+		c.now = w.at
+		if w.f != nil {
+			go w.f()
+		} else {
+			// Like time.Ticker, a slow receiver misses ticks.
+			select {
+			case w.c <- c.now:
+			default:
+			}
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+type fakeTicker struct {
+	c *fakeClock
+	w *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.c }
+
+func (t *fakeTicker) Stop() {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, w := range t.c.waiters {
+		if w == t.w {
+			t.c.waiters = append(t.c.waiters[:i], t.c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// waiting blocks until n tickers, timers or sleepers are registered, so a test can
+// advance the clock past a deadline that another goroutine is about to set.
+func (c *fakeClock) waiting(n int) {
+	for {
+		c.mu.Lock()
+		got := len(c.waiters)
+		c.mu.Unlock()
+		if got >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// useFakeClock makes a fake clock the proxy's for the rest of the test.
+// Targets remember the time they were created, so call it before making
+// any.
+func useFakeClock(t *testing.T) *fakeClock {
+	c := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	prev := clk
+	clk = c
+	t.Cleanup(func() { clk = prev })
+	return c
+}
+
+func TestInactivityScaleDown(t *testing.T) {
+	c := useFakeClock(t)
+	rt, api := fakeKubeRoute(t, "idle", 0, "secret")
+	rt.InactivityMinutes = 10
+	if err := scaleDeployment(rt.scale, 1, "traffic"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Advance(9 * time.Minute)
+	checkInactivity()
+	if got := api.Replicas("test", "idle"); got != 1 {
+		t.Fatalf("replicas after 9 idle minutes = %d, want 1", got)
+	}
+	c.Advance(time.Minute)
+	checkInactivity()
+	if got := api.Replicas("test", "idle"); got != 0 {
+		t.Fatalf("replicas after 10 idle minutes = %d, want 0", got)
+	}
+	if st := targetStatusOf(rt.scale); st.LastScale == nil || st.LastScale.Cause != "inactivity" {
+		t.Fatalf("status after scale down = %+v", st)
+	}
+}
+
+func TestNoScalingAfterHandoff(t *testing.T) {
+	c := useFakeClock(t)
+	rt, api := fakeKubeRoute(t, "handoff", 0, "secret")
+	rt.InactivityMinutes = 10
+	if err := scaleDeployment(rt.scale, 1, "traffic"); err != nil {
+		t.Fatal(err)
+	}
+	handedOff.Store(true)
+	t.Cleanup(func() { handedOff.Store(false) })
+
+	go inactivityWatcher()
+	c.waiting(1)
+	c.Advance(15 * time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	if got := api.ScaleCalls("test", "handoff"); !slices.Equal(got, []int{1}) {
+		t.Fatalf("scale calls after the handoff = %v, want only the scale up", got)
+	}
+}
+
+func TestCooldownAndDwell(t *testing.T) {
+	defer func(up, down, dwell int) {
+		scaleUpCooldownSeconds, scaleDownCooldownSeconds, scaleUpDwellSeconds = up, down, dwell
+	}(scaleUpCooldownSeconds, scaleDownCooldownSeconds, scaleUpDwellSeconds)
+	scaleUpCooldownSeconds, scaleDownCooldownSeconds, scaleUpDwellSeconds = 60, 120, 300
+
+	c := useFakeClock(t)
+	rt, api := fakeKubeRoute(t, "cool", 0, "secret")
+	if err := scaleDeployment(rt.scale, 2, "traffic"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Freshly scaled up, it dwells at two replicas.
+	if err := scaleDeployment(rt.scale, 1, "inactivity"); !errors.Is(err, errCooldown) {
+		t.Fatalf("scale down during the dwell = %v, want errCooldown", err)
+	}
+	c.Advance(299 * time.Second)
+	if d := rt.scale.cooldown(1); d != time.Second {
+		t.Fatalf("cooldown with a second of dwell left = %s", d)
+	}
+	c.Advance(time.Second)
+	if err := scaleDeployment(rt.scale, 1, "inactivity"); err != nil {
+		t.Fatalf("scale down after the dwell: %v", err)
+	}
+
+	// After a scale-down, neither direction is allowed for a while.
+	if err := scaleDeployment(rt.scale, 2, "traffic"); !errors.Is(err, errCooldown) {
+		t.Fatalf("scale up in the cooldown = %v, want errCooldown", err)
+	}
+	c.Advance(time.Minute)
+	if err := scaleDeployment(rt.scale, 0, "inactivity"); !errors.Is(err, errCooldown) {
+		t.Fatalf("scale down in the cooldown = %v, want errCooldown", err)
+	}
+	// The admin API is not held back,
+	if err := scaleDeployment(rt.scale, 0, "admin"); err != nil {
+		t.Fatalf("admin scale down in the cooldown: %v", err)
+	}
+	// but it starts the cooldown over.
+	c.Advance(59 * time.Second)
+	if err := scaleDeployment(rt.scale, 1, "traffic"); !errors.Is(err, errCooldown) {
+		t.Fatalf("scale up right after the admin scale down = %v, want errCooldown", err)
+	}
+	c.Advance(time.Second)
+	if err := scaleDeployment(rt.scale, 1, "traffic"); err != nil {
+		t.Fatalf("scale up after the cooldown: %v", err)
+	}
+	if got := api.ScaleCalls("test", "cool"); !slices.Equal(got, []int{2, 1, 0, 1}) {
+		t.Fatalf("scale calls = %v, want [2 1 0 1]", got)
+	}
+}
+
+func TestDwellNotRestartedByRefresh(t *testing.T) {
+	defer func(dwell, hours int) {
+		scaleUpDwellSeconds, ReplicaUpdateIntervalHours = dwell, hours
+	}(scaleUpDwellSeconds, ReplicaUpdateIntervalHours)
+	scaleUpDwellSeconds, ReplicaUpdateIntervalHours = 300, 1
+
+	c := useFakeClock(t)
+	rt, api := fakeKubeRoute(t, "refresh", 0, "secret")
+	if err := scaleDeployment(rt.scale, 2, "traffic"); err != nil {
+		t.Fatal(err)
+	}
+	// Past the update interval the same count is sent again.
+	c.Advance(time.Hour)
+	if err := scaleDeployment(rt.scale, 2, "traffic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := scaleDeployment(rt.scale, 1, "inactivity"); err != nil {
+		t.Fatalf("scale down an hour after the scale-up: %v", err)
+	}
+	if got := api.ScaleCalls("test", "refresh"); !slices.Equal(got, []int{2, 2, 1}) {
+		t.Fatalf("scale calls = %v, want [2 2 1]", got)
+	}
+}
+
+func TestQueueWaitTimeout(t *testing.T) {
+	defer func(n int) { queueWaitSecondsEnv = n }(queueWaitSecondsEnv)
+	queueWaitSecondsEnv = 30
+	c := useFakeClock(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	q := &queuedClient{released: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- q.wait(r) }()
+	c.waiting(1)
+	c.Advance(29 * time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("wait returned %v before its deadline", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	if err := <-done; !errors.Is(err, errNotReady) {
+		t.Fatalf("wait past its deadline = %v, want errNotReady", err)
+	}
+
+	q = &queuedClient{released: make(chan struct{})}
+	go func() { done <- q.wait(r) }()
+	c.waiting(1)
+	c.Advance(10 * time.Second)
+	close(q.released)
+	if err := <-done; err != nil {
+		t.Fatalf("wait after release = %v", err)
+	}
+}
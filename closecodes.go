@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// closeCodesSpec overrides the default mapping, e.g.
+	// "scale_down=4000:backend sleeping,auth_failed=4001:unauthorized".
+	closeCodesSpec       = getEnv("CLOSE_CODES", "")
+	rejectWithCloseFrame = getEnvAsBool("REJECT_WITH_CLOSE_FRAME", false)
+	closeCodes           = map[string]closeCode{
+		"scale_down":      {1012, "backend scaling down"},
+		"backend_error":   {1011, "backend connection lost"},
+		"scale_failed":    {1013, "backend unavailable"},
+		"queue_full":      {1013, "try again later"},
+		"not_ready":       {1013, "backend not ready"},
+		"auth_failed":     {1008, "unauthorized"},
+		"origin_denied":   {1008, "origin not allowed"},
+		"quota_exceeded":  {1008, "quota exceeded"},
+		"message_too_big": {1009, "message too big"},
+		"going_away":      {1001, "proxy shutting down"},
+		"admin_closed":    {1008, "closed by administrator"},
+	}
+)
+
+// closeCode is the WebSocket close status and reason sent to peers when the
+// proxy itself ends a session for a given condition.
+type closeCode struct {
+	code   uint16
+	reason string
+}
+
+func (cc closeCode) payload() []byte {
+	reason := cc.reason
+	if len(reason) > 123 { // control frame payloads are capped at 125 bytes
+		// Cut on a rune boundary: peers fail the connection on invalid UTF-8.
+		n := 123
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	return append(binary.BigEndian.AppendUint16(nil, cc.code), reason...)
+}
+
+func closeCodeFor(condition string) closeCode {
+	if cc, ok := closeCodes[condition]; ok {
+		return cc
+	}
+	return closeCode{1011, condition}
+}
+
+// sendableCloseCode reports whether code may be sent in a close frame: RFC
+// 6455 reserves 1004 and keeps 1005, 1006 and 1015 for reporting locally.
+func sendableCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	default:
+		return code >= 3000 && code <= 4999
+	}
+}
+
+func setupCloseCodes() error {
+	if closeCodesSpec == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(closeCodesSpec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return fmt.Errorf("invalid CLOSE_CODES entry %q", entry)
+		}
+		codeStr, reason, _ := strings.Cut(value, ":")
+		code, err := strconv.Atoi(codeStr)
+		if err != nil || !sendableCloseCode(code) {
+			return fmt.Errorf("invalid close code in CLOSE_CODES entry %q", entry)
+		}
+		if reason == "" {
+			reason = closeCodeFor(name).reason
+		}
+		closeCodes[name] = closeCode{uint16(code), reason}
+	}
+	return nil
+}
+
+// rejectUpgrade refuses a request for condition. Browsers cannot see the
+// HTTP status of a failed upgrade, so with REJECT_WITH_CLOSE_FRAME the
+// handshake is completed instead and immediately closed with the mapped
+// close code, letting clients tell the conditions apart.
+func rejectUpgrade(w http.ResponseWriter, r *http.Request, condition string, status int) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !rejectWithCloseFrame || key == "" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	brw.Write(appendWSFrame(nil, opClose, closeCodeFor(condition).payload(), false))
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := brw.Flush(); err != nil {
+		slog.Warn("Failed to send close frame", "request_id", requestID(r), "condition", condition, "error", err)
+	}
+}
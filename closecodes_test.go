@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSendableCloseCode(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		ok   bool
+	}{
+		{999, false},
+		{1000, true},
+		{1003, true},
+		{1004, false},
+		{1005, false},
+		{1006, false},
+		{1007, true},
+		{1014, true},
+		{1015, false},
+		{2999, false},
+		{3000, true},
+		{4999, true},
+		{5000, false},
+	} {
+		if got := sendableCloseCode(tc.code); got != tc.ok {
+			t.Errorf("sendableCloseCode(%d) = %v, want %v", tc.code, got, tc.ok)
+		}
+	}
+}
+
+func TestSetupCloseCodesRejectsReserved(t *testing.T) {
+	defer func(spec string) { closeCodesSpec = spec }(closeCodesSpec)
+	for _, spec := range []string{"scale_down=1005", "scale_down=1006:x", "scale_down=1015", "scale_down=1004"} {
+		closeCodesSpec = spec
+		if err := setupCloseCodes(); err == nil {
+			t.Errorf("CLOSE_CODES=%q accepted", spec)
+		}
+	}
+}
+
+func TestCloseCodePayloadTruncatesOnRuneBoundary(t *testing.T) {
+	for _, reason := range []string{
+		strings.Repeat("a", 200),
+		strings.Repeat("é", 100),      // 2 bytes each, byte 123 is a continuation
+		strings.Repeat("€", 50),       // 3 bytes each
+		"a" + strings.Repeat("😀", 40), // 4 bytes each
+	} {
+		p := closeCode{4000, reason}.payload()
+		if len(p) > 125 {
+			t.Errorf("payload of %d bytes exceeds a control frame", len(p))
+		}
+		if code := binary.BigEndian.Uint16(p); code != 4000 {
+			t.Errorf("code = %d", code)
+		}
+		if !utf8.Valid(p[2:]) {
+			t.Errorf("reason %q is not valid UTF-8", p[2:])
+		}
+		if !strings.HasPrefix(reason, string(p[2:])) || len(p)-2 < 120 {
+			t.Errorf("reason cut to %d bytes", len(p)-2)
+		}
+	}
+}
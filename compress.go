@@ -0,0 +1,130 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// compressResponses gzips decoy, health and plain HTTP route responses
+	// for clients that accept it, as web servers commonly do. Upgrades are
+	// never compressed.
+	compressResponses = getEnvAsBool("COMPRESS_RESPONSES", true)
+	// compressTypes are the content types compressed; a trailing "/*"
+	// matches a whole type.
+	compressTypes = strings.Split(getEnv("COMPRESS_TYPES", "text/*,application/json,application/javascript,application/xml,image/svg+xml"), ",")
+	// compressMinBytes leaves responses known to be shorter as they are.
+	compressMinBytes = getEnvAsInt("COMPRESS_MIN_BYTES", 256)
+
+	gzipWriters = sync.Pool{New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return gz
+	}}
+)
+
+// compressed wraps w to gzip the response to r when the client accepts it.
+// The returned function must be called once the response is complete.
+func compressed(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if !compressResponses || r.Method == http.MethodHead || !acceptsGzip(r) {
+		return w, func() {}
+	}
+	cw := &gzipWriter{ResponseWriter: w}
+	return cw, cw.close
+}
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+			if !ok {
+				return true
+			}
+			f, err := strconv.ParseFloat(q, 64)
+			return err == nil && f > 0
+		}
+	}
+	return false
+}
+
+func compressibleType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range compressTypes {
+		t = strings.TrimSpace(t)
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mt, prefix) || mt == t {
+			// Event streams are flushed per event; leave them be.
+			return mt != "text/event-stream"
+		}
+	}
+	return false
+}
+
+// gzipWriter decides when the header is written whether to compress: only
+// complete, uncompressed responses of a compressible type.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if !w.decided && code >= 200 {
+		w.decided = true
+		h := w.Header()
+		if code != http.StatusNoContent && code != http.StatusNotModified && code != http.StatusPartialContent &&
+			h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" && compressibleType(h.Get("Content-Type")) {
+			if n, err := strconv.Atoi(h.Get("Content-Length")); err != nil || n >= compressMinBytes {
+				h.Add("Vary", "Accept-Encoding")
+				h.Del("Content-Length")
+				h.Set("Content-Encoding", "gzip")
+				w.gz = gzipWriters.Get().(*gzip.Writer)
+				w.gz.Reset(w.ResponseWriter)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// routeChange names the settings of a route that a candidate config changes.
+type routeChange struct {
+	Route  string   `json:"route"`
+	Fields []string `json:"fields"`
+}
+
+type configCheck struct {
+	Valid   bool          `json:"valid"`
+	Error   string        `json:"error,omitempty"`
+	Added   []string      `json:"added,omitempty"`
+	Removed []string      `json:"removed,omitempty"`
+	Changed []routeChange `json:"changed,omitempty"`
+}
+
+// checkConfig validates a candidate CONFIG_FILE and, with diff set, compares
+// its routes with the live ones by name.
+func checkConfig(data []byte, diff bool) configCheck {
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return configCheck{Error: err.Error()}
+	}
+	routes := cfg.Routes
+	if len(routes) == 0 {
+		if routes, err = defaultRoutes(); err != nil {
+			return configCheck{Error: err.Error()}
+		}
+	}
+	if err := validateRoutes(routes); err != nil {
+		return configCheck{Error: err.Error()}
+	}
+	if err := validateListeners(cfg.Listeners); err != nil {
+		return configCheck{Error: err.Error()}
+	}
+	res := configCheck{Valid: true}
+	if !diff {
+		return res
+	}
+
+	live := make(map[string]*route)
+	for _, rt := range routing.Load().routes {
+		live[rt.Name] = rt
+	}
+	for _, rt := range routes {
+		old, ok := live[rt.Name]
+		if !ok {
+			res.Added = append(res.Added, rt.Name)
+			continue
+		}
+		delete(live, rt.Name)
+		if fields := changedFields(old, rt); len(fields) > 0 {
+			res.Changed = append(res.Changed, routeChange{Route: rt.Name, Fields: fields})
+		}
+	}
+	for name := range live {
+		res.Removed = append(res.Removed, name)
+	}
+	sort.Strings(res.Removed)
+	return res
+}
+
+// changedFields compares the configurable fields of two routes, by their
+// JSON names. Values are left out since they may include credentials.
+func changedFields(a, b *route) []string {
+	var fields []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		f := va.Type().Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			name, _, _ := strings.Cut(tag, ",")
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// handleConfigCheck serves POST /admin/config/validate and
+// /admin/config/diff with a candidate config as the body; it answers 422
+// if the config would be rejected.
+func handleConfigCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := checkConfig(data, strings.HasSuffix(r.URL.Path, "/diff"))
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Valid {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(res)
+}
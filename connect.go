@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Routes of kind "connect" take HTTP CONNECT requests, as sent by clients
+// configured with an HTTPS proxy, and pass them on to a backend that is
+// itself a forward proxy, waking it like any other route. They match any
+// CONNECT request arriving on a listener that serves them, whatever its
+// target, so give them a listener of their own.
+
+// serveProxyListener is the handler of proxy listeners. CONNECT requests
+// carry no path for the mux to go by, so they are dispatched here.
+func serveProxyListener(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		handleWebSocketProxy(w, r)
+		return
+	}
+	http.DefaultServeMux.ServeHTTP(w, r)
+}
+
+// matchConnect picks the first connect route the request's listener serves.
+func (t *routeTable) matchConnect(r *http.Request) *route {
+	for _, rt := range t.routes {
+		if rt.Kind == "connect" && listenerAllows(r, rt) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// proxyAuthRequest returns r with its Proxy-Authorization as Authorization,
+// so the route's basic_auth can check it.
+func proxyAuthRequest(r *http.Request) *http.Request {
+	return &http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+}
+
+// serveConnect forwards the CONNECT request r to the backend at target and,
+// once the backend has opened the tunnel, relays it.
+func serveConnect(w http.ResponseWriter, r *http.Request, rt *route, target *url.URL, s *session) {
+	conn, err := dialConnectBackend(r, rt, target)
+	if err != nil {
+		s.logger().Warn("Proxy error", "error", err)
+		http.Error(w, "Proxy error", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	out := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: r.Host},
+		Host:   r.Host,
+		Header: http.Header{},
+	}
+	// With basic_auth, check has removed the proxy's own credentials.
+	for _, name := range []string{"User-Agent", "Proxy-Authorization"} {
+		if v := r.Header[name]; v != nil {
+			out.Header[name] = v
+		}
+	}
+	if rt.Headers != nil {
+		rt.Headers.Request.apply(out.Header, newHeaderContext(r, rt))
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := out.Write(conn); err != nil {
+		s.logger().Warn("Proxy error", "error", err)
+		http.Error(w, "Proxy error", http.StatusBadGateway)
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		s.logger().Warn("Proxy error", "error", err)
+		http.Error(w, "Proxy error", http.StatusBadGateway)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if resp.StatusCode != http.StatusOK {
+		// Relay the refusal, e.g. 403 for a disallowed target.
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	client, cbrw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		s.logger().Warn("Proxy error", "error", err)
+		http.Error(w, "Proxy error", http.StatusInternalServerError)
+		return
+	}
+	c := newTapConn(client, s)
+	s.status.Store(http.StatusOK)
+	s.conn = c
+	sessions.add(s)
+	defer c.Close()
+	if _, err := c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// Bytes the client sent along with its request come first.
+		io.Copy(conn, io.MultiReader(io.LimitReader(cbrw.Reader, int64(cbrw.Reader.Buffered())), c))
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, br)
+		done <- struct{}{}
+	}()
+	// Either side closing ends the tunnel.
+	<-done
+}
+
+func dialConnectBackend(r *http.Request, rt *route, target *url.URL) (net.Conn, error) {
+	addr := target.Host
+	if target.Port() == "" {
+		addr = proxyAddr(target)
+	}
+	conn, err := backendDialer.dialTimeout(addr, 10*time.Second)
+	if err != nil || target.Scheme != "https" {
+		return conn, err
+	}
+	cfg := rt.backendTLSConfig(target.Hostname())
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(r.Context()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s: %w", addr, err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectionInfo describes an open session for the admin API.
+type connectionInfo struct {
+	ID         uint64    `json:"id"`
+	Route      string    `json:"route"`
+	Client     string    `json:"client"`
+	Identity   string    `json:"identity,omitempty"`
+	Started    time.Time `json:"started"`
+	AgeSeconds int64     `json:"age_seconds"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+}
+
+func (r *sessionRegistry) get(id uint64) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.m[id]
+}
+
+// handleConnections is the admin API for open sessions: GET
+// /admin/connections lists them and DELETE /admin/connections/<id> closes
+// one.
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	idPart := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/connections"), "/")
+	switch {
+	case r.Method == http.MethodGet && idPart == "":
+		list := []connectionInfo{}
+		for _, s := range sessions.list() {
+			list = append(list, connectionInfo{
+				ID: s.id, Route: s.route, Client: s.remote, Identity: s.identity,
+				Started: s.started.UTC(), AgeSeconds: int64(time.Since(s.started).Seconds()),
+				BytesUp: s.bytesUp.Load(), BytesDown: s.bytesDown.Load(),
+			})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodDelete && idPart != "":
+		id, err := strconv.ParseUint(idPart, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		s := sessions.get(id)
+		if s == nil {
+			http.Error(w, "no such connection", http.StatusNotFound)
+			return
+		}
+		s.closeWith("admin_closed")
+		audit(adminUser(r.Context()), "close_connection", idPart, map[string]interface{}{"route": s.route, "client": s.remote}, nil)
+		w.WriteHeader(http.StatusNoContent)
+	case idPart == "":
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Cooldowns keep a deployment from flapping, say between 0 and 1 replicas
+// when a stray request arrives just after it was scaled down. They hold
+// back every scaler except /admin/scale and the scale-down on shutdown; a
+// client arriving while the backend may not scale up gets 503 with
+// Retry-After.
+var (
+	// scaleUpCooldownSeconds is how long after a scale-down the deployment
+	// may not be scaled up again.
+	scaleUpCooldownSeconds = getEnvAsInt("SCALE_UP_COOLDOWN_SECONDS", 0)
+	// scaleDownCooldownSeconds is how long after a scale-down it may not be
+	// scaled down further.
+	scaleDownCooldownSeconds = getEnvAsInt("SCALE_DOWN_COOLDOWN_SECONDS", 0)
+	// scaleUpDwellSeconds is how long after a scale-up it keeps its
+	// replicas, however idle.
+	scaleUpDwellSeconds = getEnvAsInt("SCALE_UP_DWELL_SECONDS", 0)
+)
+
+var errCooldown = errors.New("in scaling cooldown")
+
+// cooldown returns how long t may not yet be scaled to replicas for.
+func (t *scaleTarget) cooldown(replicas int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastScaledReplicas < 0 || replicas == t.lastScaledReplicas {
+		return 0
+	}
+	var until time.Time
+	if replicas > t.lastScaledReplicas {
+		until = t.lastScaleDown.Add(time.Duration(scaleUpCooldownSeconds) * time.Second)
+	} else {
+		until = t.lastScaleDown.Add(time.Duration(scaleDownCooldownSeconds) * time.Second)
+		if dwell := t.lastScaleUp.Add(time.Duration(scaleUpDwellSeconds) * time.Second); dwell.After(until) {
+			until = dwell
+		}
+	}
+	return max(until.Sub(clk.Now()), 0)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy controls which browser origins may use a route. Browsers don't
+// apply CORS to WebSocket upgrades, so for those the Origin header is
+// checked here and disallowed origins are refused outright.
+type corsPolicy struct {
+	// AllowedOrigins are exact origins, "*" or wildcard subdomains such as
+	// "https://*.example.com".
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	MaxAgeSeconds    int      `json:"max_age_seconds,omitempty"`
+}
+
+func (c *corsPolicy) allows(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if scheme, host, ok := strings.Cut(allowed, "://*."); ok {
+			if strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check applies the policy to r. It returns false when the request has been
+// answered: a preflight, or an upgrade from a disallowed origin.
+func (c *corsPolicy) check(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Not a browser request; nothing to enforce.
+		return true
+	}
+	if !c.allows(origin) {
+		if isUpgrade(r) {
+			rejectUpgrade(w, r, "origin_denied", http.StatusForbidden)
+			return false
+		}
+		// Without CORS headers the browser won't expose the response.
+		return true
+	}
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		c.setHeaders(w.Header(), origin)
+		methods := c.AllowedMethods
+		if len(methods) == 0 {
+			methods = []string{"GET", "POST", "OPTIONS"}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(c.AllowedHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		} else if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+		if c.MaxAgeSeconds > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAgeSeconds))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	return true
+}
+
+// setHeaders adds the CORS response headers for an allowed origin.
+func (c *corsPolicy) setHeaders(h http.Header, origin string) {
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
+
+func isUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
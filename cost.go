@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// baselineReplicas is what each deployment would run if it were always
+	// on; savings are measured against it.
+	baselineReplicas = getEnvAsInt("BASELINE_REPLICAS", 1)
+	// costPerReplicaHour prices savings, e.g. "0.05"; 0 reports hours only.
+	costPerReplicaHourEnv = getEnv("COST_PER_REPLICA_HOUR", "")
+	costCurrency          = getEnv("COST_CURRENCY", "$")
+
+	costPerReplicaHour float64
+	costs              = &costTracker{targets: make(map[string]*targetCost)}
+
+	replicaHours = newCounter("wsproxy_replica_hours_total",
+		"Replica-hours the deployment ran, as last scaled by the proxy.", "target")
+	replicaHoursSaved = newGauge("wsproxy_replica_hours_saved",
+		"Replica-hours avoided versus BASELINE_REPLICAS always on.", "target")
+	costSaved = newGauge("wsproxy_cost_saved",
+		"Replica-hours saved times COST_PER_REPLICA_HOUR.", "target")
+)
+
+type targetCost struct {
+	Used  float64 `json:"replica_hours"`
+	Saved float64 `json:"replica_hours_saved"`
+	Money float64 `json:"cost_saved,omitempty"`
+}
+
+// costTracker integrates each deployment's replica count over time.
+type costTracker struct {
+	mu      sync.Mutex
+	since   time.Time
+	last    time.Time
+	targets map[string]*targetCost
+}
+
+// tick adds the time since the last tick at each target's current replicas.
+// Targets whose replicas are unknown count as the baseline.
+func (c *costTracker) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last.IsZero() {
+		c.since, c.last = now, now
+		return
+	}
+	hours := now.Sub(c.last).Hours()
+	c.last = now
+	for _, t := range routeTargets() {
+		t.mu.Lock()
+		replicas := t.lastScaledReplicas
+		t.mu.Unlock()
+		if replicas < 0 {
+			replicas = baselineReplicas
+		}
+		tc := c.targets[t.String()]
+		if tc == nil {
+			tc = &targetCost{}
+			c.targets[t.String()] = tc
+		}
+		used := float64(replicas) * hours
+		tc.Used += used
+		tc.Saved += float64(baselineReplicas)*hours - used
+		tc.Money = tc.Saved * costPerReplicaHour
+		replicaHours.add(used, t.String())
+		replicaHoursSaved.set(tc.Saved, t.String())
+		if costPerReplicaHour > 0 {
+			costSaved.set(tc.Money, t.String())
+		}
+	}
+}
+
+func (c *costTracker) snapshot() map[string]targetCost {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]targetCost, len(c.targets))
+	for name, tc := range c.targets {
+		out[name] = *tc
+	}
+	return out
+}
+
+// formatSavings renders hours saved, and money if priced, for reports.
+func formatSavings(hours float64) string {
+	if costPerReplicaHour <= 0 {
+		return fmt.Sprintf("%.1f", hours)
+	}
+	return fmt.Sprintf("%.1f (%s%.2f)", hours, costCurrency, hours*costPerReplicaHour)
+}
+
+func setupCost() error {
+	if costPerReplicaHourEnv != "" {
+		v, err := strconv.ParseFloat(costPerReplicaHourEnv, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("COST_PER_REPLICA_HOUR: invalid price %q", costPerReplicaHourEnv)
+		}
+		costPerReplicaHour = v
+	}
+	go func() {
+		for {
+			costs.tick(clk.Now())
+			clk.Sleep(time.Minute)
+		}
+	}()
+	return nil
+}
+
+// handleSavings lists each deployment's replica-hours used and saved
+// since the proxy started.
+func handleSavings(w http.ResponseWriter, r *http.Request) {
+	costs.tick(clk.Now())
+	snap := costs.snapshot()
+	names := make([]string, 0, len(snap))
+	for name := range snap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type entry struct {
+		Target string `json:"target"`
+		targetCost
+	}
+	list := make([]entry, 0, len(names))
+	for _, name := range names {
+		list = append(list, entry{name, snap[name]})
+	}
+	costs.mu.Lock()
+	since := costs.since
+	costs.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Since            time.Time `json:"since"`
+		BaselineReplicas int       `json:"baseline_replicas"`
+		Currency         string    `json:"currency,omitempty"`
+		Targets          []entry   `json:"targets"`
+	}{since.UTC(), baselineReplicas, currencyIfPriced(), list})
+}
+
+func currencyIfPriced() string {
+	if costPerReplicaHour > 0 {
+		return costCurrency
+	}
+	return ""
+}
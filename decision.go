@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var (
+	// decisionWebhookURL is asked for each deployment's replica count every
+	// DECISION_INTERVAL_SECONDS, so scaling policy can live outside the
+	// proxy. The built-in inactivity scale-down steps aside while it
+	// answers.
+	decisionWebhookURL      = getEnv("DECISION_WEBHOOK_URL", "")
+	decisionIntervalSeconds = getEnvAsInt("DECISION_INTERVAL_SECONDS", 30)
+)
+
+// decisionSignals is what the decision webhook is told about a deployment.
+type decisionSignals struct {
+	Time           time.Time `json:"time"`
+	Target         string    `json:"target"`
+	Routes         []string  `json:"routes"`
+	Replicas       int       `json:"replicas"` // as last scaled by the proxy, -1 if unknown
+	BackendUp      bool      `json:"backend_up"`
+	Connections    int       `json:"connections"`
+	Queued         int       `json:"queued"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+	IdleSeconds    float64   `json:"idle_seconds"`
+	Hour           int       `json:"hour"`
+	Weekday        string    `json:"weekday"`
+	ScheduleFloor  int       `json:"schedule_floor"`
+}
+
+// decision is the webhook's answer; a missing or null replicas leaves the
+// deployment to the built-in policy.
+type decision struct {
+	Replicas *int   `json:"replicas"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// decided reports whether t is currently scaled by the decision webhook.
+func (t *scaleTarget) decided() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return clk.Since(t.lastDecision) < 2*time.Duration(decisionIntervalSeconds)*time.Second
+}
+
+// targetBytes is the traffic t's sessions have carried so far.
+func targetBytes(t *scaleTarget) int64 {
+	n := t.bytes.Load()
+	for _, s := range sessions.list() {
+		if s.rt.scale == t {
+			n += s.bytesUp.Load() + s.bytesDown.Load()
+		}
+	}
+	return n
+}
+
+func decisionLoop() {
+	lastBytes := make(map[*scaleTarget]int64)
+	last := clk.Now()
+	for {
+		clk.Sleep(time.Duration(decisionIntervalSeconds) * time.Second)
+		now := clk.Now()
+		elapsed := now.Sub(last).Seconds()
+		last = now
+		if !isActive() {
+			// Rates start over on takeover rather than spanning the standby time.
+			clear(lastBytes)
+			continue
+		}
+
+		routesOf := make(map[*scaleTarget][]string)
+		for _, rt := range routing.Load().routes {
+			routesOf[rt.scale] = append(routesOf[rt.scale], rt.Name)
+		}
+		floors := scheduleFloors(now)
+		for _, rt := range routing.Load().routes {
+			t := rt.scale
+			names, ok := routesOf[t]
+			if !ok || t.overridden() {
+				continue
+			}
+			delete(routesOf, t)
+			b := targetBytes(t)
+			rate := 0.0
+			if prev, ok := lastBytes[t]; ok && b >= prev {
+				rate = float64(b-prev) / elapsed
+			}
+			lastBytes[t] = b
+
+			t.mu.Lock()
+			sig := decisionSignals{
+				Time:           now.UTC(),
+				Target:         t.String(),
+				Routes:         names,
+				Replicas:       t.lastScaledReplicas,
+				Connections:    t.open,
+				Queued:         t.queued,
+				BytesPerSecond: rate,
+				IdleSeconds:    now.Sub(t.lastRequestTime).Seconds(),
+				Hour:           now.Hour(),
+				Weekday:        now.Weekday().String(),
+				ScheduleFloor:  floors[t],
+			}
+			t.mu.Unlock()
+			go decide(rt, sig)
+		}
+	}
+}
+
+// decide asks the webhook about rt's deployment and applies its answer.
+func decide(rt *route, sig decisionSignals) {
+	t := rt.scale
+	sig.BackendUp = isBackendUp(rt)
+	d, err := askDecision(sig)
+	if err != nil {
+		slog.Error("Decision webhook failed", "route", rt.Name, "deployment", t.String(), "error", err)
+		return
+	}
+	if d.Replicas == nil {
+		return
+	}
+	n := *d.Replicas
+	if n < 0 {
+		slog.Warn("Decision webhook asked for negative replicas, ignoring", "route", rt.Name, "deployment", t.String(), "replicas", n)
+		return
+	}
+	t.mu.Lock()
+	t.lastDecision = clk.Now()
+	t.mu.Unlock()
+	if n == sig.Replicas {
+		return
+	}
+	lg := slog.With("route", rt.Name, "deployment", t.String(), "replicas", n, "cause", "webhook")
+	lg.Info("Decision webhook scales deployment", "reason", d.Reason)
+	if n == 0 {
+		if closed := sessions.closeTarget(t, "scale_down"); closed > 0 {
+			lg.Info("Closed open sessions before scaling down", "sessions", closed)
+		}
+	}
+	if err := scaleDeployment(t, n, "webhook"); err != nil {
+		lg.Error("Error scaling deployment", "error", err)
+	}
+}
+
+func askDecision(sig decisionSignals) (*decision, error) {
+	body, _ := json.Marshal(sig)
+	resp, err := httpClient.Post(decisionWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("answered %d", resp.StatusCode)
+	}
+	var d decision
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func setupDecisionWebhook() error {
+	if decisionWebhookURL == "" {
+		return nil
+	}
+	if decisionIntervalSeconds <= 0 {
+		return fmt.Errorf("DECISION_INTERVAL_SECONDS must be positive")
+	}
+	slog.Info("Asking the decision webhook for replica counts", "interval_seconds", decisionIntervalSeconds)
+	go decisionLoop()
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	// decoyMode decides what probes see instead of the tunnel: "notfound"
+	// serves an nginx-style 404, "redirect" redirects to DECOY_URL, "proxy"
+	// reverse-proxies DECOY_URL and "static" serves DECOY_DIR (or the
+	// embedded default site). Empty keeps the default behavior.
+	decoyMode   = getEnv("DECOY_MODE", "")
+	decoyURL    = getEnv("DECOY_URL", "")
+	decoyDir    = getEnv("DECOY_DIR", "")
+	decoyServer = getEnv("DECOY_SERVER_HEADER", "nginx")
+
+	decoy http.Handler
+
+	//go:embed decoy_site
+	defaultDecoySite embed.FS
+)
+
+const nginxNotFound = `<html>
+<head><title>404 Not Found</title></head>
+<body>
+<center><h1>404 Not Found</h1></center>
+<hr><center>nginx</center>
+</body>
+</html>
+`
+
+func setupDecoy() error {
+	switch decoyMode {
+	case "":
+		return nil
+	case "notfound":
+		decoy = http.HandlerFunc(serveDecoyNotFound)
+	case "redirect":
+		if decoyURL == "" {
+			return fmt.Errorf("DECOY_MODE=redirect requires DECOY_URL")
+		}
+		decoy = http.RedirectHandler(decoyURL, http.StatusFound)
+	case "proxy":
+		target, err := url.Parse(decoyURL)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("DECOY_MODE=proxy requires a valid DECOY_URL")
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Host = target.Host
+			// Don't reveal that the request passed through a proxy.
+			req.Header["X-Forwarded-For"] = nil
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Decoy proxy error", "request_id", requestID(r), "error", err)
+			serveDecoyNotFound(w, r)
+		}
+		decoy = proxy
+	case "static":
+		site, err := decoySiteFS()
+		if err != nil {
+			return err
+		}
+		decoy = &staticSite{fsys: site, files: http.FileServer(http.FS(site))}
+	default:
+		return fmt.Errorf("unknown DECOY_MODE %q", decoyMode)
+	}
+	slog.Info("Decoy enabled", "mode", decoyMode)
+	return nil
+}
+
+func serveDecoyNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, nginxNotFound)
+}
+
+func decoySiteFS() (fs.FS, error) {
+	if decoyDir == "" {
+		return fs.Sub(defaultDecoySite, "decoy_site")
+	}
+	if fi, err := os.Stat(decoyDir); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("DECOY_DIR %q is not a directory", decoyDir)
+	}
+	return os.DirFS(decoyDir), nil
+}
+
+// staticSite serves a decoy website the way a plain web server would: index
+// pages for directories, no listings, and nginx's 404 for anything missing.
+type staticSite struct {
+	fsys  fs.FS
+	files http.Handler
+}
+
+func (s *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	if err == nil && fi.IsDir() {
+		_, err = fs.Stat(s.fsys, path.Join(name, "index.html"))
+	}
+	if err != nil {
+		serveDecoyNotFound(w, r)
+		return
+	}
+	s.files.ServeHTTP(w, r)
+}
+
+// serveDecoy answers requests that must not reach a backend.
+func serveDecoy(w http.ResponseWriter, r *http.Request) {
+	if decoy == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if decoyServer != "" && decoyMode != "proxy" {
+		// A proxied site sends its own Server header.
+		w.Header().Set("Server", decoyServer)
+	}
+	w, done := compressed(w, r)
+	defer done()
+	decoy.ServeHTTP(w, r)
+}
+
+// isValidUpgrade reports whether r is a well-formed WebSocket handshake.
+// refuse turns away a client the proxy will not serve (banned, wrong
+// region) without revealing why: with the decoy's response if there is one.
+func refuse(w http.ResponseWriter, r *http.Request) {
+	if decoy != nil {
+		serveDecoy(w, r)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+func isValidUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		isUpgrade(r) &&
+		headerContainsToken(r.Header, "Connection", "upgrade") &&
+		r.Header.Get("Sec-WebSocket-Key") != "" &&
+		r.Header.Get("Sec-WebSocket-Version") == "13"
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
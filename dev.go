@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"auto_scale/fakekube"
+)
+
+// runDev implements the "dev" subcommand: the proxy with an in-process
+// WebSocket echo backend and a fake Kubernetes API that accepts every
+// scale request, so the whole request path works on a laptop.
+func runDev(args []string) int {
+	fs := flag.NewFlagSet("dev", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "proxy listen address (LISTEN_ADDR)")
+	admin := fs.String("admin", "127.0.0.1:9090", "admin listen address (ADMIN_ADDR)")
+	fs.Parse(args)
+
+	echo := httptest.NewServer(http.HandlerFunc(handleEcho))
+	defer echo.Close()
+	api := fakekube.New("dev")
+	api.AutoCreate = true
+	api.OnScale = func(ns, name string, replicas int) {
+		slog.Info("[dev] Deployment scaled (no-op)", "deployment", ns+"/"+name, "replicas", replicas)
+	}
+	kube := httptest.NewServer(api)
+	defer kube.Close()
+
+	// The proxy reads its configuration at startup, so it runs as a child
+	// process; variables already set take precedence.
+	env := os.Environ()
+	for _, kv := range [][2]string{
+		{"LISTEN_ADDR", *addr},
+		{"ADMIN_ADDR", *admin},
+		{"ADMIN_TOKEN", "dev"},
+		{"BACKEND_URL", echo.URL},
+		{"KUBE_CLUSTER_ENDPOINT", kube.URL},
+		{"KUBE_CLUSTER_TOKEN", "dev"},
+	} {
+		if os.Getenv(kv[0]) == "" {
+			env = append(env, kv[0]+"="+kv[1])
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	slog.Info("[dev] Started the echo backend and a fake Kubernetes API", "backend", echo.URL, "kube_api", kube.URL)
+	slog.Info("[dev] Ready; the admin token is \"dev\"", "connect", "ws://"+*addr+secretPath, "admin", "http://"+*admin)
+	cmd := exec.Command(self)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// Keep the backend up while the proxy drains.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return exit.ExitCode()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runEcho implements the "echo" subcommand: just the dev backend, e.g. as
+// the sample deployment the proxy scales in the end-to-end tests.
+func runEcho(args []string) int {
+	fs := flag.NewFlagSet("echo", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "listen address")
+	fs.Parse(args)
+	slog.Info("Echoing WebSocket messages", "addr", *addr)
+	if err := http.ListenAndServe(*addr, http.HandlerFunc(handleEcho)); err != nil {
+		slog.Error("Echo server failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// handleEcho is the dev backend: it echoes WebSocket messages and, like an
+// xray inbound, answers other requests with 400 so the default health
+// check passes.
+func handleEcho(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	c := &wsClient{conn: conn, br: brw.Reader}
+	for {
+		opcode, fin, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		reply := opcode
+		switch opcode {
+		case opPing:
+			reply = opPong
+		case opPong:
+			continue
+		}
+		frame := appendWSFrame(nil, reply, payload, false)
+		if !fin {
+			frame[0] &^= 0x80
+		}
+		if _, err := conn.Write(frame); err != nil || opcode == opClose {
+			return
+		}
+	}
+}
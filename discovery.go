@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	consulAddr               = getEnv("CONSUL_HTTP_ADDR", "http://127.0.0.1:8500")
+	consulToken              = newSecret("CONSUL_HTTP_TOKEN")
+	discoveryIntervalSeconds = getEnvAsInt("DISCOVERY_INTERVAL_SECONDS", 30)
+
+	discoverersMu sync.Mutex
+	discoverers   = make(map[string]*discoverer)
+)
+
+// discoverer resolves a backend URL of the form srv+http://_svc._tcp.domain
+// (DNS SRV) or consul+http://service (Consul catalog, passing instances
+// only) to a set of endpoints, and keeps them fresh. Requests are spread
+// round-robin over the endpoints.
+type discoverer struct {
+	spec   string
+	kind   string // "srv" or "consul"
+	scheme string // scheme used to reach the endpoints
+	name   string
+
+	mu        sync.Mutex
+	endpoints []string // host:port
+	next      int
+	resolved  time.Time
+}
+
+// isDiscoveryURL reports whether u names a service to resolve rather than a
+// fixed backend.
+func isDiscoveryURL(u *url.URL) bool {
+	return strings.HasPrefix(u.Scheme, "srv+") || strings.HasPrefix(u.Scheme, "consul+")
+}
+
+// checkDiscoveryURL reports whether discovery can serve u.
+func checkDiscoveryURL(u *url.URL) error {
+	if discoveryIntervalSeconds <= 0 {
+		return fmt.Errorf("DISCOVERY_INTERVAL_SECONDS must be positive")
+	}
+	_, scheme, _ := strings.Cut(u.Scheme, "+")
+	switch scheme {
+	case "http", "https", "ws", "wss":
+		return nil
+	}
+	return fmt.Errorf("unsupported scheme %q in %s", scheme, u)
+}
+
+// discovererFor returns the shared discoverer for u, resolving it once and
+// starting its refresh loop the first time it is seen.
+func discovererFor(u *url.URL) (*discoverer, error) {
+	if err := checkDiscoveryURL(u); err != nil {
+		return nil, err
+	}
+	kind, scheme, _ := strings.Cut(u.Scheme, "+")
+	spec := u.Scheme + "://" + u.Host
+
+	discoverersMu.Lock()
+	defer discoverersMu.Unlock()
+	if d, ok := discoverers[spec]; ok {
+		return d, nil
+	}
+	d := &discoverer{spec: spec, kind: kind, scheme: scheme, name: u.Host}
+	discoverers[spec] = d
+	d.refresh()
+	go d.loop()
+	return d, nil
+}
+
+func (d *discoverer) loop() {
+	ticker := time.NewTicker(time.Duration(discoveryIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.refresh()
+	}
+}
+
+// refresh re-resolves the endpoints. On failure the previous endpoints are
+// kept, since the registry being briefly unreachable says nothing about the
+// backend.
+func (d *discoverer) refresh() {
+	var endpoints []string
+	var err error
+	switch d.kind {
+	case "srv":
+		endpoints, err = resolveSRV(d.name)
+	case "consul":
+		endpoints, err = resolveConsul(d.name)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resolved = time.Now()
+	if err != nil {
+		slog.Error("Backend discovery failed", "backend", d.spec, "error", err)
+		return
+	}
+	sort.Strings(endpoints)
+	if strings.Join(endpoints, ",") != strings.Join(d.endpoints, ",") {
+		slog.Info("Discovered backend endpoints", "backend", d.spec, "endpoints", strings.Join(endpoints, " "))
+	}
+	d.endpoints = endpoints
+}
+
+// pick returns the next endpoint as a URL, or nil when none is known. An
+// empty set is re-resolved at most every few seconds, so a backend that has
+// just been scaled up is found without waiting for the next refresh.
+func (d *discoverer) pick() *url.URL {
+	d.mu.Lock()
+	if len(d.endpoints) == 0 && time.Since(d.resolved) > 2*time.Second {
+		d.mu.Unlock()
+		d.refresh()
+		d.mu.Lock()
+	}
+	defer d.mu.Unlock()
+	if len(d.endpoints) == 0 {
+		return nil
+	}
+	ep := d.endpoints[d.next%len(d.endpoints)]
+	d.next++
+	return &url.URL{Scheme: d.scheme, Host: ep}
+}
+
+// resolveSRV returns the targets of the lowest-priority SRV records.
+func resolveSRV(name string) ([]string, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, a := range addrs {
+		if a.Priority != addrs[0].Priority {
+			break
+		}
+		endpoints = append(endpoints, net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port))))
+	}
+	return endpoints, nil
+}
+
+// resolveConsul returns the instances of service whose health checks pass.
+func resolveConsul(service string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(consulAddr, "/")+"/v1/health/service/"+url.PathEscape(service)+"?passing=1", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := consulToken.get(); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s", resp.Status)
+	}
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, 0, len(entries))
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		endpoints = append(endpoints, net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)))
+	}
+	return endpoints, nil
+}
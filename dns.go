@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// backendDNSRefreshSeconds is how long resolved backend addresses are
+	// used before the name is looked up again; a failed dial re-resolves
+	// at once. 0 resolves on every dial.
+	backendDNSRefreshSeconds = getEnvAsInt("BACKEND_DNS_REFRESH_SECONDS", 30)
+
+	backendDNS = &dnsCache{hosts: make(map[string]*resolvedHost)}
+)
+
+// dnsCache keeps the addresses of backend hostnames, so a name whose
+// addresses change (a headless service, external DNS) is followed rather
+// than a stale address being kept.
+type dnsCache struct {
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	mu       sync.Mutex
+	addrs    []string
+	resolved time.Time
+	next     int // rotates the first address tried
+}
+
+func (c *dnsCache) host(name string) *resolvedHost {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.hosts[name]
+	if !ok {
+		h = &resolvedHost{}
+		c.hosts[name] = h
+	}
+	return h
+}
+
+// lookup returns name's addresses, resolving it if they are older than
+// the refresh interval or force is set, starting from a rotating offset.
+func (c *dnsCache) lookup(ctx context.Context, name string, force bool) ([]string, error) {
+	h := c.host(name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if force || len(h.addrs) == 0 || clk.Since(h.resolved) >= time.Duration(backendDNSRefreshSeconds)*time.Second {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		if err != nil {
+			if len(h.addrs) == 0 {
+				return nil, err
+			}
+			// Keep using what worked last rather than failing outright.
+			slog.Warn("Failed to re-resolve backend, keeping the last addresses", "backend", name, "addrs", strings.Join(h.addrs, ","), "error", err)
+		} else {
+			sort.Strings(addrs)
+			if strings.Join(addrs, ",") != strings.Join(h.addrs, ",") && len(h.addrs) > 0 {
+				slog.Info("Backend resolves to new addresses", "backend", name, "addrs", strings.Join(addrs, ","))
+			}
+			h.addrs = addrs
+		}
+		h.resolved = clk.Now()
+	}
+	h.next++
+	n := len(h.addrs)
+	out := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, h.addrs[(h.next+i)%n])
+	}
+	return out, nil
+}
+
+// snapshot returns the addresses name last resolved to, if it has been.
+func (c *dnsCache) snapshot(name string) ([]string, time.Time) {
+	c.mu.Lock()
+	h, ok := c.hosts[name]
+	c.mu.Unlock()
+	if !ok {
+		return nil, time.Time{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.addrs...), h.resolved
+}
+
+// dialBackend connects to addr, resolving a hostname through the cache and
+// trying its addresses in turn. If none answers, the name is resolved
+// again and any new addresses are tried.
+func dialBackend(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || backendDNSRefreshSeconds <= 0 || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	tried := make(map[string]bool)
+	var lastErr error
+	for _, force := range []bool{false, true} {
+		addrs, err := backendDNS.lookup(ctx, host, force)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if tried[a] {
+				continue
+			}
+			tried[a] = true
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("dial %s: %w", addr, lastErr)
+}
@@ -0,0 +1,478 @@
+//go:build e2e
+
+// Package e2e runs the proxy in a kind cluster in front of a sample
+// WebSocket backend and checks what the proxy promises: a connection to a
+// backend scaled to zero wakes it, an idle backend is scaled back to zero,
+// and stopping the proxy drains open sessions before closing them.
+//
+//	go test -tags e2e -v -timeout 30m ./e2e
+//
+// It needs docker, kind and kubectl. E2E_CLUSTER names the kind cluster
+// (created and deleted by the run unless it already exists), E2E_PORT is
+// the host port the proxy is reached on and E2E_KEEP=1 keeps a cluster the
+// run created.
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	namespace  = "wsproxy-e2e"
+	image      = "auto-scale-ws-proxy:e2e"
+	proxyName  = "auto-scale-ws-proxy"
+	backend    = "echo"
+	tunnelPath = "/ws"
+	nodePort   = 30080
+	// drainSeconds is STOP_DRAIN_SECONDS for the proxy under test.
+	drainSeconds = 10
+)
+
+var (
+	cluster = getenv("E2E_CLUSTER", "wsproxy-e2e")
+	port    = getenv("E2E_PORT", strconv.Itoa(nodePort))
+	proxyWS = "127.0.0.1:" + port
+)
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func TestMain(m *testing.M) {
+	for _, tool := range []string{"docker", "kind", "kubectl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			fmt.Fprintf(os.Stderr, "e2e: %s is required: %v\n", tool, err)
+			os.Exit(1)
+		}
+	}
+	created, err := setup()
+	code := 1
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "e2e setup:", err)
+	} else {
+		code = m.Run()
+	}
+	if code != 0 {
+		run("kubectl", "--context", "kind-"+cluster, "-n", namespace, "logs", "deployment/"+proxyName, "--tail", "200")
+	}
+	if created && os.Getenv("E2E_KEEP") == "" {
+		run("kind", "delete", "cluster", "--name", cluster)
+	}
+	os.Exit(code)
+}
+
+// setup brings up the cluster, the backend at zero replicas and the proxy,
+// and reports whether it created the cluster.
+func setup() (created bool, err error) {
+	out, err := output("kind", "get", "clusters")
+	if err != nil {
+		return false, err
+	}
+	if !containsLine(out, cluster) {
+		config := fmt.Sprintf(`kind: Cluster
+apiVersion: kind.x-k8s.io/v1alpha4
+nodes:
+  - role: control-plane
+    extraPortMappings:
+      - containerPort: %d
+        hostPort: %s
+        listenAddress: "127.0.0.1"
+`, nodePort, port)
+		if err := runStdin(config, "kind", "create", "cluster", "--name", cluster, "--config", "-", "--wait", "2m"); err != nil {
+			return false, err
+		}
+		created = true
+	}
+	if err := run("docker", "build", "-t", image, ".."); err != nil {
+		return created, err
+	}
+	if err := run("kind", "load", "docker-image", image, "--name", cluster); err != nil {
+		return created, err
+	}
+
+	if err := kubectlApply(fmt.Sprintf(backendManifest, namespace, backend, image)); err != nil {
+		return created, err
+	}
+	manifests := exec.Command("go", "run", "..", "manifests", "-namespace", namespace, "-image", image)
+	manifests.Env = append(os.Environ(),
+		"NAMESPACE="+namespace,
+		"DEPLOYMENT_NAME="+backend,
+		fmt.Sprintf("BACKEND_URL=http://%s.%s.svc:8080", backend, namespace),
+		"SECRET_PATH="+tunnelPath,
+		"BACKEND_PATH="+tunnelPath,
+		"INACTIVITY_MINUTES=1",
+		"BACKEND_HEALTH_CHECK_INTERVAL=1",
+		"PROXY_MODE=frame",
+		"STOP_DRAIN_SECONDS="+strconv.Itoa(drainSeconds),
+	)
+	manifests.Stderr = os.Stderr
+	yaml, err := manifests.Output()
+	if err != nil {
+		return created, fmt.Errorf("manifests: %w", err)
+	}
+	if err := kubectlApply(string(yaml)); err != nil {
+		return created, err
+	}
+	// Reach the proxy through the port kind maps to the host.
+	if err := kubectl("patch", "service", proxyName, "--type", "json", "-p",
+		fmt.Sprintf(`[{"op":"replace","path":"/spec/type","value":"NodePort"},{"op":"add","path":"/spec/ports/0/nodePort","value":%d}]`, nodePort)); err != nil {
+		return created, err
+	}
+	return created, kubectl("rollout", "status", "deployment/"+proxyName, "--timeout", "3m")
+}
+
+// backendManifest is the sample backend: the proxy image's echo
+// subcommand, starting at zero replicas.
+const backendManifest = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: %[1]s
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+spec:
+  replicas: 0
+  selector:
+    matchLabels:
+      app: %[2]s
+  template:
+    metadata:
+      labels:
+        app: %[2]s
+    spec:
+      containers:
+        - name: echo
+          image: %[3]s
+          args: ["/auto_scale", "echo", "-addr", ":8080"]
+          ports:
+            - containerPort: 8080
+          readinessProbe:
+            tcpSocket:
+              port: 8080
+            periodSeconds: 1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+spec:
+  selector:
+    app: %[2]s
+  ports:
+    - port: 8080
+      targetPort: 8080
+`
+
+func TestColdStart(t *testing.T) {
+	scaleBackend(t, 0)
+
+	c := dialUntil(t, 3*time.Minute)
+	defer c.Close()
+	c.echo(t, "hello")
+	if n := replicas(t); n != 1 {
+		t.Fatalf("backend has %d replicas after a cold start, want 1", n)
+	}
+}
+
+func TestScaleDown(t *testing.T) {
+	scaleBackend(t, 1)
+	c := dialUntil(t, 3*time.Minute)
+	c.echo(t, "before idling")
+	c.Close()
+
+	// INACTIVITY_MINUTES is 1 and the proxy checks every five minutes.
+	deadline := time.Now().Add(8 * time.Minute)
+	for time.Now().Before(deadline) {
+		if replicas(t) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Second)
+	}
+	t.Fatalf("backend still has %d replicas after idling", replicas(t))
+}
+
+func TestDrain(t *testing.T) {
+	scaleBackend(t, 1)
+	c := dialUntil(t, 3*time.Minute)
+	defer c.Close()
+	c.echo(t, "before stopping")
+
+	pod := strings.TrimSpace(mustOutput(t, "kubectl", "--context", "kind-"+cluster, "-n", namespace,
+		"get", "pods", "-l", "app="+proxyName, "-o", "jsonpath={.items[0].metadata.name}"))
+	stopped := time.Now()
+	if err := kubectl("delete", "pod", pod, "--wait=false"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session keeps working while the proxy drains...
+	time.Sleep(2 * time.Second)
+	c.echo(t, "while draining")
+
+	// ...and is closed as going away once the drain time is up.
+	c.conn.SetReadDeadline(time.Now().Add((drainSeconds + 15) * time.Second))
+	for {
+		op, payload, err := c.read()
+		if err != nil {
+			t.Fatalf("session ended without a close frame: %v", err)
+		}
+		if op != opClose {
+			continue
+		}
+		if len(payload) < 2 {
+			t.Fatalf("close frame without a status")
+		}
+		if code := binary.BigEndian.Uint16(payload); code != 1001 {
+			t.Fatalf("session closed with %d %q, want 1001", code, payload[2:])
+		}
+		if d := time.Since(stopped); d < (drainSeconds-2)*time.Second {
+			t.Fatalf("session closed after %s, before the %ds drain", d, drainSeconds)
+		}
+		break
+	}
+	if err := kubectl("rollout", "status", "deployment/"+proxyName, "--timeout", "3m"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// scaleBackend sets the backend's replicas and waits for them to be ready.
+func scaleBackend(t *testing.T, n int) {
+	t.Helper()
+	if err := kubectl("scale", "deployment/"+backend, "--replicas", strconv.Itoa(n)); err != nil {
+		t.Fatal(err)
+	}
+	if n > 0 {
+		if err := kubectl("rollout", "status", "deployment/"+backend, "--timeout", "3m"); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	deadline := time.Now().Add(3 * time.Minute)
+	for {
+		pods := mustOutput(t, "kubectl", "--context", "kind-"+cluster, "-n", namespace,
+			"get", "pods", "-l", "app="+backend, "-o", "name")
+		if strings.TrimSpace(pods) == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backend pods still running: %s", pods)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func replicas(t *testing.T) int {
+	t.Helper()
+	out := mustOutput(t, "kubectl", "--context", "kind-"+cluster, "-n", namespace,
+		"get", "deployment", backend, "-o", "jsonpath={.spec.replicas}")
+	n, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatalf("replicas: %q: %v", out, err)
+	}
+	return n
+}
+
+func kubectl(args ...string) error {
+	return run("kubectl", append([]string{"--context", "kind-" + cluster, "-n", namespace}, args...)...)
+}
+
+func kubectlApply(yaml string) error {
+	return runStdin(yaml, "kubectl", "--context", "kind-"+cluster, "apply", "-f", "-")
+}
+
+func run(name string, args ...string) error {
+	return runStdin("", name, args...)
+}
+
+func runStdin(stdin, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func output(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+func mustOutput(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := output(name, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func containsLine(s, line string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+)
+
+// wsConn is a minimal WebSocket client, enough to exchange text messages
+// and see close frames.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialUntil retries the handshake until it succeeds; while the backend
+// cold-starts the proxy may hold or refuse connections.
+func dialUntil(t *testing.T, timeout time.Duration) *wsConn {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		c, err := dial()
+		if err == nil {
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no WebSocket connection through the proxy after %s: %v", timeout, err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func dial() (*wsConn, error) {
+	conn, err := net.DialTimeout("tcp", proxyWS, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", tunnelPath, proxyWS, key)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("handshake: %s", resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, errors.New("handshake: wrong Sec-WebSocket-Accept")
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, br: br}, nil
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// echo sends msg and expects it back.
+func (c *wsConn) echo(t *testing.T, msg string) {
+	t.Helper()
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	if err := c.write(opText, []byte(msg)); err != nil {
+		t.Fatalf("send %q: %v", msg, err)
+	}
+	op, payload, err := c.read()
+	if err != nil {
+		t.Fatalf("echo of %q: %v", msg, err)
+	}
+	if op != opText || string(payload) != msg {
+		t.Fatalf("echo of %q: got opcode %d %q", msg, op, payload)
+	}
+}
+
+// write sends a masked, unfragmented frame.
+func (c *wsConn) write(op byte, payload []byte) error {
+	var b bytes.Buffer
+	b.WriteByte(0x80 | op)
+	switch n := len(payload); {
+	case n < 126:
+		b.WriteByte(0x80 | byte(n))
+	case n <= 0xffff:
+		b.WriteByte(0x80 | 126)
+		binary.Write(&b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(0x80 | 127)
+		binary.Write(&b, binary.BigEndian, uint64(n))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	b.Write(mask[:])
+	for i, x := range payload {
+		b.WriteByte(x ^ mask[i%4])
+	}
+	_, err := c.conn.Write(b.Bytes())
+	return err
+}
+
+// read returns the next frame; servers don't mask.
+func (c *wsConn) read() (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	return h[0] & 0x0f, payload, nil
+}
@@ -0,0 +1,318 @@
+// Package fakekube emulates the parts of the Kubernetes API the proxy uses
+// (deployments and their scale subresource) so scaling can be exercised
+// without a cluster. It can also answer with the errors a real API server
+// gives: 401 for a wrong token, and 409 or 429 on demand.
+//
+//	api := fakekube.New("token")
+//	api.AddDeployment("test", "t2", 0)
+//	srv := httptest.NewServer(api)
+//	// run the proxy with KUBE_CLUSTER_ENDPOINT=srv.URL, KUBE_CLUSTER_TOKEN=token
+//	api.FailNext(http.StatusTooManyRequests, 1)
+package fakekube
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Call is one request the server answered.
+type Call struct {
+	Time      time.Time
+	Method    string
+	Namespace string
+	Name      string
+	Scale     bool // on the scale subresource
+	Replicas  int  // requested by a scale PUT, -1 otherwise
+	Status    int
+}
+
+type deployment struct {
+	replicas        int
+	annotations     map[string]string
+	resourceVersion int
+}
+
+type fault struct {
+	status int
+	left   int
+}
+
+// Server is a fake API server; it implements http.Handler.
+type Server struct {
+	// OnScale, if set, is called after a deployment's replicas change,
+	// e.g. to start or stop a fake backend.
+	OnScale func(namespace, name string, replicas int)
+	// AutoCreate makes unknown deployments spring into existence with
+	// zero replicas instead of answering 404.
+	AutoCreate bool
+
+	token string
+
+	mu          sync.Mutex
+	deployments map[string]*deployment
+	faults      []fault
+	calls       []Call
+}
+
+// New returns a server that accepts bearer token; an empty token accepts
+// any request.
+func New(token string) *Server {
+	return &Server{token: token, deployments: make(map[string]*deployment)}
+}
+
+// AddDeployment creates a deployment with the given replicas.
+func (s *Server) AddDeployment(namespace, name string, replicas int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deployments[namespace+"/"+name] = &deployment{replicas: replicas, annotations: map[string]string{}, resourceVersion: 1}
+}
+
+// Replicas returns a deployment's replicas, or -1 if it does not exist.
+func (s *Server) Replicas(namespace, name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deployments[namespace+"/"+name]
+	if !ok {
+		return -1
+	}
+	return d.replicas
+}
+
+// Annotations returns a copy of a deployment's annotations.
+func (s *Server) Annotations(namespace, name string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string)
+	if d, ok := s.deployments[namespace+"/"+name]; ok {
+		for k, v := range d.annotations {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// FailNext answers the next n requests with status (e.g. 409 or 429)
+// instead of serving them. Faults queue up behind each other.
+func (s *Server) FailNext(status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault{status, n})
+}
+
+// Calls returns the requests answered so far.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// ScaleCalls returns the replicas requested by scale PUTs to a deployment,
+// in order, whether or not they succeeded.
+func (s *Server) ScaleCalls(namespace, name string) []int {
+	var out []int
+	for _, c := range s.Calls() {
+		if c.Scale && c.Method == http.MethodPut && c.Namespace == namespace && c.Name == name {
+			out = append(out, c.Replicas)
+		}
+	}
+	return out
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	call := Call{Time: time.Now(), Method: r.Method, Replicas: -1}
+	defer func() {
+		s.mu.Lock()
+		s.calls = append(s.calls, call)
+		s.mu.Unlock()
+	}()
+
+	// /apis/apps/v1/namespaces/<ns>/deployments/<name>[/scale]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 7 || len(parts) > 8 || parts[0] != "apis" || parts[1] != "apps" || parts[2] != "v1" ||
+		parts[3] != "namespaces" || parts[5] != "deployments" || (len(parts) == 8 && parts[7] != "scale") {
+		call.Status = writeStatus(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+		return
+	}
+	call.Namespace, call.Name, call.Scale = parts[4], parts[6], len(parts) == 8
+
+	if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+		call.Status = writeStatus(w, http.StatusUnauthorized, "Unauthorized", "Unauthorized")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if call.Scale && r.Method == http.MethodPut {
+		var scale struct {
+			Spec struct {
+				Replicas int `json:"replicas"`
+			} `json:"spec"`
+		}
+		if err := json.Unmarshal(body, &scale); err != nil {
+			call.Status = writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		call.Replicas = scale.Spec.Replicas
+	}
+	if status, ok := s.takeFault(); ok {
+		switch status {
+		case http.StatusTooManyRequests:
+			w.Header().Set("Retry-After", "1")
+			call.Status = writeStatus(w, status, "TooManyRequests", "the server has received too many requests and has asked us to try again later")
+		case http.StatusConflict:
+			call.Status = writeStatus(w, status, "Conflict", "Operation cannot be fulfilled: the object has been modified; please apply your changes to the latest version and try again")
+		default:
+			call.Status = writeStatus(w, status, http.StatusText(status), "injected failure")
+		}
+		return
+	}
+
+	s.mu.Lock()
+	key := call.Namespace + "/" + call.Name
+	d, ok := s.deployments[key]
+	if !ok && s.AutoCreate {
+		d = &deployment{annotations: map[string]string{}, resourceVersion: 1}
+		s.deployments[key] = d
+	}
+	if d == nil {
+		s.mu.Unlock()
+		call.Status = writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("deployments.apps %q not found", call.Name))
+		return
+	}
+
+	var changed bool
+	switch {
+	case call.Scale && r.Method == http.MethodGet:
+	case call.Scale && r.Method == http.MethodPut:
+		changed = d.replicas != call.Replicas
+		d.replicas = call.Replicas
+		d.resourceVersion++
+	case !call.Scale && r.Method == http.MethodGet:
+	case !call.Scale && r.Method == http.MethodPatch:
+		var patch struct {
+			Metadata struct {
+				Annotations map[string]*string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			s.mu.Unlock()
+			call.Status = writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		for k, v := range patch.Metadata.Annotations {
+			if v == nil {
+				delete(d.annotations, k)
+			} else {
+				d.annotations[k] = *v
+			}
+		}
+		d.resourceVersion++
+	default:
+		s.mu.Unlock()
+		call.Status = writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "the server does not allow this method on the requested resource")
+		return
+	}
+	obj := s.object(call, d)
+	replicas := d.replicas
+	s.mu.Unlock()
+
+	if changed && s.OnScale != nil {
+		s.OnScale(call.Namespace, call.Name, replicas)
+	}
+	call.Status = http.StatusOK
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (s *Server) takeFault() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.faults) > 0 {
+		f := &s.faults[0]
+		if f.left <= 0 {
+			s.faults = s.faults[1:]
+			continue
+		}
+		f.left--
+		return f.status, true
+	}
+	return 0, false
+}
+
+// object renders a deployment or its scale. Callers hold s.mu.
+func (s *Server) object(c Call, d *deployment) interface{} {
+	meta := map[string]interface{}{
+		"name":            c.Name,
+		"namespace":       c.Namespace,
+		"resourceVersion": strconv.Itoa(d.resourceVersion),
+	}
+	if c.Scale {
+		return map[string]interface{}{
+			"kind": "Scale", "apiVersion": "autoscaling/v1", "metadata": meta,
+			"spec":   map[string]int{"replicas": d.replicas},
+			"status": map[string]int{"replicas": d.replicas},
+		}
+	}
+	annotations := make(map[string]string, len(d.annotations))
+	for k, v := range d.annotations {
+		annotations[k] = v
+	}
+	meta["annotations"] = annotations
+	return map[string]interface{}{
+		"kind": "Deployment", "apiVersion": "apps/v1", "metadata": meta,
+		"spec":   map[string]int{"replicas": d.replicas},
+		"status": map[string]int{"replicas": d.replicas, "readyReplicas": d.replicas},
+	}
+}
+
+// writeStatus answers with a Kubernetes Status object and returns code.
+func writeStatus(w http.ResponseWriter, code int, reason, message string) int {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind": "Status", "apiVersion": "v1", "status": "Failure",
+		"message": message, "reason": reason, "code": code,
+	})
+	return code
+}
+
+// ControlHandler lets scripts drive the server over HTTP: POST
+// fail?status=429&n=1 injects failures, GET calls lists the calls and GET
+// replicas?namespace=..&name=.. reports a deployment's replicas. Paths are
+// relative to where it is mounted.
+func (s *Server) ControlHandler(prefix string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+"fail", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		status, err := strconv.Atoi(r.URL.Query().Get("status"))
+		if err != nil || status < 400 {
+			http.Error(w, "status must be an error code", http.StatusBadRequest)
+			return
+		}
+		n := 1
+		if v := r.URL.Query().Get("n"); v != "" {
+			if n, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		s.FailNext(status, n)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(prefix+"calls", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Calls())
+	})
+	mux.HandleFunc(prefix+"replicas", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Replicas(r.URL.Query().Get("namespace"), r.URL.Query().Get("name")))
+	})
+	return mux
+}
@@ -0,0 +1,154 @@
+package main
+
+// Integration tests of the scaling path against the fakekube API server:
+// scale calls, readiness polling and the API errors a real cluster gives.
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"auto_scale/fakekube"
+)
+
+// fakeKubeRoute returns a route whose deployment test/name lives in a
+// fakekube server with the given replicas, reached with token, and whose
+// backend always passes its health check. The route table is installed as
+// the proxy's.
+func fakeKubeRoute(t *testing.T, name string, replicas int, token string) (*route, *fakekube.Server) {
+	t.Helper()
+	api := fakekube.New("secret")
+	api.AddDeployment("test", name, replicas)
+	kube := httptest.NewServer(api)
+	t.Cleanup(kube.Close)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(backend.Close)
+
+	rt := &route{
+		Name:         name,
+		Path:         "/" + name,
+		BackendURL:   backend.URL,
+		Protocol:     "tcp",
+		Namespace:    "test",
+		Deployment:   name,
+		KubeEndpoint: kube.URL,
+		KubeToken:    token,
+	}
+	table, err := newRouteTable([]*route{rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := routing.Load()
+	routing.Store(table)
+	t.Cleanup(func() { routing.Store(prev) })
+	return rt, api
+}
+
+func TestFakeKubeScaleUpReadyAndDown(t *testing.T) {
+	rt, api := fakeKubeRoute(t, "updown", 0, "secret")
+
+	if err := scaleDeployment(rt.scale, 2, "traffic"); err != nil {
+		t.Fatalf("scale up: %v", err)
+	}
+	if got := api.Replicas("test", "updown"); got != 2 {
+		t.Fatalf("replicas after scale up = %d, want 2", got)
+	}
+	if err := waitReady(rt); err != nil {
+		t.Fatalf("waitReady: %v", err)
+	}
+	if n, err := readyReplicas(rt.scale); err != nil || n != 2 {
+		t.Fatalf("readyReplicas = %d, %v; want 2", n, err)
+	}
+
+	if err := scaleDeployment(rt.scale, 0, "inactivity"); err != nil {
+		t.Fatalf("scale down: %v", err)
+	}
+	// Scaling to the replicas it already has is not sent again.
+	if err := scaleDeployment(rt.scale, 0, "inactivity"); err != nil {
+		t.Fatalf("repeated scale down: %v", err)
+	}
+	if got := api.ScaleCalls("test", "updown"); len(got) != 2 || got[0] != 2 || got[1] != 0 {
+		t.Fatalf("scale calls = %v, want [2 0]", got)
+	}
+	st := targetStatusOf(rt.scale)
+	if st.Replicas != 0 || st.LastScale == nil || st.LastScale.Cause != "inactivity" {
+		t.Fatalf("status after scale down = %+v", st)
+	}
+}
+
+func TestFakeKubeWaitReady(t *testing.T) {
+	defer func(initial, timeout int) { readyPollInitialMs, readyTimeoutSeconds = initial, timeout }(readyPollInitialMs, readyTimeoutSeconds)
+	readyPollInitialMs, readyTimeoutSeconds = 10, 1
+
+	rt, _ := fakeKubeRoute(t, "ready", 0, "secret")
+	// No replica ever becomes ready.
+	if err := waitReady(rt); !errors.Is(err, errNotReady) {
+		t.Fatalf("waitReady with no replicas = %v, want errNotReady", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- waitReady(rt) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := scaleDeployment(rt.scale, 1, "traffic"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("waitReady after scale up = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitReady did not return")
+	}
+}
+
+func TestFakeKubeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		token  string
+		status int // injected fault, 0 for none
+		want   string
+	}{
+		{"unauthorized", "wrong", 0, "401"},
+		{"conflict", "secret", http.StatusConflict, "409"},
+		{"throttled", "secret", http.StatusTooManyRequests, "429"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rt, api := fakeKubeRoute(t, "err-"+tc.name, 1, tc.token)
+			if tc.status != 0 {
+				api.FailNext(tc.status, 1)
+			}
+			err := scaleDeployment(rt.scale, 3, "traffic")
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("scale error = %v, want one mentioning %s", err, tc.want)
+			}
+			if got := api.Replicas("test", "err-"+tc.name); got != 1 {
+				t.Fatalf("replicas after failed scale = %d, want 1", got)
+			}
+			// A failed call leaves the replicas unknown, so the next
+			// request tries again.
+			if st := targetStatusOf(rt.scale); st.Replicas != -1 || st.LastScale != nil {
+				t.Fatalf("status after failed scale = %+v", st)
+			}
+			if _, err := readyReplicas(rt.scale); tc.status == 0 && (err == nil || !strings.Contains(err.Error(), "401")) {
+				t.Fatalf("readyReplicas with a wrong token = %v, want a 401", err)
+			}
+			if tc.status == 0 {
+				return
+			}
+			// The fault was one-off; a retry goes through.
+			if err := scaleDeployment(rt.scale, 3, "traffic"); err != nil {
+				t.Fatalf("retry: %v", err)
+			}
+			if got := api.ScaleCalls("test", "err-"+tc.name); len(got) != 2 {
+				t.Fatalf("scale calls = %v, want 2", got)
+			}
+			if got := api.Replicas("test", "err-"+tc.name); got != 3 {
+				t.Fatalf("replicas after retry = %d, want 3", got)
+			}
+		})
+	}
+}
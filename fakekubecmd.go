@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"auto_scale/fakekube"
+)
+
+// runFakeKube implements the "fakekube" subcommand: a stand-in Kubernetes
+// API for integration tests of the scaling path, controlled over HTTP
+// under /_fake/.
+func runFakeKube(args []string) int {
+	fs := flag.NewFlagSet("fakekube", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:6443", "address to listen on")
+	token := fs.String("token", "", "bearer token to require (any if empty)")
+	deployments := fs.String("deployments", "", "comma-separated namespace/name deployments to create, scaled to 0")
+	autoCreate := fs.Bool("auto-create", false, "create unknown deployments on first use instead of answering 404")
+	fs.Parse(args)
+
+	api := fakekube.New(*token)
+	api.AutoCreate = *autoCreate
+	for _, d := range strings.Split(*deployments, ",") {
+		if d == "" {
+			continue
+		}
+		ns, name, ok := strings.Cut(d, "/")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "invalid deployment %q, want namespace/name\n", d)
+			return 2
+		}
+		api.AddDeployment(ns, name, 0)
+	}
+	api.OnScale = func(ns, name string, replicas int) {
+		slog.Info("Deployment scaled", "deployment", ns+"/"+name, "replicas", replicas)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/_fake/", api.ControlHandler("/_fake/"))
+	mux.Handle("/", api)
+	slog.Info("Fake Kubernetes API listening", "addr", *addr)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
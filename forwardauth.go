@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	// forwardAuthWaitSeconds is how long a forward-auth call waits for the
+	// backend to become ready before answering 503.
+	forwardAuthWaitSeconds = getEnvAsInt("FORWARD_AUTH_WAIT_SECONDS", 30)
+)
+
+// handleForwardAuth lets an external reverse proxy (Traefik forwardAuth,
+// Caddy forward_auth, nginx auth_request) use the proxy purely for
+// wake-on-traffic: it records activity, scales the backend up if needed and
+// answers 200 once the backend is ready. The route's bans, geo rules,
+// listeners and basic_auth apply as they do to proxied requests, so only
+// callers that could connect wake the backend.
+func handleForwardAuth(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	if bans.banned(ip) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	rt := forwardAuthRoute(r)
+	if rt == nil {
+		http.Error(w, "no matching route", http.StatusNotFound)
+		return
+	}
+	if !listenerAllows(r, rt) || !geoAllowed(rt, ip) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if rt.BasicAuth != nil && !rt.BasicAuth.allows(r) {
+		bans.strike(ip, "auth failures")
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", rt.BasicAuth.Realm))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if serveMaintenance(w, r, rt) {
+		return
+	}
+	recordActivity(rt)
+
+	if isBackendUp(rt) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	lg := slog.With("request_id", requestID(r), "route", rt.Name, "deployment", rt.scale.String(), "cause", "forward_auth")
+	lg.Info("Backend is down, scaling up for forward-auth")
+	if err := scaleDeployment(rt.scale, rt.scale.wakeReplicas(), "forward_auth"); err != nil {
+		lg.Error("Failed to scale backend up", "error", err)
+		if errors.Is(err, errCooldown) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(rt.scale.cooldown(rt.scale.wakeReplicas()).Seconds())+1))
+		}
+		http.Error(w, "Failed to scale backend up", http.StatusServiceUnavailable)
+		return
+	}
+
+	deadline := clk.Now().Add(time.Duration(forwardAuthWaitSeconds) * time.Second)
+	poll := clk.NewTicker(time.Second)
+	defer poll.Stop()
+	for clk.Now().Before(deadline) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-poll.C():
+		}
+		if isBackendUp(rt) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(5))
+	http.Error(w, "Backend is starting", http.StatusServiceUnavailable)
+}
+
+// forwardAuthRoute finds the route for a forward-auth call, either by name
+// (?route=) or from the original URI reported by the calling proxy; with
+// neither there is none.
+func forwardAuthRoute(r *http.Request) *route {
+	t := routing.Load()
+	if name := r.URL.Query().Get("route"); name != "" {
+		return t.byName(name)
+	}
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = r.Header.Get("X-Original-URI")
+	}
+	if uri == "" {
+		return nil
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil
+	}
+	orig := &http.Request{URL: u, Header: r.Header}
+	return t.match(orig)
+}
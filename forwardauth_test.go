@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestForwardAuthWaitTimeout(t *testing.T) {
+	defer func(n int) { forwardAuthWaitSeconds = n }(forwardAuthWaitSeconds)
+	forwardAuthWaitSeconds = 30
+	c := useFakeClock(t)
+	rt, api := fakeKubeRoute(t, "fwd", 0, "secret")
+	// Nothing listens on port 1, so the backend never comes up.
+	rt.BackendURL = "http://127.0.0.1:1"
+	table, err := newRouteTable([]*route{rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routing.Store(table)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handleForwardAuth(w, httptest.NewRequest(http.MethodGet, "/forward-auth?route=fwd", nil))
+		close(done)
+	}()
+	c.waiting(1)
+	if got := api.Replicas("test", "fwd"); got != 1 {
+		t.Fatalf("replicas after forward-auth = %d, want 1", got)
+	}
+	c.Advance(29 * time.Second)
+	select {
+	case <-done:
+		t.Fatalf("forward-auth answered %d before its deadline", w.Code)
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	<-done
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("forward-auth past its deadline = %d, Retry-After %q; want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestForwardAuthCooldown(t *testing.T) {
+	defer func(n int) { scaleUpCooldownSeconds = n }(scaleUpCooldownSeconds)
+	scaleUpCooldownSeconds = 60
+	c := useFakeClock(t)
+	rt, api := fakeKubeRoute(t, "fwdcool", 1, "secret")
+	rt.BackendURL = "http://127.0.0.1:1"
+	table, err := newRouteTable([]*route{rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routing.Store(table)
+	if err := scaleDeployment(rt.scale, 1, "traffic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := scaleDeployment(rt.scale, 0, "inactivity"); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(20 * time.Second)
+
+	w := httptest.NewRecorder()
+	handleForwardAuth(w, httptest.NewRequest(http.MethodGet, "/forward-auth?route=fwdcool", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "41" {
+		t.Fatalf("forward-auth in the cooldown = %d, Retry-After %q; want 503 with Retry-After 41", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := api.Replicas("test", "fwdcool"); got != 0 {
+		t.Fatalf("replicas after forward-auth in the cooldown = %d, want 0", got)
+	}
+}
+
+func TestForwardAuthAccess(t *testing.T) {
+	rt, api := fakeKubeRoute(t, "fwdauth", 0, "secret")
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.BasicAuth = &basicAuth{Realm: "wake", Users: map[string]string{"alice": string(hash)}}
+
+	w := httptest.NewRecorder()
+	handleForwardAuth(w, httptest.NewRequest(http.MethodGet, "/forward-auth", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("forward-auth without a route or URI = %d, want 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleForwardAuth(w, httptest.NewRequest(http.MethodGet, "/forward-auth?route=fwdauth", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("forward-auth without credentials = %d, WWW-Authenticate %q; want 401 with a challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if got := api.ScaleCalls("test", "fwdauth"); len(got) != 0 {
+		t.Fatalf("scale calls after a refused forward-auth = %v, want none", got)
+	}
+}
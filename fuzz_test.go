@@ -0,0 +1,311 @@
+package main
+
+// Fuzz targets for the input the proxy takes from the internet, from
+// backends and from the files it is given. Run one
+// with e.g.
+//
+//	go test -run '^$' -fuzz FuzzRouteMatch -fuzztime 1m
+//
+// Plain go test runs the seeds.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fuzzRequest(path string, header http.Header) *http.Request {
+	return &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: path},
+		Header:     header,
+		RemoteAddr: "203.0.113.7:40000",
+	}
+}
+
+func FuzzRouteMatch(f *testing.F) {
+	table, err := newRouteTable([]*route{
+		{Path: "/ws", BackendURL: "http://127.0.0.1:3001"},
+		{Path: "/ws", BackendURL: "http://127.0.0.1:3002", Subprotocols: []string{"mqtt", "v2.chat"}},
+		{Path: "/events", Kind: "http", BackendURL: "http://127.0.0.1:3003"},
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add("/ws", "mqtt")
+	f.Add("/ws", " , v2.chat ,,mqtt")
+	f.Add("/events", "")
+	f.Add("/ws/", "\x00")
+	f.Add("", ",,,,")
+	f.Fuzz(func(t *testing.T, path, protocols string) {
+		h := http.Header{}
+		for _, line := range strings.Split(protocols, "\n") {
+			h.Add("Sec-WebSocket-Protocol", line)
+		}
+		rt := table.match(fuzzRequest(path, h))
+		if rt == nil {
+			return
+		}
+		if rt.Path != path {
+			t.Fatalf("path %q matched route %s on %q", path, rt.Name, rt.Path)
+		}
+		if len(rt.Subprotocols) > 0 {
+			offered := offeredSubprotocols(fuzzRequest(path, h))
+			ok := false
+			for _, p := range rt.Subprotocols {
+				ok = ok || offered[p]
+			}
+			if !ok {
+				t.Fatalf("route %s matched without one of its subprotocols offered (%q)", rt.Name, protocols)
+			}
+		}
+	})
+}
+
+func FuzzClientIP(f *testing.F) {
+	trusted, err := parseCIDRList("10.0.0.0/8,2001:db8::/32", nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add("10.1.2.3:443", "198.51.100.1, 10.0.0.1", "", "")
+	f.Add("[2001:db8::1]:443", "[2001:db8::2]:80,garbage", "::ffff:1.2.3.4", "")
+	f.Add("203.0.113.9:1", "1.1.1.1", "2.2.2.2", "3.3.3.3")
+	f.Add("10.0.0.1", ",,,", "[", "]:")
+	f.Fuzz(func(t *testing.T, remote, xff, cf, real string) {
+		saved := trustedProxies
+		trustedProxies = trusted
+		defer func() { trustedProxies = saved }()
+
+		r := fuzzRequest("/ws", http.Header{})
+		r.RemoteAddr = remote
+		for _, hop := range strings.Split(xff, "\n") {
+			r.Header.Add("X-Forwarded-For", hop)
+		}
+		r.Header.Set("CF-Connecting-IP", cf)
+		r.Header.Set("X-Real-IP", real)
+		ip := clientIP(r)
+		if !fromTrustedProxy(r) && ip != remoteAddr(r).String() {
+			t.Fatalf("untrusted peer %q reported as %q", remote, ip)
+		}
+		stripUntrustedClientHeaders(r)
+		if !fromTrustedProxy(r) {
+			for _, name := range clientIPHeaders {
+				if r.Header.Get(name) != "" {
+					t.Fatalf("%s kept on a request from untrusted %q", name, remote)
+				}
+			}
+		}
+	})
+}
+
+// frameLog records what a parser reports, payloads joined per frame.
+type frameLog struct {
+	events []string
+	cur    bytes.Buffer
+}
+
+func (l *frameLog) frameStart(f *wsFrame) error {
+	f.wantPayload = true
+	l.cur.Reset()
+	return nil
+}
+
+func (l *frameLog) framePayload(f *wsFrame, p []byte) error {
+	l.cur.Write(p)
+	return nil
+}
+
+func (l *frameLog) frameEnd(f *wsFrame) error {
+	l.events = append(l.events, opcodeName(f.opcode)+":"+l.cur.String())
+	return nil
+}
+
+func FuzzWSFrameParser(f *testing.F) {
+	f.Add(appendWSFrame(nil, opText, []byte("hello"), true), 3)
+	f.Add(append(appendWSFrame(nil, opPing, nil, false), appendWSFrame(nil, opBinary, make([]byte, 300), true)...), 1)
+	f.Add([]byte{0x81, 0xff, 0, 0, 0, 0, 0, 0, 0, 1}, 5)
+	f.Add([]byte{0x89, 0x7e, 0x01, 0x00}, 2)
+	f.Fuzz(func(t *testing.T, data []byte, split int) {
+		whole := &frameLog{}
+		errWhole := newWSFrameParser(whole).feed(data)
+
+		if split < 0 {
+			split = -split
+		}
+		split %= len(data) + 1
+		parts := &frameLog{}
+		p := newWSFrameParser(parts)
+		errParts := p.feed(data[:split])
+		if errParts == nil {
+			errParts = p.feed(data[split:])
+		}
+		if (errWhole == nil) != (errParts == nil) {
+			t.Fatalf("feeding at once: %v, in two parts at %d: %v", errWhole, split, errParts)
+		}
+		if errWhole == nil && strings.Join(whole.events, "|") != strings.Join(parts.events, "|") {
+			t.Fatalf("frames differ when split at %d:\n%q\n%q", split, whole.events, parts.events)
+		}
+	})
+}
+
+func FuzzAdminAuthorized(f *testing.F) {
+	f.Add("Bearer s3cret")
+	f.Add("Bearer s3cret ")
+	f.Add("bearer s3cret")
+	f.Add("Bearer ")
+	f.Add("Basic czNjcmV0")
+	f.Fuzz(func(t *testing.T, authorization string) {
+		saved := adminToken.get()
+		adminToken.set("s3cret")
+		defer adminToken.set(saved)
+
+		r := fuzzRequest("/admin", http.Header{"Authorization": {authorization}})
+		if _, ok := adminAuthorized(r); ok != (authorization == "Bearer s3cret") {
+			t.Fatalf("Authorization %q: authorized %t", authorization, ok)
+		}
+	})
+}
+
+func FuzzOIDCVerify(f *testing.F) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	p := &oidcProvider{
+		issuer:      "https://issuer.example",
+		allowed:     []string{"alice"},
+		keys:        map[string]crypto.PublicKey{"k1": &key.PublicKey},
+		keysFetched: time.Now().Add(time.Hour), // never fetch
+	}
+	sign := func(header, claims string) string {
+		enc := base64.RawURLEncoding
+		input := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(claims))
+		digest := sha256.Sum256([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			f.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return input + "." + enc.EncodeToString(sig)
+	}
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": p.issuer, "aud": oidcClientID, "sub": "alice", "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	valid := sign(`{"alg":"ES256","kid":"k1"}`, string(claims))
+	f.Add(valid)
+	f.Add(sign(`{"alg":"none","kid":"k1"}`, string(claims)))
+	f.Add(sign(`{"alg":"ES256","kid":"k1"}`, `{"iss":1}`))
+	f.Add("a.b.c")
+	f.Add("..")
+	f.Fuzz(func(t *testing.T, token string) {
+		c, err := p.verify(token, "")
+		if token == valid && err != nil {
+			t.Fatal(err)
+		}
+		if err == nil && c == nil {
+			t.Fatal("no claims for an accepted token")
+		}
+		// Only the header and claims signed here can be accepted.
+		if err == nil && !strings.HasPrefix(token, valid[:strings.LastIndex(valid, ".")+1]) {
+			t.Fatalf("accepted a token not signed by the key: %q", token)
+		}
+	})
+}
+
+// mmdbFile wraps data in an IPv4 database with one node, where
+// 0.0.0.0/1 is not found and 128.0.0.0/1 maps to the start of data.
+func mmdbFile(data string) []byte {
+	b := []byte{0, 0, 1, 0, 0, 17}
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	return append(b, "\xe3\x4anode_count\xc1\x01\x4brecord_size\xa1\x18\x4aip_version\xa1\x04"...)
+}
+
+func FuzzMMDB(f *testing.F) {
+	f.Add(mmdbFile("\xe1\x47country\xe1\x48iso_code\x42NL"))
+	// A pointer to itself, and a map whose key points back at the map.
+	f.Add(mmdbFile("\x20\x00"))
+	f.Add(mmdbFile("\xe1\x20\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := parseMMDB(data)
+		if err != nil {
+			return
+		}
+		for _, ip := range []string{"0.0.0.0", "128.0.0.1", "255.255.255.255", "::1", "2001:db8::1"} {
+			r.lookup(netip.MustParseAddr(ip))
+		}
+	})
+}
+
+func FuzzParseYAML(f *testing.F) {
+	for _, doc := range []string{kindKubeconfig, eksKubeconfig, gkeKubeconfig} {
+		f.Add([]byte(doc))
+	}
+	f.Add([]byte("a: \"x\\\"\"\nb: 'y''z'\nc: [1, \"2\"]\nd: {e: f}\ng: |\n  h\n"))
+	f.Add([]byte("- a\n-\n  - b\n  -   c: d\n      e\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := parseYAML(data)
+		if err != nil {
+			return
+		}
+		var check func(v any)
+		check = func(v any) {
+			switch v := v.(type) {
+			case map[string]any:
+				for _, e := range v {
+					check(e)
+				}
+			case []any:
+				for _, e := range v {
+					check(e)
+				}
+			case string, bool, nil:
+			default:
+				t.Fatalf("parsed to a %T", v)
+			}
+		}
+		check(v)
+	})
+}
+
+// fuzzConn reads from a fixed buffer and discards what is written.
+type fuzzConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c fuzzConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c fuzzConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func FuzzReadGRPCResponse(f *testing.F) {
+	headers := appendHPACKLiteral(nil, ":status", "200")
+	b := appendH2Frame(nil, h2FrameSettings, 0, 0, nil)
+	b = appendH2Frame(b, h2FrameHeaders, h2FlagEndHeaders, 1, headers)
+	b = appendH2Frame(b, h2FrameData, h2FlagPadded, 1, append([]byte{2}, append(grpcMessage([]byte{0x08, 0x01}), 0, 0)...))
+	f.Add(appendH2Frame(b, h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, appendHPACKLiteral(nil, "grpc-status", "0")))
+	f.Add(appendH2Frame(nil, h2FrameData, h2FlagEndStream, 1, grpcMessage([]byte{0x12, 0x03, 'a', 'b', 'c', 0x08, 0x02})))
+	f.Add(appendH2Frame(nil, h2FramePing, 0, 0, make([]byte, 8)))
+	f.Add(appendH2Frame(nil, h2FrameRSTStream, 0, 1, make([]byte, 4)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := readGRPCResponse(fuzzConn{r: bytes.NewReader(data)})
+		if err != nil {
+			return
+		}
+		parseHealthCheckResponse(msg)
+	})
+}
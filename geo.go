@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// geoIPDB is a MaxMind DB (e.g. GeoLite2-Country.mmdb) used for
+	// per-route country rules; it is reloaded when the file changes.
+	geoIPDB = getEnv("GEOIP_DB", "")
+
+	geoDB atomic.Pointer[mmdbReader]
+
+	geoRequests = newCounter("wsproxy_geo_requests_total",
+		"Requests on routes by client country, when GEOIP_DB is set.", "route", "country", "result")
+)
+
+// geoPolicy restricts a route by client country (ISO 3166 codes). Clients
+// whose country is unknown, such as private addresses, pass unless
+// DenyUnknown is set.
+type geoPolicy struct {
+	AllowCountries []string `json:"allow_countries,omitempty"`
+	DenyCountries  []string `json:"deny_countries,omitempty"`
+	DenyUnknown    bool     `json:"deny_unknown,omitempty"`
+}
+
+func (p *geoPolicy) validate() error {
+	if geoIPDB == "" {
+		return fmt.Errorf("geo rules need GEOIP_DB")
+	}
+	for _, list := range [][]string{p.AllowCountries, p.DenyCountries} {
+		for i, c := range list {
+			if len(c) != 2 {
+				return fmt.Errorf("invalid country code %q", c)
+			}
+			list[i] = strings.ToUpper(c)
+		}
+	}
+	return nil
+}
+
+func (p *geoPolicy) allows(country string) bool {
+	if country == "" {
+		return !p.DenyUnknown
+	}
+	for _, c := range p.DenyCountries {
+		if c == country {
+			return false
+		}
+	}
+	if len(p.AllowCountries) == 0 {
+		return true
+	}
+	for _, c := range p.AllowCountries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+func setupGeoIP() error {
+	if geoIPDB == "" {
+		return nil
+	}
+	db, err := openMMDB(geoIPDB)
+	if err != nil {
+		return fmt.Errorf("GEOIP_DB: %w", err)
+	}
+	geoDB.Store(db)
+	go watchGeoIP()
+	return nil
+}
+
+// watchGeoIP reloads the database after it has been replaced, e.g. by
+// geoipupdate.
+func watchGeoIP() {
+	var modTime time.Time
+	if fi, err := os.Stat(geoIPDB); err == nil {
+		modTime = fi.ModTime()
+	}
+	for range time.Tick(time.Minute) {
+		fi, err := os.Stat(geoIPDB)
+		if err != nil || fi.ModTime().Equal(modTime) {
+			continue
+		}
+		db, err := openMMDB(geoIPDB)
+		if err != nil {
+			slog.Error("Failed to reload GEOIP_DB", "file", geoIPDB, "error", err)
+			continue
+		}
+		modTime = fi.ModTime()
+		geoDB.Store(db)
+		slog.Info("Reloaded GEOIP_DB", "file", geoIPDB)
+	}
+}
+
+// countryOf returns the ISO country code of ip, or "" when unknown.
+func countryOf(ip string) string {
+	db := geoDB.Load()
+	if db == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	rec, err := db.lookup(addr)
+	if err != nil {
+		slog.Warn("GeoIP lookup failed", "client", ip, "error", err)
+		return ""
+	}
+	m, _ := rec.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		c, _ := m[key].(map[string]interface{})
+		if code, _ := c["iso_code"].(string); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// geoAllowed applies rt's country rules to the client at ip and counts the
+// request by country.
+func geoAllowed(rt *route, ip string) bool {
+	if geoDB.Load() == nil {
+		return true
+	}
+	country := countryOf(ip)
+	allowed := rt.Geo == nil || rt.Geo.allows(country)
+	label, result := country, "allowed"
+	if label == "" {
+		label = "unknown"
+	}
+	if !allowed {
+		result = "denied"
+	}
+	geoRequests.inc(rt.Name, label, result)
+	return allowed
+}
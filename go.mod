@@ -1,3 +1,8 @@
 module auto_scale
 
 go 1.21.4
+
+require (
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+)
@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// grafanaDashboard charts the metrics exported on /metrics; import it into
+// Grafana and pick the Prometheus data source scraping the proxy.
+//
+//go:embed grafana/dashboard.json
+var grafanaDashboard []byte
+
+func handleGrafanaDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="auto-scale-ws-proxy.json"`)
+	w.Write(grafanaDashboard)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// The grpc-health preset calls grpc.health.v1.Health/Check on the backend
+// and counts it as up only when it answers SERVING. The call is made with
+// a minimal HTTP/2 client of its own, so h2c backends work without pulling
+// in an HTTP/2 library: request headers are sent as plain literals and only
+// the response message is read, never the response headers.
+
+const (
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePing         = 0x6
+	h2FrameGoAway       = 0x7
+	h2FlagEndStream     = 0x1
+	h2FlagAck           = 0x1
+	h2FlagEndHeaders    = 0x4
+	h2FlagPadded        = 0x8
+	h2ClientPreface     = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+)
+
+// grpcServingStatus names HealthCheckResponse.ServingStatus values.
+var grpcServingStatus = map[uint64]string{
+	0: "UNKNOWN",
+	1: "SERVING",
+	2: "NOT_SERVING",
+	3: "SERVICE_UNKNOWN",
+}
+
+// checkGRPCHealth asks the backend at target whether rt.HealthService (the
+// whole server if empty) is serving.
+func checkGRPCHealth(rt *route, target *url.URL) error {
+	addr := backendDialAddr(target)
+	conn, err := backendDialer.dialTimeout(addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	scheme := "http"
+	if target.Scheme == "https" || target.Scheme == "wss" {
+		scheme = "https"
+		cfg := rt.backendTLSConfig(target.Hostname())
+		cfg.NextProtos = []string{"h2"}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		if p := tlsConn.ConnectionState().NegotiatedProtocol; p != "h2" {
+			return fmt.Errorf("backend does not speak HTTP/2 (ALPN %q)", p)
+		}
+		conn = tlsConn
+	}
+
+	var msg []byte
+	if rt.HealthService != "" {
+		msg = appendProtoString(msg, 1, rt.HealthService)
+	}
+	req := []byte(h2ClientPreface)
+	req = appendH2Frame(req, h2FrameSettings, 0, 0, nil)
+	var hdr []byte
+	for _, f := range [][2]string{
+		{":method", "POST"},
+		{":scheme", scheme},
+		{":path", grpcHealthCheckPath},
+		{":authority", target.Host},
+		{"content-type", "application/grpc"},
+		{"te", "trailers"},
+	} {
+		hdr = appendHPACKLiteral(hdr, f[0], f[1])
+	}
+	req = appendH2Frame(req, h2FrameHeaders, h2FlagEndHeaders, 1, hdr)
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	req = appendH2Frame(req, h2FrameData, h2FlagEndStream, 1, append(body, msg...))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	resp, err := readGRPCResponse(conn)
+	if err != nil {
+		return err
+	}
+	status, err := parseHealthCheckResponse(resp)
+	if err != nil {
+		return err
+	}
+	if status != 1 {
+		name := grpcServingStatus[status]
+		if name == "" {
+			name = fmt.Sprint(status)
+		}
+		return fmt.Errorf("status %s", name)
+	}
+	return nil
+}
+
+// readGRPCResponse reads frames until stream 1 ends and returns the gRPC
+// message it carried.
+func readGRPCResponse(conn net.Conn) ([]byte, error) {
+	br := bufio.NewReader(conn)
+	var data []byte
+	var head [9]byte
+	for {
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			return nil, err
+		}
+		length := int(head[0])<<16 | int(head[1])<<8 | int(head[2])
+		typ, flags := head[3], head[4]
+		stream := binary.BigEndian.Uint32(head[5:]) & 0x7fffffff
+		if length > 1<<20 {
+			return nil, fmt.Errorf("HTTP/2 frame of %d bytes", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return nil, err
+		}
+		switch typ {
+		case h2FrameSettings:
+			if flags&h2FlagAck == 0 {
+				if _, err := conn.Write(appendH2Frame(nil, h2FrameSettings, h2FlagAck, 0, nil)); err != nil {
+					return nil, err
+				}
+			}
+		case h2FramePing:
+			if flags&h2FlagAck == 0 {
+				if _, err := conn.Write(appendH2Frame(nil, h2FramePing, h2FlagAck, 0, payload)); err != nil {
+					return nil, err
+				}
+			}
+		case h2FrameGoAway:
+			return nil, errors.New("backend sent GOAWAY")
+		case h2FrameRSTStream:
+			if stream == 1 {
+				return nil, errors.New("backend reset the stream")
+			}
+		case h2FrameData, h2FrameHeaders:
+			if stream != 1 {
+				continue
+			}
+			if typ == h2FrameData {
+				if flags&h2FlagPadded != 0 {
+					if len(payload) == 0 || int(payload[0]) >= len(payload) {
+						return nil, errors.New("malformed HTTP/2 padding")
+					}
+					payload = payload[1 : len(payload)-int(payload[0])]
+				}
+				data = append(data, payload...)
+			}
+			if flags&h2FlagEndStream != 0 {
+				// A call that failed, e.g. with UNIMPLEMENTED when the
+				// server has no health service, ends without a message.
+				if len(data) < 5 {
+					return nil, errors.New("no health check response (is grpc.health.v1 served?)")
+				}
+				if data[0] != 0 {
+					return nil, errors.New("compressed health check response")
+				}
+				n := binary.BigEndian.Uint32(data[1:5])
+				if uint32(len(data)-5) < n {
+					return nil, errors.New("truncated health check response")
+				}
+				return data[5 : 5+n], nil
+			}
+		}
+	}
+}
+
+// parseHealthCheckResponse returns the status field of a protobuf
+// HealthCheckResponse, skipping any other fields.
+func parseHealthCheckResponse(b []byte) (uint64, error) {
+	var status uint64
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errors.New("malformed health check response")
+		}
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return 0, errors.New("malformed health check response")
+			}
+			b = b[n:]
+			if key>>3 == 1 {
+				status = v
+			}
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return 0, errors.New("malformed health check response")
+			}
+			b = b[n+int(l):]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return 0, errors.New("malformed health check response")
+			}
+			b = b[size:]
+		default:
+			return 0, errors.New("malformed health check response")
+		}
+	}
+	return status, nil
+}
+
+func appendH2Frame(b []byte, typ, flags byte, stream uint32, payload []byte) []byte {
+	n := len(payload)
+	b = append(b, byte(n>>16), byte(n>>8), byte(n), typ, flags)
+	b = binary.BigEndian.AppendUint32(b, stream)
+	return append(b, payload...)
+}
+
+// appendHPACKLiteral appends a header field as a literal without indexing
+// and without Huffman coding (RFC 7541, 6.2.2).
+func appendHPACKLiteral(b []byte, name, value string) []byte {
+	b = append(b, 0)
+	b = appendHPACKString(b, name)
+	return appendHPACKString(b, value)
+}
+
+func appendHPACKString(b []byte, s string) []byte {
+	n := len(s)
+	if n < 127 {
+		b = append(b, byte(n))
+	} else {
+		b = append(b, 127)
+		for n -= 127; n >= 128; n >>= 7 {
+			b = append(b, byte(n&0x7f|0x80))
+		}
+		b = append(b, byte(n))
+	}
+	return append(b, s...)
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// grpcMessage frames a protobuf message as a gRPC length-prefixed message.
+func grpcMessage(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// h2Server returns a connection to a server that sends frames and then
+// ends its side, reading whatever the client writes until it hangs up.
+func h2Server(t *testing.T, frames []byte) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write(frames)
+		c.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, c) // the client's SETTINGS and PING acks
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestReadGRPCResponse(t *testing.T) {
+	var headers []byte
+	for _, f := range [][2]string{{":status", "200"}, {"content-type", "application/grpc"}} {
+		headers = appendHPACKLiteral(headers, f[0], f[1])
+	}
+	trailers := appendHPACKLiteral(nil, "grpc-status", "0")
+	// Clipped, so the cases that start with it don't share its array.
+	settings := slices.Clip(appendH2Frame(nil, h2FrameSettings, 0, 0, nil))
+	reply := func(msg []byte) []byte {
+		b := appendH2Frame(settings, h2FrameHeaders, h2FlagEndHeaders, 1, headers)
+		b = appendH2Frame(b, h2FrameData, 0, 1, grpcMessage(msg))
+		return appendH2Frame(b, h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, trailers)
+	}
+	serving := []byte{0x08, 0x01}
+
+	for _, tc := range []struct {
+		name    string
+		frames  []byte
+		want    []byte
+		wantErr string
+	}{
+		{name: "SERVING", frames: reply(serving), want: serving},
+		{name: "NOT_SERVING", frames: reply([]byte{0x08, 0x02}), want: []byte{0x08, 0x02}},
+		{name: "empty message", frames: reply(nil), want: []byte{}},
+		{
+			name: "split over frames with padding, a ping and another stream",
+			frames: func() []byte {
+				msg := grpcMessage(serving)
+				b := appendH2Frame(settings, h2FrameHeaders, h2FlagEndHeaders, 1, headers)
+				b = appendH2Frame(b, h2FramePing, 0, 0, make([]byte, 8))
+				b = appendH2Frame(b, h2FrameData, h2FlagPadded, 1, append(append([]byte{3}, msg[:3]...), 0, 0, 0))
+				b = appendH2Frame(b, h2FrameData, 0, 3, []byte("other"))
+				b = appendH2Frame(b, h2FrameData, 0, 1, msg[3:])
+				return appendH2Frame(b, h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, trailers)
+			}(),
+			want: serving,
+		},
+		{
+			name:    "truncated frame",
+			frames:  reply(serving)[:len(settings)+9+4],
+			wantErr: "unexpected EOF",
+		},
+		{
+			name:    "truncated frame header",
+			frames:  reply(serving)[:len(settings)+4],
+			wantErr: "unexpected EOF",
+		},
+		{
+			name: "truncated message",
+			frames: func() []byte {
+				msg := grpcMessage([]byte{0x08, 0x01, 0x12, 0x03})
+				b := appendH2Frame(settings, h2FrameHeaders, h2FlagEndHeaders, 1, headers)
+				return appendH2Frame(b, h2FrameData, h2FlagEndStream, 1, msg[:len(msg)-2])
+			}(),
+			wantErr: "truncated health check response",
+		},
+		{
+			// A failed call is trailers-only: one HEADERS frame with
+			// grpc-status and no message.
+			name: "grpc-status error in trailers",
+			frames: func() []byte {
+				var h []byte
+				for _, f := range [][2]string{{":status", "200"}, {"grpc-status", "12"}, {"grpc-message", "unknown service grpc.health.v1.Health"}} {
+					h = appendHPACKLiteral(h, f[0], f[1])
+				}
+				return appendH2Frame(settings, h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, h)
+			}(),
+			wantErr: "no health check response",
+		},
+		{
+			name:    "compressed message",
+			frames:  appendH2Frame(settings, h2FrameData, h2FlagEndStream, 1, append([]byte{1}, grpcMessage(serving)[1:]...)),
+			wantErr: "compressed",
+		},
+		{
+			name:    "bad padding",
+			frames:  appendH2Frame(settings, h2FrameData, h2FlagPadded|h2FlagEndStream, 1, []byte{9, 0}),
+			wantErr: "padding",
+		},
+		{
+			name:    "stream reset",
+			frames:  appendH2Frame(settings, h2FrameRSTStream, 0, 1, []byte{0, 0, 0, 8}),
+			wantErr: "reset",
+		},
+		{
+			name:    "GOAWAY",
+			frames:  appendH2Frame(settings, h2FrameGoAway, 0, 0, make([]byte, 8)),
+			wantErr: "GOAWAY",
+		},
+		{
+			name:    "oversized frame",
+			frames:  []byte{0x20, 0, 0, h2FrameData, 0, 0, 0, 0, 1},
+			wantErr: "HTTP/2 frame of",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readGRPCResponse(h2Server(t, tc.frames))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(tc.want) {
+				t.Fatalf("message %x, want %x", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseHealthCheckResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		b      []byte
+		status uint64
+		ok     bool
+	}{
+		{"empty is UNKNOWN", nil, 0, true},
+		{"SERVING", []byte{0x08, 0x01}, 1, true},
+		{"NOT_SERVING", []byte{0x08, 0x02}, 2, true},
+		{"SERVICE_UNKNOWN", []byte{0x08, 0x03}, 3, true},
+		{"unknown fields skipped", []byte{
+			0x12, 0x02, 'h', 'i', // field 2, bytes
+			0x19, 1, 2, 3, 4, 5, 6, 7, 8, // field 3, fixed64
+			0x25, 1, 2, 3, 4, // field 4, fixed32
+			0x28, 0x96, 0x01, // field 5, varint
+			0x08, 0x01,
+		}, 1, true},
+		{"last status wins", []byte{0x08, 0x02, 0x08, 0x01}, 1, true},
+		{"truncated varint", []byte{0x08, 0x80}, 0, false},
+		{"missing value", []byte{0x08}, 0, false},
+		{"bytes past the end", []byte{0x12, 0x05, 'h'}, 0, false},
+		{"truncated fixed64", []byte{0x19, 1, 2}, 0, false},
+		{"truncated fixed32", []byte{0x25, 1}, 0, false},
+		{"group wire type", []byte{0x0b}, 0, false},
+	} {
+		status, err := parseHealthCheckResponse(tc.b)
+		if (err == nil) != tc.ok || status != tc.status {
+			t.Errorf("%s: %d, %v; want %d, ok %t", tc.name, status, err, tc.status, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With HA_PEER_URL set, two proxies run as an active/standby pair. Each
+// sends the other a heartbeat with its activity every HA_HEARTBEAT_SECONDS
+// through the admin API, and both keep the later last-request time of every
+// deployment, so either can decide when to scale down. Only the active one
+// runs the scale-down, schedule and keep-warm watchers; requests still wake
+// backends on either. The standby takes over once it has not heard from the
+// active one for HA_TIMEOUT_SECONDS, and hands back when the instance
+// configured as active returns.
+var (
+	haPeerURL          = getEnv("HA_PEER_URL", "")
+	haRole             = getEnv("HA_ROLE", "active") // configured role: active or standby
+	haHeartbeatSeconds = getEnvAsInt("HA_HEARTBEAT_SECONDS", 2)
+	haTimeoutSeconds   = getEnvAsInt("HA_TIMEOUT_SECONDS", 10)
+	// haTakeoverHook and haReleaseHook run when this instance becomes active
+	// or standby, e.g. to move a floating IP.
+	haTakeoverHook = getEnv("HA_TAKEOVER_HOOK", "")
+	haReleaseHook  = getEnv("HA_RELEASE_HOOK", "")
+
+	haPeerToken = newSecret("HA_PEER_TOKEN") // the peer's ADMIN_TOKEN
+
+	ha = &haState{}
+
+	_ = newGaugeFunc("wsproxy_ha_active",
+		"1 if this instance makes scaling decisions, 0 while it is standby.", func() float64 {
+			if isActive() {
+				return 1
+			}
+			return 0
+		})
+)
+
+type haState struct {
+	active   atomic.Bool
+	mu       sync.Mutex
+	lastPeer time.Time      // when the peer was last heard from
+	peerOpen map[string]int // sessions the peer has open, by target
+	warned   bool
+	changes  chan struct{} // tells runHooks the state may have changed
+}
+
+// haHeartbeat is what each instance tells the other.
+type haHeartbeat struct {
+	Role    string                `json:"role"`   // configured
+	Active  bool                  `json:"active"` // current
+	Targets map[string]haActivity `json:"targets"`
+}
+
+type haActivity struct {
+	LastRequest time.Time `json:"last_request"`
+	Open        int       `json:"open"`
+	Replicas    int       `json:"replicas"`
+}
+
+// isActive reports whether this instance makes scaling decisions, always
+// so without a peer, and never once it has handed over to an upgraded
+// process.
+func isActive() bool {
+	if handedOff.Load() {
+		return false
+	}
+	return haPeerURL == "" || ha.active.Load()
+}
+
+func setupHA() error {
+	if haPeerURL == "" {
+		return nil
+	}
+	switch haRole {
+	case "active", "standby":
+	default:
+		return fmt.Errorf("HA_ROLE must be active or standby, not %q", haRole)
+	}
+	// Heartbeats are admin POSTs, which are refused without a token, and
+	// a pair that can't hear each other would both end up active.
+	if adminToken.get() == "" {
+		return fmt.Errorf("HA_PEER_URL needs ADMIN_TOKEN so the peer's heartbeats are accepted")
+	}
+	if haPeerToken.get() == "" {
+		return fmt.Errorf("HA_PEER_URL needs HA_PEER_TOKEN, the peer's ADMIN_TOKEN")
+	}
+	ha.changes = make(chan struct{}, 1)
+	go ha.runHooks()
+	ha.mu.Lock()
+	// A standby starting alone waits a full timeout before taking over.
+	ha.lastPeer = clk.Now()
+	ha.mu.Unlock()
+	ha.setActive(haRole == "active", "starting")
+	go ha.heartbeats()
+	return nil
+}
+
+func (h *haState) setActive(active bool, why string) {
+	if h.active.Swap(active) == active && why != "starting" {
+		return
+	}
+	if active {
+		slog.Info("HA: this instance is active", "reason", why)
+	} else {
+		slog.Info("HA: this instance is standby", "reason", why)
+	}
+	// Never block the heartbeats on a slow hook: a pending signal already
+	// makes runHooks read the latest state.
+	select {
+	case h.changes <- struct{}{}:
+	default:
+	}
+}
+
+// runHooks runs the takeover or release hook for the current state, one at
+// a time. Changes that come while a hook runs are coalesced into the latest
+// state, whose hook runs next unless it was the last one run.
+func (h *haState) runHooks() {
+	ran, hooked := false, false
+	for range h.changes {
+		active := h.active.Load()
+		if ran && active == hooked {
+			continue
+		}
+		ran, hooked = true, active
+		command, event := haReleaseHook, "release"
+		if active {
+			command, event = haTakeoverHook, "takeover"
+		}
+		if command == "" {
+			continue
+		}
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", command)
+		} else {
+			cmd = exec.Command("/bin/sh", "-c", command)
+		}
+		cmd.Env = append(os.Environ(), "HA_EVENT="+event, "HA_PEER_URL="+haPeerURL)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			slog.Error("HA hook failed", "event", event, "error", err, "output", strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// heartbeats sends ours to the peer and watches for it going quiet.
+func (h *haState) heartbeats() {
+	client := &http.Client{Timeout: time.Duration(haHeartbeatSeconds) * time.Second}
+	failing := false
+	for {
+		if peer, err := h.send(client); err != nil {
+			if !failing {
+				slog.Warn("HA: heartbeat to the peer failed", "peer", haPeerURL, "error", err)
+				failing = true
+			}
+		} else {
+			if failing {
+				slog.Info("HA: the peer is reachable again", "peer", haPeerURL)
+				failing = false
+			}
+			h.receive(peer)
+		}
+		h.mu.Lock()
+		quiet := clk.Since(h.lastPeer)
+		h.mu.Unlock()
+		if !isActive() && quiet > time.Duration(haTimeoutSeconds)*time.Second {
+			h.setActive(true, fmt.Sprintf("no heartbeat from the peer for %s", quiet.Round(time.Second)))
+		}
+		clk.Sleep(time.Duration(haHeartbeatSeconds) * time.Second)
+	}
+}
+
+func (h *haState) send(client *http.Client) (*haHeartbeat, error) {
+	body, _ := json.Marshal(h.local())
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(haPeerURL, "/")+"/admin/ha/heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := haPeerToken.get(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var peer haHeartbeat
+	if err := json.NewDecoder(resp.Body).Decode(&peer); err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+// local describes this instance for the peer.
+func (h *haState) local() *haHeartbeat {
+	hb := &haHeartbeat{Role: haRole, Active: isActive(), Targets: make(map[string]haActivity)}
+	targetsMu.Lock()
+	list := make([]*scaleTarget, 0, len(targets))
+	for _, t := range targets {
+		list = append(list, t)
+	}
+	targetsMu.Unlock()
+	for _, t := range list {
+		t.mu.Lock()
+		hb.Targets[t.String()] = haActivity{LastRequest: t.lastRequestTime, Open: t.open, Replicas: t.lastScaledReplicas}
+		t.mu.Unlock()
+	}
+	return hb
+}
+
+// receive takes in a heartbeat from the peer.
+func (h *haState) receive(peer *haHeartbeat) {
+	h.mu.Lock()
+	h.lastPeer = clk.Now()
+	h.peerOpen = make(map[string]int)
+	for name, a := range peer.Targets {
+		h.peerOpen[name] = a.Open
+	}
+	if peer.Role == haRole && !h.warned {
+		h.warned = true
+		slog.Warn("HA: the peer has the same role; set HA_ROLE=active on one and standby on the other", "role", haRole)
+	}
+	h.mu.Unlock()
+
+	targetsMu.Lock()
+	list := make([]*scaleTarget, 0, len(targets))
+	for _, t := range targets {
+		list = append(list, t)
+	}
+	targetsMu.Unlock()
+	for _, t := range list {
+		a, ok := peer.Targets[t.String()]
+		if !ok {
+			continue
+		}
+		t.mu.Lock()
+		if a.LastRequest.After(t.lastRequestTime) {
+			t.lastRequestTime = a.LastRequest
+		}
+		if peer.Active && a.Replicas >= 0 {
+			t.lastScaledReplicas = a.Replicas
+		}
+		t.mu.Unlock()
+	}
+
+	if peer.Active && isActive() && haRole == "standby" {
+		h.setActive(false, "the configured active instance is back")
+	}
+}
+
+// peerSessions returns the sessions the peer has open on t.
+func (h *haState) peerSessions(t *scaleTarget) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.peerOpen[t.String()]
+}
+
+// handleHAHeartbeat is the peer's side of a heartbeat: it takes the
+// sender's state and answers with ours.
+func handleHAHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if haPeerURL == "" {
+		http.Error(w, "HA_PEER_URL is not set", http.StatusNotFound)
+		return
+	}
+	var peer haHeartbeat
+	if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ha.receive(&peer)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ha.local())
+}
+
+// handleHA describes the pair.
+func handleHA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	st := struct {
+		Enabled  bool       `json:"enabled"`
+		Role     string     `json:"role,omitempty"`
+		Active   bool       `json:"active"`
+		Peer     string     `json:"peer,omitempty"`
+		LastPeer *time.Time `json:"last_peer,omitempty"`
+		// PeerSessions are the sessions open on the peer, by deployment.
+		PeerSessions map[string]int `json:"peer_sessions,omitempty"`
+	}{Enabled: haPeerURL != "", Active: isActive()}
+	if st.Enabled {
+		st.Role, st.Peer = haRole, haPeerURL
+		ha.mu.Lock()
+		t := ha.lastPeer.UTC()
+		st.LastPeer = &t
+		st.PeerSessions = ha.peerOpen
+		ha.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetActiveDoesNotBlockOnHooks(t *testing.T) {
+	h := &haState{changes: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	go func() {
+		// Nothing runs the hooks, as if one were stuck.
+		for i := 0; i < 20; i++ {
+			h.setActive(i%2 == 0, "test")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("setActive blocked while the hooks were not running")
+	}
+	if len(h.changes) != 1 || h.active.Load() {
+		t.Fatalf("%d pending signals, active %v; want one signal for the last state, standby", len(h.changes), h.active.Load())
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// headerPolicy rewrites the headers of requests sent to a route's backend and
+// of the responses relayed back to clients.
+type headerPolicy struct {
+	Request  headerRules `json:"request"`
+	Response headerRules `json:"response"`
+}
+
+func (p *headerPolicy) validate() error {
+	if err := p.Request.compile(); err != nil {
+		return fmt.Errorf("request headers: %w", err)
+	}
+	if err := p.Response.compile(); err != nil {
+		return fmt.Errorf("response headers: %w", err)
+	}
+	return nil
+}
+
+// headerRules are applied in order: remove, then set, then add. Remove
+// entries ending in "*" match every header with that prefix, e.g.
+// "X-Forwarded-*". Set and add values are templates over headerContext,
+// e.g. "{{.ClientIP}}-{{.Route}}".
+type headerRules struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+// headerTemplates holds the parsed header value templates by their text,
+// outside headerRules so that routes still compare equal across reloads.
+var headerTemplates sync.Map // string -> *template.Template
+
+// headerContext is what header value templates can refer to.
+type headerContext struct {
+	ClientIP   string
+	Route      string
+	Host       string // as requested by the client
+	Path       string
+	UnixMillis int64
+}
+
+func newHeaderContext(r *http.Request, rt *route) *headerContext {
+	return &headerContext{
+		ClientIP:   clientIP(r),
+		Route:      rt.Name,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		UnixMillis: time.Now().UnixMilli(),
+	}
+}
+
+func (hr *headerRules) compile() error {
+	for _, values := range []map[string]string{hr.Set, hr.Add} {
+		for name, value := range values {
+			if !strings.Contains(value, "{{") {
+				continue
+			}
+			t, err := template.New(name).Parse(value)
+			if err == nil {
+				// Catch unknown fields now rather than on every request.
+				err = t.Execute(io.Discard, &headerContext{})
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			headerTemplates.Store(value, t)
+		}
+	}
+	return nil
+}
+
+// expand renders value for ctx if it is a template.
+func (hr *headerRules) expand(value string, ctx *headerContext) string {
+	t, ok := headerTemplates.Load(value)
+	if !ok {
+		return value
+	}
+	var b strings.Builder
+	if err := t.(*template.Template).Execute(&b, ctx); err != nil {
+		return ""
+	}
+	// Header values cannot hold line breaks.
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(b.String())
+}
+
+func (hr *headerRules) apply(h http.Header, ctx *headerContext) {
+	for _, pattern := range hr.Remove {
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		if !wildcard {
+			removeHeader(h, http.CanonicalHeaderKey(pattern))
+			continue
+		}
+		prefix = strings.ToLower(prefix)
+		for name := range h {
+			if strings.HasPrefix(strings.ToLower(name), prefix) {
+				removeHeader(h, name)
+			}
+		}
+		if strings.HasPrefix("x-forwarded-for", prefix) {
+			removeHeader(h, "X-Forwarded-For")
+		}
+	}
+	for name, value := range hr.Set {
+		h.Set(name, hr.expand(value, ctx))
+	}
+	for name, value := range hr.Add {
+		h.Add(name, hr.expand(value, ctx))
+	}
+}
+
+func removeHeader(h http.Header, name string) {
+	if name == "X-Forwarded-For" {
+		// A nil value stops the reverse proxy from appending the client
+		// address itself.
+		h[name] = nil
+		return
+	}
+	delete(h, name)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var (
+	// healthCheckProtocol is the preset used by routes that don't set one.
+	healthCheckProtocol = getEnv("HEALTH_CHECK_PROTOCOL", "vmess")
+)
+
+// healthPreset says how a backend speaking a given protocol answers a plain
+// HTTP GET on its tunnel path once it is ready. A nil check means only the
+// TCP connect is tested, unless probe replaces the GET altogether.
+type healthPreset struct {
+	check func(status int) error
+	probe func(rt *route, target *url.URL) error
+}
+
+var healthPresets = map[string]healthPreset{
+	// xray/v2ray WebSocket inbounds reject a non-upgrade GET with 400.
+	"vmess": {check: expectStatus(http.StatusBadRequest)},
+	"vless": {check: expectStatus(http.StatusBadRequest)},
+	// trojan-ws hands non-trojan requests to its fallback web server, so
+	// any answer that isn't an error from a missing upstream counts.
+	"trojan": {check: func(status int) error {
+		if status == http.StatusNotFound || status >= 500 {
+			return fmt.Errorf("status %d", status)
+		}
+		return nil
+	}},
+	// gRPC transports reject HTTP/1.1 requests without the grpc content type.
+	"grpc": {check: expectStatus(http.StatusUnsupportedMediaType)},
+	// Backends serving grpc.health.v1 report readiness themselves.
+	"grpc-health": {probe: checkGRPCHealth},
+	"http": {check: func(status int) error {
+		if status < 200 || status >= 400 {
+			return fmt.Errorf("status %d", status)
+		}
+		return nil
+	}},
+	"tcp": {},
+}
+
+func expectStatus(want int) func(int) error {
+	return func(status int) error {
+		switch status {
+		case want:
+			return nil
+		case http.StatusNotFound:
+			// 404 means the backend isn't serving the tunnel path yet
+			return fmt.Errorf("404 received")
+		}
+		return fmt.Errorf("unexpected status code %d", status)
+	}
+}
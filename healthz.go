@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	// healthPath additionally serves /healthz on proxy listeners under this
+	// path, for probes that cannot reach an admin listener. Off by default
+	// so the public listener gives nothing away. readyPath does the same
+	// for /readyz.
+	healthPath = getEnv("HEALTH_PATH", "")
+	readyPath  = getEnv("READY_PATH", "")
+)
+
+// handleHealthz reports whether the proxy is alive. It keeps answering 200
+// while stopping or draining, so a liveness probe does not restart the
+// proxy before its sessions have ended; readiness is /readyz.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the proxy takes new clients; it fails once
+// the proxy is stopping or draining so no new clients are sent its way.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if stopping.Load() {
+		http.Error(w, "stopping", http.StatusServiceUnavailable)
+		return
+	}
+	if adminDrain.active() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// runHealthcheck implements the "healthcheck" subcommand for container
+// HEALTHCHECKs and exec probes: it queries the local health endpoint and
+// exits 0 if it answers 200.
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	url := fs.String("url", "", "health endpoint to query (default: derived from the listeners)")
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for an answer")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: *timeout}
+	if *url == "" {
+		u, err := localHealthURL()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		*url = u
+		// The listener's certificate is not for the loopback address.
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Get(*url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "%s answered %s\n", *url, resp.Status)
+		return 1
+	}
+	return 0
+}
+
+// localHealthURL points at /healthz on the first admin listener, else at
+// HEALTH_PATH on the first proxy listener.
+func localHealthURL() (string, error) {
+	ls, err := loadListeners()
+	if err != nil {
+		return "", err
+	}
+	if err := validateListeners(ls); err != nil {
+		return "", err
+	}
+	for _, role := range []string{"admin", "proxy"} {
+		path := "/healthz"
+		if role == "proxy" {
+			if healthPath == "" {
+				continue
+			}
+			path = healthPath
+		}
+		for _, l := range ls {
+			if l.Role != role {
+				continue
+			}
+			host, port, err := net.SplitHostPort(l.Addr)
+			if err != nil {
+				return "", err
+			}
+			if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+				host = "127.0.0.1"
+				if l.Network == "tcp6" {
+					host = "::1"
+				}
+			}
+			scheme := "http"
+			if l.tls {
+				scheme = "https"
+			}
+			return scheme + "://" + net.JoinHostPort(host, port) + path, nil
+		}
+	}
+	return "", fmt.Errorf("no admin listener or HEALTH_PATH to check; set ADMIN_ADDR or HEALTH_PATH, or pass -url")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Scale hooks are shell commands run around scale calls, e.g. to pre-pull
+	// images or tell another system. They get the event in SCALE_* variables.
+	scaleHooks = map[string]string{
+		"before_up":   getEnv("SCALE_HOOK_BEFORE_UP", ""),
+		"after_up":    getEnv("SCALE_HOOK_AFTER_UP", ""),
+		"before_down": getEnv("SCALE_HOOK_BEFORE_DOWN", ""),
+		"after_down":  getEnv("SCALE_HOOK_AFTER_DOWN", ""),
+	}
+	scaleHookTimeoutSeconds = getEnvAsInt("SCALE_HOOK_TIMEOUT_SECONDS", 30)
+	// scaleHookFailure is "ignore" to scale even if a before hook fails or
+	// times out, or "abort" to skip the scale call. After hooks run in the
+	// background and are only logged.
+	scaleHookFailure = getEnv("SCALE_HOOK_FAILURE", "ignore")
+)
+
+func setupScaleHooks() error {
+	switch scaleHookFailure {
+	case "ignore", "abort":
+	default:
+		return fmt.Errorf("SCALE_HOOK_FAILURE must be ignore or abort, not %q", scaleHookFailure)
+	}
+	return nil
+}
+
+// scaleEvent describes a scale call to hooks.
+type scaleEvent struct {
+	target   *scaleTarget
+	replicas int
+	previous int
+	cause    string
+	err      error // of the scale call, for after hooks
+}
+
+// runScaleHook runs the hook for event ("before_up", "after_down", ...) if
+// one is set, waiting at most SCALE_HOOK_TIMEOUT_SECONDS.
+func runScaleHook(event string, e scaleEvent) error {
+	command := scaleHooks[event]
+	if command == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(scaleHookTimeoutSeconds)*time.Second)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	// Children of the shell may keep the output open after it is killed.
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(),
+		"SCALE_EVENT="+event,
+		"SCALE_NAMESPACE="+e.target.namespace,
+		"SCALE_DEPLOYMENT="+e.target.deployment,
+		"SCALE_REPLICAS="+strconv.Itoa(e.replicas),
+		"SCALE_PREVIOUS_REPLICAS="+strconv.Itoa(e.previous),
+		"SCALE_CAUSE="+e.cause,
+	)
+	if e.err != nil {
+		cmd.Env = append(cmd.Env, "SCALE_ERROR="+e.err.Error())
+	}
+	started := time.Now()
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %ds", scaleHookTimeoutSeconds)
+	}
+	if err != nil {
+		slog.Error("Scale hook failed", "event", event, "deployment", e.target.String(), "replicas", e.replicas, "cause", e.cause, "error", err, "output", strings.TrimSpace(string(out)))
+		return err
+	}
+	slog.Info("Scale hook ran", "event", event, "deployment", e.target.String(), "replicas", e.replicas, "cause", e.cause, "duration_ms", time.Since(started).Milliseconds())
+	return nil
+}
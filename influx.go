@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// influxURL is an InfluxDB write endpoint, e.g.
+	// http://influx:8086/api/v2/write?org=home&bucket=proxy or
+	// http://influx:8086/write?db=proxy; disabled unless set.
+	influxURL             = getEnv("INFLUX_URL", "")
+	influxToken           = newSecret("INFLUX_TOKEN")
+	influxIntervalSeconds = getEnvAsInt("INFLUX_INTERVAL_SECONDS", 30)
+)
+
+func setupInflux() error {
+	if influxURL == "" {
+		return nil
+	}
+	if !strings.HasPrefix(influxURL, "http://") && !strings.HasPrefix(influxURL, "https://") {
+		return fmt.Errorf("INFLUX_URL: %q is not an http(s) URL", influxURL)
+	}
+	if influxIntervalSeconds <= 0 {
+		return fmt.Errorf("INFLUX_INTERVAL_SECONDS must be positive")
+	}
+	slog.Info("Pushing metrics to InfluxDB", "interval_seconds", influxIntervalSeconds)
+	go func() {
+		ticker := time.NewTicker(time.Duration(influxIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := pushInflux(); err != nil {
+				slog.Error("Failed to push metrics to InfluxDB", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// pushInflux writes every series as one point: counters and gauges with a
+// "value" field, histograms with "count" and "sum".
+func pushInflux() error {
+	var body bytes.Buffer
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, s := range snapshotMetrics() {
+		body.WriteString(influxEscape(s.name, false))
+		for i, l := range s.labels {
+			if s.values[i] == "" {
+				continue
+			}
+			body.WriteString("," + influxEscape(l, true) + "=" + influxEscape(s.values[i], true))
+		}
+		if s.kind == histogramKind {
+			fmt.Fprintf(&body, " count=%di,sum=%s", s.count, formatFloat(s.sum))
+		} else {
+			body.WriteString(" value=" + formatFloat(s.value))
+		}
+		body.WriteString(" " + now + "\n")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, influxURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if tok := influxToken.get(); tok != "" {
+		req.Header.Set("Authorization", "Token "+tok)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB returned %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+var (
+	influxNameEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper  = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`, "\n", `\n`)
+)
+
+// influxEscape escapes a measurement name or, with tag set, a tag key or value.
+func influxEscape(s string, tag bool) string {
+	if tag {
+		return influxTagEscaper.Replace(s)
+	}
+	return influxNameEscaper.Replace(s)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// jsonlWriter appends one JSON object per line to a log stream.
+type jsonlWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix string
+}
+
+// openJSONL opens spec, a file path (created if missing and only ever
+// appended to) or "stdout"/"-", where each line starts with stdoutPrefix so
+// it can be told apart from operational logs. An empty spec returns nil.
+func openJSONL(spec, stdoutPrefix string) (*jsonlWriter, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case "stdout", "-":
+		return &jsonlWriter{out: os.Stdout, prefix: stdoutPrefix}, nil
+	}
+	f, err := os.OpenFile(spec, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlWriter{out: f}, nil
+}
+
+// write is a no-op on a nil writer, so disabled logs cost nothing.
+func (w *jsonlWriter) write(v interface{}) {
+	if w == nil {
+		return
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Failed to encode log entry", "error", err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := fmt.Fprintf(w.out, "%s%s\n", w.prefix, line); err != nil {
+		slog.Error("Failed to write log entry", "error", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// keepWarm sends a route's backend a synthetic health request every
+// IntervalSeconds during Hours (always if empty) and counts it as traffic,
+// trading a running replica for no cold starts on that route.
+type keepWarm struct {
+	IntervalSeconds int           `json:"interval_seconds,omitempty"`
+	Hours           []*timeWindow `json:"hours,omitempty"`
+}
+
+func (k *keepWarm) validate() error {
+	if k.IntervalSeconds <= 0 {
+		k.IntervalSeconds = 60
+	}
+	for i, w := range k.Hours {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("keep_warm hours %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (k *keepWarm) active(now time.Time) bool {
+	if len(k.Hours) == 0 {
+		return true
+	}
+	for _, w := range k.Hours {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepWarmWatcher pings the backends of keep-warm routes when due.
+func keepWarmWatcher() {
+	tick := clk.NewTicker(5 * time.Second)
+	for range tick.C() {
+		if !isActive() {
+			continue
+		}
+		now := clk.Now()
+		for _, rt := range routing.Load().routes {
+			if rt.KeepWarm == nil || !rt.KeepWarm.active(now) {
+				continue
+			}
+			rt.mu.Lock()
+			due := now.Sub(rt.lastWarm) >= time.Duration(rt.KeepWarm.IntervalSeconds)*time.Second
+			if due {
+				rt.lastWarm = now
+			}
+			rt.mu.Unlock()
+			if due {
+				go warm(rt)
+			}
+		}
+	}
+}
+
+func warm(rt *route) {
+	// Not recordActivity: these pings are not reconnects for the adaptive
+	// inactivity window.
+	rt.scale.mu.Lock()
+	rt.scale.lastRequestTime = clk.Now()
+	rt.scale.mu.Unlock()
+	if wakeRoute(rt, "keep_warm") {
+		return
+	}
+	if !checkBackend(rt) {
+		slog.Warn("Keep-warm request failed", "route", rt.Name, "deployment", rt.scale.String())
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// kubeSATokenFile is the pod's own service account token, used to read
+	// KUBE_TOKEN_SECRET and, without KUBE_CLUSTER_TOKEN, for every call.
+	kubeSATokenFile = getEnv("KUBE_SA_TOKEN_FILE", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	// kubeCAFile is trusted for the Kubernetes API besides the system roots
+	// when it exists.
+	kubeCAFile = getEnv("KUBE_CA_FILE", "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+
+	// The kubelet rotates projected tokens (hourly by default) and the CA
+	// bundle in place, so both are re-read once they are a minute old.
+	saToken = &cachedFile{path: kubeSATokenFile}
+	kubeCA  = &cachedFile{path: kubeCAFile}
+
+	// kubeClient makes the Kubernetes API calls; KUBE_RECORD_FILE and
+	// KUBE_REPLAY_FILE swap its transport.
+	kubeClient = &http.Client{Timeout: 5 * time.Second}
+	// watchClient has no overall timeout; watch requests are long-lived.
+	watchClient = &http.Client{}
+)
+
+// newKubeRequest builds an authenticated request against the Kubernetes API;
+// path is relative to KUBE_CLUSTER_ENDPOINT.
+func newKubeRequest(method, path string, body io.Reader) (*http.Request, error) {
+	return newKubeRequestAs(kubeAPIToken(), method, path, body)
+}
+
+func newKubeRequestAs(token, method, path string, body io.Reader) (*http.Request, error) {
+	if token == "" && kubeconf == nil {
+		return nil, fmt.Errorf("KUBE_CLUSTER_TOKEN not set and no service account token in %s", kubeSATokenFile)
+	}
+	return newKubeRequestTo(kubeClusterAPI, token, method, path, body)
+}
+
+// kubeRequest builds a request against the cluster t's deployment is in:
+// the route's kube_endpoint, or KUBE_CLUSTER_ENDPOINT.
+func (t *scaleTarget) kubeRequest(method, path string, body io.Reader) (*http.Request, error) {
+	if t.endpoint == "" {
+		return newKubeRequest(method, path, body)
+	}
+	t.mu.Lock()
+	token := t.token
+	t.mu.Unlock()
+	return newKubeRequestTo(t.endpoint, token, method, path, body)
+}
+
+func newKubeRequestTo(api, token, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(api, "/")+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if token != "" {
+		// Without one, KUBECONFIG authenticates with a client certificate.
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// serviceAccountToken returns the pod's service account token, falling back
+// to KUBE_CLUSTER_TOKEN outside a cluster.
+func serviceAccountToken() string {
+	if b, err := saToken.get(); err == nil {
+		return strings.TrimSpace(string(b))
+	}
+	return kubeToken.get()
+}
+
+// kubeAPIToken returns the token for Kubernetes API calls: KUBE_CLUSTER_TOKEN,
+// the KUBECONFIG user's, or else the pod's service account token.
+func kubeAPIToken() string {
+	if token := kubeToken.get(); token != "" {
+		return token
+	}
+	if kubeconf != nil {
+		return kubeconf.token()
+	}
+	if b, err := saToken.get(); err == nil {
+		return strings.TrimSpace(string(b))
+	}
+	return ""
+}
+
+// cachedFile is a file re-read when its contents are a minute old.
+type cachedFile struct {
+	path string
+
+	mu   sync.Mutex
+	data []byte
+	read time.Time
+	err  error
+}
+
+func (f *cachedFile) get() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.read.IsZero() && time.Since(f.read) < time.Minute {
+		return f.data, f.err
+	}
+	data, err := os.ReadFile(f.path)
+	switch {
+	case err == nil:
+		f.data, f.err = data, nil
+	case f.data == nil:
+		f.err = err
+	default:
+		// Keep the last good copy through a failed read, e.g. while the
+		// kubelet swaps the files.
+		slog.Warn("Failed to re-read file, keeping the last copy", "path", f.path, "error", err)
+	}
+	f.read = time.Now()
+	return f.data, f.err
+}
+
+// kubeTLSConfig trusts the system roots and, in a pod, the cluster's CA. The
+// CA is looked up at each handshake so that a rotated one is picked up.
+func kubeTLSConfig() *tls.Config {
+	if _, err := kubeCA.get(); err != nil {
+		return nil
+	}
+	return &tls.Config{
+		// The chain is verified by VerifyConnection instead.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			roots, err := x509.SystemCertPool()
+			if err != nil {
+				roots = x509.NewCertPool()
+			}
+			if ca, err := kubeCA.get(); err == nil {
+				roots.AppendCertsFromPEM(ca)
+			}
+			opts := x509.VerifyOptions{DNSName: cs.ServerName, Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err = cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+// kubeEvent is one event of a watch stream.
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watchKube streams the watch on path (a collection URL, possibly with a
+// query) from resource version rv, calling handle for every event other
+// than bookmarks. It returns the last resource version seen when the server
+// ends the watch, or an error, in which case the caller should relist.
+func watchKube(token, path, rv string, handle func(kubeEvent) error) (string, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	req, err := newKubeRequestAs(token, http.MethodGet, path+sep+"watch=1&allowWatchBookmarks=true&resourceVersion="+url.QueryEscape(rv), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := watchClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("K8s API returned %d: %s", resp.StatusCode, data)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev kubeEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return rv, nil
+			}
+			return "", err
+		}
+		if ev.Type == "ERROR" {
+			// Typically 410 Gone: the resource version is too old.
+			return "", fmt.Errorf("watch error: %s", ev.Object)
+		}
+		var meta struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(ev.Object, &meta); err != nil {
+			return "", err
+		}
+		rv = meta.Metadata.ResourceVersion
+		if ev.Type == "BOOKMARK" {
+			continue
+		}
+		if err := handle(ev); err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With KUBECONFIG set, e.g. when the proxy runs on a VM, the Kubernetes API
+// and how to authenticate to it come from a kubeconfig file instead of
+// KUBE_CLUSTER_ENDPOINT and KUBE_CLUSTER_TOKEN (which still take
+// precedence): the server and CA of the context's cluster, and the user's
+// token, client certificate or exec credential plugin (aws eks get-token,
+// gke-gcloud-auth-plugin, kubelogin), whose credentials are cached until
+// they expire. Files are read as JSON or as block-style YAML as kubectl and
+// the cloud CLIs write it; several files separated like PATH are merged,
+// the first to define a name winning.
+var (
+	kubeconfigPath = getEnv("KUBECONFIG", "")
+	kubeContext    = getEnv("KUBE_CONTEXT", "") // current-context if empty
+
+	kubeconf *kubeconfigAuth
+)
+
+type kubeconfigFile struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string            `json:"name"`
+		Cluster kubeconfigCluster `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string         `json:"name"`
+		User kubeconfigUser `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+type kubeconfigCluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthority     string `json:"certificate-authority"`
+	CertificateAuthorityData string `json:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+	TLSServerName            string `json:"tls-server-name"`
+}
+
+type kubeconfigUser struct {
+	Token                 string          `json:"token"`
+	TokenFile             string          `json:"tokenFile"`
+	ClientCertificate     string          `json:"client-certificate"`
+	ClientCertificateData string          `json:"client-certificate-data"`
+	ClientKey             string          `json:"client-key"`
+	ClientKeyData         string          `json:"client-key-data"`
+	Exec                  *kubeconfigExec `json:"exec"`
+	AuthProvider          *struct {
+		Name string `json:"name"`
+	} `json:"auth-provider"`
+	Username string `json:"username"`
+}
+
+type kubeconfigExec struct {
+	APIVersion string   `json:"apiVersion"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args"`
+	Env        []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"env"`
+	ProvideClusterInfo bool `json:"provideClusterInfo"`
+}
+
+// kubeconfigAuth is what the proxy took from the kubeconfig.
+type kubeconfigAuth struct {
+	context string
+	server  string
+	cluster kubeconfigCluster
+	user    kubeconfigUser
+	dir     string // relative paths are relative to the file's directory
+	tls     *tls.Config
+
+	mu      sync.Mutex
+	cred    execCredential // from the exec plugin
+	expires time.Time
+}
+
+// execCredential is the status of an ExecCredential printed by a plugin.
+type execCredential struct {
+	Token                 string     `json:"token"`
+	ExpirationTimestamp   *time.Time `json:"expirationTimestamp"`
+	ClientCertificateData string     `json:"clientCertificateData"`
+	ClientKeyData         string     `json:"clientKeyData"`
+}
+
+func setupKubeconfig() error {
+	if kubeconfigPath == "" {
+		return nil
+	}
+	kc, err := loadKubeconfig(kubeconfigPath, kubeContext)
+	if err != nil {
+		return fmt.Errorf("KUBECONFIG: %w", err)
+	}
+	if os.Getenv("KUBE_CLUSTER_ENDPOINT") == "" {
+		kubeClusterAPI = kc.server
+	}
+	u, err := url.Parse(kubeClusterAPI)
+	if err != nil {
+		return fmt.Errorf("KUBE_CLUSTER_ENDPOINT: %w", err)
+	}
+	// Only the kubeconfig's cluster gets its CA and client certificate;
+	// routes' kube_endpoint clusters keep the default transport.
+	if base, ok := kubeClient.Transport.(*http.Transport); ok {
+		t := base.Clone()
+		t.TLSClientConfig = kc.tls
+		rt := &hostTransport{host: u.Host, match: t, other: base}
+		kubeClient.Transport = rt
+		watchClient.Transport = rt
+	}
+	if kubeToken.get() == "" && kc.user.Exec != nil {
+		// Fail early on a plugin that does not work.
+		if _, err := kc.credential(); err != nil {
+			return fmt.Errorf("KUBECONFIG: %w", err)
+		}
+	}
+	kubeconf = kc
+	slog.Info("Using kubeconfig for the Kubernetes API", "context", kc.context, "path", kubeconfigPath, "endpoint", kubeClusterAPI)
+	return nil
+}
+
+// loadKubeconfig reads the files in paths and picks the named context.
+func loadKubeconfig(paths, context string) (*kubeconfigAuth, error) {
+	var merged kubeconfigFile
+	dirs := make(map[string]string) // cluster or user name -> directory
+	for _, path := range filepath.SplitList(paths) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var f kubeconfigFile
+		if err := decodeKubeconfig(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = f.CurrentContext
+		}
+		dir := filepath.Dir(path)
+		for _, c := range f.Clusters {
+			if _, ok := dirs["cluster "+c.Name]; !ok {
+				dirs["cluster "+c.Name] = dir
+				merged.Clusters = append(merged.Clusters, c)
+			}
+		}
+		for _, u := range f.Users {
+			if _, ok := dirs["user "+u.Name]; !ok {
+				dirs["user "+u.Name] = dir
+				merged.Users = append(merged.Users, u)
+			}
+		}
+		merged.Contexts = append(merged.Contexts, f.Contexts...)
+	}
+	if context == "" {
+		context = merged.CurrentContext
+	}
+	if context == "" {
+		return nil, fmt.Errorf("no current-context; set KUBE_CONTEXT")
+	}
+	kc := &kubeconfigAuth{context: context}
+	var clusterName, userName string
+	found := false
+	for _, c := range merged.Contexts {
+		if c.Name == context {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no context %q", context)
+	}
+	found = false
+	for _, c := range merged.Clusters {
+		if c.Name == clusterName {
+			kc.cluster, kc.dir, found = c.Cluster, dirs["cluster "+c.Name], true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q: no cluster %q", context, clusterName)
+	}
+	if kc.server = kc.cluster.Server; kc.server == "" {
+		return nil, fmt.Errorf("cluster %q has no server", clusterName)
+	}
+	userDir := kc.dir
+	for _, u := range merged.Users {
+		if u.Name == userName {
+			kc.user, userDir = u.User, dirs["user "+u.Name]
+			break
+		}
+	}
+	if p := kc.user.AuthProvider; p != nil {
+		return nil, fmt.Errorf("user %q: auth-provider %q is not supported; use an exec plugin", userName, p.Name)
+	}
+	if kc.user.Username != "" && kc.user.Token == "" && kc.user.TokenFile == "" && kc.user.Exec == nil {
+		return nil, fmt.Errorf("user %q: basic authentication is not supported", userName)
+	}
+	var err error
+	if kc.tls, err = kc.tlsConfig(userDir); err != nil {
+		return nil, err
+	}
+	kc.user.TokenFile = resolvePath(userDir, kc.user.TokenFile)
+	return kc, nil
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// pemData returns inline base64 data, or else the file at path.
+func pemData(data, dir, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	return os.ReadFile(resolvePath(dir, path))
+}
+
+func (kc *kubeconfigAuth) tlsConfig(userDir string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         kc.cluster.TLSServerName,
+		InsecureSkipVerify: kc.cluster.InsecureSkipTLSVerify,
+	}
+	ca, err := pemData(kc.cluster.CertificateAuthorityData, kc.dir, kc.cluster.CertificateAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("certificate authority: %w", err)
+	}
+	if ca != nil {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("certificate authority: no PEM certificates")
+		}
+	}
+	certPEM, err := pemData(kc.user.ClientCertificateData, userDir, kc.user.ClientCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %w", err)
+	}
+	keyPEM, err := pemData(kc.user.ClientKeyData, userDir, kc.user.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("client key: %w", err)
+	}
+	var static *tls.Certificate
+	if certPEM != nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		static = &cert
+	}
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if kc.user.Exec != nil {
+			cred, err := kc.credential()
+			if err != nil {
+				return nil, err
+			}
+			if cred.ClientCertificateData != "" {
+				cert, err := tls.X509KeyPair([]byte(cred.ClientCertificateData), []byte(cred.ClientKeyData))
+				return &cert, err
+			}
+		}
+		if static != nil {
+			return static, nil
+		}
+		return &tls.Certificate{}, nil
+	}
+	return cfg, nil
+}
+
+// token returns the bearer token of the kubeconfig's user, if it has one.
+func (kc *kubeconfigAuth) token() string {
+	switch {
+	case kc.user.Token != "":
+		return kc.user.Token
+	case kc.user.TokenFile != "":
+		b, err := os.ReadFile(kc.user.TokenFile)
+		if err != nil {
+			slog.Error("Failed to read the kubeconfig token file", "path", kc.user.TokenFile, "error", err)
+			return ""
+		}
+		return strings.TrimSpace(string(b))
+	case kc.user.Exec != nil:
+		cred, err := kc.credential()
+		if err != nil {
+			slog.Error("Kubeconfig exec plugin failed", "command", kc.user.Exec.Command, "error", err)
+			return ""
+		}
+		return cred.Token
+	}
+	return ""
+}
+
+// credential returns the exec plugin's credential, running it again once
+// the last one has (nearly) expired.
+func (kc *kubeconfigAuth) credential() (execCredential, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if kc.cred != (execCredential{}) && (kc.expires.IsZero() || time.Until(kc.expires) > time.Minute) {
+		return kc.cred, nil
+	}
+	e := kc.user.Exec
+	apiVersion := e.APIVersion
+	if apiVersion == "" {
+		apiVersion = "client.authentication.k8s.io/v1"
+	}
+	info := map[string]any{"apiVersion": apiVersion, "kind": "ExecCredential", "spec": map[string]any{"interactive": false}}
+	if e.ProvideClusterInfo {
+		cluster := map[string]any{
+			"server":                     kc.server,
+			"tls-server-name":            kc.cluster.TLSServerName,
+			"insecure-skip-tls-verify":   kc.cluster.InsecureSkipTLSVerify,
+			"certificate-authority-data": kc.cluster.CertificateAuthorityData,
+		}
+		info["spec"].(map[string]any)["cluster"] = cluster
+	}
+	infoJSON, _ := json.Marshal(info)
+
+	cmd := exec.Command(resolveExecCommand(kc.dir, e.Command), e.Args...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(infoJSON))
+	for _, v := range e.Env {
+		cmd.Env = append(cmd.Env, v.Name+"="+v.Value)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return execCredential{}, fmt.Errorf("%s: %w: %s", e.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	var resp struct {
+		Status execCredential `json:"status"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return execCredential{}, fmt.Errorf("%s: %w", e.Command, err)
+	}
+	if resp.Status.Token == "" && resp.Status.ClientCertificateData == "" {
+		return execCredential{}, fmt.Errorf("%s returned no credential", e.Command)
+	}
+	kc.cred, kc.expires = resp.Status, time.Time{}
+	if t := resp.Status.ExpirationTimestamp; t != nil {
+		kc.expires = *t
+	}
+	return kc.cred, nil
+}
+
+// resolveExecCommand finds a plugin given by a relative path (with a
+// slash) next to the kubeconfig; bare names are looked up in PATH.
+func resolveExecCommand(dir, command string) string {
+	if strings.ContainsRune(command, '/') && !filepath.IsAbs(command) {
+		return filepath.Join(dir, command)
+	}
+	return command
+}
+
+// hostTransport sends requests to host through match and all others
+// through other.
+type hostTransport struct {
+	host         string
+	match, other http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.host {
+		return t.match.RoundTrip(req)
+	}
+	return t.other.RoundTrip(req)
+}
+
+// decodeKubeconfig decodes a kubeconfig written as JSON or YAML into v.
+func decodeKubeconfig(data []byte, v any) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return json.Unmarshal(trimmed, v)
+	}
+	doc, err := parseYAML(data)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// kubeRecordFile captures every Kubernetes API call as a JSON line, to
+	// be served back by KUBE_REPLAY_FILE in tests. Secret bodies are left
+	// out; watches are not recorded.
+	kubeRecordFile = getEnv("KUBE_RECORD_FILE", "")
+	// kubeReplayFile answers Kubernetes API calls from such a recording
+	// instead of contacting KUBE_CLUSTER_ENDPOINT.
+	kubeReplayFile = getEnv("KUBE_REPLAY_FILE", "")
+)
+
+// kubeExchange is one recorded API call.
+type kubeExchange struct {
+	Method       string          `json:"method"`
+	Path         string          `json:"path"`
+	RequestBody  json.RawMessage `json:"request_body,omitempty"`
+	Status       int             `json:"status"`
+	ContentType  string          `json:"content_type,omitempty"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+}
+
+// rawJSON keeps b as is if it is JSON and quotes it otherwise.
+func rawJSON(b []byte) json.RawMessage {
+	if len(b) == 0 {
+		return nil
+	}
+	if json.Valid(b) {
+		return b
+	}
+	q, _ := json.Marshal(string(b))
+	return q
+}
+
+// kubePath is the request's path relative to KUBE_CLUSTER_ENDPOINT.
+func kubePath(req *http.Request) string {
+	return strings.TrimPrefix(req.URL.String(), kubeClusterAPI)
+}
+
+// recordingTransport passes requests on and writes each exchange out.
+type recordingTransport struct {
+	next http.RoundTripper
+	out  *jsonlWriter
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ex := kubeExchange{Method: req.Method, Path: kubePath(req)}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		ex.RequestBody = rawJSON(body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	ex.Status = resp.StatusCode
+	ex.ContentType = resp.Header.Get("Content-Type")
+	if strings.Contains(ex.Path, "/secrets/") {
+		ex.ResponseBody = rawJSON([]byte(`{"redacted":true}`))
+	} else {
+		ex.ResponseBody = rawJSON(body)
+	}
+	t.out.write(ex)
+	return resp, nil
+}
+
+// replayTransport answers from a recording. Calls to the same method and
+// path get the recorded responses in order, the last one repeating.
+type replayTransport struct {
+	mu    sync.Mutex
+	queue map[string][]kubeExchange
+}
+
+func loadKubeReplay(path string) (*replayTransport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &replayTransport{queue: make(map[string][]kubeExchange)}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var ex kubeExchange
+		if err := json.Unmarshal(sc.Bytes(), &ex); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		key := ex.Method + " " + ex.Path
+		t.queue[key] = append(t.queue[key], ex)
+	}
+	return t, sc.Err()
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := kubePath(req)
+	key := req.Method + " " + path
+	t.mu.Lock()
+	list := t.queue[key]
+	if len(list) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("kube replay: no recorded response for %s", key)
+	}
+	ex := list[0]
+	if len(list) > 1 {
+		t.queue[key] = list[1:]
+	}
+	t.mu.Unlock()
+
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		if !sameJSON(body, ex.RequestBody) {
+			slog.Warn("Kube replay: request body differs from the recording", "request", key, "body", string(body), "recorded", string(ex.RequestBody))
+		}
+	}
+	var body []byte
+	if len(ex.ResponseBody) > 0 {
+		body = ex.ResponseBody
+		var s string
+		if json.Unmarshal(body, &s) == nil {
+			body = []byte(s)
+		}
+	}
+	header := http.Header{}
+	if ex.ContentType != "" {
+		header.Set("Content-Type", ex.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// sameJSON compares two request bodies ignoring formatting.
+func sameJSON(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(bytes.TrimSpace(a), bytes.TrimSpace(b))
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
+
+func setupKubeRecording() error {
+	switch {
+	case kubeRecordFile != "" && kubeReplayFile != "":
+		return fmt.Errorf("KUBE_RECORD_FILE and KUBE_REPLAY_FILE are exclusive")
+	case kubeRecordFile != "":
+		out, err := openJSONL(kubeRecordFile, "KUBE ")
+		if err != nil {
+			return fmt.Errorf("KUBE_RECORD_FILE: %w", err)
+		}
+		kubeClient.Transport = &recordingTransport{next: kubeClient.Transport, out: out}
+		slog.Info("Recording Kubernetes API calls", "file", kubeRecordFile)
+	case kubeReplayFile != "":
+		t, err := loadKubeReplay(kubeReplayFile)
+		if err != nil {
+			return fmt.Errorf("KUBE_REPLAY_FILE: %w", err)
+		}
+		kubeClient.Transport = t
+		slog.Info("Answering Kubernetes API calls from a recording", "file", kubeReplayFile)
+	}
+	return nil
+}
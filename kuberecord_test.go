@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"auto_scale/fakekube"
+)
+
+var updateKubeFixture = flag.Bool("update-kube-fixture", false, "record "+kubeFixture+" again against fakekube")
+
+// kubeFixture is a recording of a scale-up, a readiness poll, a scale-down
+// refused with 409 and then 429 before it goes through, and another poll.
+// It was made through recordingTransport against the fakekube server; a
+// recording from a cluster (KUBE_RECORD_FILE) can take its place.
+const kubeFixture = "testdata/kube-scale.jsonl"
+
+// kubeFixtureRoute installs a route table with one route scaling
+// test/recorded through endpoint.
+func kubeFixtureRoute(t *testing.T, endpoint string) *route {
+	t.Helper()
+	rt := &route{Name: "recorded", Path: "/recorded", BackendURL: "http://127.0.0.1:1", Namespace: "test", Deployment: "recorded", KubeEndpoint: endpoint, KubeToken: "fixture"}
+	table, err := newRouteTable([]*route{rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := routing.Load()
+	routing.Store(table)
+	t.Cleanup(func() { routing.Store(prev) })
+	return rt
+}
+
+func useKubeTransport(t *testing.T, endpoint string, tr http.RoundTripper) {
+	prevAPI, prevTransport := kubeClusterAPI, kubeClient.Transport
+	kubeClusterAPI, kubeClient.Transport = endpoint, tr
+	t.Cleanup(func() { kubeClusterAPI, kubeClient.Transport = prevAPI, prevTransport })
+}
+
+func recordKubeFixture(t *testing.T) {
+	api := fakekube.New("fixture")
+	api.AddDeployment("test", "recorded", 0)
+	kube := httptest.NewServer(api)
+	defer kube.Close()
+
+	f, err := os.Create(kubeFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	useKubeTransport(t, kube.URL, &recordingTransport{next: http.DefaultTransport, out: &jsonlWriter{out: f}})
+	rt := kubeFixtureRoute(t, kube.URL)
+	if err := putScale(rt.scale, 1, "traffic"); err != nil {
+		t.Fatal(err)
+	}
+	readyReplicas(rt.scale)
+	api.FailNext(http.StatusConflict, 1)
+	api.FailNext(http.StatusTooManyRequests, 1)
+	for i := 0; i < 3; i++ {
+		putScale(rt.scale, 0, "inactivity")
+	}
+	readyReplicas(rt.scale)
+}
+
+func TestKubeReplay(t *testing.T) {
+	if *updateKubeFixture {
+		recordKubeFixture(t)
+	}
+	tr, err := loadKubeReplay(kubeFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Recorded paths are relative to the endpoint, so any will do.
+	const endpoint = "https://kube.invalid"
+	useKubeTransport(t, endpoint, tr)
+	rt := kubeFixtureRoute(t, endpoint)
+
+	if err := putScale(rt.scale, 1, "traffic"); err != nil {
+		t.Fatalf("scale up: %v", err)
+	}
+	if n, err := readyReplicas(rt.scale); err != nil || n != 1 {
+		t.Fatalf("readyReplicas after scale up = %d, %v; want 1", n, err)
+	}
+	for _, want := range []string{"409", "429"} {
+		if err := putScale(rt.scale, 0, "inactivity"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("scale down = %v, want a %s", err, want)
+		}
+		if st := targetStatusOf(rt.scale); st.Replicas != 1 {
+			t.Fatalf("replicas after a refused scale down = %d, want 1", st.Replicas)
+		}
+	}
+	if err := putScale(rt.scale, 0, "inactivity"); err != nil {
+		t.Fatalf("scale down: %v", err)
+	}
+	if n, err := readyReplicas(rt.scale); err != nil || n != 0 {
+		t.Fatalf("readyReplicas after scale down = %d, %v; want 0", n, err)
+	}
+	if st := targetStatusOf(rt.scale); st.Replicas != 0 || st.LastScale.Cause != "inactivity" {
+		t.Fatalf("status after scale down = %+v", st)
+	}
+}
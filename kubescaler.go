@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"auto_scale/scaler"
+)
+
+// kubeScaler scales a Deployment through its scale subresource.
+type kubeScaler struct{ t *scaleTarget }
+
+func (k kubeScaler) Scale(replicas int) error {
+	t := k.t
+	scaleBody := map[string]interface{}{
+		"kind":       "Scale",
+		"apiVersion": "autoscaling/v1",
+		"metadata": map[string]string{
+			"name":      t.deployment,
+			"namespace": t.namespace,
+		},
+		"spec": map[string]int{
+			"replicas": replicas,
+		},
+	}
+	bodyBytes, _ := json.Marshal(scaleBody)
+
+	req, err := t.kubeRequest(http.MethodPut, fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s/scale", t.namespace, t.deployment), bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("K8s API call failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respData, _ := io.ReadAll(resp.Body)
+		return &kubeError{resp.StatusCode, string(respData)}
+	}
+	return nil
+}
+
+func (k kubeScaler) Ready() (int, error) {
+	var dep struct {
+		Status struct {
+			ReadyReplicas int `json:"readyReplicas"`
+		} `json:"status"`
+	}
+	t := k.t
+	if err := getKube(t, fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", t.namespace, t.deployment), &dep); err != nil {
+		return 0, err
+	}
+	return dep.Status.ReadyReplicas, nil
+}
+
+// kubeError is an error status from the Kubernetes API; it wraps the
+// scaler error its status stands for, if any.
+type kubeError struct {
+	status int
+	body   string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("K8s API returned %d: %s", e.status, e.body)
+}
+
+func (e *kubeError) Unwrap() error {
+	switch e.status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return scaler.ErrUnauthorized
+	case http.StatusNotFound:
+		return scaler.ErrNotFound
+	case http.StatusConflict:
+		return scaler.ErrConflict
+	case http.StatusTooManyRequests:
+		return scaler.ErrThrottled
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"auto_scale/fakekube"
+	"auto_scale/scaler"
+	"auto_scale/scaler/scalertest"
+)
+
+func TestKubeScalerConformance(t *testing.T) {
+	scalertest.Run(t, func(t *testing.T) *scalertest.Backend {
+		name := strings.ToLower(strings.NewReplacer("/", "-", "_", "-").Replace(t.Name()))
+		api := fakekube.New("secret")
+		api.AddDeployment("test", name, 0)
+		kube := httptest.NewServer(api)
+		t.Cleanup(kube.Close)
+		return &scalertest.Backend{
+			Scaler:   targetFor(kube.URL, "secret", "test", name).scaler,
+			Replicas: func() int { return api.Replicas("test", name) },
+			Fail: func(class error) {
+				status := http.StatusConflict
+				if class == scaler.ErrThrottled {
+					status = http.StatusTooManyRequests
+				}
+				api.FailNext(status, 1)
+			},
+			// The trailing slash keeps it from sharing the target, and so
+			// the token, of Scaler.
+			Unauthorized: targetFor(kube.URL+"/", "wrong", "test", name).scaler,
+			Missing:      targetFor(kube.URL, "secret", "test", name+"-missing").scaler,
+		}
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// listenerConfig is one address the proxy listens on. Without "listeners"
+// in CONFIG_FILE, LISTEN_ADDR is the proxy listener and ADMIN_ADDR, if set,
+// the admin listener.
+type listenerConfig struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	Role string `json:"role,omitempty"` // "proxy" (default) or "admin"
+	// Network is "tcp4" or "tcp6" to accept only that family; by default
+	// a wildcard address accepts both.
+	Network string `json:"network,omitempty"`
+	// Interface binds to the address of the named network interface
+	// (matching Network) instead of the host part of Addr.
+	Interface string `json:"interface,omitempty"`
+	// Tailscale binds to this node's tailnet address instead, and
+	// identifies clients by their tailnet login; see tailscale.go.
+	Tailscale bool `json:"tailscale,omitempty"`
+	// Routes limits a proxy listener to the named routes; all if empty.
+	Routes []string `json:"routes,omitempty"`
+	// RateLimit applies MAX_CONN_RATE, default true, e.g. false for a
+	// listener only a CDN connects to.
+	RateLimit *bool `json:"rate_limit,omitempty"`
+	// WakeOnConnect scales up the listener's routes as soon as a TCP
+	// connection is accepted, before its request arrives.
+	WakeOnConnect bool `json:"wake_on_connect,omitempty"`
+	// TLS serves TLS with TLS_CERT_FILE or ACME_DOMAINS; by default proxy
+	// listeners do once either is set and admin listeners don't.
+	TLS *bool `json:"tls,omitempty"`
+
+	routes map[string]bool
+	tls    bool
+}
+
+type listenerKey struct{}
+
+var (
+	// handshakeSeconds limits how long a client may take to send its
+	// request headers (including the TLS handshake where there is one), so
+	// slow clients cannot hold connections open before a route is picked.
+	handshakeSeconds = getEnvAsInt("HANDSHAKE_TIMEOUT_SECONDS", 10)
+	maxHeaderBytes   = getEnvAsInt("MAX_HEADER_BYTES", 32<<10)
+
+	serversMu sync.Mutex
+	servers   []*http.Server
+)
+
+func defaultListeners() []*listenerConfig {
+	ls := []*listenerConfig{{Name: "main", Addr: listenAddr, Network: listenNetwork, Interface: listenInterface, WakeOnConnect: wakeOnConnect}}
+	if adminAddr != "" {
+		ls = append(ls, &listenerConfig{Name: "admin", Addr: adminAddr, Role: "admin"})
+	}
+	return ls
+}
+
+func loadListeners() ([]*listenerConfig, error) {
+	if configFile == "" {
+		return defaultListeners(), nil
+	}
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Listeners) == 0 {
+		return defaultListeners(), nil
+	}
+	return cfg.Listeners, nil
+}
+
+func validateListeners(ls []*listenerConfig) error {
+	names := make(map[string]bool)
+	for i, l := range ls {
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("listener%d", i)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listener %q is defined twice", l.Name)
+		}
+		names[l.Name] = true
+		if l.Addr == "" {
+			return fmt.Errorf("listener %s: addr is required", l.Name)
+		}
+		switch l.Role {
+		case "":
+			l.Role = "proxy"
+		case "proxy", "admin":
+		default:
+			return fmt.Errorf("listener %s: unknown role %q", l.Name, l.Role)
+		}
+		switch l.Network {
+		case "":
+			l.Network = "tcp"
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("listener %s: unknown network %q", l.Name, l.Network)
+		}
+		if l.Tailscale && l.Interface != "" {
+			return fmt.Errorf("listener %s: tailscale and interface are exclusive", l.Name)
+		}
+		if l.TLS != nil && *l.TLS && tlsCertFile == "" && acmeDomainsSpec == "" {
+			return fmt.Errorf("listener %s: tls needs TLS_CERT_FILE or ACME_DOMAINS", l.Name)
+		}
+		l.tls = (tlsCertFile != "" || acmeDomainsSpec != "") && (l.TLS == nil && l.Role == "proxy" || l.TLS != nil && *l.TLS)
+		if len(l.Routes) > 0 {
+			l.routes = make(map[string]bool)
+			for _, r := range l.Routes {
+				l.routes[r] = true
+			}
+		}
+	}
+	return nil
+}
+
+// startListeners opens every listener and serves it in the background.
+func startListeners() error {
+	ls, err := loadListeners()
+	if err != nil {
+		return err
+	}
+	if err := validateListeners(ls); err != nil {
+		return err
+	}
+	for _, l := range ls {
+		addr := l.Addr
+		if l.Interface != "" {
+			if addr, err = interfaceAddr(l.Interface, l.Network, l.Addr); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Name, err)
+			}
+		}
+		var ln net.Listener
+		switch {
+		case l.Tailscale && tsnetListen != nil:
+			if ln, err = tsnetListen(l.Network, l.Addr); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Name, err)
+			}
+		case l.Tailscale:
+			if addr, err = tailscaleAddr(l.Network, l.Addr); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Name, err)
+			}
+			fallthrough
+		default:
+			if ln, err = listen(l.Name, l.Network, addr); err != nil {
+				return err
+			}
+		}
+		srv := &http.Server{
+			Handler:           adminMux,
+			ReadHeaderTimeout: time.Duration(handshakeSeconds) * time.Second,
+			MaxHeaderBytes:    maxHeaderBytes,
+		}
+		if l.Role == "proxy" {
+			srv.Handler = http.HandlerFunc(serveProxyListener)
+			if l.RateLimit == nil || *l.RateLimit {
+				ln = limitListener(ln)
+			}
+			if l.WakeOnConnect {
+				ln = wakeListener{ln, l}
+			}
+			l := l
+			srv.BaseContext = func(net.Listener) context.Context {
+				return context.WithValue(context.Background(), listenerKey{}, l)
+			}
+		}
+		scheme := "http"
+		if l.tls {
+			// Wrapped last, so the rate limit and wake-on-connect act
+			// before the handshake.
+			ln = tls.NewListener(ln, listenerTLS)
+			scheme = "https"
+		}
+		slog.Info("Listening", "role", l.Role, "addr", ln.Addr().String(), "listener", l.Name, "scheme", scheme)
+		serversMu.Lock()
+		servers = append(servers, srv)
+		serversMu.Unlock()
+		go func() {
+			if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				fatal("Server failed", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// interfaceAddr replaces the host of addr with the first address of the
+// network interface name that suits network, preferring global ones.
+func interfaceAddr(name, network, addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var fallback string
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipn.IP
+		if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+			continue
+		}
+		host := ip.String()
+		if ip.IsLinkLocalUnicast() {
+			host += "%" + iface.Name
+		}
+		if ip.IsGlobalUnicast() || ip.IsPrivate() || ip.IsLoopback() {
+			return net.JoinHostPort(host, port), nil
+		}
+		if fallback == "" {
+			fallback = net.JoinHostPort(host, port)
+		}
+	}
+	if fallback == "" {
+		return "", fmt.Errorf("interface %s has no %s address", name, network)
+	}
+	return fallback, nil
+}
+
+// listenerAllows reports whether the listener r arrived on serves rt.
+func listenerAllows(r *http.Request, rt *route) bool {
+	l, _ := r.Context().Value(listenerKey{}).(*listenerConfig)
+	return l == nil || l.routes == nil || l.routes[rt.Name]
+}
+
+// shutdownServers stops all listeners and waits for plain requests to end.
+func shutdownServers(ctx context.Context) {
+	serversMu.Lock()
+	list := append([]*http.Server(nil), servers...)
+	serversMu.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range list {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			srv.Shutdown(ctx)
+		}(srv)
+	}
+	wg.Wait()
+}
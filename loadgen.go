@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadProfile is a per-session traffic pattern for loadgen.
+type loadProfile struct {
+	size int     // message size in bytes
+	rate float64 // messages per second, 0 to only hold the session
+}
+
+var loadProfiles = map[string]loadProfile{
+	"idle":   {0, 0},
+	"chat":   {128, 1},
+	"stream": {16 << 10, 20},
+	"bulk":   {256 << 10, 2},
+}
+
+// latencySample keeps a uniform sample of at most max observations.
+type latencySample struct {
+	mu      sync.Mutex
+	max     int
+	n       int
+	samples []time.Duration
+}
+
+func (s *latencySample) add(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	if len(s.samples) < s.max {
+		s.samples = append(s.samples, d)
+	} else if i := rand.Intn(s.n); i < s.max {
+		s.samples[i] = d
+	}
+}
+
+// summary formats the percentiles of the sample.
+func (s *latencySample) summary() string {
+	s.mu.Lock()
+	sorted := append([]time.Duration(nil), s.samples...)
+	s.mu.Unlock()
+	if len(sorted) == 0 {
+		return "no samples"
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))].Round(10 * time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %s  p90 %s  p99 %s  max %s", at(0.5), at(0.9), at(0.99), sorted[len(sorted)-1].Round(10*time.Microsecond))
+}
+
+type loadStats struct {
+	open, opened, failed, dropped atomic.Int64
+	sent, echoed, bytes           atomic.Int64
+	connect, rtt                  latencySample
+}
+
+// runLoadgen implements the "loadgen" subcommand: it ramps up concurrent
+// WebSocket sessions that send messages following a profile and reports
+// connect and round-trip latencies. Round trips are only measured against
+// backends that echo, like the dev backend.
+func runLoadgen(args []string) int {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := fs.String("url", "", "WebSocket URL to load, e.g. ws://127.0.0.1:8080/vmessws")
+	sessions := fs.Int("sessions", 10, "concurrent sessions")
+	ramp := fs.Duration("ramp", 0, "time over which sessions are opened")
+	duration := fs.Duration("duration", time.Minute, "how long to run, including the ramp")
+	profileName := fs.String("profile", "chat", "traffic profile: idle, chat, stream or bulk")
+	size := fs.Int("size", 0, "message size in bytes (default from the profile)")
+	rate := fs.Float64("rate", 0, "messages per second per session (default from the profile)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: auto_scale loadgen -url ws://host/path [-sessions n] [-ramp d] [-duration d] [-profile p] [-size n] [-rate n]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	profile, ok := loadProfiles[*profileName]
+	if *target == "" || !ok || *sessions < 1 || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "size":
+			profile.size = *size
+		case "rate":
+			profile.rate = *rate
+		}
+	})
+	if profile.size < 8 {
+		// room for the send time
+		profile.size = 8
+	}
+
+	stats := &loadStats{}
+	stats.connect.max, stats.rtt.max = 100000, 100000
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	slog.Info("Opening sessions", "sessions", *sessions, "target", *target, "ramp", ramp.String(), "profile", *profileName, "bytes", profile.size, "rate", profile.rate)
+	go func() {
+		for i := 0; i < *sessions; i++ {
+			if *ramp > 0 {
+				wait := time.Until(start.Add(*ramp * time.Duration(i) / time.Duration(*sessions)))
+				select {
+				case <-time.After(wait):
+				case <-done:
+					return
+				}
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				loadSession(*target, profile, stats, done)
+			}()
+		}
+	}()
+
+	report := time.NewTicker(5 * time.Second)
+	defer report.Stop()
+	end := time.After(*duration)
+	var lastSent int64
+wait:
+	for {
+		select {
+		case <-report.C:
+			sent := stats.sent.Load()
+			slog.Info("Load", "elapsed", time.Since(start).Round(time.Second).String(), "open", stats.open.Load(), "failed", stats.failed.Load(),
+				"dropped", stats.dropped.Load(), "msg_per_second", float64(sent-lastSent)/5, "rtt", stats.rtt.summary())
+			lastSent = sent
+		case <-end:
+			break wait
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	fmt.Printf("sessions: %d opened, %d failed, %d dropped before the end\n", stats.opened.Load(), stats.failed.Load(), stats.dropped.Load())
+	fmt.Printf("connect:  %s\n", stats.connect.summary())
+	fmt.Printf("messages: %d sent, %d echoed, %.1f KiB/s\n", stats.sent.Load(), stats.echoed.Load(), float64(stats.bytes.Load())/1024/elapsed.Seconds())
+	fmt.Printf("rtt:      %s\n", stats.rtt.summary())
+	if stats.failed.Load() > 0 || stats.dropped.Load() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadSession runs one session until done.
+func loadSession(target string, profile loadProfile, stats *loadStats, done <-chan struct{}) {
+	began := time.Now()
+	c, _, err := dialWS(target, nil, 30*time.Second)
+	if err != nil {
+		stats.failed.Add(1)
+		slog.Warn("Session failed", "error", err)
+		return
+	}
+	defer c.Close()
+	stats.connect.add(time.Since(began))
+	stats.opened.Add(1)
+	stats.open.Add(1)
+	defer stats.open.Add(-1)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, _, payload, err := c.readFrame()
+			if err != nil || op == opClose {
+				return
+			}
+			if op == opBinary && len(payload) >= 8 {
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+				stats.rtt.add(time.Since(sent))
+				stats.echoed.Add(1)
+			}
+		}
+	}()
+
+	var tick <-chan time.Time
+	if profile.rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / profile.rate))
+		defer t.Stop()
+		tick = t.C
+	}
+	payload := make([]byte, profile.size)
+	for {
+		select {
+		case <-done:
+			c.writeFrame(opClose, closeCode{1000, ""}.payload())
+			return
+		case <-closed:
+			stats.dropped.Add(1)
+			return
+		case <-tick:
+			binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+			if err := c.writeFrame(opBinary, payload); err != nil {
+				stats.dropped.Add(1)
+				return
+			}
+			stats.sent.Add(1)
+			stats.bytes.Add(int64(len(payload)))
+		}
+	}
+}
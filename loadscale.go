@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// With SESSIONS_PER_REPLICA set, a running deployment is also sized by its
+// open sessions, like a small HPA driven by WebSocket traffic: as soon as
+// there are more than that many per replica it is scaled up to fit them,
+// and once fewer would do it gives back one replica every
+// LOAD_SCALE_DOWN_MINUTES. Scaling from zero is still left to the first
+// request and scaling to MIN_REPLICAS (or the schedule's floor) to the
+// inactivity watcher. MAX_REPLICAS caps every scale-up, whatever its cause.
+var (
+	minReplicas          = getEnvAsInt("MIN_REPLICAS", 0)
+	maxReplicas          = getEnvAsInt("MAX_REPLICAS", 0) // 0 for no limit
+	sessionsPerReplica   = getEnvAsInt("SESSIONS_PER_REPLICA", 0)
+	loadCheckSeconds     = getEnvAsInt("LOAD_CHECK_SECONDS", 15)
+	loadScaleDownMinutes = getEnvAsInt("LOAD_SCALE_DOWN_MINUTES", 5)
+)
+
+func setupReplicaBounds() error {
+	if minReplicas < 0 || maxReplicas < 0 || sessionsPerReplica < 0 {
+		return fmt.Errorf("MIN_REPLICAS, MAX_REPLICAS and SESSIONS_PER_REPLICA must not be negative")
+	}
+	if maxReplicas > 0 && maxReplicas < minReplicas {
+		return fmt.Errorf("MAX_REPLICAS (%d) is below MIN_REPLICAS (%d)", maxReplicas, minReplicas)
+	}
+	if sessionsPerReplica > 0 && loadCheckSeconds <= 0 {
+		return fmt.Errorf("LOAD_CHECK_SECONDS must be positive")
+	}
+	return nil
+}
+
+// boundReplicas keeps n within MIN_REPLICAS and MAX_REPLICAS.
+func boundReplicas(n int) int {
+	if maxReplicas > 0 && n > maxReplicas {
+		n = maxReplicas
+	}
+	return max(n, minReplicas)
+}
+
+// specReplicas returns the replicas t's deployment asks for.
+func specReplicas(t *scaleTarget) (int, error) {
+	var dep struct {
+		Spec struct {
+			Replicas int `json:"replicas"`
+		} `json:"spec"`
+	}
+	if err := getKube(t, fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", t.namespace, t.deployment), &dep); err != nil {
+		return 0, err
+	}
+	return dep.Spec.Replicas, nil
+}
+
+// wakeReplicas is what a request finding t's backend down scales it to: one
+// replica, or as many as it had, so that a failed health check does not
+// take capacity away.
+func (t *scaleTarget) wakeReplicas() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return max(t.lastScaledReplicas, 1)
+}
+
+// loadWatcher sizes running deployments by their open sessions.
+func loadWatcher() {
+	if sessionsPerReplica <= 0 {
+		return
+	}
+	tick := clk.NewTicker(time.Duration(loadCheckSeconds) * time.Second)
+	defer tick.Stop()
+	for range tick.C() {
+		if !isActive() {
+			continue
+		}
+		for t, floor := range scheduleFloors(clk.Now()) {
+			if !t.decided() && !t.overridden() {
+				t.scaleForLoad(floor)
+			}
+		}
+	}
+}
+
+// scaleForLoad scales t up to fit its sessions, or one replica down if it
+// has had more than it needed for LOAD_SCALE_DOWN_MINUTES.
+func (t *scaleTarget) scaleForLoad(floor int) {
+	open := ha.peerSessions(t)
+	t.mu.Lock()
+	open += t.open
+	replicas := t.lastScaledReplicas
+	t.mu.Unlock()
+	if replicas < 0 {
+		// Not scaled since the proxy started: ask the API.
+		n, err := specReplicas(t)
+		if err != nil {
+			slog.Warn("Could not read the deployment's replicas", "deployment", t.String(), "error", err)
+			return
+		}
+		t.mu.Lock()
+		if t.lastScaledReplicas < 0 {
+			t.lastScaledReplicas = n
+		}
+		replicas = t.lastScaledReplicas
+		t.mu.Unlock()
+	}
+	if replicas <= 0 {
+		return
+	}
+	want := boundReplicas(max((open+sessionsPerReplica-1)/sessionsPerReplica, floor, 1))
+	switch {
+	case want > replicas:
+		if t.cooldown(want) > 0 {
+			return
+		}
+		lg := slog.With("deployment", t.String(), "replicas", want, "cause", "load")
+		lg.Info("Scaling up to fit open sessions", "sessions", open)
+		if err := scaleDeployment(t, want, "load"); err != nil {
+			lg.Error("Failed to scale backend up", "error", err)
+			return
+		}
+		t.mu.Lock()
+		t.overSince = time.Time{}
+		t.mu.Unlock()
+	case want < replicas:
+		t.mu.Lock()
+		if t.overSince.IsZero() {
+			t.overSince = clk.Now()
+		}
+		due := clk.Since(t.overSince) >= time.Duration(loadScaleDownMinutes)*time.Minute
+		t.mu.Unlock()
+		if !due || t.cooldown(replicas-1) > 0 {
+			return
+		}
+		lg := slog.With("deployment", t.String(), "replicas", replicas-1, "cause", "load")
+		lg.Info("Fewer sessions open, stepping down", "sessions", open)
+		if err := scaleDeployment(t, replicas-1, "load"); err != nil {
+			lg.Error("Error scaling down deployment", "error", err)
+			return
+		}
+		t.mu.Lock()
+		// The next step waits a full period again.
+		t.overSince = clk.Now()
+		t.mu.Unlock()
+	default:
+		t.mu.Lock()
+		t.overSince = time.Time{}
+		t.mu.Unlock()
+	}
+}
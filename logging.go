@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Logs go through log/slog, as text or as one JSON object per line
+// (LOG_FORMAT) for Loki or ELK, with records below LOG_LEVEL dropped. The
+// request path and scale events log with fields (request_id, client, route,
+// deployment, replicas, cause) and every message has an explicit level.
+var (
+	logLevel  = getEnv("LOG_LEVEL", "info")  // debug, info, warn or error
+	logFormat = getEnv("LOG_FORMAT", "text") // text or json
+
+	// requestIDHeader carries the ID given to each request to the backend,
+	// and is taken from the client if it may set it.
+	requestIDHeader = "X-Request-Id"
+)
+
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	// log.Writer is the event log when running as a Windows service.
+	out := log.Writer()
+	var h slog.Handler
+	switch logFormat {
+	case "text":
+		h = slog.NewTextHandler(out, opts)
+	case "json":
+		h = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("LOG_FORMAT must be text or json, not %q", logFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs err as what stopped the proxy and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// requestID returns the ID of r: the one the client sent if it may set
+// headers the proxy trusts, or else a new one. Either way it is passed on
+// to the backend.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 128 || strings.ContainsFunc(id, func(c rune) bool { return c < 0x21 || c > 0x7e }) ||
+		(len(trustedProxies) > 0 && !fromTrustedProxy(r)) {
+		var b [8]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+		r.Header.Set(requestIDHeader, id)
+	}
+	return id
+}
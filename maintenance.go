@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	maintenance = &maintenanceList{m: make(map[string]*maintenanceEntry)}
+
+	errMaintenance = errors.New("in maintenance")
+)
+
+// maintenanceList holds the routes put into maintenance through the admin
+// API, by name so that it survives config reloads. A route in maintenance
+// turns new clients away and its deployment is not scaled up
+// automatically; open sessions are left alone.
+type maintenanceList struct {
+	mu sync.Mutex
+	m  map[string]*maintenanceEntry
+}
+
+type maintenanceEntry struct {
+	Route      string    `json:"route"`
+	Since      time.Time `json:"since"`
+	RetryAfter int       `json:"retry_after_seconds"`
+	Page       string    `json:"page,omitempty"` // HTML served instead of the plain 503
+}
+
+func (l *maintenanceList) get(name string) *maintenanceEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.m[name]
+}
+
+// blocksScaleUp reports whether a route of t is in maintenance.
+func (l *maintenanceList) blocksScaleUp(t *scaleTarget) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.m) == 0 {
+		return false
+	}
+	for _, rt := range routing.Load().routes {
+		if rt.scale == t && l.m[rt.Name] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *maintenanceList) list() []maintenanceEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := []maintenanceEntry{}
+	for _, e := range l.m {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Route < list[j].Route })
+	return list
+}
+
+// serveMaintenance answers a new client of a route in maintenance with
+// 503 and Retry-After, and reports whether it did.
+func serveMaintenance(w http.ResponseWriter, r *http.Request, rt *route) bool {
+	e := maintenance.get(rt.Name)
+	if e == nil {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	if e.Page == "" {
+		http.Error(w, "Service is down for maintenance", http.StatusServiceUnavailable)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprint(w, e.Page)
+	return true
+}
+
+// handleMaintenance is the admin API for maintenance mode: GET lists the
+// routes in maintenance, POST {"route": "...", "retry_after_seconds": N,
+// "page": "..."} puts one into it and DELETE ?route=... ends it.
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(maintenance.list())
+	case http.MethodPost:
+		var req maintenanceEntry
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if routing.Load().byName(req.Route) == nil {
+			http.Error(w, "unknown route", http.StatusBadRequest)
+			return
+		}
+		if req.RetryAfter <= 0 {
+			req.RetryAfter = 300
+		}
+		req.Since = time.Now()
+		maintenance.mu.Lock()
+		maintenance.m[req.Route] = &req
+		maintenance.mu.Unlock()
+		audit(adminUser(r.Context()), "maintenance_on", req.Route, map[string]interface{}{"retry_after_seconds": req.RetryAfter}, nil)
+		slog.Info("Route is in maintenance", "admin", adminUser(r.Context()), "route", req.Route, "retry_after_seconds", req.RetryAfter)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("route")
+		maintenance.mu.Lock()
+		_, ok := maintenance.m[name]
+		delete(maintenance.m, name)
+		maintenance.mu.Unlock()
+		if !ok {
+			http.Error(w, "not in maintenance", http.StatusNotFound)
+			return
+		}
+		audit(adminUser(r.Context()), "maintenance_off", name, nil, nil)
+		slog.Info("Route is out of maintenance", "admin", adminUser(r.Context()), "route", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+// manifestEnv lists the settings carried over into the generated ConfigMap.
+var manifestEnv = []string{
+	"SECRET_PATH", "BACKEND_URL", "BACKEND_PATH", "NAMESPACE", "DEPLOYMENT_NAME",
+	"INACTIVITY_MINUTES", "REPLICA_UPDATE_INTERVAL_HOURS", "BACKEND_HEALTH_CHECK_INTERVAL",
+	"HEALTH_CHECK_PROTOCOL", "PROXY_MODE", "DECOY_MODE", "DECOY_URL", "TRUSTED_PROXIES",
+	"ADMIN_ADDR", "ROUTE_CRD_NAMESPACE", "KUBE_TOKEN_SECRET", "SHUTDOWN_BACKEND",
+	"STOP_DRAIN_SECONDS",
+}
+
+type manifestParams struct {
+	Name       string
+	Namespace  string
+	Image      string
+	Port       int
+	AdminPort  int
+	Target     string // namespace of the scaled deployment
+	Deployment string
+	Env        map[string]string
+	EnvKeys    []string
+	Config     string // contents of CONFIG_FILE, if any
+	CRD        bool   // also install the AutoScaleRoute CRD
+	CRDScope   string // namespace watched for AutoScaleRoutes, "*" for all
+	ReadyLog   bool   // some route waits for a log line, so pods are read
+	// GracePeriod is how long Kubernetes waits after SIGTERM before killing
+	// the pod: the drain, with time to close what is left.
+	GracePeriod int
+	// Secret read for KUBE_TOKEN_SECRET, if any
+	TokenSecretNamespace, TokenSecretName string
+
+	Group, Version, Plural string
+}
+
+// runManifests implements the "manifests" subcommand: it prints everything
+// needed to run the proxy in-cluster, with RBAC limited to scaling the one
+// target deployment. With -crd, routes come from AutoScaleRoute objects and
+// may name any deployment, so scaling is granted on the watched namespace
+// (or cluster-wide) instead.
+func runManifests(args []string) int {
+	fs := flag.NewFlagSet("manifests", flag.ExitOnError)
+	p := manifestParams{
+		Target:     kubeNamespace,
+		Deployment: deploymentName,
+		Env:        map[string]string{},
+		Group:      routeCRDGroup,
+		Version:    routeCRDVersion,
+		Plural:     routeCRDPlural,
+	}
+	fs.StringVar(&p.Name, "name", "auto-scale-ws-proxy", "name of the proxy's resources")
+	fs.StringVar(&p.Namespace, "namespace", kubeNamespace, "namespace the proxy runs in")
+	fs.StringVar(&p.Image, "image", "ghcr.io/aalaei/auto-scale-ws-proxy:main", "proxy container image")
+	fs.BoolVar(&p.CRD, "crd", routeCRDNamespace != "", "install the AutoScaleRoute CRD and take routes from it")
+	fs.Parse(args)
+
+	p.Port = portOf(listenAddr, 8080)
+	p.AdminPort = portOf(adminAddr, 0)
+	p.GracePeriod = stopDrainSeconds + 10
+	for _, key := range manifestEnv {
+		if v := os.Getenv(key); v != "" {
+			p.Env[key] = v
+		}
+	}
+	p.Env["LISTEN_ADDR"] = fmt.Sprintf(":%d", p.Port)
+	p.Env["NAMESPACE"] = p.Target
+	p.Env["DEPLOYMENT_NAME"] = p.Deployment
+	if p.CRD {
+		p.CRDScope = routeCRDNamespace
+		if p.CRDScope == "" {
+			p.CRDScope = p.Namespace
+		}
+		p.Env["ROUTE_CRD_NAMESPACE"] = p.CRDScope
+	}
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			slog.Error("Failed to read CONFIG_FILE", "file", configFile, "error", err)
+			return 1
+		}
+		p.Config = string(data)
+		if cfg, err := parseConfig(data); err == nil {
+			for _, rt := range cfg.Routes {
+				p.ReadyLog = p.ReadyLog || rt.ReadyLog != nil
+			}
+		}
+		p.Env["CONFIG_FILE"] = "/etc/auto-scale-ws-proxy/config.json"
+	}
+	if kubeTokenSecret != "" {
+		ref, err := parseSecretRef(kubeTokenSecret)
+		if err != nil {
+			slog.Error("Invalid KUBE_TOKEN_SECRET", "error", err)
+			return 1
+		}
+		p.TokenSecretNamespace, p.TokenSecretName = ref.namespace, ref.name
+	}
+	for key := range p.Env {
+		p.EnvKeys = append(p.EnvKeys, key)
+	}
+	sort.Strings(p.EnvKeys)
+
+	if err := manifestTemplate.Execute(os.Stdout, p); err != nil {
+		slog.Error("Failed to write the manifests", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func portOf(addr string, fallback int) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fallback
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// yamlQuote renders s as a double-quoted scalar; JSON strings are valid YAML.
+func yamlQuote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+var manifestTemplate = template.Must(template.New("manifests").Funcs(template.FuncMap{"q": yamlQuote}).Parse(`
+{{- if .CRD -}}
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: {{.Plural}}.{{.Group}}
+spec:
+  group: {{.Group}}
+  scope: Namespaced
+  names:
+    kind: AutoScaleRoute
+    listKind: AutoScaleRouteList
+    plural: {{.Plural}}
+    singular: autoscaleroute
+    shortNames: ["asr"]
+  versions:
+    - name: {{.Version}}
+      served: true
+      storage: true
+      additionalPrinterColumns:
+        - name: Path
+          type: string
+          jsonPath: .spec.path
+        - name: Backend
+          type: string
+          jsonPath: .spec.backend.url
+        - name: Deployment
+          type: string
+          jsonPath: .spec.target.deployment
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: ["path", "backend", "target"]
+              properties:
+                path:
+                  type: string
+                  pattern: "^/"
+                kind:
+                  type: string
+                  enum: ["websocket", "http"]
+                subprotocols:
+                  type: array
+                  items:
+                    type: string
+                backend:
+                  type: object
+                  required: ["url"]
+                  properties:
+                    url:
+                      type: string
+                    path:
+                      type: string
+                    protocol:
+                      type: string
+                target:
+                  type: object
+                  required: ["deployment"]
+                  properties:
+                    namespace:
+                      type: string
+                    deployment:
+                      type: string
+                idle:
+                  type: object
+                  properties:
+                    inactivityMinutes:
+                      type: integer
+                      minimum: 1
+---
+{{end -}}
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{.Name}}-scaler
+  namespace: {{.Target}}
+rules:
+  - apiGroups: ["apps"]
+    resources: ["deployments"]
+    resourceNames: [{{q .Deployment}}]
+    verbs: ["get", "patch"]
+  - apiGroups: ["apps"]
+    resources: ["deployments/scale"]
+    resourceNames: [{{q .Deployment}}]
+    verbs: ["get", "update", "patch"]
+{{- if .ReadyLog}}
+  - apiGroups: [""]
+    resources: ["pods", "pods/log"]
+    verbs: ["get", "list"]
+{{- end}}
+---
+{{- if .CRD}}
+apiVersion: rbac.authorization.k8s.io/v1
+kind: {{if eq .CRDScope "*"}}ClusterRole{{else}}Role{{end}}
+metadata:
+  name: {{.Name}}-routes
+{{- if ne .CRDScope "*"}}
+  namespace: {{.CRDScope}}
+{{- end}}
+rules:
+  - apiGroups: [{{q .Group}}]
+    resources: [{{q .Plural}}]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: ["apps"]
+    resources: ["deployments", "deployments/scale"]
+    verbs: ["get", "update", "patch"]
+{{- if .ReadyLog}}
+  - apiGroups: [""]
+    resources: ["pods", "pods/log"]
+    verbs: ["get", "list"]
+{{- end}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: {{if eq .CRDScope "*"}}ClusterRoleBinding{{else}}RoleBinding{{end}}
+metadata:
+  name: {{.Name}}-routes
+{{- if ne .CRDScope "*"}}
+  namespace: {{.CRDScope}}
+{{- end}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: {{if eq .CRDScope "*"}}ClusterRole{{else}}Role{{end}}
+  name: {{.Name}}-routes
+subjects:
+  - kind: ServiceAccount
+    name: {{.Name}}
+    namespace: {{.Namespace}}
+---
+{{- end}}
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{.Name}}-scaler
+  namespace: {{.Target}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{.Name}}-scaler
+subjects:
+  - kind: ServiceAccount
+    name: {{.Name}}
+    namespace: {{.Namespace}}
+---
+{{- if .TokenSecretName}}
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{.Name}}-token-reader
+  namespace: {{.TokenSecretNamespace}}
+rules:
+  - apiGroups: [""]
+    resources: ["secrets"]
+    resourceNames: [{{q .TokenSecretName}}]
+    verbs: ["get", "list", "watch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{.Name}}-token-reader
+  namespace: {{.TokenSecretNamespace}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{.Name}}-token-reader
+subjects:
+  - kind: ServiceAccount
+    name: {{.Name}}
+    namespace: {{.Namespace}}
+---
+{{- end}}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+data:
+{{- range .EnvKeys}}
+  {{.}}: {{q (index $.Env .)}}
+{{- end}}
+{{- if .Config}}
+  config.json: {{q .Config}}
+{{- end}}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.Name}}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: {{.Name}}
+  template:
+    metadata:
+      labels:
+        app: {{.Name}}
+    spec:
+      serviceAccountName: {{.Name}}
+      terminationGracePeriodSeconds: {{.GracePeriod}}
+      containers:
+        - name: proxy
+          image: {{.Image}}
+          ports:
+            - name: http
+              containerPort: {{.Port}}
+{{- if .AdminPort}}
+            - name: admin
+              containerPort: {{.AdminPort}}
+{{- end}}
+          envFrom:
+            - configMapRef:
+                name: {{.Name}}
+          env:
+            - name: KUBE_CLUSTER_ENDPOINT
+              value: "https://kubernetes.default.svc"
+{{- if .AdminPort}}
+          livenessProbe:
+            httpGet:
+              path: /healthz
+              port: admin
+          readinessProbe:
+            httpGet:
+              path: /readyz
+              port: admin
+            periodSeconds: 5
+{{- end}}
+{{- if .Config}}
+          volumeMounts:
+            - name: config
+              mountPath: /etc/auto-scale-ws-proxy
+              readOnly: true
+      volumes:
+        - name: config
+          configMap:
+            name: {{.Name}}
+            items:
+              - key: config.json
+                path: config.json
+{{- end}}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+spec:
+  selector:
+    app: {{.Name}}
+  ports:
+    - name: http
+      port: {{.Port}}
+      targetPort: http
+`))
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal Prometheus-compatible metrics registry; the proxy only needs
+// labelled counters, gauges and histograms rendered in the text format.
+
+type metricKind string
+
+const (
+	counterKind   metricKind = "counter"
+	gaugeKind     metricKind = "gauge"
+	histogramKind metricKind = "histogram"
+)
+
+var (
+	sizeBuckets     = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+	durationBuckets = []float64{1, 10, 60, 300, 900, 3600, 14400, 86400}
+	coldBuckets     = []float64{1, 2, 5, 10, 20, 30, 60, 120, 300}
+	apiBuckets      = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+	metricsMu sync.Mutex
+	allMetric []*metric
+
+	framesTotal = newCounter("wsproxy_frames_total",
+		"WebSocket frames relayed in frame mode.", "route", "direction", "type")
+	messageSize = newHistogram("wsproxy_message_size_bytes",
+		"Size of complete WebSocket data messages relayed in frame mode.", sizeBuckets, "route", "direction", "type")
+	sessionDuration = newHistogram("wsproxy_session_duration_seconds",
+		"Lifetime of upgraded sessions.", durationBuckets, "route")
+	coldStart = newHistogram("wsproxy_cold_start_seconds",
+		"Time from the first request finding the backend down to it passing a health check.", coldBuckets, "route")
+	scaleOps = newCounter("wsproxy_scale_operations_total",
+		"Scale calls made to the Kubernetes API.", "target", "cause", "direction", "result")
+	scaleAPISeconds = newHistogram("wsproxy_scale_api_seconds",
+		"Latency of scale calls to the Kubernetes API.", apiBuckets, "target", "cause", "result")
+	scaleReadySeconds = newHistogram("wsproxy_scale_ready_seconds",
+		"Time from a scale-up call to the backend first passing a health check.", coldBuckets, "target", "cause")
+	_ = newGaugeFunc("wsproxy_active_sessions",
+		"Upgraded sessions currently open.", func() float64 { return float64(sessions.count()) })
+)
+
+type metric struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+	fn      func() float64 // for gauges computed on scrape
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64 // per bucket, histograms only
+	count       uint64
+	sum         float64
+}
+
+func register(m *metric) *metric {
+	m.series = make(map[string]*series)
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	allMetric = append(allMetric, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return register(&metric{name: name, help: help, kind: counterKind, labels: labels})
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return register(&metric{name: name, help: help, kind: gaugeKind, labels: labels})
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *metric {
+	return register(&metric{name: name, help: help, kind: gaugeKind, fn: fn})
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return register(&metric{name: name, help: help, kind: histogramKind, labels: labels, buckets: buckets})
+}
+
+// get returns the series for labelValues, creating it. m.mu must be held.
+func (m *metric) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == histogramKind {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	list := append([]*metric(nil), allMetric...)
+	metricsMu.Unlock()
+
+	for _, m := range list {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		if m.fn != nil {
+			fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.fn()))
+			continue
+		}
+		m.mu.Lock()
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := m.series[k]
+			labels := formatLabels(m.labels, s.labelValues)
+			if m.kind != histogramKind {
+				fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatFloat(s.value))
+				continue
+			}
+			names := append(append([]string(nil), m.labels...), "le")
+			values := append(append([]string(nil), s.labelValues...), "")
+			for i, b := range m.buckets {
+				values[len(values)-1] = formatFloat(b)
+				fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.counts[i])
+			}
+			values[len(values)-1] = "+Inf"
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// metricSample is one series at a point in time, for exporters that push
+// metrics instead of being scraped.
+type metricSample struct {
+	name   string
+	kind   metricKind
+	labels []string
+	values []string
+	value  float64 // counters and gauges
+	count  uint64  // histograms
+	sum    float64 // histograms
+}
+
+// key identifies the series across snapshots.
+func (s metricSample) key() string {
+	return s.name + "\xff" + strings.Join(s.values, "\xff")
+}
+
+func snapshotMetrics() []metricSample {
+	metricsMu.Lock()
+	list := append([]*metric(nil), allMetric...)
+	metricsMu.Unlock()
+
+	var samples []metricSample
+	for _, m := range list {
+		if m.fn != nil {
+			samples = append(samples, metricSample{name: m.name, kind: m.kind, value: m.fn()})
+			continue
+		}
+		m.mu.Lock()
+		for _, s := range m.series {
+			samples = append(samples, metricSample{
+				name: m.name, kind: m.kind, labels: m.labels, values: s.labelValues,
+				value: s.value, count: s.count, sum: s.sum,
+			})
+		}
+		m.mu.Unlock()
+	}
+	return samples
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
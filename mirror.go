@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorPolicy copies the client side of a route's sessions to a shadow
+// backend, e.g. a new version being load-tested with real traffic. What
+// the shadow answers is discarded, and it is never scaled by the proxy.
+type mirrorPolicy struct {
+	BackendURL  string `json:"backend_url"`
+	BackendPath string `json:"backend_path,omitempty"` // the route's by default
+	Percent     int    `json:"percent,omitempty"`      // of sessions mirrored, 100 by default
+}
+
+func (p *mirrorPolicy) validate() error {
+	u, err := url.Parse(p.BackendURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("mirror: invalid backend URL %q", p.BackendURL)
+	}
+	switch u.Scheme {
+	case "http", "https", "ws", "wss":
+	default:
+		return fmt.Errorf("mirror: unsupported scheme %q", u.Scheme)
+	}
+	if p.Percent == 0 {
+		p.Percent = 100
+	}
+	if p.Percent < 0 || p.Percent > 100 {
+		return fmt.Errorf("mirror: percent must be between 1 and 100")
+	}
+	return nil
+}
+
+// mirrorConn relays one session's client bytes to the shadow backend. The
+// client's frames are passed on as they are, already masked, so the
+// shadow must agree to the extensions the real backend chose; if it does
+// not, or cannot keep up, mirroring stops for the session rather than
+// slowing the client down.
+type mirrorConn struct {
+	s    *session
+	ch   chan []byte
+	mu   sync.Mutex
+	done bool
+}
+
+// startMirror begins mirroring s if its route asks for it. resp is the real
+// backend's 101 response.
+func startMirror(s *session, resp *http.Response) *mirrorConn {
+	p := s.rt.Mirror
+	if p == nil || rand.Intn(100) >= p.Percent {
+		return nil
+	}
+	m := &mirrorConn{s: s, ch: make(chan []byte, 256)}
+	go m.run(p, resp.Header)
+	return m
+}
+
+func (m *mirrorConn) run(p *mirrorPolicy, negotiated http.Header) {
+	defer m.stop()
+	path := p.BackendPath
+	if path == "" {
+		path = m.s.rt.BackendPath
+	}
+	u := strings.TrimSuffix(p.BackendURL, "/") + path
+	h := http.Header{}
+	for _, name := range []string{"Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions"} {
+		if v := negotiated.Get(name); v != "" {
+			h.Set(name, v)
+		}
+	}
+	c, resp, err := dialWS(u, h, 10*time.Second)
+	if err != nil {
+		m.s.logger().Warn("Mirror failed", "mirror", p.BackendURL, "error", err)
+		return
+	}
+	defer c.conn.Close()
+	if got, want := resp.Header.Get("Sec-WebSocket-Extensions"), negotiated.Get("Sec-WebSocket-Extensions"); got != want {
+		m.s.logger().Warn("Mirror negotiated other extensions, not mirroring", "mirror", p.BackendURL, "extensions", got, "want", want)
+		return
+	}
+	go io.Copy(io.Discard, c.br)
+	for b := range m.ch {
+		if _, err := c.conn.Write(b); err != nil {
+			m.s.logger().Warn("Mirror failed", "mirror", p.BackendURL, "error", err)
+			return
+		}
+	}
+}
+
+// feed queues a copy of bytes the client sent.
+func (m *mirrorConn) feed(b []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done {
+		return
+	}
+	select {
+	case m.ch <- append([]byte(nil), b...):
+	default:
+		// Skipping bytes would leave the shadow mid-frame, so give up.
+		m.done = true
+		close(m.ch)
+		m.s.logger().Warn("Mirror is falling behind, stopped mirroring")
+	}
+}
+
+// stop ends mirroring once the session is over or the mirror failed.
+func (m *mirrorConn) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.done {
+		m.done = true
+		close(m.ch)
+	}
+}
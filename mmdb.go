@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// A minimal reader for MaxMind DB files (GeoLite2, DB-IP and similar); see
+// https://maxmind.github.io/MaxMind-DB/. Only lookups are supported.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+type mmdbReader struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node reached by the 96 zero bits of ::/96
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMMDB(buf)
+}
+
+func parseMMDB(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta := buf[i+len(mmdbMetadataMarker):]
+	v, _, err := (&mmdbReader{data: meta}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	m, _ := v.(map[string]interface{})
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  uint(mmdbUint(m["node_count"])),
+		recordSize: uint(mmdbUint(m["record_size"])),
+		ipVersion:  uint(mmdbUint(m["ip_version"])),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.nodeCount > uint(i)/(r.recordSize/4) {
+		return nil, errors.New("invalid search tree size")
+	}
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("invalid search tree size")
+	}
+	r.data = buf[treeSize+16 : i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < r.nodeCount; j++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b := r.buf[node*8+bit*4:]
+		return uint(binary.BigEndian.Uint32(b))
+	}
+}
+
+// lookup returns the record for addr, or nil if it is not in the database.
+func (r *mmdbReader) lookup(addr netip.Addr) (interface{}, error) {
+	addr = addr.Unmap()
+	var ip []byte
+	node := uint(0)
+	switch {
+	case addr.Is4():
+		b := addr.As4()
+		ip = b[:]
+		node = r.ipv4Start
+	case r.ipVersion == 6:
+		b := addr.As16()
+		ip = b[:]
+	default:
+		return nil, nil
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("invalid search tree")
+	}
+	v, _, err := r.decode(node - r.nodeCount - 16)
+	return v, err
+}
+
+var errMMDBData = errors.New("invalid data section")
+
+// A corrupt file could otherwise nest maps and arrays without end, or
+// point at the same values over and over to decode exponentially many.
+const (
+	mmdbMaxDepth  = 512
+	mmdbMaxValues = 1 << 16 // per lookup
+)
+
+// decode decodes the value at offset in the data section and returns it
+// with the offset following it.
+func (r *mmdbReader) decode(offset uint) (interface{}, uint, error) {
+	budget := mmdbMaxValues
+	return r.decodeAt(offset, 0, &budget)
+}
+
+func (r *mmdbReader) decodeAt(offset uint, depth int, budget *int) (interface{}, uint, error) {
+	*budget--
+	if depth > mmdbMaxDepth || *budget < 0 {
+		return nil, 0, errMMDBData
+	}
+	if offset >= uint(len(r.data)) {
+		return nil, 0, errMMDBData
+	}
+	ctrl := r.data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 { // pointer
+		ss := uint(ctrl>>3) & 3
+		n := ss + 1
+		if offset+n > uint(len(r.data)) {
+			return nil, 0, errMMDBData
+		}
+		p := uint(0)
+		if ss < 3 {
+			p = uint(ctrl & 7)
+		}
+		for _, b := range r.data[offset : offset+n] {
+			p = p<<8 | uint(b)
+		}
+		p += [4]uint{0, 2048, 526336, 0}[ss]
+		// Pointers may not point at pointers.
+		if p < uint(len(r.data)) && r.data[p]>>5 == 1 {
+			return nil, 0, errMMDBData
+		}
+		v, _, err := r.decodeAt(p, depth, budget)
+		return v, offset + n, err
+	}
+	if typ == 0 {
+		if offset >= uint(len(r.data)) {
+			return nil, 0, errMMDBData
+		}
+		typ = 7 + uint(r.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(r.data)) {
+			return nil, 0, errMMDBData
+		}
+		v := uint(0)
+		for _, b := range r.data[offset : offset+n] {
+			v = v<<8 | uint(b)
+		}
+		size = [4]uint{0, 29, 285, 65821}[n] + v
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		// Each entry takes at least two bytes.
+		m := make(map[string]interface{}, min(size, (uint(len(r.data))-offset)/2))
+		for i := uint(0); i < size; i++ {
+			k, next, err := r.decodeAt(offset, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := r.decodeAt(next, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, min(size, uint(len(r.data))-offset))
+		for i := uint(0); i < size; i++ {
+			v, next, err := r.decodeAt(offset, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean, stored in the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(r.data)) {
+		return nil, 0, errMMDBData
+	}
+	b := r.data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), offset, nil
+	case 5, 6, 9, 10: // unsigned integers; uint128 keeps the low 64 bits
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBData
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+func mmdbUint(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+var (
+	// notifyWebhookURL receives a JSON POST for every notification, e.g. a
+	// Slack/Mattermost-compatible incoming webhook or an alerting relay.
+	notifyWebhookURL = getEnv("NOTIFY_WEBHOOK_URL", "")
+
+	// Notifications are also sent as Telegram messages when both are set.
+	telegramBotToken = newSecret("TELEGRAM_BOT_TOKEN")
+	telegramChatID   = getEnv("TELEGRAM_CHAT_ID", "")
+)
+
+type notification struct {
+	Time    time.Time              `json:"time"`
+	Event   string                 `json:"event"`
+	Text    string                 `json:"text"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// notify logs a notable event and delivers it to the configured notifiers
+// in the background.
+func notify(event, text string, details map[string]interface{}) {
+	slog.Info("Notification", "event", event, "text", text)
+	n := notification{Time: time.Now().UTC(), Event: event, Text: text, Details: details}
+	if notifyWebhookURL != "" {
+		go postWebhook(n)
+	}
+	if telegramChatID != "" && telegramBotToken.get() != "" {
+		go sendTelegram(n)
+	}
+}
+
+func postWebhook(n notification) {
+	body, _ := json.Marshal(n)
+	resp, err := httpClient.Post(notifyWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Failed to deliver webhook notification", "event", n.Event, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Error("Webhook notification rejected", "event", n.Event, "status", resp.StatusCode)
+	}
+}
+
+func sendTelegram(n notification) {
+	form := url.Values{"chat_id": {telegramChatID}, "text": {n.Text}}
+	resp, err := httpClient.PostForm("https://api.telegram.org/bot"+telegramBotToken.get()+"/sendMessage", form)
+	if err != nil {
+		// The error includes the URL, and with it the bot token.
+		slog.Error("Failed to deliver Telegram notification", "event", n.Event)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Error("Telegram notification rejected", "event", n.Event, "status", resp.StatusCode)
+	}
+}
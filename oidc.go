@@ -0,0 +1,464 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	oidcIssuer       = getEnv("OIDC_ISSUER", "")
+	oidcClientID     = getEnv("OIDC_CLIENT_ID", "")
+	oidcClientSecret = newSecret("OIDC_CLIENT_SECRET")
+	// oidcRedirectURL is the admin listener's callback as registered with
+	// the provider, e.g. https://proxy-admin.example.com/oidc/callback.
+	oidcRedirectURL = getEnv("OIDC_REDIRECT_URL", "")
+	// oidcAllowedUsers restricts logins to these emails, "@domain" suffixes
+	// or subjects; empty allows anyone the provider authenticates.
+	oidcAllowedUsers = getEnv("OIDC_ALLOWED_USERS", "")
+	oidcCookieSecret = getEnv("OIDC_COOKIE_SECRET", "")
+
+	oidc *oidcProvider
+)
+
+const (
+	oidcSessionCookie = "admin_session"
+	oidcLoginCookie   = "admin_login"
+	oidcSessionTTL    = 8 * time.Hour
+	oidcLoginTTL      = 10 * time.Minute
+)
+
+// oidcProvider protects the admin listener with an OpenID Connect
+// authorization-code login for browsers, and accepts the provider's ID
+// tokens as bearer tokens for API clients.
+type oidcProvider struct {
+	issuer   string
+	authURL  string
+	tokenURL string
+	jwksURL  string
+	callback *url.URL
+	allowed  []string
+	secure   bool
+	key      []byte // signs the session and login cookies
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+type oidcClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	NotBefore     int64    `json:"nbf"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+}
+
+// audience is the "aud" claim, which may be a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func setupOIDC() error {
+	if oidcIssuer == "" {
+		return nil
+	}
+	if oidcClientID == "" || oidcRedirectURL == "" {
+		return fmt.Errorf("OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+	}
+	callback, err := url.Parse(oidcRedirectURL)
+	if err != nil || callback.Path == "" {
+		return fmt.Errorf("invalid OIDC_REDIRECT_URL %q", oidcRedirectURL)
+	}
+
+	resp, err := httpClient.Get(strings.TrimSuffix(oidcIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC discovery returned %s", resp.Status)
+	}
+	var doc struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	// The document must be the issuer's own (OpenID Connect Discovery
+	// §4.3), or tokens signed by another issuer would be accepted.
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(oidcIssuer, "/") {
+		return fmt.Errorf("OIDC discovery: issuer %q does not match OIDC_ISSUER %q", doc.Issuer, oidcIssuer)
+	}
+
+	p := &oidcProvider{
+		issuer:   doc.Issuer,
+		authURL:  doc.AuthURL,
+		tokenURL: doc.TokenURL,
+		jwksURL:  doc.JWKSURL,
+		callback: callback,
+		secure:   callback.Scheme == "https",
+		key:      []byte(oidcCookieSecret),
+	}
+	for _, u := range strings.Split(oidcAllowedUsers, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			p.allowed = append(p.allowed, strings.ToLower(u))
+		}
+	}
+	if len(p.key) == 0 {
+		// Sessions then end when the proxy restarts.
+		p.key = make([]byte, 32)
+		rand.Read(p.key)
+	}
+	oidc = p
+	slog.Info("Admin endpoints protected by OIDC", "issuer", p.issuer)
+	return nil
+}
+
+// startLogin redirects a browser to the provider, remembering state, nonce
+// and the PKCE verifier in a signed cookie.
+func (p *oidcProvider) startLogin(w http.ResponseWriter, r *http.Request) {
+	login := map[string]string{
+		"state":    randomToken(),
+		"nonce":    randomToken(),
+		"verifier": randomToken(),
+		"return":   r.URL.RequestURI(),
+	}
+	p.setCookie(w, oidcLoginCookie, login, oidcLoginTTL)
+
+	challenge := sha256.Sum256([]byte(login["verifier"]))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcClientID},
+		"redirect_uri":          {oidcRedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {login["state"]},
+		"nonce":                 {login["nonce"]},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.authURL+sep+q.Encode(), http.StatusFound)
+}
+
+// handleCallback completes the login started by startLogin.
+func (p *oidcProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var login map[string]string
+	if !p.readCookie(r, oidcLoginCookie, &login) || r.URL.Query().Get("state") != login["state"] {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusForbidden)
+		return
+	}
+
+	resp, err := httpClient.PostForm(p.tokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {oidcRedirectURL},
+		"client_id":     {oidcClientID},
+		"client_secret": {oidcClientSecret.get()},
+		"code_verifier": {login["verifier"]},
+	})
+	if err != nil {
+		slog.Error("OIDC token exchange failed", "error", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		slog.Error("OIDC token exchange was refused", "status", resp.StatusCode)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := p.verify(tok.IDToken, login["nonce"])
+	if err != nil {
+		slog.Warn("OIDC login rejected", "client", clientIP(r), "error", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+
+	p.setCookie(w, oidcSessionCookie, map[string]string{"sub": claims.Subject, "email": claims.Email}, oidcSessionTTL)
+	http.SetCookie(w, &http.Cookie{Name: oidcLoginCookie, Path: "/", MaxAge: -1})
+	slog.Info("Admin login", "admin", claims.user(), "client", clientIP(r))
+
+	target := login["return"]
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// session returns the user of a valid session cookie on r.
+func (p *oidcProvider) session(r *http.Request) (string, bool) {
+	var s map[string]string
+	if !p.readCookie(r, oidcSessionCookie, &s) {
+		return "", false
+	}
+	if s["email"] != "" {
+		return s["email"], true
+	}
+	return s["sub"], true
+}
+
+// verify checks an ID token's signature and claims; nonce is only checked
+// when non-empty, i.e. for tokens from our own login flow.
+func (p *oidcProvider) verify(token, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("bad signature")
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	var c oidcClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	const skew = 60
+	switch {
+	case c.Issuer != p.issuer:
+		return nil, fmt.Errorf("unexpected issuer %q", c.Issuer)
+	case !c.Audience.contains(oidcClientID):
+		return nil, errors.New("token not issued for this client")
+	case now > c.Expiry+skew:
+		return nil, errors.New("token expired")
+	case c.NotBefore != 0 && now < c.NotBefore-skew:
+		return nil, errors.New("token not yet valid")
+	case nonce != "" && c.Nonce != nonce:
+		return nil, errors.New("nonce mismatch")
+	case !p.allows(&c):
+		return nil, fmt.Errorf("user %s is not allowed", c.user())
+	}
+	return &c, nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *oidcClaims) user() string {
+	if c.Email != "" {
+		return c.Email
+	}
+	return c.Subject
+}
+
+func (p *oidcProvider) allows(c *oidcClaims) bool {
+	if len(p.allowed) == 0 {
+		return true
+	}
+	email := strings.ToLower(c.Email)
+	if c.EmailVerified != nil && !*c.EmailVerified {
+		email = ""
+	}
+	for _, a := range p.allowed {
+		switch {
+		case a == strings.ToLower(c.Subject):
+			return true
+		case email == "":
+		case a == email, strings.HasPrefix(a, "@") && strings.HasSuffix(email, a):
+			return true
+		}
+	}
+	return false
+}
+
+// publicKey returns the signing key kid, refetching the provider's key set
+// (at most once a minute) when it is unknown, e.g. after key rotation.
+func (p *oidcProvider) publicKey(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if clk.Since(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.keysFetched = clk.Now()
+	keys, err := fetchJWKS(p.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func fetchJWKS(jwksURL string) (map[string]crypto.PublicKey, error) {
+	resp, err := httpClient.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// setCookie stores v with an expiry, signed with the provider's key.
+func (p *oidcProvider) setCookie(w http.ResponseWriter, name string, v map[string]string, ttl time.Duration) {
+	v["exp"] = fmt.Sprint(clk.Now().Add(ttl).Unix())
+	payload, _ := json.Marshal(v)
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(name))
+	mac.Write(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   p.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (p *oidcProvider) readCookie(r *http.Request, name string, v *map[string]string) bool {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	payloadPart, sigPart, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return false
+	}
+	payload, err1 := base64.RawURLEncoding.DecodeString(payloadPart)
+	sig, err2 := base64.RawURLEncoding.DecodeString(sigPart)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(name))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) || json.Unmarshal(payload, v) != nil {
+		return false
+	}
+	var exp int64
+	fmt.Sscan((*v)["exp"], &exp)
+	return clk.Now().Unix() < exp
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOIDCIssuerMismatch(t *testing.T) {
+	issuer := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": "https://idp.example/auth",
+			"token_endpoint":         "https://idp.example/token",
+			"jwks_uri":               "https://idp.example/keys",
+		})
+	}))
+	defer srv.Close()
+	defer func(i, c, r string, p *oidcProvider) {
+		oidcIssuer, oidcClientID, oidcRedirectURL, oidc = i, c, r, p
+	}(oidcIssuer, oidcClientID, oidcRedirectURL, oidc)
+	oidcIssuer, oidcClientID, oidcRedirectURL = srv.URL, "proxy", "https://proxy.example/oidc/callback"
+
+	issuer = "https://attacker.example"
+	if err := setupOIDC(); err == nil {
+		t.Fatal("setupOIDC accepted a discovery document for another issuer")
+	}
+	issuer = srv.URL + "/"
+	if err := setupOIDC(); err != nil {
+		t.Fatalf("setupOIDC with the issuer's own document, trailing slash aside: %v", err)
+	}
+}
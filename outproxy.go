@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	// kubeProxy is how Kubernetes API calls leave the proxy: an http://,
+	// https:// or socks5:// proxy URL, "env" for HTTPS_PROXY and NO_PROXY,
+	// or "direct".
+	kubeProxy = getEnv("KUBE_PROXY", "env")
+	// backendProxy is the same for connections to backends, which are
+	// direct by default. WebSocket and plain HTTP backends alike are
+	// reached through a CONNECT or SOCKS5 tunnel.
+	backendProxy = getEnv("BACKEND_PROXY", "direct")
+
+	// backendDialer opens connections to backends, through BACKEND_PROXY
+	// if set and otherwise to the addresses in backendDNS.
+	backendDialer = &proxyDialer{}
+)
+
+// proxySetting parses a KUBE_PROXY or BACKEND_PROXY value into a
+// http.Transport Proxy function; nil means direct.
+func proxySetting(name, v string) (func(*http.Request) (*url.URL, error), error) {
+	switch v {
+	case "", "direct":
+		return nil, nil
+	case "env":
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%s: invalid proxy URL %q", name, v)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%s: unsupported proxy scheme %q", name, u.Scheme)
+	}
+	return http.ProxyURL(u), nil
+}
+
+func setupOutboundProxies() error {
+	kube, err := proxySetting("KUBE_PROXY", kubeProxy)
+	if err != nil {
+		return err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = kube
+	t.TLSClientConfig = kubeTLSConfig()
+	kubeClient.Transport = t
+	watchClient.Transport = t
+	if kubeProxy != "env" && kubeProxy != "direct" {
+		slog.Info("Reaching the Kubernetes API through a proxy", "proxy", redactURL(kubeProxy))
+	}
+
+	if backendDialer.proxy, err = proxySetting("BACKEND_PROXY", backendProxy); err != nil {
+		return err
+	}
+	if backendDialer.proxy != nil {
+		slog.Info("Reaching backends through a proxy", "proxy", redactURL(backendProxy))
+	}
+	return nil
+}
+
+// redactURL hides the password of a proxy URL for logging.
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Redacted()
+	}
+	return s
+}
+
+// proxyDialer dials TCP connections, tunnelling them through an HTTP
+// CONNECT or SOCKS5 proxy when one applies to the address.
+type proxyDialer struct {
+	proxy func(*http.Request) (*url.URL, error)
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.proxy == nil {
+		return dialBackend(ctx, network, addr)
+	}
+	// The proxy functions decide by URL; NO_PROXY only looks at the host.
+	p, err := d.proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return dialBackend(ctx, network, addr)
+	}
+	// The proxy resolves addr itself.
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(p))
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", p.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	switch p.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, p, addr)
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.Hostname()})
+		conn = tlsConn
+		if err = tlsConn.HandshakeContext(ctx); err == nil {
+			conn, err = httpConnect(conn, p, addr)
+		}
+	default:
+		conn, err = httpConnect(conn, p, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", p.Host, err)
+	}
+	return conn, nil
+}
+
+// dialTimeout is net.DialTimeout through the dialer.
+func (d *proxyDialer) dialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request.
+func httpConnect(conn net.Conn, p *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if p.User != nil {
+		pass, _ := p.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(p.User.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn hands out bytes read ahead of the tunnel's start first.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+// socks5Connect asks a SOCKS5 proxy (RFC 1928) to connect to addr, which
+// it resolves, authenticating with the URL's user and password (RFC 1929)
+// if given.
+func socks5Connect(conn net.Conn, p *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || len(host) > 255 {
+		return fmt.Errorf("invalid address %q", addr)
+	}
+	method := byte(0x00)
+	if p.User != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return errors.New("SOCKS5: no acceptable authentication method")
+	}
+	if method == 0x02 {
+		user := p.User.Username()
+		pass, _ := p.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("SOCKS5: user name or password too long")
+		}
+		b := append([]byte{1, byte(len(user))}, user...)
+		b = append(append(b, byte(len(pass))), pass...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5: authentication failed")
+		}
+	}
+
+	b := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != 0 {
+		return fmt.Errorf("SOCKS5: connect to %s failed with code %d", addr, hdr[1])
+	}
+	// Skip the bound address.
+	var skip int
+	switch hdr[3] {
+	case 1:
+		skip = 4
+	case 4:
+		skip = 16
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("SOCKS5: bad address type %d", hdr[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+var (
+	// backendSPKIPins is the default for routes without backend_pins.
+	backendSPKIPins = getEnv("BACKEND_SPKI_PINS", "")
+)
+
+// parsePins decodes SHA-256 SPKI fingerprints given as base64, optionally
+// prefixed with "sha256/" (or curl's "sha256//").
+func parsePins(pins []string) ([][]byte, error) {
+	var out [][]byte
+	for _, p := range pins {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		p = strings.TrimPrefix(strings.TrimPrefix(p, "sha256/"), "/")
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q", p)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// pluginFiles are WASM plugins (comma-separated paths) that can score
+	// routes, veto scale-downs and rewrite request headers. WASM support
+	// is only compiled in with -tags wazero, which needs
+	// github.com/tetratelabs/wazero.
+	pluginFiles = getEnv("PLUGIN_FILES", "")
+
+	plugins []plugin
+
+	// loadWASMPlugin is set by the wazero build.
+	loadWASMPlugin func(path string) (plugin, error)
+)
+
+// plugin is custom logic the proxy consults at its decision points. A
+// plugin that does not implement a hook answers with the zero value.
+type plugin interface {
+	// scoreRoute rates rt for r when several routes serve r's path; the
+	// highest positive score wins.
+	scoreRoute(r *http.Request, rt *route) int
+	// vetoScaleDown keeps t running although it has been idle.
+	vetoScaleDown(t *scaleTarget, idle time.Duration) bool
+	// mutateHeaders rewrites the headers of a request to rt's backend.
+	mutateHeaders(rt *route, h http.Header)
+	name() string
+}
+
+func setupPlugins() error {
+	if pluginFiles == "" {
+		return nil
+	}
+	if loadWASMPlugin == nil {
+		return fmt.Errorf("PLUGIN_FILES: this binary was built without WASM support (-tags wazero)")
+	}
+	for _, path := range strings.Split(pluginFiles, ",") {
+		p, err := loadWASMPlugin(strings.TrimSpace(path))
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", path, err)
+		}
+		slog.Info("Loaded plugin", "plugin", p.name())
+		plugins = append(plugins, p)
+	}
+	return nil
+}
+
+// pluginPick returns the candidate the plugins score highest, or nil if
+// none has a positive score.
+func pluginPick(r *http.Request, candidates []*route) *route {
+	if len(plugins) == 0 || len(candidates) < 2 {
+		return nil
+	}
+	var best *route
+	bestScore := 0
+	for _, rt := range candidates {
+		score := 0
+		for _, p := range plugins {
+			score += p.scoreRoute(r, rt)
+		}
+		if score > bestScore {
+			best, bestScore = rt, score
+		}
+	}
+	return best
+}
+
+func pluginVetoesScaleDown(t *scaleTarget, idle time.Duration) bool {
+	for _, p := range plugins {
+		if p.vetoScaleDown(t, idle) {
+			slog.Info("Plugin vetoed scaling down", "plugin", p.name(), "deployment", t.String())
+			return true
+		}
+	}
+	return false
+}
+
+func pluginHeaders(rt *route, h http.Header) {
+	for _, p := range plugins {
+		p.mutateHeaders(rt, h)
+	}
+}
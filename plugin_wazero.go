@@ -0,0 +1,205 @@
+//go:build wazero
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// pluginCallTimeout bounds each call into a plugin; a plugin that runs
+// over is closed and no longer consulted.
+const pluginCallTimeout = 100 * time.Millisecond
+
+func init() {
+	loadWASMPlugin = newWASMPlugin
+}
+
+// wasmPlugin talks JSON to a WASM module. The module exports
+// alloc(size) ptr for the host to pass input, and any of:
+//
+//	score_route(ptr, len) i32
+//	veto_scale_down(ptr, len) i32 (non-zero vetoes)
+//	mutate_headers(ptr, len) i64 (ptr<<32 | len of the JSON answer, 0 for none)
+//
+// It may import env.log(ptr, len) to write to the proxy's log.
+type wasmPlugin struct {
+	path string
+
+	mu      sync.Mutex // module instances are not safe for concurrent use
+	mod     api.Module
+	alloc   api.Function
+	score   api.Function
+	veto    api.Function
+	headers api.Function
+}
+
+func newWASMPlugin(path string) (plugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	_, err = r.NewHostModuleBuilder("env").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) {
+			if b, ok := m.Memory().Read(ptr, size); ok {
+				slog.Info("Plugin log", "plugin", path, "text", string(b))
+			}
+		}).
+		Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Plugins are reactors: _initialize, if exported, sets them up and
+	// the host then calls their exports.
+	mod, err := r.InstantiateWithConfig(ctx, code, wazero.NewModuleConfig().
+		WithStartFunctions("_initialize").
+		WithStdout(os.Stderr).
+		WithStderr(os.Stderr))
+	if err != nil {
+		return nil, err
+	}
+	p := &wasmPlugin{
+		path:    path,
+		mod:     mod,
+		alloc:   mod.ExportedFunction("alloc"),
+		score:   mod.ExportedFunction("score_route"),
+		veto:    mod.ExportedFunction("veto_scale_down"),
+		headers: mod.ExportedFunction("mutate_headers"),
+	}
+	if p.alloc == nil {
+		return nil, fmt.Errorf("module does not export alloc")
+	}
+	return p, nil
+}
+
+func (p *wasmPlugin) name() string {
+	return p.path
+}
+
+// call passes input as JSON to fn and returns its result. Callers hold p.mu.
+func (p *wasmPlugin) call(fn api.Function, input interface{}) (uint64, error) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pluginCallTimeout)
+	defer cancel()
+	res, err := p.alloc.Call(ctx, uint64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+	ptr := uint32(res[0])
+	if !p.mod.Memory().Write(ptr, b) {
+		return 0, fmt.Errorf("alloc returned %d, outside memory", ptr)
+	}
+	res, err = fn.Call(ctx, uint64(ptr), uint64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+	if len(res) == 0 {
+		return 0, nil
+	}
+	return res[0], nil
+}
+
+type pluginRequest struct {
+	Method  string      `json:"method"`
+	Host    string      `json:"host"`
+	Path    string      `json:"path"`
+	Client  string      `json:"client"`
+	Headers http.Header `json:"headers"`
+}
+
+func (p *wasmPlugin) scoreRoute(r *http.Request, rt *route) int {
+	if p.score == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res, err := p.call(p.score, struct {
+		Route   string        `json:"route"`
+		Request pluginRequest `json:"request"`
+	}{rt.Name, pluginRequest{r.Method, r.Host, r.URL.Path, clientIP(r), r.Header}})
+	if err != nil {
+		slog.Error("Plugin call failed", "plugin", p.path, "call", "score_route", "error", err)
+		return 0
+	}
+	return int(int32(res))
+}
+
+func (p *wasmPlugin) vetoScaleDown(t *scaleTarget, idle time.Duration) bool {
+	if p.veto == nil {
+		return false
+	}
+	t.mu.Lock()
+	in := struct {
+		Target      string  `json:"target"`
+		IdleSeconds float64 `json:"idle_seconds"`
+		Replicas    int     `json:"replicas"`
+		Connections int     `json:"connections"`
+	}{t.String(), idle.Seconds(), t.lastScaledReplicas, t.open}
+	t.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res, err := p.call(p.veto, in)
+	if err != nil {
+		slog.Error("Plugin call failed", "plugin", p.path, "call", "veto_scale_down", "error", err)
+		return false
+	}
+	return uint32(res) != 0
+}
+
+// mutateHeaders applies the plugin's answer, {"set": {name: value},
+// "delete": [name]}.
+func (p *wasmPlugin) mutateHeaders(rt *route, h http.Header) {
+	if p.headers == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res, err := p.call(p.headers, struct {
+		Route   string      `json:"route"`
+		Headers http.Header `json:"headers"`
+	}{rt.Name, h})
+	if err != nil {
+		slog.Error("Plugin call failed", "plugin", p.path, "call", "mutate_headers", "error", err)
+		return
+	}
+	if res == 0 {
+		return
+	}
+	b, ok := p.mod.Memory().Read(uint32(res>>32), uint32(res))
+	if !ok {
+		slog.Error("Plugin answered outside its memory", "plugin", p.path, "call", "mutate_headers")
+		return
+	}
+	var change struct {
+		Set    map[string]string `json:"set"`
+		Delete []string          `json:"delete"`
+	}
+	if err := json.Unmarshal(b, &change); err != nil {
+		slog.Error("Plugin call failed", "plugin", p.path, "call", "mutate_headers", "error", err)
+		return
+	}
+	for _, k := range change.Delete {
+		h.Del(k)
+	}
+	for k, v := range change.Set {
+		h.Set(k, v)
+	}
+}
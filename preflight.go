@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// preflight checks, before anything is started, that the process may bind
+// its listeners and open the files it is configured with, so a missing
+// capability or permission fails fast with a hint instead of surfacing
+// as a bare "permission denied" later.
+func preflight() error {
+	var problems []string
+	if !socketsInherited() {
+		ls, err := loadListeners()
+		if err != nil {
+			return err
+		}
+		start := unprivilegedPortStart()
+		for _, l := range ls {
+			_, p, err := net.SplitHostPort(l.Addr)
+			if err != nil {
+				continue
+			}
+			port, _ := strconv.Atoi(p)
+			if port > 0 && port < start && !canBindPrivilegedPorts() {
+				problems = append(problems, fmt.Sprintf(
+					"listener %s: port %d needs root or CAP_NET_BIND_SERVICE; run `setcap cap_net_bind_service=+ep %s`, "+
+						"add NET_BIND_SERVICE to the container's securityContext.capabilities, or listen on a port >= %d",
+					l.Addr, port, executableName(), start))
+			}
+		}
+	}
+
+	read := [][2]string{{"CONFIG_FILE", configFile}, {"GEOIP_DB", geoIPDB}, {"DECOY_DIR", decoyDir}, {"KUBE_REPLAY_FILE", kubeReplayFile}}
+	for _, f := range read {
+		if err := checkAccess(f[1], os.O_RDONLY); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f[0], err))
+		}
+	}
+	write := [][2]string{{"AUDIT_LOG", auditLog}, {"ACCESS_LOG", accessLog}, {"PID_FILE", pidFile}, {"KUBE_RECORD_FILE", kubeRecordFile}}
+	for _, f := range write {
+		if f[1] == "stdout" || f[1] == "-" {
+			continue
+		}
+		if err := checkAccess(f[1], os.O_WRONLY|os.O_APPEND|os.O_CREATE); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f[0], err))
+		}
+	}
+	if recordDir != "" {
+		if err := checkAccess(filepath.Join(recordDir, ".preflight"), os.O_WRONLY|os.O_CREATE); err != nil {
+			problems = append(problems, fmt.Sprintf("RECORD_DIR: %v", err))
+		} else {
+			os.Remove(filepath.Join(recordDir, ".preflight"))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("startup checks failed:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// checkAccess opens path with flag and explains permission errors.
+func checkAccess(path string, flag int) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, flag, 0600)
+	if err == nil {
+		f.Close()
+		return nil
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	hint := fmt.Sprintf("running as %s", processUser())
+	if owner := fileOwner(path); owner != "" {
+		hint += ", " + owner
+	}
+	return fmt.Errorf("%w (%s); run as a user that may access it, e.g. via runAsUser/fsGroup in Kubernetes, or fix its ownership and mode", err, hint)
+}
+
+func executableName() string {
+	if exe, err := os.Executable(); err == nil {
+		return exe
+	}
+	return os.Args[0]
+}
@@ -0,0 +1,71 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capNetBindService is the bit of CAP_NET_BIND_SERVICE in capability sets.
+const capNetBindService = 10
+
+func socketsInherited() bool {
+	return os.Getenv(upgradeListenersEnv) != "" || os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid())
+}
+
+func unprivilegedPortStart() int {
+	if runtime.GOOS != "linux" {
+		// macOS lets anyone bind low ports on wildcard addresses; other
+		// systems vary, so leave it to the listen error.
+		return 0
+	}
+	if b, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			return n
+		}
+	}
+	return 1024
+}
+
+func canBindPrivilegedPorts() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if v, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return err == nil && caps&(1<<capNetBindService) != 0
+		}
+	}
+	return false
+}
+
+func processUser() string {
+	return fmt.Sprintf("uid %d gid %d", os.Geteuid(), os.Getegid())
+}
+
+// fileOwner describes the ownership of path or of its nearest existing
+// parent directory.
+func fileOwner(path string) string {
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if fi, err := os.Stat(p); err == nil {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				return fmt.Sprintf("%s is owned by uid %d gid %d with mode %v", p, st.Uid, st.Gid, fi.Mode().Perm())
+			}
+			return ""
+		}
+		if p == filepath.Dir(p) {
+			return ""
+		}
+	}
+}
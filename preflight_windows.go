@@ -0,0 +1,14 @@
+package main
+
+// Windows has no privileged ports and reports file permissions through
+// ACLs, so only the generic checks apply.
+
+func socketsInherited() bool { return false }
+
+func unprivilegedPortStart() int { return 0 }
+
+func canBindPrivilegedPorts() bool { return true }
+
+func processUser() string { return "the service account" }
+
+func fileOwner(path string) string { return "" }
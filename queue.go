@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"slices"
+	"time"
+)
+
+var (
+	// queueClientsPerReplica sizes a cold start by the clients held waiting
+	// for it: each this many clients start another replica, up to
+	// queueMaxReplicas. 0 always starts exactly one.
+	queueClientsPerReplica = getEnvAsInt("QUEUE_CLIENTS_PER_REPLICA", 0)
+	queueMaxReplicas       = getEnvAsInt("QUEUE_MAX_REPLICAS", 3)
+	// queueMaxClients caps the clients held per cold start; the rest are
+	// told to come back after QUEUE_RETRY_AFTER_SECONDS plus a random part
+	// of QUEUE_RETRY_JITTER_SECONDS, so they don't all reconnect at once.
+	// 0 holds everyone.
+	queueMaxClients         = getEnvAsInt("QUEUE_MAX_CLIENTS", 0)
+	queueRetryAfterSeconds  = getEnvAsInt("QUEUE_RETRY_AFTER_SECONDS", 10)
+	queueRetryJitterSeconds = getEnvAsInt("QUEUE_RETRY_JITTER_SECONDS", 20)
+	// queueWaitSecondsEnv is how long each client may be held, up to
+	// READY_TIMEOUT_SECONDS if 0; queueReleaseIntervalMs spaces out the
+	// release of held clients so a fresh backend is not hit all at once.
+	queueWaitSecondsEnv    = getEnvAsInt("QUEUE_WAIT_SECONDS", 0)
+	queueReleaseIntervalMs = getEnvAsInt("QUEUE_RELEASE_INTERVAL_MS", 0)
+
+	coldStartQueue = newGauge("wsproxy_cold_start_queue",
+		"Clients held waiting for a cold start.", "target")
+)
+
+// setupQueue checks the timeouts a held client waits for, which would
+// otherwise only fail once a client is held.
+func setupQueue() error {
+	if readyTimeoutSeconds <= 0 {
+		return fmt.Errorf("READY_TIMEOUT_SECONDS must be positive")
+	}
+	if readyPollInitialMs <= 0 {
+		return fmt.Errorf("READY_POLL_INITIAL_MS must be positive")
+	}
+	if readyPollMaxMs < readyPollInitialMs {
+		return fmt.Errorf("READY_POLL_MAX_MS must not be less than READY_POLL_INITIAL_MS")
+	}
+	if queueWaitSecondsEnv < 0 {
+		return fmt.Errorf("QUEUE_WAIT_SECONDS must not be negative")
+	}
+	return nil
+}
+
+// queueReplicas returns the replicas to start for depth held clients.
+func queueReplicas(depth int) int {
+	if queueClientsPerReplica <= 0 || depth <= 0 {
+		return 1
+	}
+	n := (depth + queueClientsPerReplica - 1) / queueClientsPerReplica
+	if n > queueMaxReplicas {
+		n = queueMaxReplicas
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// queueRetryAfter returns a Retry-After in seconds for a client turned
+// away from a full queue.
+func queueRetryAfter() int {
+	n := queueRetryAfterSeconds
+	if queueRetryJitterSeconds > 0 {
+		n += rand.Intn(queueRetryJitterSeconds + 1)
+	}
+	return n
+}
+
+// queuedClient is a client held while its deployment cold-starts.
+type queuedClient struct {
+	released chan struct{}
+	err      error // why it was released without a ready backend
+}
+
+// enqueue holds a client while rt's deployment cold-starts and, once the
+// queue is deep enough, scales it beyond the single replica the first
+// client asked for. The first client also starts the one readiness poll
+// all of them wait on. It reports false, without queueing, if the queue is
+// full. Callers must dequeue when they stop waiting.
+func (t *scaleTarget) enqueue(rt *route) (*queuedClient, bool) {
+	t.mu.Lock()
+	if queueMaxClients > 0 && t.queued >= queueMaxClients {
+		t.mu.Unlock()
+		return nil, false
+	}
+	c := &queuedClient{released: make(chan struct{})}
+	t.queue = append(t.queue, c)
+	t.queued++
+	depth := t.queued
+	poll := !t.polling
+	t.polling = true
+	t.mu.Unlock()
+	coldStartQueue.set(float64(depth), t.String())
+	if poll {
+		go t.pollReady(rt)
+	}
+
+	n := queueReplicas(depth)
+	if n <= 1 {
+		return c, true
+	}
+	// Serialized so a larger count is never overtaken by a smaller one.
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+	if n <= t.queueReplicas {
+		return c, true
+	}
+	lg := slog.With("route", rt.Name, "deployment", t.String(), "replicas", n, "cause", "queue")
+	lg.Info("Clients waiting for a cold start, starting more replicas", "queued", depth)
+	if err := scaleDeployment(t, n, "queue"); err != nil {
+		lg.Error("Failed to scale backend up", "error", err)
+		return c, true
+	}
+	t.queueReplicas = n
+	return c, true
+}
+
+// pollReady waits for rt's backend to become ready and then releases the
+// held clients in the order they arrived, QUEUE_RELEASE_INTERVAL_MS apart.
+func (t *scaleTarget) pollReady(rt *route) {
+	err := waitReady(rt)
+	t.mu.Lock()
+	queue := t.queue
+	t.queue = nil
+	t.polling = false
+	t.mu.Unlock()
+	for i, c := range queue {
+		if i > 0 && err == nil && queueReleaseIntervalMs > 0 {
+			clk.Sleep(time.Duration(queueReleaseIntervalMs) * time.Millisecond)
+		}
+		c.err = err
+		close(c.released)
+	}
+}
+
+// wait blocks until c is released, QUEUE_WAIT_SECONDS pass or the client
+// goes away.
+func (c *queuedClient) wait(r *http.Request) error {
+	timeout := clk.NewTimer(time.Duration(queueWaitSeconds()) * time.Second)
+	defer timeout.Stop()
+	select {
+	case <-c.released:
+		return c.err
+	case <-timeout.C():
+		return errNotReady
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+func (t *scaleTarget) dequeue(c *queuedClient) {
+	t.mu.Lock()
+	t.queued--
+	depth := t.queued
+	if i := slices.Index(t.queue, c); i >= 0 {
+		t.queue = slices.Delete(t.queue, i, i+1)
+	}
+	t.mu.Unlock()
+	coldStartQueue.set(float64(depth), t.String())
+	if depth == 0 {
+		t.queueMu.Lock()
+		t.queueReplicas = 0
+		t.queueMu.Unlock()
+	}
+}
+
+// queueWaitSeconds is the longest a client is held.
+func queueWaitSeconds() int {
+	if queueWaitSecondsEnv > 0 {
+		return queueWaitSecondsEnv
+	}
+	return readyTimeoutSeconds
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var (
+	// maxConnRate caps new connections per second across the listener;
+	// 0 disables the limit.
+	maxConnRate  = getEnvAsInt("MAX_CONN_RATE", 0)
+	maxConnBurst = getEnvAsInt("MAX_CONN_BURST", 0)
+	// connQueueWaitMS is how long an accepted connection may wait for a
+	// slot before it is closed; until then further connections queue in
+	// the kernel's accept backlog.
+	connQueueWaitMS = getEnvAsInt("CONN_QUEUE_WAIT_MS", 250)
+
+	connsRejected = newCounter("wsproxy_connections_rejected_total",
+		"Connections closed on accept because MAX_CONN_RATE was exceeded.")
+)
+
+// tokenBucket is a rate limiter that hands out reservations, so waiters are
+// served in order without polling.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: clk.Now()}
+}
+
+// reserve takes n tokens and returns how long to wait before using them, or
+// false if that would take longer than max.
+func (b *tokenBucket) reserve(n float64, max time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := clk.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	wait := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	if wait > max {
+		return 0, false
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+// rateLimitedListener paces connections to maxConnRate. Connections are
+// accepted as they arrive and handed to the server once their slot comes
+// up; those that would wait longer than connQueueWaitMS are closed before
+// any bytes are read.
+type rateLimitedListener struct {
+	net.Listener
+	bucket *tokenBucket
+	conns  chan net.Conn
+	errs   chan error
+	// closed is closed by Close, after which connections still waiting
+	// for a slot are closed instead of handed over.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func limitListener(l net.Listener) net.Listener {
+	if maxConnRate <= 0 {
+		return l
+	}
+	ll := &rateLimitedListener{
+		Listener: l,
+		bucket:   newTokenBucket(float64(maxConnRate), float64(maxConnBurst)),
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go ll.run()
+	return ll
+}
+
+func (l *rateLimitedListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		wait, ok := l.bucket.reserve(1, time.Duration(connQueueWaitMS)*time.Millisecond)
+		if !ok {
+			l.reject(conn)
+			continue
+		}
+		if wait == 0 {
+			l.hand(conn)
+			continue
+		}
+		go func() {
+			t := clk.NewTimer(wait)
+			defer t.Stop()
+			select {
+			case <-t.C():
+				l.hand(conn)
+			case <-l.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// hand passes conn to Accept, closing it if the listener is closed first.
+func (l *rateLimitedListener) hand(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *rateLimitedListener) reject(conn net.Conn) {
+	connsRejected.inc()
+	if addr, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+		if ip := addr.Addr().Unmap(); !prefixesContain(trustedProxies, ip) {
+			bans.strike(ip.String(), "rate limit violations")
+		}
+	}
+	conn.Close()
+}
+
+func (l *rateLimitedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *rateLimitedListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// flightGroup collapses concurrent calls with the same key into one, so a
+// burst of connections causes one health check or scale call rather than
+// one each.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+var errBackendDown = errors.New("backend down")
+
+func (g *flightGroup) do(key string, fn func() error) error {
+	g.mu.Lock()
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.err
+	}
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.m[key] = c
+	g.mu.Unlock()
+
+	c.err = fn()
+	g.mu.Lock()
+	delete(g.m, key)
+	g.mu.Unlock()
+	close(c.done)
+	return c.err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// After scaling a deployment up, the clients held for it wait until it has
+// a ready replica and its backend passes a health check, polled with
+// exponential backoff rather than for a fixed time. Clients still waiting
+// after READY_TIMEOUT_SECONDS are turned away with 503 and Retry-After.
+var (
+	readyTimeoutSeconds = getEnvAsInt("READY_TIMEOUT_SECONDS", 60)
+	readyPollInitialMs  = getEnvAsInt("READY_POLL_INITIAL_MS", 250)
+	readyPollMaxMs      = getEnvAsInt("READY_POLL_MAX_MS", 5000)
+
+	readyWaitSeconds = newHistogram("wsproxy_ready_wait_seconds",
+		"Time cold starts waited for a scaled-up backend to become ready.",
+		coldBuckets, "route", "result")
+
+	errNotReady = errors.New("backend did not become ready in time")
+)
+
+// waitReady polls until rt's deployment reports a ready replica and its
+// backend is up, or READY_TIMEOUT_SECONDS pass.
+func waitReady(rt *route) (err error) {
+	started := clk.Now()
+	defer func() {
+		result := "ready"
+		if err != nil {
+			result = "timeout"
+		}
+		readyWaitSeconds.observe(clk.Since(started).Seconds(), rt.Name, result)
+	}()
+	deadline := started.Add(time.Duration(readyTimeoutSeconds) * time.Second)
+	delay := time.Duration(readyPollInitialMs) * time.Millisecond
+	warned := false
+	for {
+		if n, err := readyReplicas(rt.scale); err != nil {
+			// The health check alone decides when the API cannot tell.
+			if !warned {
+				slog.Warn("Could not read the deployment's status", "deployment", rt.scale.String(), "error", err)
+				warned = true
+			}
+			if isBackendUp(rt) {
+				return nil
+			}
+		} else if n >= 1 && isBackendUp(rt) {
+			return nil
+		}
+		left := deadline.Sub(clk.Now())
+		if left <= 0 {
+			return errNotReady
+		}
+		clk.Sleep(min(delay, left))
+		delay = min(2*delay, time.Duration(readyPollMaxMs)*time.Millisecond)
+	}
+}
+
+// readyReplicas returns the ready replicas of t's deployment.
+func readyReplicas(t *scaleTarget) (int, error) {
+	return t.scaler.Ready()
+}
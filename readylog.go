@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// readyLogPolicy holds a route's traffic back until a pod of its deployment
+// has logged a line matching Pattern, for backends whose port opens before
+// they are ready (e.g. "Xray .* started"). Pods are looked at each time the
+// backend is health-checked, and a pod that matched once stays ready.
+type readyLogPolicy struct {
+	Pattern   string `json:"pattern"`
+	Container string `json:"container,omitempty"` // needed for pods with several
+}
+
+// readyLogPatterns holds the compiled patterns by their text, outside
+// readyLogPolicy so that routes still compare equal across reloads.
+var readyLogPatterns sync.Map // string -> *regexp.Regexp
+
+// readyLogMaxBytes is how much of a pod's log is searched.
+const readyLogMaxBytes = 1 << 20
+
+func (p *readyLogPolicy) validate() error {
+	if p.Pattern == "" {
+		return fmt.Errorf("ready_log: pattern is required")
+	}
+	re, err := regexp.Compile(p.Pattern)
+	if err != nil {
+		return fmt.Errorf("ready_log: %w", err)
+	}
+	readyLogPatterns.Store(p.Pattern, re)
+	return nil
+}
+
+// readyPods remembers the pods (by UID) that have logged a route's pattern.
+var readyPods = struct {
+	mu sync.Mutex
+	m  map[string]bool
+}{m: make(map[string]bool)}
+
+// check returns nil once a running pod of t's deployment has logged the
+// pattern.
+func (p *readyLogPolicy) check(t *scaleTarget) error {
+	v, _ := readyLogPatterns.Load(p.Pattern)
+	re := v.(*regexp.Regexp)
+	pods, err := deploymentPods(t)
+	if err != nil {
+		return err
+	}
+	forgetGonePods(pods, p.Pattern)
+	for _, pod := range pods {
+		key := pod.uid + " " + p.Pattern
+		readyPods.mu.Lock()
+		ready := readyPods.m[key]
+		readyPods.mu.Unlock()
+		if !ready {
+			if ready, err = podLogMatches(t, pod.name, p.Container, re); err != nil {
+				return err
+			}
+		}
+		if ready {
+			readyPods.mu.Lock()
+			readyPods.m[key] = true
+			readyPods.mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("no pod has logged %q yet", p.Pattern)
+}
+
+// forgetGonePods drops the pods no longer running from readyPods.
+func forgetGonePods(pods []podRef, pattern string) {
+	running := make(map[string]bool)
+	for _, pod := range pods {
+		running[pod.uid+" "+pattern] = true
+	}
+	readyPods.mu.Lock()
+	defer readyPods.mu.Unlock()
+	for key := range readyPods.m {
+		if strings.HasSuffix(key, " "+pattern) && !running[key] {
+			delete(readyPods.m, key)
+		}
+	}
+}
+
+type podRef struct {
+	name string
+	uid  string
+}
+
+// deploymentPods lists the running pods selected by t's deployment.
+func deploymentPods(t *scaleTarget) ([]podRef, error) {
+	var dep struct {
+		Spec struct {
+			Selector struct {
+				MatchLabels map[string]string `json:"matchLabels"`
+			} `json:"selector"`
+		} `json:"spec"`
+	}
+	if err := getKube(t, fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", t.namespace, t.deployment), &dep); err != nil {
+		return nil, err
+	}
+	var selector []string
+	for k, v := range dep.Spec.Selector.MatchLabels {
+		selector = append(selector, k+"="+v)
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name              string  `json:"name"`
+				UID               string  `json:"uid"`
+				DeletionTimestamp *string `json:"deletionTimestamp"`
+			} `json:"metadata"`
+			Status struct {
+				Phase string `json:"phase"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", t.namespace, url.QueryEscape(strings.Join(selector, ",")))
+	if err := getKube(t, path, &list); err != nil {
+		return nil, err
+	}
+	var pods []podRef
+	for _, item := range list.Items {
+		if item.Status.Phase == "Running" && item.Metadata.DeletionTimestamp == nil {
+			pods = append(pods, podRef{item.Metadata.Name, item.Metadata.UID})
+		}
+	}
+	return pods, nil
+}
+
+// podLogMatches searches the start of a pod's log for re.
+func podLogMatches(t *scaleTarget, pod, container string, re *regexp.Regexp) (bool, error) {
+	q := url.Values{"limitBytes": {fmt.Sprint(readyLogMaxBytes)}}
+	if container != "" {
+		q.Set("container", container)
+	}
+	req, err := t.kubeRequest(http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?%s", t.namespace, pod, q.Encode()), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("K8s API returned %d: %s", resp.StatusCode, msg)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), readyLogMaxBytes)
+	for sc.Scan() {
+		if re.Match(sc.Bytes()) {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// getKube GETs path from t's Kubernetes API into v.
+func getKube(t *scaleTarget, path string, v any) error {
+	req, err := t.kubeRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return &kubeError{resp.StatusCode, string(msg)}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// recordDir enables session recording in frame mode: every frame of
+	// every session is written to a JSON-lines file in this directory.
+	recordDir = getEnv("RECORD_DIR", "")
+)
+
+// recordHeader is the first line of a recording.
+type recordHeader struct {
+	Session     uint64    `json:"session"`
+	Route       string    `json:"route"`
+	Remote      string    `json:"remote"`
+	Started     time.Time `json:"started"`
+	BackendURL  string    `json:"backend_url"`
+	BackendPath string    `json:"backend_path"`
+}
+
+// recordedFrame is one frame of a recording, payload unmasked.
+type recordedFrame struct {
+	OffsetMS int64  `json:"t_ms"`
+	Dir      string `json:"dir"`
+	Opcode   byte   `json:"op"`
+	Fin      bool   `json:"fin"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+// recorder writes one session's frames; both directions share it.
+type recorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	started time.Time
+}
+
+func newRecorder(s *session, rt *route) *recorder {
+	if recordDir == "" || !frameMode() {
+		return nil
+	}
+	name := filepath.Join(recordDir, fmt.Sprintf("session-%s-%d.jsonl", s.started.Format("20060102T150405"), s.id))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		s.logger().Error("Failed to start session recording", "file", name, "error", err)
+		return nil
+	}
+	w := bufio.NewWriter(f)
+	rec := &recorder{f: f, w: w, enc: json.NewEncoder(w), started: s.started}
+	rec.enc.Encode(recordHeader{
+		Session:     s.id,
+		Route:       s.route,
+		Remote:      s.remote,
+		Started:     s.started,
+		BackendURL:  rt.BackendURL,
+		BackendPath: rt.BackendPath,
+	})
+	return rec
+}
+
+func (r *recorder) frame(dir string, f *wsFrame, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return
+	}
+	r.enc.Encode(recordedFrame{
+		OffsetMS: time.Since(r.started).Milliseconds(),
+		Dir:      dir,
+		Opcode:   f.opcode,
+		Fin:      f.fin,
+		Data:     payload,
+	})
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	r.w.Flush()
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// runReplay implements the "replay" subcommand: it feeds the client→backend
+// frames of a recording to a backend with their original timing and prints
+// what the backend sends back.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	backend := fs.String("backend", "", "backend WebSocket URL (default: the recorded backend URL and path)")
+	speed := fs.Float64("speed", 1, "playback speed multiplier, 0 sends frames without delay")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: auto_scale replay [-backend url] [-speed n] recording.jsonl")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		slog.Error("Failed to open the recording", "error", err)
+		return 1
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	var hdr recordHeader
+	if err := dec.Decode(&hdr); err != nil {
+		slog.Error("Invalid recording header", "file", fs.Arg(0), "error", err)
+		return 1
+	}
+	target := *backend
+	if target == "" {
+		target = hdr.BackendURL + hdr.BackendPath
+	}
+
+	c, _, err := dialWS(target, nil, 10*time.Second)
+	if err != nil {
+		slog.Error("Failed to connect to the backend", "backend", target, "error", err)
+		return 1
+	}
+	defer c.Close()
+	slog.Info("Replaying session", "session", hdr.Session, "route", hdr.Route, "backend", target)
+
+	go func() {
+		for {
+			op, fin, payload, err := c.readFrame()
+			if err != nil {
+				return
+			}
+			fmt.Printf("<- %s fin=%t len=%d %q\n", opcodeName(op), fin, len(payload), truncate(payload, 120))
+		}
+	}()
+
+	start := time.Now()
+	for {
+		var rf recordedFrame
+		if err := dec.Decode(&rf); err != nil {
+			break
+		}
+		if rf.Dir != "up" {
+			continue
+		}
+		if *speed > 0 {
+			due := time.Duration(float64(rf.OffsetMS)/(*speed)) * time.Millisecond
+			time.Sleep(due - time.Since(start))
+		}
+		fmt.Printf("-> %s fin=%t len=%d %q\n", opcodeName(rf.Opcode), rf.Fin, len(rf.Data), truncate(rf.Data, 120))
+		if _, err := c.conn.Write(appendFrame(rf)); err != nil {
+			slog.Error("Replay aborted", "session", hdr.Session, "route", hdr.Route, "error", err)
+			return 1
+		}
+		if rf.Opcode == opClose {
+			break
+		}
+	}
+	// Give the backend a moment to answer the last frames.
+	time.Sleep(time.Second)
+	return 0
+}
+
+// appendFrame re-encodes a recorded client frame, keeping its fragmentation.
+func appendFrame(rf recordedFrame) []byte {
+	b := appendWSFrame(nil, rf.Opcode, rf.Data, true)
+	if !rf.Fin {
+		b[0] &^= 0x80
+	}
+	return b
+}
+
+func truncate(p []byte, n int) []byte {
+	if len(p) > n {
+		return p[:n]
+	}
+	return p
+}
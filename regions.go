@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Routes on the same path (and subprotocols) that set "region" reach the
+// same service in different places, each with its own backend and
+// deployment, possibly in another cluster (kube_endpoint). New sessions go
+// to the region whose backend is up with the lowest health-check round
+// trip, which regionProber keeps measuring for every region; when none is up, the first one listed is woken, and if it cannot be
+// scaled up the next one is tried. The routes should share their policies,
+// since those of the first region are the ones checked.
+
+var (
+	// regionFailoverSeconds is how long a region whose scale-up failed is
+	// passed over.
+	regionFailoverSeconds = getEnvAsInt("REGION_FAILOVER_SECONDS", 300)
+	// regionProbeSeconds is how often every region's backend is health
+	// checked for its round trip.
+	regionProbeSeconds = getEnvAsInt("REGION_PROBE_SECONDS", 30)
+)
+
+func validateRegion(rt *route) error {
+	if regionProbeSeconds <= 0 {
+		return fmt.Errorf("REGION_PROBE_SECONDS must be positive")
+	}
+	if rt.KubeEndpoint != "" {
+		u, err := url.Parse(rt.KubeEndpoint)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid kube_endpoint %q", rt.KubeEndpoint)
+		}
+		if rt.KubeToken == "" {
+			return fmt.Errorf("kube_endpoint needs kube_token")
+		}
+	}
+	return nil
+}
+
+// recordRTT folds the duration of a successful health check into rt's
+// round-trip estimate.
+func recordRTT(rt *route, d time.Duration) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.rtt == 0 {
+		rt.rtt = d
+	} else {
+		rt.rtt = (3*rt.rtt + d) / 4
+	}
+}
+
+// regionProber health checks the backend of every region route, not just
+// the ones sessions are sent to, so that the others have a round trip to be
+// compared by. Regions known to be scaled to zero are left alone, as their
+// checks could only fail.
+func regionProber() {
+	if regionProbeSeconds <= 0 {
+		return
+	}
+	tick := clk.NewTicker(time.Duration(regionProbeSeconds) * time.Second)
+	defer tick.Stop()
+	for range tick.C() {
+		for _, rt := range routing.Load().routes {
+			if rt.Region == "" {
+				continue
+			}
+			rt.scale.mu.Lock()
+			down := rt.scale.lastScaledReplicas == 0
+			rt.scale.mu.Unlock()
+			if down {
+				continue
+			}
+			rt := rt
+			go rt.checks.do("health", func() error {
+				if checkBackend(rt) {
+					return nil
+				}
+				return errBackendDown
+			})
+		}
+	}
+}
+
+// regionState is a snapshot of what region selection goes by.
+func (rt *route) regionState() (up bool, rtt time.Duration, failed bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	up = clk.Since(rt.lastHealthy) < time.Minute*time.Duration(backendHealthCheckInterval)
+	failed = !rt.scaleFailed.IsZero() && clk.Since(rt.scaleFailed) < time.Duration(regionFailoverSeconds)*time.Second
+	return up, rt.rtt, failed
+}
+
+// regions returns the routes of rt's region group, in config order.
+func (t *routeTable) regions(rt *route) []*route {
+	var group []*route
+	for _, other := range t.byPath[rt.Path] {
+		if other.Region != "" && slices.Equal(other.Subprotocols, rt.Subprotocols) {
+			group = append(group, other)
+		}
+	}
+	return group
+}
+
+// nearestRegion picks the region of rt's group to send a new session to.
+func (t *routeTable) nearestRegion(rt *route) *route {
+	var best, fallback *route
+	var bestRTT time.Duration
+	for _, other := range t.regions(rt) {
+		up, rtt, failed := other.regionState()
+		if failed {
+			continue
+		}
+		if up && (best == nil || rtt < bestRTT) {
+			best, bestRTT = other, rtt
+		}
+		if fallback == nil {
+			fallback = other
+		}
+	}
+	if best != nil {
+		return best
+	}
+	if fallback != nil {
+		return fallback
+	}
+	// Every region failed recently; try the preferred one again.
+	return rt
+}
+
+// failover marks rt's region as failed and returns the region to try
+// instead, or nil if there is none left.
+func failover(rt *route) *route {
+	if rt.Region == "" {
+		return nil
+	}
+	rt.mu.Lock()
+	rt.scaleFailed = clk.Now()
+	rt.mu.Unlock()
+	next := routing.Load().nearestRegion(rt)
+	if next == rt || next.Region == "" {
+		return nil
+	}
+	if _, _, failed := next.regionState(); failed {
+		return nil
+	}
+	slog.Warn("Region could not be scaled up, failing over", "route", rt.Name, "region", rt.Region, "to", next.Region)
+	return next
+}
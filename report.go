@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// reportSchedule sends a usage summary through the notifiers every day
+	// or week (at midnight UTC, weeks starting on Monday); disabled if empty.
+	reportSchedule = getEnv("REPORT_SCHEDULE", "")
+
+	reports = newReportStats()
+)
+
+// reportStats accumulates what the next summary covers.
+type reportStats struct {
+	mu          sync.Mutex
+	since       time.Time
+	sessions    int
+	clients     map[string]bool
+	bytesUp     int64
+	bytesDown   int64
+	coldStarts  int
+	coldSeconds float64
+	scaleUps    int
+	downSince   map[*scaleTarget]time.Time // targets currently scaled to zero
+	downtime    map[*scaleTarget]time.Duration
+}
+
+func newReportStats() *reportStats {
+	return &reportStats{
+		since:     time.Now(),
+		clients:   make(map[string]bool),
+		downSince: make(map[*scaleTarget]time.Time),
+		downtime:  make(map[*scaleTarget]time.Duration),
+	}
+}
+
+func (r *reportStats) session(s *session, up, down int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions++
+	r.clients[s.remote] = true
+	r.bytesUp += up
+	r.bytesDown += down
+}
+
+func (r *reportStats) coldStart(seconds float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.coldStarts++
+	r.coldSeconds += seconds
+}
+
+func (r *reportStats) scaled(t *scaleTarget, replicas int) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if replicas == 0 {
+		if _, ok := r.downSince[t]; !ok {
+			r.downSince[t] = now
+		}
+		return
+	}
+	r.scaleUps++
+	if since, ok := r.downSince[t]; ok {
+		r.downtime[t] += now.Sub(since)
+		delete(r.downSince, t)
+	}
+}
+
+// flush returns the summary of the period ending now and starts a new one.
+func (r *reportStats) flush() (string, map[string]interface{}) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Replica-hours saved counts the BASELINE_REPLICAS each target would
+	// have kept running while it was scaled to zero.
+	saved := make(map[string]float64)
+	total := 0.0
+	for t, d := range r.downtime {
+		saved[t.String()] += d.Hours() * float64(baselineReplicas)
+	}
+	for t, since := range r.downSince {
+		saved[t.String()] += now.Sub(since).Hours() * float64(baselineReplicas)
+		r.downSince[t] = now
+	}
+	targets := make([]string, 0, len(saved))
+	for t, h := range saved {
+		targets = append(targets, t)
+		total += h
+	}
+	sort.Strings(targets)
+	avgCold := 0.0
+	if r.coldStarts > 0 {
+		avgCold = r.coldSeconds / float64(r.coldStarts)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage %s to %s\n", r.since.UTC().Format("2006-01-02 15:04"), now.UTC().Format("2006-01-02 15:04 MST"))
+	fmt.Fprintf(&b, "Sessions: %d from %d clients\n", r.sessions, len(r.clients))
+	fmt.Fprintf(&b, "Traffic: %s up, %s down\n", formatBytes(r.bytesUp), formatBytes(r.bytesDown))
+	fmt.Fprintf(&b, "Scale-ups: %d, cold starts: %d (avg %.1fs)\n", r.scaleUps, r.coldStarts, avgCold)
+	fmt.Fprintf(&b, "Replica-hours saved: %s", formatSavings(total))
+	for _, t := range targets {
+		fmt.Fprintf(&b, "\n  %s: %s", t, formatSavings(saved[t]))
+	}
+	details := map[string]interface{}{
+		"from": r.since.UTC(), "to": now.UTC(),
+		"sessions": r.sessions, "unique_clients": len(r.clients),
+		"bytes_up": r.bytesUp, "bytes_down": r.bytesDown,
+		"scale_ups": r.scaleUps, "cold_starts": r.coldStarts, "cold_start_avg_seconds": avgCold,
+		"replica_hours_saved": saved,
+	}
+	if costPerReplicaHour > 0 {
+		details["cost_saved"] = total * costPerReplicaHour
+		details["currency"] = costCurrency
+	}
+
+	r.since = now
+	r.sessions, r.bytesUp, r.bytesDown = 0, 0, 0
+	r.clients = make(map[string]bool)
+	r.coldStarts, r.coldSeconds, r.scaleUps = 0, 0, 0
+	r.downtime = make(map[*scaleTarget]time.Duration)
+	return b.String(), details
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// nextReport returns when the period containing now ends.
+func nextReport(now time.Time) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	if reportSchedule == "weekly" {
+		for next.Weekday() != time.Monday {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+func setupReports() error {
+	switch reportSchedule {
+	case "":
+		return nil
+	case "daily", "weekly":
+	default:
+		return fmt.Errorf("REPORT_SCHEDULE: unknown schedule %q", reportSchedule)
+	}
+	slog.Info("Sending usage reports", "schedule", reportSchedule, "next", nextReport(time.Now()).Format(time.RFC3339))
+	go func() {
+		for {
+			time.Sleep(time.Until(nextReport(time.Now())))
+			text, details := reports.flush()
+			notify("usage_report", text, details)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	routeCRDGroup   = "autoscale.aalaei.github.io"
+	routeCRDVersion = "v1alpha1"
+	routeCRDPlural  = "autoscaleroutes"
+)
+
+var (
+	// routeCRDNamespace switches the route table over to AutoScaleRoute
+	// objects in this namespace ("*" watches all namespaces).
+	routeCRDNamespace = getEnv("ROUTE_CRD_NAMESPACE", "")
+)
+
+// autoScaleRoute is the AutoScaleRoute custom resource.
+type autoScaleRoute struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Path         string   `json:"path"`
+		Kind         string   `json:"kind,omitempty"`
+		Subprotocols []string `json:"subprotocols,omitempty"`
+		Backend      struct {
+			URL      string `json:"url"`
+			Path     string `json:"path,omitempty"`
+			Protocol string `json:"protocol,omitempty"`
+		} `json:"backend"`
+		Target struct {
+			Namespace  string `json:"namespace,omitempty"`
+			Deployment string `json:"deployment"`
+		} `json:"target"`
+		Idle struct {
+			InactivityMinutes int `json:"inactivityMinutes,omitempty"`
+		} `json:"idle"`
+	} `json:"spec"`
+}
+
+func (o *autoScaleRoute) key() string {
+	return o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+// route converts o; the target namespace defaults to the object's own.
+func (o *autoScaleRoute) route() *route {
+	rt := &route{
+		Name:              o.key(),
+		Path:              o.Spec.Path,
+		Kind:              o.Spec.Kind,
+		Subprotocols:      o.Spec.Subprotocols,
+		BackendURL:        o.Spec.Backend.URL,
+		BackendPath:       o.Spec.Backend.Path,
+		Protocol:          o.Spec.Backend.Protocol,
+		Namespace:         o.Spec.Target.Namespace,
+		Deployment:        o.Spec.Target.Deployment,
+		InactivityMinutes: o.Spec.Idle.InactivityMinutes,
+	}
+	if rt.Namespace == "" {
+		rt.Namespace = o.Metadata.Namespace
+	}
+	return rt
+}
+
+func routeCRDPath() string {
+	if routeCRDNamespace == "*" {
+		return fmt.Sprintf("/apis/%s/%s/%s", routeCRDGroup, routeCRDVersion, routeCRDPlural)
+	}
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", routeCRDGroup, routeCRDVersion, url.PathEscape(routeCRDNamespace), routeCRDPlural)
+}
+
+// setupRouteCRD loads the AutoScaleRoute objects and keeps the route table
+// in sync with them. The initial list must succeed so the proxy does not
+// start with an empty table.
+func setupRouteCRD() error {
+	if routeCRDNamespace == "" {
+		return nil
+	}
+	objs := make(map[string]*autoScaleRoute)
+	rv, err := listRouteCRD(objs)
+	if err != nil {
+		return fmt.Errorf("listing AutoScaleRoutes: %w", err)
+	}
+	applyRouteCRD(objs)
+	go watchRouteCRD(objs, rv)
+	return nil
+}
+
+// watchRouteCRD follows changes from resource version rv, relisting when the
+// watch fails or its version has expired.
+func watchRouteCRD(objs map[string]*autoScaleRoute, rv string) {
+	for {
+		var err error
+		if rv == "" {
+			if rv, err = listRouteCRD(objs); err == nil {
+				applyRouteCRD(objs)
+			}
+		}
+		if err == nil {
+			rv, err = streamRouteCRD(objs, rv)
+		}
+		if err != nil {
+			slog.Error("AutoScaleRoute watch failed", "error", err)
+			rv = ""
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// listRouteCRD replaces the contents of objs and returns the list's
+// resource version.
+func listRouteCRD(objs map[string]*autoScaleRoute) (string, error) {
+	req, err := newKubeRequest(http.MethodGet, routeCRDPath(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("K8s API returned %d: %s", resp.StatusCode, data)
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*autoScaleRoute `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	for k := range objs {
+		delete(objs, k)
+	}
+	for _, o := range list.Items {
+		objs[o.key()] = o
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// streamRouteCRD applies watch events until the server ends the watch, and
+// returns the last resource version seen.
+func streamRouteCRD(objs map[string]*autoScaleRoute, rv string) (string, error) {
+	return watchKube(kubeAPIToken(), routeCRDPath(), rv, func(ev kubeEvent) error {
+		var o autoScaleRoute
+		if err := json.Unmarshal(ev.Object, &o); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			objs[o.key()] = &o
+		case "DELETED":
+			delete(objs, o.key())
+		default:
+			return nil
+		}
+		slog.Info("AutoScaleRoute changed", "route", o.key(), "event", ev.Type)
+		applyRouteCRD(objs)
+		return nil
+	})
+}
+
+// applyRouteCRD rebuilds the route table from objs, skipping invalid
+// objects so one bad resource cannot take down the others.
+func applyRouteCRD(objs map[string]*autoScaleRoute) {
+	keys := make([]string, 0, len(objs))
+	for k := range objs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var routes []*route
+	for _, k := range keys {
+		rt := objs[k].route()
+		if _, err := newRouteTable([]*route{rt}); err != nil {
+			slog.Warn("Ignoring invalid AutoScaleRoute", "route", k, "error", err)
+			continue
+		}
+		routes = append(routes, rt)
+	}
+	if err := storeRoutes(routes); err != nil {
+		slog.Error("Failed to apply AutoScaleRoutes", "error", err)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	configFile = getEnv("CONFIG_FILE", "")
+	// routesJSON is a route table given inline, as a JSON array in the
+	// format of the config file's "routes".
+	routesJSON = getEnv("ROUTES_JSON", "")
+
+	routing atomic.Pointer[routeTable]
+)
+
+// config is the optional JSON file named by CONFIG_FILE.
+type config struct {
+	Routes    []*route          `json:"routes"`
+	Listeners []*listenerConfig `json:"listeners,omitempty"`
+}
+
+// route maps a listen path, and optionally the WebSocket subprotocols a
+// client offers on it, to a backend.
+type route struct {
+	Name         string   `json:"name,omitempty"`
+	Path         string   `json:"path"`
+	Kind         string   `json:"kind,omitempty"` // "websocket" (default), "http" for plain/SSE routes or "connect"
+	Subprotocols []string `json:"subprotocols,omitempty"`
+	BackendURL   string   `json:"backend_url"`
+	BackendPath  string   `json:"backend_path"`
+	Protocol     string   `json:"protocol,omitempty"` // health-check preset, see healthPresets
+	// HealthService is the service asked about by the grpc-health preset;
+	// empty for the server as a whole.
+	HealthService string   `json:"health_service,omitempty"`
+	BackendPins   []string `json:"backend_pins,omitempty"` // SPKI SHA-256 pins for TLS backends
+	HostHeader    string   `json:"host_header,omitempty"`  // "backend" (default), "original" or a fixed host
+
+	// The deployment woken for this route and how long it may sit idle;
+	// NAMESPACE, DEPLOYMENT_NAME and INACTIVITY_MINUTES by default.
+	Namespace         string `json:"namespace,omitempty"`
+	Deployment        string `json:"deployment,omitempty"`
+	InactivityMinutes int    `json:"inactivity_minutes,omitempty"`
+	// KubeEndpoint and KubeToken reach the deployment in a cluster other
+	// than KUBE_CLUSTER_ENDPOINT's.
+	KubeEndpoint string `json:"kube_endpoint,omitempty"`
+	KubeToken    string `json:"kube_token,omitempty"`
+	// Region makes the route one of several alternatives on its path; see
+	// regions.go.
+	Region string `json:"region,omitempty"`
+
+	// Schedule sets replica floors by time of day.
+	Schedule replicaSchedule `json:"schedule,omitempty"`
+	KeepWarm *keepWarm       `json:"keep_warm,omitempty"`
+	ReadyLog *readyLogPolicy `json:"ready_log,omitempty"`
+
+	Chaos  *chaosPolicy  `json:"chaos,omitempty"`
+	Mirror *mirrorPolicy `json:"mirror,omitempty"`
+
+	Headers   *headerPolicy `json:"headers,omitempty"`
+	CORS      *corsPolicy   `json:"cors,omitempty"`
+	BasicAuth *basicAuth    `json:"basic_auth,omitempty"`
+	Geo       *geoPolicy    `json:"geo,omitempty"`
+	// TailscaleUsers limits the route to these tailnet logins, "*" for
+	// any, arriving on tailscale listeners.
+	TailscaleUsers []string `json:"tailscale_users,omitempty"`
+
+	target    *url.URL
+	pins      [][]byte
+	discovery *discoverer // set when BackendURL is a srv+ or consul+ URL
+	scale     *scaleTarget
+
+	mu          sync.Mutex
+	lastHealthy time.Time     // when the backend last passed a health check
+	coldSince   time.Time     // when a request first found the backend down
+	lastWarm    time.Time     // when keep_warm last pinged the backend
+	rtt         time.Duration // smoothed health-check round trip
+	scaleFailed time.Time     // when waking the backend last failed
+	checks      flightGroup
+
+	proxyOnce sync.Once
+	proxy     *httputil.ReverseProxy
+}
+
+// routeTable is an immutable snapshot of the configured routes; it is
+// swapped as a whole when the configuration changes.
+type routeTable struct {
+	routes []*route
+	byPath map[string][]*route
+}
+
+// defaultRoutes is the route table used when the config file has none:
+// ROUTES_JSON, or else the single route described by SECRET_PATH,
+// BACKEND_URL and BACKEND_PATH.
+func defaultRoutes() ([]*route, error) {
+	if routesJSON != "" {
+		cfg, err := parseConfig([]byte(`{"routes": ` + routesJSON + `}`))
+		if err != nil {
+			return nil, fmt.Errorf("ROUTES_JSON: %w", err)
+		}
+		if len(cfg.Routes) == 0 {
+			return nil, fmt.Errorf("ROUTES_JSON has no routes")
+		}
+		return cfg.Routes, nil
+	}
+	return []*route{{
+		Path:        secretPath,
+		BackendURL:  backendTargetURL,
+		BackendPath: backendPath,
+	}}, nil
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*config, error) {
+	data, err := expandConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return &cfg, nil
+}
+
+func loadRoutes() ([]*route, error) {
+	if configFile == "" {
+		return defaultRoutes()
+	}
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Routes) == 0 {
+		return defaultRoutes()
+	}
+	if routesJSON != "" {
+		return nil, fmt.Errorf("routes are set in both CONFIG_FILE and ROUTES_JSON")
+	}
+	return cfg.Routes, nil
+}
+
+func newRouteTable(routes []*route) (*routeTable, error) {
+	if err := validateRoutes(routes); err != nil {
+		return nil, err
+	}
+	t := &routeTable{routes: routes, byPath: make(map[string][]*route)}
+	for i, rt := range routes {
+		if isDiscoveryURL(rt.target) {
+			var err error
+			if rt.discovery, err = discovererFor(rt.target); err != nil {
+				return nil, fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		rt.scale = targetFor(rt.KubeEndpoint, rt.KubeToken, rt.Namespace, rt.Deployment)
+		if rt.Kind != "connect" {
+			t.byPath[rt.Path] = append(t.byPath[rt.Path], rt)
+		}
+	}
+	return t, nil
+}
+
+// validateRoutes checks routes and fills in their defaults without starting
+// anything, so candidate configurations can be checked too.
+func validateRoutes(routes []*route) error {
+	for i, rt := range routes {
+		switch rt.Kind {
+		case "":
+			rt.Kind = "websocket"
+		case "websocket", "http", "connect":
+		default:
+			return fmt.Errorf("route %d: unknown kind %q", i, rt.Kind)
+		}
+		// CONNECT requests have no path; connect routes go by listener.
+		if rt.Kind != "connect" && !strings.HasPrefix(rt.Path, "/") {
+			return fmt.Errorf("route %d: path %q must start with /", i, rt.Path)
+		}
+		if rt.BackendURL == "" {
+			rt.BackendURL = backendTargetURL
+		}
+		if rt.BackendPath == "" {
+			rt.BackendPath = backendPath
+		}
+		target, err := url.Parse(rt.BackendURL)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("route %d: invalid backend URL %q", i, rt.BackendURL)
+		}
+		rt.target = target
+		if isDiscoveryURL(target) {
+			if err := checkDiscoveryURL(target); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		switch rt.HostHeader {
+		case "":
+			rt.HostHeader = "backend"
+		case "backend", "original":
+		default:
+			if u, err := url.Parse("http://" + rt.HostHeader); err != nil || u.Host != rt.HostHeader {
+				return fmt.Errorf("route %d: invalid host_header %q", i, rt.HostHeader)
+			}
+		}
+		if rt.Protocol == "" && rt.Kind == "connect" {
+			// A forward proxy has no path to probe.
+			rt.Protocol = "tcp"
+		}
+		if rt.Protocol == "" {
+			rt.Protocol = healthCheckProtocol
+		}
+		if _, ok := healthPresets[rt.Protocol]; !ok {
+			return fmt.Errorf("route %d: unknown protocol %q", i, rt.Protocol)
+		}
+		if len(rt.BackendPins) == 0 && backendSPKIPins != "" {
+			rt.BackendPins = strings.Split(backendSPKIPins, ",")
+		}
+		if rt.pins, err = parsePins(rt.BackendPins); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		if rt.Headers != nil {
+			if err := rt.Headers.validate(); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if rt.BasicAuth != nil {
+			if err := rt.BasicAuth.validate(); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if rt.Geo != nil {
+			if err := rt.Geo.validate(); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if err := rt.Schedule.validate(); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		if rt.KeepWarm != nil {
+			if err := rt.KeepWarm.validate(); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if err := validateRegion(rt); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		if rt.ReadyLog != nil {
+			if err := rt.ReadyLog.validate(); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if rt.Chaos != nil {
+			if err := rt.Chaos.validate(); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if rt.Mirror != nil {
+			if err := rt.Mirror.validate(); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+		if rt.Namespace == "" {
+			rt.Namespace = kubeNamespace
+		}
+		if rt.Deployment == "" {
+			rt.Deployment = deploymentName
+		}
+		if rt.InactivityMinutes <= 0 {
+			rt.InactivityMinutes = inactivityMinutes
+		}
+		if rt.Name == "" && rt.Kind == "connect" {
+			rt.Name = "connect"
+		}
+		if rt.Name == "" {
+			rt.Name = rt.Path
+			if len(rt.Subprotocols) > 0 {
+				rt.Name += "#" + strings.Join(rt.Subprotocols, "+")
+			}
+			if rt.Region != "" {
+				rt.Name += "@" + rt.Region
+			}
+		}
+	}
+	// Admin actions, listener route lists and config diffs find routes by
+	// name.
+	seen := make(map[string]int, len(routes))
+	for i, rt := range routes {
+		if j, ok := seen[rt.Name]; ok {
+			return fmt.Errorf("route %d: name %q is already used by route %d; set a distinct name", i, rt.Name, j)
+		}
+		seen[rt.Name] = i
+	}
+	return nil
+}
+
+// backendTarget returns the backend to use for the next request, or nil if
+// discovery currently knows of no endpoint.
+func (rt *route) backendTarget() *url.URL {
+	if rt.discovery != nil {
+		return rt.discovery.pick()
+	}
+	return rt.target
+}
+
+// backendHost returns the Host header to send to target for r, following
+// the route's host_header.
+func (rt *route) backendHost(r *http.Request, target *url.URL) string {
+	switch rt.HostHeader {
+	case "original":
+		return r.Host
+	case "", "backend":
+		return target.Host
+	}
+	return rt.HostHeader
+}
+
+// match picks the route for r: among the routes on its path, the first whose
+// subprotocols include one offered by the client, else the first route on
+// the path without subprotocols, then the nearest of its regions if it has
+// any. CONNECT requests go to connect routes.
+func (t *routeTable) match(r *http.Request) *route {
+	rt := t.matchPath(r)
+	if rt != nil && rt.Region != "" {
+		return t.nearestRegion(rt)
+	}
+	return rt
+}
+
+func (t *routeTable) matchPath(r *http.Request) *route {
+	if r.Method == http.MethodConnect {
+		return t.matchConnect(r)
+	}
+	candidates := t.byPath[r.URL.Path]
+	if rt := pluginPick(r, candidates); rt != nil {
+		return rt
+	}
+	offered := offeredSubprotocols(r)
+	var fallback *route
+	for _, rt := range candidates {
+		if len(rt.Subprotocols) == 0 {
+			if fallback == nil {
+				fallback = rt
+			}
+			continue
+		}
+		for _, p := range rt.Subprotocols {
+			if offered[p] {
+				return rt
+			}
+		}
+	}
+	return fallback
+}
+
+func (t *routeTable) byName(name string) *route {
+	for _, rt := range t.routes {
+		if rt.Name == name {
+			return rt
+		}
+	}
+	return nil
+}
+
+// offeredSubprotocols returns the Sec-WebSocket-Protocol tokens of r, which
+// may be spread over several comma-separated header lines.
+func offeredSubprotocols(r *http.Request) map[string]bool {
+	offered := make(map[string]bool)
+	for _, line := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(line, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				offered[p] = true
+			}
+		}
+	}
+	return offered
+}
+
+func setupRoutes() error {
+	routes, err := loadRoutes()
+	if err != nil {
+		return err
+	}
+	return storeRoutes(routes)
+}
+
+// storeRoutes validates routes and makes them the live route table.
+func storeRoutes(routes []*route) error {
+	t, err := newRouteTable(routes)
+	if err != nil {
+		return err
+	}
+	routing.Store(t)
+	for _, rt := range t.routes {
+		if rt.Kind == "connect" {
+			slog.Info("Route", "route", rt.Name, "kind", rt.Kind, "backend", rt.BackendURL, "deployment", rt.scale.String())
+		} else {
+			slog.Info("Route", "route", rt.Name, "kind", rt.Kind, "path", rt.Path, "backend", rt.BackendURL, "backend_path", rt.BackendPath, "deployment", rt.scale.String())
+		}
+		if rt.Chaos != nil {
+			slog.Warn("Route injects faults", "route", rt.Name, "chaos", fmt.Sprintf("%+v", *rt.Chaos))
+		}
+	}
+	return nil
+}
+
+// resetBackendHealth forgets cached health results of the routes served by
+// t, e.g. after scaling it.
+func resetBackendHealth(t *scaleTarget) {
+	for _, rt := range routing.Load().routes {
+		if rt.scale != t {
+			continue
+		}
+		rt.mu.Lock()
+		rt.lastHealthy = time.Time{}
+		rt.mu.Unlock()
+	}
+}
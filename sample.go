@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync"
+)
+
+var (
+	payloadSampleRate    = getEnvAsInt("PAYLOAD_SAMPLE_RATE", 0) // log 1 in N frames per route, 0 disables
+	payloadSampleBytes   = getEnvAsInt("PAYLOAD_SAMPLE_BYTES", 256)
+	payloadSampleHex     = getEnvAsBool("PAYLOAD_SAMPLE_HEX", false)
+	payloadRedactPattern = getEnv("PAYLOAD_REDACT_REGEX", "")
+
+	payloadSampler = &sampler{counts: make(map[string]uint64)}
+)
+
+// payloadRedactor rewrites a sampled payload before it is logged. Redactors
+// run in registration order and must not retain p.
+type payloadRedactor func(route string, p []byte) []byte
+
+var payloadRedactors []payloadRedactor
+
+func registerPayloadRedactor(fn payloadRedactor) {
+	payloadRedactors = append(payloadRedactors, fn)
+}
+
+func setupPayloadSampling() error {
+	if payloadSampleRate <= 0 {
+		return nil
+	}
+	if !frameMode() {
+		slog.Warn("PAYLOAD_SAMPLE_RATE is set but PROXY_MODE is not \"frame\"; payload sampling is inactive")
+		return nil
+	}
+	if payloadRedactPattern != "" {
+		re, err := regexp.Compile(payloadRedactPattern)
+		if err != nil {
+			return fmt.Errorf("invalid PAYLOAD_REDACT_REGEX: %w", err)
+		}
+		registerPayloadRedactor(func(route string, p []byte) []byte {
+			return re.ReplaceAll(p, []byte("[REDACTED]"))
+		})
+	}
+	slog.Info("Payload sampling enabled", "one_in", payloadSampleRate, "max_bytes", payloadSampleBytes)
+	return nil
+}
+
+// sampler picks every Nth frame of each route for payload logging.
+type sampler struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (s *sampler) pick(route string) bool {
+	if payloadSampleRate <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[route]++
+	return s.counts[route]%uint64(payloadSampleRate) == 0
+}
+
+func (s *sampler) log(sess *session, dir string, f *wsFrame, payload []byte) {
+	p := payload
+	for _, redact := range payloadRedactors {
+		p = redact(sess.route, p)
+	}
+	payloadAttr := slog.String("payload", string(p))
+	if payloadSampleHex {
+		payloadAttr = slog.String("payload_hex", hex.Dump(p))
+	}
+	sess.logger().Info("Sampled frame", "opcode", opcodeName(f.opcode), "dir", dir, "len", len(p), "truncated", f.length > uint64(len(payload)), "frame_len", f.length, payloadAttr)
+}
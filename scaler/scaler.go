@@ -0,0 +1,37 @@
+// Package scaler defines what the proxy needs from whatever runs its
+// backends: setting how many replicas there are and telling how many are
+// ready. The Kubernetes scaler is built in; other platforms (Docker, Nomad,
+// ECS, a script) plug in by implementing Scaler, and package scalertest
+// checks that they behave the way the proxy expects.
+package scaler
+
+import "errors"
+
+// Scaler scales one workload.
+type Scaler interface {
+	// Scale sets the workload's replicas. Asking for the replicas it
+	// already has succeeds and changes nothing.
+	Scale(replicas int) error
+	// Ready returns how many replicas are ready to serve; a workload
+	// scaled to zero has none, which is not an error.
+	Ready() (int, error)
+}
+
+// Errors returned by a Scaler wrap one of these when the platform says why
+// it refused, so callers can tell a retry from a misconfiguration.
+var (
+	// ErrUnauthorized: the credentials were rejected or lack permission.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound: the workload does not exist.
+	ErrNotFound = errors.New("workload not found")
+	// ErrConflict: the workload changed underneath the call.
+	ErrConflict = errors.New("conflicting change")
+	// ErrThrottled: the platform asked to slow down.
+	ErrThrottled = errors.New("throttled")
+)
+
+// Temporary reports whether err is likely to go away if the call is simply
+// made again.
+func Temporary(err error) bool {
+	return errors.Is(err, ErrConflict) || errors.Is(err, ErrThrottled)
+}
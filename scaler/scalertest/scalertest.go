@@ -0,0 +1,149 @@
+// Package scalertest is the conformance suite for scaler.Scaler
+// implementations. A new scaler passes it before the proxy can rely on it:
+//
+//	func TestConformance(t *testing.T) {
+//		scalertest.Run(t, func(t *testing.T) *scalertest.Backend {
+//			w := startWorkload(t) // zero replicas
+//			return &scalertest.Backend{Scaler: newScaler(w), Replicas: w.replicas}
+//		})
+//	}
+package scalertest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"auto_scale/scaler"
+)
+
+// Backend is a scaler under test together with what the suite needs to
+// look at and disturb the platform behind it.
+type Backend struct {
+	// Scaler scales a workload that exists and has zero replicas.
+	Scaler scaler.Scaler
+	// Replicas returns the replicas the platform has the workload set to.
+	Replicas func() int
+	// Fail makes the platform refuse the next call for the reason class
+	// stands for, scaler.ErrConflict or scaler.ErrThrottled. Without it
+	// those tests are skipped.
+	Fail func(class error)
+	// Unauthorized scales the same workload with credentials the platform
+	// rejects, and Missing a workload that does not exist; either may be
+	// nil to skip its test.
+	Unauthorized scaler.Scaler
+	Missing      scaler.Scaler
+	// ReadyTimeout is how long replicas may take to become ready; 10
+	// seconds if zero.
+	ReadyTimeout time.Duration
+}
+
+// Run runs the suite. newBackend is called for each test and should start
+// from a fresh workload.
+func Run(t *testing.T, newBackend func(t *testing.T) *Backend) {
+	t.Run("Idempotent", func(t *testing.T) { testIdempotent(t, newBackend(t)) })
+	t.Run("Ready", func(t *testing.T) { testReady(t, newBackend(t)) })
+	for _, class := range []error{scaler.ErrConflict, scaler.ErrThrottled} {
+		t.Run("Temporary/"+class.Error(), func(t *testing.T) { testTemporary(t, newBackend(t), class) })
+	}
+	t.Run("Unauthorized", func(t *testing.T) { testUnauthorized(t, newBackend(t)) })
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, newBackend(t)) })
+}
+
+func testIdempotent(t *testing.T, b *Backend) {
+	for _, n := range []int{2, 2, 0, 0} {
+		if err := b.Scaler.Scale(n); err != nil {
+			t.Fatalf("Scale(%d): %v", n, err)
+		}
+		if got := b.Replicas(); got != n {
+			t.Fatalf("replicas after Scale(%d) = %d", n, got)
+		}
+	}
+}
+
+func testReady(t *testing.T, b *Backend) {
+	if n, err := b.Scaler.Ready(); err != nil || n != 0 {
+		t.Fatalf("Ready() at zero replicas = %d, %v; want 0, nil", n, err)
+	}
+	for _, want := range []int{2, 0} {
+		if err := b.Scaler.Scale(want); err != nil {
+			t.Fatalf("Scale(%d): %v", want, err)
+		}
+		waitReady(t, b, want)
+	}
+}
+
+// waitReady polls until b reports want ready replicas, failing if it
+// reports more than it was scaled to or takes too long.
+func waitReady(t *testing.T, b *Backend, want int) {
+	t.Helper()
+	timeout := b.ReadyTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := b.Scaler.Ready()
+		switch {
+		case err != nil:
+			t.Fatalf("Ready(): %v", err)
+		case n == want:
+			return
+		case want > 0 && n > want:
+			t.Fatalf("Ready() = %d after scaling to %d", n, want)
+		case time.Now().After(deadline):
+			t.Fatalf("Ready() = %d after %s, want %d", n, timeout, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func testTemporary(t *testing.T, b *Backend, class error) {
+	if b.Fail == nil {
+		t.Skip("the backend cannot inject failures")
+	}
+	if err := b.Scaler.Scale(1); err != nil {
+		t.Fatalf("Scale(1): %v", err)
+	}
+	b.Fail(class)
+	err := b.Scaler.Scale(3)
+	if !errors.Is(err, class) || !scaler.Temporary(err) {
+		t.Fatalf("Scale(3) = %v, want a temporary error wrapping %q", err, class)
+	}
+	if got := b.Replicas(); got != 1 {
+		t.Fatalf("replicas after a refused Scale(3) = %d, want 1", got)
+	}
+	if err := b.Scaler.Scale(3); err != nil {
+		t.Fatalf("Scale(3) again: %v", err)
+	}
+	if got := b.Replicas(); got != 3 {
+		t.Fatalf("replicas after retrying Scale(3) = %d", got)
+	}
+}
+
+func testUnauthorized(t *testing.T, b *Backend) {
+	if b.Unauthorized == nil {
+		t.Skip("the backend has no credentials to get wrong")
+	}
+	if err := b.Unauthorized.Scale(1); !errors.Is(err, scaler.ErrUnauthorized) || scaler.Temporary(err) {
+		t.Fatalf("Scale(1) with bad credentials = %v, want a permanent error wrapping %q", err, scaler.ErrUnauthorized)
+	}
+	if got := b.Replicas(); got != 0 {
+		t.Fatalf("replicas after an unauthorized Scale(1) = %d, want 0", got)
+	}
+	if _, err := b.Unauthorized.Ready(); !errors.Is(err, scaler.ErrUnauthorized) {
+		t.Fatalf("Ready() with bad credentials = %v, want one wrapping %q", err, scaler.ErrUnauthorized)
+	}
+}
+
+func testNotFound(t *testing.T, b *Backend) {
+	if b.Missing == nil {
+		t.Skip("the backend cannot name a missing workload")
+	}
+	if err := b.Missing.Scale(1); !errors.Is(err, scaler.ErrNotFound) || scaler.Temporary(err) {
+		t.Fatalf("Scale(1) of a missing workload = %v, want a permanent error wrapping %q", err, scaler.ErrNotFound)
+	}
+	if _, err := b.Missing.Ready(); !errors.Is(err, scaler.ErrNotFound) {
+		t.Fatalf("Ready() of a missing workload = %v, want one wrapping %q", err, scaler.ErrNotFound)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// timeWindow is a time of day from From to To ("15:04", local time; a To
+// before From runs past midnight) on Days ("mon".."sun", every day if
+// empty).
+type timeWindow struct {
+	Days []string `json:"days,omitempty"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+
+	days     map[time.Weekday]bool
+	from, to int // minutes since midnight
+}
+
+// replicaWindow keeps at least Replicas running during its window.
+type replicaWindow struct {
+	timeWindow
+	Replicas int `json:"replicas"`
+}
+
+// replicaSchedule is a route's replica floors by time of day; traffic can
+// scale above them but inactivity only scales down to them.
+type replicaSchedule []*replicaWindow
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (s replicaSchedule) validate() error {
+	for i, w := range s {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("schedule %d: %w", i, err)
+		}
+		if w.Replicas < 0 {
+			return fmt.Errorf("schedule %d: negative replicas", i)
+		}
+	}
+	return nil
+}
+
+func (w *timeWindow) validate() error {
+	var err error
+	if w.from, err = parseClock(w.From); err != nil {
+		return err
+	}
+	if w.to, err = parseClock(w.To); err != nil {
+		return err
+	}
+	if len(w.Days) > 0 {
+		w.days = make(map[time.Weekday]bool)
+		for _, d := range w.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return fmt.Errorf("unknown day %q", d)
+			}
+			w.days[wd] = true
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether now falls in w. The part of an overnight window
+// after midnight belongs to the day it started on.
+func (w *timeWindow) contains(now time.Time) bool {
+	m := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	switch {
+	case w.from <= w.to:
+		if m < w.from || m >= w.to {
+			return false
+		}
+	case m >= w.from:
+	case m < w.to:
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	return w.days == nil || w.days[day]
+}
+
+// floor returns the most replicas any window containing now asks for.
+func (s replicaSchedule) floor(now time.Time) int {
+	n := 0
+	for _, w := range s {
+		if w.Replicas > n && w.contains(now) {
+			n = w.Replicas
+		}
+	}
+	return n
+}
+
+// scheduleFloors returns the replica floor of every deployment at now, at
+// least MIN_REPLICAS.
+func scheduleFloors(now time.Time) map[*scaleTarget]int {
+	floors := make(map[*scaleTarget]int)
+	for _, rt := range routing.Load().routes {
+		n := max(rt.Schedule.floor(now), minReplicas)
+		if cur, ok := floors[rt.scale]; !ok || n > cur {
+			floors[rt.scale] = n
+		}
+	}
+	return floors
+}
+
+// scheduleWatcher raises deployments to their scheduled floor as windows
+// open, and to MIN_REPLICAS. Lowering is left to the inactivity watcher.
+func scheduleWatcher() {
+	for {
+		for t, n := range scheduleFloors(clk.Now()) {
+			if n == 0 || !isActive() || t.overridden() {
+				continue
+			}
+			t.mu.Lock()
+			below := t.lastScaledReplicas < n
+			t.mu.Unlock()
+			if !below {
+				continue
+			}
+			lg := slog.With("deployment", t.String(), "replicas", n, "cause", "schedule")
+			lg.Info("Raising deployment to its scheduled floor")
+			if err := scaleDeployment(t, n, "schedule"); err != nil {
+				lg.Error("Error scaling deployment", "error", err)
+			}
+		}
+		now := clk.Now()
+		clk.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+	}
+}
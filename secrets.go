@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	vaultAddr = getEnv("VAULT_ADDR", "http://127.0.0.1:8200")
+	// vaultRole logs in with the pod's service account token (Kubernetes
+	// auth method) instead of VAULT_TOKEN.
+	vaultRole            = getEnv("VAULT_ROLE", "")
+	vaultAuthPath        = getEnv("VAULT_AUTH_PATH", "kubernetes")
+	vaultJWTFile         = getEnv("VAULT_JWT_FILE", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	secretRefreshSeconds = getEnvAsInt("SECRET_REFRESH_SECONDS", 300)
+
+	secretsMu  sync.Mutex
+	allSecrets []*secret
+
+	kubeToken = newSecret("KUBE_CLUSTER_TOKEN")
+)
+
+// secret is a credential taken from an environment variable whose value is
+// either the secret itself or a reference resolved at startup and then
+// refreshed every SECRET_REFRESH_SECONDS:
+//
+//	vault:secret/data/proxy#kube_token   a field of a Vault KV secret
+//	exec:/usr/local/bin/get-token arg    the trimmed stdout of a command
+type secret struct {
+	env string
+	ref string
+
+	mu    sync.RWMutex
+	value string
+}
+
+func newSecret(env string) *secret {
+	s := &secret{env: env}
+	v := os.Getenv(env)
+	if strings.HasPrefix(v, "vault:") || strings.HasPrefix(v, "exec:") {
+		s.ref = v
+	} else {
+		s.value = v
+	}
+	secretsMu.Lock()
+	allSecrets = append(allSecrets, s)
+	secretsMu.Unlock()
+	return s
+}
+
+func (s *secret) get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// set replaces the value, reporting whether it changed.
+func (s *secret) set(v string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.value != v
+	s.value = v
+	return changed
+}
+
+func (s *secret) refresh() error {
+	var v string
+	var err error
+	switch {
+	case strings.HasPrefix(s.ref, "vault:"):
+		v, err = readVault(strings.TrimPrefix(s.ref, "vault:"))
+	case strings.HasPrefix(s.ref, "exec:"):
+		v, err = readExec(strings.TrimPrefix(s.ref, "exec:"))
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.env, err)
+	}
+	s.mu.Lock()
+	changed := s.value != "" && s.value != v
+	s.value = v
+	s.mu.Unlock()
+	if changed {
+		slog.Info("Secret rotated", "secret", s.env)
+	}
+	return nil
+}
+
+// setupSecrets resolves every secret reference; a secret that can't be read
+// at startup is fatal, while later refresh failures keep the last value.
+func setupSecrets() error {
+	secretsMu.Lock()
+	list := append([]*secret(nil), allSecrets...)
+	secretsMu.Unlock()
+
+	var refs []*secret
+	for _, s := range list {
+		if s.ref == "" {
+			continue
+		}
+		if err := s.refresh(); err != nil {
+			return err
+		}
+		refs = append(refs, s)
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	if secretRefreshSeconds <= 0 {
+		return fmt.Errorf("SECRET_REFRESH_SECONDS must be positive")
+	}
+	go func() {
+		for range time.Tick(time.Duration(secretRefreshSeconds) * time.Second) {
+			for _, s := range refs {
+				if err := s.refresh(); err != nil {
+					slog.Error("Failed to refresh secret", "secret", s.env, "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func readExec(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty exec command")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// readVault reads field from the secret at path, which is given as in the
+// HTTP API (e.g. secret/data/proxy for KV version 2).
+func readVault(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", fmt.Errorf("vault reference %q needs a #field", ref)
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(vaultAddr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	data := body.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner // KV version 2
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no string field %q", path, field)
+	}
+	return v, nil
+}
+
+// vaultToken returns VAULT_TOKEN, or logs in with the service account token
+// when VAULT_ROLE is set. Logins are short-lived, so this happens on every
+// refresh rather than managing lease renewal.
+func vaultToken() (string, error) {
+	if vaultRole == "" {
+		if t := os.Getenv("VAULT_TOKEN"); t != "" {
+			return t, nil
+		}
+		return "", fmt.Errorf("neither VAULT_TOKEN nor VAULT_ROLE set")
+	}
+	jwt, err := os.ReadFile(vaultJWTFile)
+	if err != nil {
+		return "", err
+	}
+	body, _ := json.Marshal(map[string]string{"role": vaultRole, "jwt": strings.TrimSpace(string(jwt))})
+	resp, err := httpClient.Post(strings.TrimSuffix(vaultAddr, "/")+"/v1/auth/"+vaultAuthPath+"/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault login returned %s", resp.Status)
+	}
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		return "", err
+	}
+	return login.Auth.ClientToken, nil
+}
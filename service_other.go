@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Elsewhere service managers (systemd, launchd) run the proxy as a plain
+// process and stop it with SIGTERM.
+
+func startService() {}
+
+func runServiceCommand(args []string) int {
+	fmt.Fprintln(os.Stderr, "the service command is only available on Windows")
+	return 2
+}
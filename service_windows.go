@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the Windows service and event log source the proxy runs
+// as.
+var serviceName = getEnv("SERVICE_NAME", "auto-scale-ws-proxy")
+
+// startService hooks the proxy up to the service control manager when it
+// was started as a Windows service; logs then go to the event log.
+func startService() {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return
+	}
+	if el, err := eventlog.Open(serviceName); err == nil {
+		log.SetFlags(0)
+		log.SetOutput(eventLogWriter{el})
+	}
+	go func() {
+		if err := svc.Run(serviceName, serviceHandler{}); err != nil {
+			fatal("Windows service failed", err)
+		}
+	}()
+}
+
+type serviceHandler struct{}
+
+func (serviceHandler) Execute(args []string, reqs <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range reqs {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			stop("service stop")
+		}
+	}
+	return false, 0
+}
+
+// eventLogWriter sends each log record to the event log at the level slog
+// gave it, in either LOG_FORMAT.
+type eventLogWriter struct {
+	el *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	var err error
+	switch {
+	case strings.Contains(msg, "level=ERROR") || strings.Contains(msg, `"level":"ERROR"`):
+		err = w.el.Error(1, msg)
+	case strings.Contains(msg, "level=WARN") || strings.Contains(msg, `"level":"WARN"`):
+		err = w.el.Warning(1, msg)
+	default:
+		err = w.el.Info(1, msg)
+	}
+	return len(p), err
+}
+
+// runServiceCommand implements "service install" and "service uninstall",
+// registering the current binary as an automatically started service. The
+// environment for the service is read from the registry's Environment value
+// of the service key, which sc.exe or the registry editor can set.
+func runServiceCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: auto_scale service install|uninstall")
+		return 2
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		slog.Error("Failed to connect to the service manager", "error", err)
+		return 1
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			slog.Error("Failed to find the executable", "error", err)
+			return 1
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "Auto-scaling WebSocket proxy",
+			StartType:   mgr.StartAutomatic,
+		})
+		if err != nil {
+			slog.Error("Failed to install the service", "service", serviceName, "error", err)
+			return 1
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			slog.Warn("Failed to register event log source", "service", serviceName, "error", err)
+		}
+		slog.Info("Installed service", "service", serviceName)
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			slog.Error("Failed to open the service", "service", serviceName, "error", err)
+			return 1
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			slog.Error("Failed to remove the service", "service", serviceName, "error", err)
+			return 1
+		}
+		eventlog.Remove(serviceName)
+		slog.Info("Removed service", "service", serviceName)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: auto_scale service install|uninstall")
+		return 2
+	}
+	return 0
+}
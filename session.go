@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// proxyMode selects how upgraded connections are relayed: "stream" copies
+	// raw bytes, "frame" additionally decodes WebSocket frames on the fly so
+	// per-frame features (sampling, limits, metrics) can observe them.
+	proxyMode = getEnv("PROXY_MODE", "stream")
+
+	pingIntervalSeconds = getEnvAsInt("PING_INTERVAL_SECONDS", 30) // frame mode only, 0 disables
+	peerTimeoutSeconds  = getEnvAsInt("PEER_TIMEOUT_SECONDS", 90)
+	tcpKeepAliveSeconds = getEnvAsInt("TCP_KEEPALIVE_SECONDS", 30)
+	maxMessageBytes     = getEnvAsInt("MAX_MESSAGE_BYTES", 0) // frame mode only, 0 means unlimited
+	// maxBufferedBytes caps the frame payload a session holds in memory at
+	// once, in both directions together; only recording holds payload, as
+	// everything else is relayed as it arrives. 0 means recordBufferedBytes.
+	maxBufferedBytes = getEnvAsInt("MAX_BUFFERED_BYTES", 0)
+	// firstDataSeconds closes upgraded sessions whose client sends nothing
+	// this long after the upgrade; 0 disables.
+	firstDataSeconds = getEnvAsInt("FIRST_DATA_TIMEOUT_SECONDS", 0)
+
+	lastSessionID atomic.Uint64
+	sessions      = &sessionRegistry{m: make(map[uint64]*session)}
+)
+
+// recordBufferedBytes is the limit on what a recorded session buffers
+// without MAX_BUFFERED_BYTES, so a huge frame cannot exhaust memory.
+const recordBufferedBytes = 64 << 20
+
+func frameMode() bool {
+	return proxyMode == "frame"
+}
+
+// setupSessions checks PROXY_MODE and the settings that only work in frame
+// mode, which would otherwise be silently ignored.
+func setupSessions() error {
+	switch proxyMode {
+	case "stream", "frame":
+	default:
+		return fmt.Errorf("PROXY_MODE must be stream or frame, not %q", proxyMode)
+	}
+	if frameMode() {
+		return nil
+	}
+	if maxMessageBytes > 0 {
+		return fmt.Errorf("MAX_MESSAGE_BYTES needs PROXY_MODE=frame")
+	}
+	if maxBufferedBytes > 0 {
+		return fmt.Errorf("MAX_BUFFERED_BYTES needs PROXY_MODE=frame")
+	}
+	return nil
+}
+
+// session is one proxied request that may upgrade into a long-lived tunnel.
+type session struct {
+	id        uint64
+	requestID string
+	rt        *route
+	route     string
+	remote    string
+	identity  string // authenticated user, if any
+	started   time.Time
+
+	conn    *tapConn     // client side, set once the connection is hijacked
+	backend *backendConn // backend side, set when the backend answers 101
+	rec     *recorder    // non-nil while the session is being recorded
+	mirror  *mirrorConn  // non-nil while client traffic is mirrored
+
+	status    atomic.Int32 // response status of non-upgraded requests
+	bytesUp   atomic.Int64 // client to backend
+	bytesDown atomic.Int64 // backend to client
+	buffered  atomic.Int64 // payload held for frames in progress
+}
+
+type sessionKey struct{}
+
+func newSession(r *http.Request, rt *route) *session {
+	sessionsTotal.inc(rt.Name)
+	return &session{
+		id:        lastSessionID.Add(1),
+		requestID: r.Header.Get(requestIDHeader),
+		rt:        rt,
+		route:     rt.Name,
+		remote:    clientIP(r),
+		started:   time.Now(),
+	}
+}
+
+// logger returns the default logger with the fields identifying s.
+func (s *session) logger() *slog.Logger {
+	return slog.With("session", s.id, "request_id", s.requestID, "client", s.remote, "route", s.route)
+}
+
+// attach returns r carrying s so the reverse proxy hooks can find it.
+func (s *session) attach(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, s))
+}
+
+func sessionFrom(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+// responseWriter wraps w so the client connection is tapped when the reverse
+// proxy hijacks it for a protocol upgrade.
+func (s *session) responseWriter(w http.ResponseWriter) http.ResponseWriter {
+	return &sessionWriter{ResponseWriter: w, s: s}
+}
+
+// closeWith ends the session, telling both peers why with the close code
+// mapped to reason. Frames are only sent in frame mode, where the proxy knows
+// where it is safe to splice them into the streams.
+func (s *session) closeWith(reason string) {
+	cc := closeCodeFor(reason)
+	if b := s.backend; b != nil {
+		b.injectClose(cc)
+	}
+	if c := s.conn; c != nil {
+		c.injectClose(cc)
+		c.Close()
+	}
+}
+
+type sessionWriter struct {
+	http.ResponseWriter
+	s *session
+}
+
+func (w *sessionWriter) WriteHeader(code int) {
+	w.s.status.CompareAndSwap(0, int32(code))
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	w.s.status.CompareAndSwap(0, http.StatusOK)
+	n, err := w.ResponseWriter.Write(b)
+	w.s.bytesDown.Add(int64(n))
+	return n, err
+}
+
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *sessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := conn
+	if tc, ok := conn.(*tls.Conn); ok {
+		raw = tc.NetConn()
+	}
+	if tcp, ok := raw.(*net.TCPConn); ok && tcpKeepAliveSeconds > 0 {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(time.Duration(tcpKeepAliveSeconds) * time.Second)
+	}
+	// The 101 response is written through brw straight to conn, so the tap
+	// only ever sees the upgraded byte stream.
+	w.s.rec = newRecorder(w.s, w.s.rt)
+	w.s.conn = newTapConn(conn, w.s)
+	sessions.add(w.s)
+	return w.s.conn, brw, nil
+}
+
+// tapUpgradeResponse is the reverse proxy's ModifyResponse hook. It wraps the
+// backend side of an upgraded connection so the session can observe and
+// inject upstream frames.
+func tapUpgradeResponse(resp *http.Response) error {
+	s := sessionFrom(resp.Request.Context())
+	if s == nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil
+	}
+	rwc, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return nil
+	}
+	s.backend = newBackendConn(rwc, s)
+	resp.Body = s.backend
+	s.mirror = startMirror(s, resp)
+	return nil
+}
+
+// sessionRegistry tracks upgraded sessions that are still open.
+type sessionRegistry struct {
+	mu sync.Mutex
+	m  map[uint64]*session
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[s.id] = s
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, s.id)
+}
+
+// count is the active-connection gauge.
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.m)
+}
+
+func (r *sessionRegistry) list() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*session, 0, len(r.m))
+	for _, s := range r.m {
+		list = append(list, s)
+	}
+	return list
+}
+
+// closeAll ends every open session with the close code mapped to reason.
+func (r *sessionRegistry) closeAll(reason string) int {
+	list := r.list()
+	for _, s := range list {
+		s.closeWith(reason)
+	}
+	return len(list)
+}
+
+// closeTarget ends the open sessions whose route scales t.
+func (r *sessionRegistry) closeTarget(t *scaleTarget, reason string) int {
+	n := 0
+	for _, s := range r.list() {
+		if s.rt.scale == t {
+			s.closeWith(reason)
+			n++
+		}
+	}
+	return n
+}
+
+// tapConn is the hijacked client connection. Reads carry client→backend
+// bytes and writes carry backend→client ("down") bytes.
+type tapConn struct {
+	net.Conn
+	s *session
+
+	wmu  sync.Mutex // serializes relayed writes with frames injected by the proxy
+	down *wsFrameParser
+	obs  *frameObserver
+
+	lastRead  atomic.Int64 // unix nanos of the last bytes received from the client
+	upRate    throttle
+	downRate  throttle
+	startOnce sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newTapConn(conn net.Conn, s *session) *tapConn {
+	c := &tapConn{Conn: conn, s: s, done: make(chan struct{})}
+	c.lastRead.Store(clk.Now().UnixNano())
+	c.upRate = newThrottle(s, "up", sessionUpBPS, identityUpBPS)
+	c.downRate = newThrottle(s, "down", sessionDownBPS, identityDownBPS)
+	// CONNECT tunnels carry no WebSocket frames.
+	if frameMode() && s.rt.Kind != "connect" {
+		c.obs = &frameObserver{s: s, dir: "down"}
+		c.down = newWSFrameParser(c.obs)
+	}
+	return c
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	// The relay only starts reading once the 101 response has been flushed,
+	// so from here on frames may be injected.
+	c.startOnce.Do(c.start)
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastRead.Store(clk.Now().UnixNano())
+		c.s.bytesUp.Add(int64(n))
+		c.upRate.wait(n)
+		if m := c.s.mirror; m != nil {
+			m.feed(b[:n])
+		}
+	}
+	return n, err
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.down != nil && c.down.atBoundary() && c.s.rt.Chaos.dropFrame(c.s.rt, b) {
+		return len(b), nil
+	}
+	if c.down != nil {
+		wasBoundary := c.down.atBoundary()
+		if perr := c.down.feed(b); perr != nil && !stopParsing(c.s, &c.down, "down", perr) {
+			if cc, ok := policyClose(c.s, "down", perr); ok {
+				// The offending chunk is dropped, so if it started on a
+				// frame boundary the client can still be told why.
+				if wasBoundary {
+					c.Conn.Write(appendWSFrame(nil, opClose, cc.payload(), false))
+				}
+				if bk := c.s.backend; bk != nil {
+					bk.injectClose(cc)
+				}
+			}
+			return 0, perr
+		}
+	}
+	n, err := c.Conn.Write(b)
+	c.s.bytesDown.Add(int64(n))
+	c.downRate.wait(n)
+	return n, err
+}
+
+func (c *tapConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+		sessions.remove(c.s)
+		if c.s.rec != nil {
+			c.s.rec.Close()
+		}
+	})
+	return err
+}
+
+func (c *tapConn) start() {
+	if c.down != nil && pingIntervalSeconds > 0 {
+		go c.watchPeer()
+	}
+	if firstDataSeconds > 0 {
+		upgraded := c.lastRead.Load()
+		clk.AfterFunc(time.Duration(firstDataSeconds)*time.Second, func() {
+			if c.lastRead.Load() == upgraded {
+				c.s.logger().Info("No data from client after the upgrade, closing", "seconds", firstDataSeconds)
+				c.Close()
+			}
+		})
+	}
+}
+
+// watchPeer pings the client and tears the session down once it has been
+// silent for longer than PEER_TIMEOUT_SECONDS, so half-open connections do
+// not stay in the registry forever.
+func (c *tapConn) watchPeer() {
+	ticker := clk.NewTicker(time.Duration(pingIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	timeout := time.Duration(peerTimeoutSeconds) * time.Second
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C():
+		}
+		if idle := clk.Since(time.Unix(0, c.lastRead.Load())); idle >= timeout {
+			c.s.logger().Info("No data from client, closing dead peer", "idle_seconds", int(idle.Seconds()))
+			c.Close()
+			return
+		}
+		c.inject(opPing, nil)
+	}
+}
+
+// inject writes a proxy-generated frame to the client if the downstream is
+// at a frame boundary and no relayed write is in progress.
+func (c *tapConn) inject(opcode byte, payload []byte) bool {
+	if !c.wmu.TryLock() {
+		return false
+	}
+	defer c.wmu.Unlock()
+	if c.down == nil || !c.down.atBoundary() {
+		return false
+	}
+	_, err := c.Conn.Write(appendWSFrame(nil, opcode, payload, false))
+	return err == nil
+}
+
+// injectClose sends a close frame to the client unless the backend already
+// did. A stuck relayed write is cut short by the deadline.
+func (c *tapConn) injectClose(cc closeCode) {
+	c.Conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.down == nil || !c.down.atBoundary() || c.obs.closeSeen {
+		return
+	}
+	c.Conn.Write(appendWSFrame(nil, opClose, cc.payload(), false))
+}
+
+// backendConn is the backend side of an upgraded connection. Reads carry
+// backend→client bytes and writes carry client→backend ("up") bytes.
+type backendConn struct {
+	io.ReadWriteCloser
+	s *session
+
+	wmu sync.Mutex
+	up  *wsFrameParser
+	obs *frameObserver
+}
+
+func newBackendConn(rwc io.ReadWriteCloser, s *session) *backendConn {
+	b := &backendConn{ReadWriteCloser: rwc, s: s}
+	if frameMode() {
+		b.obs = &frameObserver{s: s, dir: "up"}
+		b.up = newWSFrameParser(b.obs)
+	}
+	return b
+}
+
+func (b *backendConn) Read(p []byte) (int, error) {
+	n, err := b.ReadWriteCloser.Read(p)
+	if n > 0 {
+		b.s.rt.Chaos.delayBackend(b.s.rt)
+	}
+	if err != nil && n == 0 && b.s.conn != nil {
+		// The backend went away; if it did so without a close frame,
+		// tell the client why instead of just dropping the socket.
+		b.s.conn.injectClose(closeCodeFor("backend_error"))
+	}
+	return n, err
+}
+
+func (b *backendConn) Write(p []byte) (int, error) {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	if b.up != nil && b.up.atBoundary() && b.s.rt.Chaos.dropFrame(b.s.rt, p) {
+		return len(p), nil
+	}
+	if b.up != nil {
+		wasBoundary := b.up.atBoundary()
+		if perr := b.up.feed(p); perr != nil && !stopParsing(b.s, &b.up, "up", perr) {
+			if cc, ok := policyClose(b.s, "up", perr); ok {
+				if wasBoundary {
+					b.ReadWriteCloser.Write(appendWSFrame(nil, opClose, cc.payload(), true))
+				}
+				if c := b.s.conn; c != nil {
+					c.injectClose(cc)
+				}
+			}
+			return 0, perr
+		}
+	}
+	return b.ReadWriteCloser.Write(p)
+}
+
+// injectClose sends a masked close frame to the backend unless the client
+// already did.
+func (b *backendConn) injectClose(cc closeCode) {
+	if !b.wmu.TryLock() {
+		return
+	}
+	defer b.wmu.Unlock()
+	if b.up == nil || !b.up.atBoundary() || b.obs.closeSeen {
+		return
+	}
+	b.ReadWriteCloser.Write(appendWSFrame(nil, opClose, cc.payload(), true))
+}
+
+// stopParsing handles a parser error. Malformed input only disables frame
+// inspection for that direction so the tunnel keeps working as a plain
+// stream; any other error is a policy decision and ends the session.
+func stopParsing(s *session, p **wsFrameParser, dir string, err error) bool {
+	if !errors.Is(err, errBadFrame) {
+		return false
+	}
+	s.logger().Warn("Stream is not valid WebSocket framing, inspection disabled", "direction", dir)
+	*p = nil
+	return true
+}
+
+// policyError ends a session because a limit was exceeded; condition selects
+// the close code sent to both peers.
+type policyError struct {
+	condition string
+	detail    string
+}
+
+func (e *policyError) Error() string {
+	return e.detail
+}
+
+func policyClose(s *session, dir string, err error) (closeCode, bool) {
+	var pe *policyError
+	if !errors.As(err, &pe) {
+		return closeCode{}, false
+	}
+	s.logger().Info("Closing session", "reason", pe.detail, "direction", dir)
+	return closeCodeFor(pe.condition), true
+}
+
+// frameObserver receives the frames of one direction of a session.
+type frameObserver struct {
+	s   *session
+	dir string
+
+	sampling bool
+	sample   []byte // payload collected for the frame being sampled
+	recorded []byte // payload collected for the session recording
+
+	closeSeen bool
+	held      uint64 // what this frame counts towards the session's buffered bytes
+
+	msgType string // type of the data message in progress
+	msgSize uint64
+}
+
+func (o *frameObserver) frameStart(f *wsFrame) error {
+	o.sampling = payloadSampler.pick(o.s.route)
+	if o.sampling {
+		f.wantPayload = true
+		o.sample = o.sample[:0]
+	}
+	if o.s.rec != nil {
+		f.wantPayload = true
+		o.recorded = o.recorded[:0]
+	}
+	if f.opcode == opClose {
+		o.closeSeen = true
+	}
+	typ := opcodeName(f.opcode)
+	if f.opcode == opContinuation {
+		typ = o.msgType
+	} else if !f.isControl() {
+		o.msgType, o.msgSize = typ, 0
+	}
+	framesTotal.inc(o.s.route, o.dir, typ)
+	if maxMessageBytes > 0 && !f.isControl() && o.msgSize+f.length > uint64(maxMessageBytes) {
+		return &policyError{"message_too_big", fmt.Sprintf("%s message exceeds %d bytes", typ, maxMessageBytes)}
+	}
+	if o.s.rec != nil {
+		limit := maxBufferedBytes
+		if limit <= 0 {
+			limit = recordBufferedBytes
+		}
+		if uint64(o.s.buffered.Load())+f.length > uint64(limit) {
+			return &policyError{"message_too_big", fmt.Sprintf("session would buffer more than %d bytes", limit)}
+		}
+		o.held = f.length
+		o.s.buffered.Add(int64(o.held))
+	}
+	return nil
+}
+
+func (o *frameObserver) framePayload(f *wsFrame, p []byte) error {
+	if room := payloadSampleBytes - len(o.sample); o.sampling && room > 0 {
+		o.sample = append(o.sample, p[:min(room, len(p))]...)
+	}
+	if o.s.rec != nil {
+		o.recorded = append(o.recorded, p...)
+	}
+	return nil
+}
+
+func (o *frameObserver) frameEnd(f *wsFrame) error {
+	if o.sampling {
+		payloadSampler.log(o.s, o.dir, f, o.sample)
+	}
+	if o.s.rec != nil {
+		o.s.rec.frame(o.dir, f, o.recorded)
+	}
+	if o.held > 0 {
+		o.s.buffered.Add(-int64(o.held))
+		o.held = 0
+	}
+	if !f.isControl() {
+		o.msgSize += f.length
+		if f.fin {
+			messageSize.observe(float64(o.msgSize), o.s.route, o.dir, o.msgType)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMaxBufferedBytes(t *testing.T) {
+	saved := maxBufferedBytes
+	maxBufferedBytes = 100
+	defer func() { maxBufferedBytes = saved }()
+
+	s := &session{route: "test", rec: &recorder{}}
+	up := &frameObserver{s: s, dir: "up"}
+	down := &frameObserver{s: s, dir: "down"}
+	binary := func(n uint64) *wsFrame { return &wsFrame{opcode: opBinary, fin: true, length: n} }
+
+	if err := up.frameStart(binary(60)); err != nil {
+		t.Fatal(err)
+	}
+	// Both directions count towards the same session.
+	var pe *policyError
+	if err := down.frameStart(binary(50)); !errors.As(err, &pe) || pe.condition != "message_too_big" {
+		t.Fatalf("second frame over the limit: %v", err)
+	}
+	if err := up.frameEnd(binary(60)); err != nil {
+		t.Fatal(err)
+	}
+	if err := down.frameStart(binary(100)); err != nil {
+		t.Fatalf("frame within the limit once the first ended: %v", err)
+	}
+	if n := s.buffered.Load(); n != 100 {
+		t.Fatalf("buffered = %d, want 100", n)
+	}
+
+	// Without a recording nothing is held, so nothing is limited.
+	s2 := &session{route: "test"}
+	if err := (&frameObserver{s: s2, dir: "up"}).frameStart(binary(recordBufferedBytes + 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordedSessionBufferDefault(t *testing.T) {
+	saved := maxBufferedBytes
+	maxBufferedBytes = 0
+	defer func() { maxBufferedBytes = saved }()
+
+	s := &session{route: "test", rec: &recorder{}}
+	up := &frameObserver{s: s, dir: "up"}
+	err := up.frameStart(&wsFrame{opcode: opBinary, fin: true, length: recordBufferedBytes + 1})
+	cc, ok := policyClose(s, "up", err)
+	if !ok || cc != closeCodeFor("message_too_big") {
+		t.Fatalf("oversized frame in a recorded session: %v, close %+v", err, cc)
+	}
+	if s.buffered.Load() != 0 {
+		t.Fatalf("buffered = %d after refusing the frame, want 0", s.buffered.Load())
+	}
+}
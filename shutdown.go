@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// stopDrainSeconds is how long open sessions may continue after a stop
+	// request (SIGTERM, Ctrl-C or a service stop) before they are closed.
+	stopDrainSeconds = getEnvAsInt("STOP_DRAIN_SECONDS", 20)
+
+	stopping atomic.Bool
+)
+
+func setupShutdown() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		stop(sig.String())
+	}()
+}
+
+// stop drains the proxy and exits; why names what asked it to stop.
+func stop(why string) {
+	if !stopping.CompareAndSwap(false, true) {
+		return
+	}
+	slog.Info("Stopping, draining sessions", "reason", why, "sessions", sessions.count())
+	notifyServiceManager("STOPPING=1")
+	drain(time.Duration(stopDrainSeconds) * time.Second)
+	// The backends stay up for the process an upgrade handed over to.
+	if !upgrading.Load() {
+		shutdownBackends()
+	}
+	os.Exit(0)
+}
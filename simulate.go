@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// simTarget is one deployment in a simulation.
+type simTarget struct {
+	name     string
+	routes   []*route
+	window   time.Duration
+	replicas int
+	changed  time.Time // when replicas last changed
+	last     time.Time // last request, as the inactivity watcher sees it
+	readyAt  time.Time // end of the cold start in progress
+
+	requests, coldStarts, delayed, cut int
+	hours                              float64
+}
+
+func (t *simTarget) set(now time.Time, replicas int) {
+	t.hours += float64(t.replicas) * now.Sub(t.changed).Hours()
+	t.replicas, t.changed = replicas, now
+}
+
+// simSession is a session from the access log; the log is written when a
+// session ends, so it started duration earlier.
+type simSession struct {
+	start, end time.Time
+	t          *simTarget
+	cut        bool // closed by a scale-down
+}
+
+// runSimulate implements the "simulate" subcommand: it replays the sessions
+// of an access log against a candidate route table and reports the cold
+// starts and replica-hours the policy would have produced. It models the
+// inactivity window, schedules and keep_warm the way the proxy applies
+// them; adaptive inactivity, stepped scale-down, cooldowns, the decision
+// webhook and plugins are not simulated.
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	logFile := fs.String("log", "", "access log to replay (ACCESS_LOG output)")
+	policy := fs.String("policy", configFile, "route table to evaluate, in the CONFIG_FILE format (default: the current settings)")
+	coldStart := fs.Duration("cold-start", 10*time.Second, "how long a backend takes to become ready")
+	price := fs.Float64("cost", 0, "price of a replica-hour (default COST_PER_REPLICA_HOUR)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: auto_scale simulate -log access.jsonl [-policy config.json] [-cold-start d] [-cost n]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *logFile == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	if *price == 0 && costPerReplicaHourEnv != "" {
+		v, err := strconv.ParseFloat(costPerReplicaHourEnv, 64)
+		if err != nil {
+			slog.Error("COST_PER_REPLICA_HOUR: invalid price", "price", costPerReplicaHourEnv)
+			return 1
+		}
+		*price = v
+	}
+
+	routes, err := defaultRoutes()
+	if err != nil {
+		slog.Error("Invalid routes", "error", err)
+		return 1
+	}
+	if *policy != "" {
+		cfg, err := loadConfig(*policy)
+		if err != nil {
+			slog.Error("Failed to load the policy", "file", *policy, "error", err)
+			return 1
+		}
+		if len(cfg.Routes) > 0 {
+			routes = cfg.Routes
+		}
+	}
+	if err := validateRoutes(routes); err != nil {
+		slog.Error("Invalid routes", "error", err)
+		return 1
+	}
+	targets := make(map[string]*simTarget)
+	byName := make(map[string]*simTarget)
+	for _, rt := range routes {
+		key := rt.Namespace + "/" + rt.Deployment
+		t, ok := targets[key]
+		if !ok {
+			t = &simTarget{name: key}
+			targets[key] = t
+		}
+		t.routes = append(t.routes, rt)
+		if d := time.Duration(rt.InactivityMinutes) * time.Minute; d > t.window {
+			t.window = d
+		}
+		byName[rt.Name] = t
+	}
+
+	sessions, skipped, err := readSimSessions(*logFile, byName)
+	if err != nil {
+		slog.Error("Failed to read the access log", "file", *logFile, "error", err)
+		return 1
+	}
+	if len(sessions) == 0 {
+		slog.Error("No sessions of the policy's routes in the access log", "file", *logFile)
+		return 1
+	}
+	begin, end := simulate(sessions, targets, *coldStart)
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	span := end.Sub(begin)
+	fmt.Printf("Replayed %d sessions from %s to %s (%s)", len(sessions), begin.Format(time.RFC3339), end.Format(time.RFC3339), span.Round(time.Minute))
+	if skipped > 0 {
+		fmt.Printf(", skipped %d of routes not in the policy", skipped)
+	}
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEPLOYMENT\tSESSIONS\tCOLD STARTS\tDELAYED\tCUT\tREPLICA-HOURS\tALWAYS ON\tSAVED")
+	for _, name := range names {
+		t := targets[name]
+		always := float64(baselineReplicas) * span.Hours()
+		saved := fmt.Sprintf("%.1f", always-t.hours)
+		if *price > 0 {
+			saved += fmt.Sprintf(" (%s%.2f)", costCurrency, (always-t.hours)**price)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.1f\t%.1f\t%s\n", name, t.requests, t.coldStarts, t.delayed, t.cut, t.hours, always, saved)
+	}
+	tw.Flush()
+	return 0
+}
+
+// readSimSessions parses an access log, as a file of JSON lines or
+// captured stdout with "ACCESS " prefixes, and returns its sessions in
+// start order with the number left out for routes the policy lacks.
+func readSimSessions(path string, byName map[string]*simTarget) ([]simSession, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var sessions []simSession
+	skipped := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if i := bytes.Index(line, []byte("ACCESS {")); i >= 0 {
+			line = line[i+len("ACCESS "):]
+		}
+		if !bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) {
+			continue
+		}
+		var e accessEntry
+		if err := json.Unmarshal(line, &e); err != nil || e.Time.IsZero() {
+			continue
+		}
+		t := byName[e.Route]
+		if t == nil {
+			skipped++
+			continue
+		}
+		// Schedules are in local time, as in the proxy.
+		end := e.Time.Local()
+		start := end.Add(-time.Duration(e.DurationMS) * time.Millisecond)
+		sessions = append(sessions, simSession{start: start, end: end, t: t})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, err
+	}
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].start.Before(sessions[j].start) })
+	return sessions, skipped, nil
+}
+
+// simulate steps through the timeline a minute at a time, running the
+// schedule and keep_warm checks every minute and the inactivity check every
+// five as the proxy does, and returns the span it covered.
+func simulate(sessions []simSession, targets map[string]*simTarget, coldStart time.Duration) (time.Time, time.Time) {
+	begin := sessions[0].start.Truncate(time.Minute)
+	end := begin
+	for _, s := range sessions {
+		if s.end.After(end) {
+			end = s.end
+		}
+	}
+	floor := func(t *simTarget, now time.Time) int {
+		n := 0
+		for _, rt := range t.routes {
+			if f := rt.Schedule.floor(now); f > n {
+				n = f
+			}
+		}
+		return n
+	}
+	lastWarm := make(map[*route]time.Time)
+	for _, t := range targets {
+		t.changed, t.last = begin, begin
+		t.set(begin, floor(t, begin))
+	}
+
+	next := 0
+	for tick := 0; ; tick++ {
+		now := begin.Add(time.Duration(tick) * time.Minute)
+		for ; next < len(sessions) && sessions[next].start.Before(now); next++ {
+			s := sessions[next]
+			t := s.t
+			t.requests++
+			t.last = s.start
+			if t.replicas == 0 {
+				t.coldStarts++
+				t.set(s.start, 1)
+				t.readyAt = s.start.Add(coldStart)
+			}
+			if s.start.Before(t.readyAt) {
+				t.delayed++
+			}
+		}
+		if now.After(end) {
+			break
+		}
+		for _, t := range targets {
+			f := floor(t, now)
+			if t.replicas < f {
+				t.set(now, f)
+			}
+			for _, rt := range t.routes {
+				k := rt.KeepWarm
+				if k == nil || !k.active(now) || now.Sub(lastWarm[rt]) < time.Duration(k.IntervalSeconds)*time.Second {
+					continue
+				}
+				lastWarm[rt] = now
+				t.last = now
+				if t.replicas == 0 {
+					t.set(now, 1)
+				}
+			}
+			if tick == 0 || tick%5 != 0 || now.Sub(t.last) < t.window || t.replicas == f {
+				continue
+			}
+			if f == 0 {
+				for i := range sessions[:next] {
+					if s := &sessions[i]; s.t == t && !s.cut && s.end.After(now) {
+						s.cut = true
+						t.cut++
+					}
+				}
+			}
+			t.set(now, f)
+		}
+	}
+	for _, t := range targets {
+		t.set(end, t.replicas)
+	}
+	return begin, end
+}
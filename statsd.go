@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	// statsdAddr is a host:port to push metrics to over UDP, in addition to
+	// the Prometheus endpoint; disabled unless set.
+	statsdAddr            = getEnv("STATSD_ADDR", "")
+	statsdPrefix          = getEnv("STATSD_PREFIX", "")
+	statsdIntervalSeconds = getEnvAsInt("STATSD_INTERVAL_SECONDS", 10)
+	// statsdTags sends labels as DogStatsD tags; plain StatsD has no tags,
+	// so label values are appended to the metric name instead.
+	statsdTags = getEnvAsBool("STATSD_DOGSTATSD", false)
+)
+
+// statsdMaxPacket keeps datagrams below a typical MTU.
+const statsdMaxPacket = 1400
+
+func setupStatsd() error {
+	if statsdAddr == "" {
+		return nil
+	}
+	if statsdIntervalSeconds <= 0 {
+		return fmt.Errorf("STATSD_INTERVAL_SECONDS must be positive")
+	}
+	conn, err := net.Dial("udp", statsdAddr)
+	if err != nil {
+		return fmt.Errorf("STATSD_ADDR: %w", err)
+	}
+	slog.Info("Pushing metrics to StatsD", "addr", statsdAddr, "interval_seconds", statsdIntervalSeconds)
+	go pushStatsd(conn)
+	return nil
+}
+
+// pushStatsd sends counters as the increase since the previous push, gauges
+// as their value and histograms as counters of observations and their sum.
+func pushStatsd(conn net.Conn) {
+	last := make(map[string]metricSample)
+	ticker := time.NewTicker(time.Duration(statsdIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		var packet strings.Builder
+		emit := func(line string) {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+				conn.Write([]byte(packet.String()))
+				packet.Reset()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+		for _, s := range snapshotMetrics() {
+			prev := last[s.key()]
+			last[s.key()] = s
+			switch s.kind {
+			case counterKind:
+				if d := s.value - prev.value; d > 0 {
+					emit(statsdLine(s, "", formatFloat(d), "c"))
+				}
+			case gaugeKind:
+				emit(statsdLine(s, "", formatFloat(s.value), "g"))
+			case histogramKind:
+				if d := s.count - prev.count; d > 0 {
+					emit(statsdLine(s, ".count", fmt.Sprint(d), "c"))
+					emit(statsdLine(s, ".sum", formatFloat(s.sum-prev.sum), "c"))
+				}
+			}
+		}
+		if packet.Len() > 0 {
+			conn.Write([]byte(packet.String()))
+		}
+	}
+}
+
+func statsdLine(s metricSample, suffix, value, typ string) string {
+	name := statsdPrefix + s.name
+	if !statsdTags {
+		for _, v := range s.values {
+			name += "." + statsdSanitize(v)
+		}
+		return name + suffix + ":" + value + "|" + typ
+	}
+	line := name + suffix + ":" + value + "|" + typ
+	for i, l := range s.labels {
+		if i == 0 {
+			line += "|#"
+		} else {
+			line += ","
+		}
+		line += l + ":" + statsdSanitize(s.values[i])
+	}
+	return line
+}
+
+// statsdSanitize replaces the characters that delimit StatsD names, values
+// and tags.
+var statsdSanitize = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "\n", "_", " ", "_").Replace
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+type routeStatus struct {
+	Name        string     `json:"name"`
+	Path        string     `json:"path"`
+	Backend     string     `json:"backend"`
+	Target      string     `json:"target"`
+	LastHealthy *time.Time `json:"last_healthy,omitempty"`
+	Maintenance bool       `json:"maintenance"`
+	Region      string     `json:"region,omitempty"`
+	// RTTMillis is the smoothed round trip of the backend's health checks.
+	RTTMillis float64 `json:"rtt_ms,omitempty"`
+	// Addresses are what the backend's hostname currently resolves to,
+	// or the endpoints found by service discovery.
+	Addresses  []string     `json:"addresses,omitempty"`
+	ResolvedAt *time.Time   `json:"resolved_at,omitempty"`
+	Scale      targetStatus `json:"scale"`
+}
+
+// targetStatus is what the proxy knows of a deployment it scales.
+type targetStatus struct {
+	Target string `json:"target"`
+	// Replicas is what the proxy last scaled it to, -1 if it has not.
+	Replicas    int        `json:"replicas"`
+	Sessions    int        `json:"sessions"`
+	LastRequest *time.Time `json:"last_request,omitempty"`
+	LastScale   *scaleInfo `json:"last_scale,omitempty"`
+	// OverrideUntil is set while replicas set through /admin/scale are held.
+	OverrideUntil *time.Time `json:"override_until,omitempty"`
+}
+
+type scaleInfo struct {
+	Time     time.Time `json:"time"`
+	Replicas int       `json:"replicas"`
+	Cause    string    `json:"cause"`
+}
+
+func targetStatusOf(t *scaleTarget) targetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := targetStatus{Target: t.String(), Replicas: t.lastScaledReplicas, Sessions: t.open}
+	if !t.lastRequestTime.IsZero() {
+		at := t.lastRequestTime.UTC()
+		st.LastRequest = &at
+	}
+	if !t.lastScaleRequestTime.IsZero() {
+		st.LastScale = &scaleInfo{Time: t.lastScaleRequestTime.UTC(), Replicas: t.lastScaledReplicas, Cause: t.lastScaleCause}
+	}
+	if clk.Now().Before(t.overrideUntil) {
+		until := t.overrideUntil.UTC()
+		st.OverrideUntil = &until
+	}
+	return st
+}
+
+// handleStatus describes the configured routes and where their backends
+// currently are.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	routes := routing.Load().routes
+	list := make([]routeStatus, 0, len(routes))
+	for _, rt := range routes {
+		st := routeStatus{
+			Name:        rt.Name,
+			Path:        rt.Path,
+			Backend:     rt.BackendURL,
+			Target:      rt.scale.String(),
+			Maintenance: maintenance.get(rt.Name) != nil,
+			Region:      rt.Region,
+			Scale:       targetStatusOf(rt.scale),
+		}
+		rt.mu.Lock()
+		st.RTTMillis = float64(rt.rtt.Microseconds()) / 1000
+		if !rt.lastHealthy.IsZero() {
+			t := rt.lastHealthy.UTC()
+			st.LastHealthy = &t
+		}
+		rt.mu.Unlock()
+		if d := rt.discovery; d != nil {
+			d.mu.Lock()
+			st.Addresses = append([]string(nil), d.endpoints...)
+			if !d.resolved.IsZero() {
+				t := d.resolved.UTC()
+				st.ResolvedAt = &t
+			}
+			d.mu.Unlock()
+		} else if host := rt.target.Hostname(); net.ParseIP(host) == nil {
+			addrs, at := backendDNS.snapshot(host)
+			st.Addresses = addrs
+			if !at.IsZero() {
+				at = at.UTC()
+				st.ResolvedAt = &at
+			}
+		}
+		list = append(list, st)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Routes []routeStatus `json:"routes"`
+		Drain  drainStatus   `json:"drain"`
+	}{list, adminDrain.status()})
+}
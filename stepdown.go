@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// scaleDownStepMinutes removes one replica above the last after each this
+// many idle minutes, so a lull does not take away all capacity at once.
+// The last replica still goes after the full inactivity window. 0 scales
+// straight down.
+var scaleDownStepMinutes = getEnvAsInt("SCALE_DOWN_STEP_MINUTES", 0)
+
+// stepDown removes one of t's replicas above keep if it has been idle for a
+// step since the last activity or step.
+func (t *scaleTarget) stepDown(keep int) {
+	if scaleDownStepMinutes <= 0 {
+		return
+	}
+	if keep < 1 {
+		keep = 1
+	}
+	step := time.Duration(scaleDownStepMinutes) * time.Minute
+	since, busy := t.idleSince()
+	t.mu.Lock()
+	replicas := t.lastScaledReplicas
+	if t.lastStepDown.After(since) {
+		since = t.lastStepDown
+	}
+	t.mu.Unlock()
+	if busy || replicas <= keep || clk.Since(since) < step || t.cooldown(replicas-1) > 0 {
+		return
+	}
+	lg := slog.With("deployment", t.String(), "replicas", replicas-1, "cause", "inactivity")
+	lg.Info("Idle for a while, stepping down", "idle_seconds", int(clk.Since(since).Seconds()))
+	if err := scaleDeployment(t, replicas-1, "inactivity"); err != nil {
+		lg.Error("Error scaling down deployment", "error", err)
+		return
+	}
+	t.mu.Lock()
+	t.lastStepDown = clk.Now()
+	t.mu.Unlock()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Listeners with "tailscale" set listen on this node's tailnet address, so
+// they are only reachable over Tailscale, and ask the local tailscaled who
+// each client is. The tailnet login becomes the session's identity and is
+// passed to the backend the way "tailscale serve" does. The tsnet build
+// embeds the Tailscale node in the proxy instead; see tailscale_tsnet.go.
+
+var (
+	tailscaleSocket = getEnv("TAILSCALE_SOCKET", "/var/run/tailscale/tailscaled.sock")
+
+	tailscaleLocal = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", tailscaleSocket)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	tailscaleHeaders = []string{"Tailscale-User-Login", "Tailscale-User-Name"}
+
+	// tsnetListen and tsnetWhois are set by the tsnet build.
+	tsnetListen func(network, addr string) (net.Listener, error)
+	tsnetWhois  func(addr string) (*tailscaleUser, error)
+)
+
+// tailscaleUser is who a tailnet client is, as far as tailscaled knows.
+type tailscaleUser struct {
+	Login string
+	Name  string
+}
+
+// tailscaleLocalAPI GETs path from tailscaled's local API into v.
+func tailscaleLocalAPI(path string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, "http://local-tailscaled.sock/localapi/v0/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Sec-Tailscale", "localapi")
+	resp, err := tailscaleLocal.Do(req)
+	if err != nil {
+		return fmt.Errorf("tailscaled: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("tailscaled: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// tailscaleAddr replaces the host of addr with this node's tailnet address
+// that suits network.
+func tailscaleAddr(network, addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	var st struct {
+		BackendState string
+		TailscaleIPs []netip.Addr
+	}
+	if err := tailscaleLocalAPI("status?peers=false", &st); err != nil {
+		return "", err
+	}
+	for _, ip := range st.TailscaleIPs {
+		if (network == "tcp4" && !ip.Is4()) || (network == "tcp6" && !ip.Is6()) {
+			continue
+		}
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+	return "", fmt.Errorf("tailscale has no %s address (state %s)", network, st.BackendState)
+}
+
+// tailscaleWhois asks tailscaled who is connecting from addr.
+func tailscaleWhois(addr string) (*tailscaleUser, error) {
+	var who struct {
+		Node struct {
+			Name string
+			Tags []string
+		}
+		UserProfile struct {
+			LoginName   string
+			DisplayName string
+		}
+	}
+	if err := tailscaleLocalAPI("whois?addr="+url.QueryEscape(addr), &who); err != nil {
+		return nil, err
+	}
+	return tailnetUser(addr, who.Node.Name, who.Node.Tags, who.UserProfile.LoginName, who.UserProfile.DisplayName)
+}
+
+// tailnetUser makes a whois answer for addr into a tailscaleUser.
+func tailnetUser(addr, node string, tags []string, login, name string) (*tailscaleUser, error) {
+	u := &tailscaleUser{Login: login, Name: name}
+	if len(tags) > 0 {
+		// Tagged devices share one placeholder user, so tell them apart
+		// by machine name.
+		u.Login = strings.TrimSuffix(node, ".")
+		u.Name = u.Login
+	}
+	if u.Login == "" {
+		return nil, fmt.Errorf("tailscale does not know %s", addr)
+	}
+	return u, nil
+}
+
+// tailnetClient returns who sent r if it arrived on a tailscale listener,
+// or nil if it did not.
+func tailnetClient(r *http.Request) (*tailscaleUser, error) {
+	l, _ := r.Context().Value(listenerKey{}).(*listenerConfig)
+	if l == nil || !l.Tailscale {
+		return nil, nil
+	}
+	if tsnetWhois != nil {
+		return tsnetWhois(r.RemoteAddr)
+	}
+	return tailscaleWhois(r.RemoteAddr)
+}
+
+// allowsTailnetUser reports whether u may use the route: anyone unless
+// tailscale_users is set, in which case only those logins ("*" for any
+// tailnet user) and nobody from outside the tailnet.
+func (rt *route) allowsTailnetUser(u *tailscaleUser) bool {
+	if len(rt.TailscaleUsers) == 0 {
+		return true
+	}
+	if u == nil {
+		return false
+	}
+	for _, login := range rt.TailscaleUsers {
+		if login == "*" || strings.EqualFold(login, u.Login) {
+			return true
+		}
+	}
+	return false
+}
+
+// setTailscaleHeaders tells the backend who the tailnet client is. Clients
+// elsewhere cannot claim to be one, unless relayed by a trusted proxy such
+// as "tailscale serve".
+func setTailscaleHeaders(r *http.Request, u *tailscaleUser) {
+	if u == nil {
+		if !fromTrustedProxy(r) {
+			for _, name := range tailscaleHeaders {
+				r.Header.Del(name)
+			}
+		}
+		return
+	}
+	r.Header.Set("Tailscale-User-Login", u.Login)
+	r.Header.Set("Tailscale-User-Name", u.Name)
+}
@@ -0,0 +1,97 @@
+//go:build tsnet
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// The tsnet build embeds a Tailscale node in the proxy: "tailscale"
+// listeners listen on the tailnet itself, with no host tailscaled and no
+// ordinary socket, and clients are looked up with the embedded node.
+
+var (
+	tsnetHostname = getEnv("TSNET_HOSTNAME", "auto-scale-ws-proxy")
+	// tsnetStateDir keeps the node's keys across restarts; tsnet picks a
+	// directory under the user's config directory if unset.
+	tsnetStateDir = getEnv("TSNET_STATE_DIR", "")
+	tsnetAuthKey  = newSecret("TS_AUTHKEY")
+
+	tsnetOnce   sync.Once
+	tsnetServer *tsnet.Server
+	tsnetErr    error
+)
+
+func init() {
+	tsnetListen = listenTsnet
+	tsnetWhois = whoisTsnet
+}
+
+// startTsnet brings the embedded node up the first time a listener needs
+// it.
+func startTsnet() (*tsnet.Server, error) {
+	tsnetOnce.Do(func() {
+		s := &tsnet.Server{
+			Hostname: tsnetHostname,
+			Dir:      tsnetStateDir,
+			AuthKey:  tsnetAuthKey.get(),
+			Logf: func(format string, args ...any) {
+				slog.Debug(fmt.Sprintf(format, args...), "component", "tsnet")
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if _, err := s.Up(ctx); err != nil {
+			s.Close()
+			tsnetErr = fmt.Errorf("tsnet: %w", err)
+			return
+		}
+		ip4, ip6 := s.TailscaleIPs()
+		slog.Info("Joined the tailnet", "hostname", tsnetHostname, "ipv4", ip4.String(), "ipv6", ip6.String())
+		tsnetServer = s
+	})
+	return tsnetServer, tsnetErr
+}
+
+// listenTsnet listens on the port of addr on every tailnet address of the
+// embedded node that suits network.
+func listenTsnet(network, addr string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := startTsnet()
+	if err != nil {
+		return nil, err
+	}
+	return s.Listen(network, ":"+port)
+}
+
+// whoisTsnet asks the embedded node who is connecting from addr.
+func whoisTsnet(addr string) (*tailscaleUser, error) {
+	s, err := startTsnet()
+	if err != nil {
+		return nil, err
+	}
+	lc, err := s.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	who, err := lc.WhoIs(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	if who.Node == nil || who.UserProfile == nil {
+		return nil, fmt.Errorf("tailscale does not know %s", addr)
+	}
+	return tailnetUser(addr, who.Node.Name, who.Node.Tags, who.UserProfile.LoginName, who.UserProfile.DisplayName)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandConfig expands the string values of a JSON config: "${VAR}" and
+// "${VAR:-default}" are replaced by environment variables ("$${" is a
+// literal "${"), and a value of the form "file:/path" by the trimmed
+// contents of the file. A variable that is unset and has no default is an
+// error rather than an empty value.
+func expandConfig(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := expandValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func expandValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			x, err := expandValue(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			v[k] = x
+		}
+	case []interface{}:
+		for i, e := range v {
+			x, err := expandValue(e)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			v[i] = x
+		}
+	case string:
+		return expandString(v)
+	}
+	return v, nil
+}
+
+func expandString(s string) (string, error) {
+	if path, ok := strings.CutPrefix(s, "file:"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		name, def, hasDef := strings.Cut(s[i+2:i+end], ":-")
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			if !hasDef {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			val = def
+		}
+		b.WriteString(s[:i] + val)
+		s = s[i+end+1:]
+	}
+}
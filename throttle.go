@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// Bandwidth limits in bytes per second for each upgraded session, and
+	// shared by all sessions of an authenticated identity; 0 is unlimited.
+	// Up is client to backend.
+	sessionUpBPS    = getEnvAsInt("SESSION_UP_BYTES_PER_SECOND", 0)
+	sessionDownBPS  = getEnvAsInt("SESSION_DOWN_BYTES_PER_SECOND", 0)
+	identityUpBPS   = getEnvAsInt("IDENTITY_UP_BYTES_PER_SECOND", 0)
+	identityDownBPS = getEnvAsInt("IDENTITY_DOWN_BYTES_PER_SECOND", 0)
+
+	identityBuckets = &bucketMap{m: make(map[string]*tokenBucket)}
+)
+
+// bucketMap holds the token buckets shared per identity and direction.
+type bucketMap struct {
+	mu sync.Mutex
+	m  map[string]*tokenBucket
+}
+
+func (bm *bucketMap) get(key string, rate int) *tokenBucket {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	b, ok := bm.m[key]
+	if !ok {
+		b = newTokenBucket(float64(rate), float64(rate))
+		bm.m[key] = b
+	}
+	return b
+}
+
+// throttle paces one direction of a session.
+type throttle []*tokenBucket
+
+func newThrottle(s *session, dir string, sessionRate, identityRate int) throttle {
+	var t throttle
+	if sessionRate > 0 {
+		t = append(t, newTokenBucket(float64(sessionRate), float64(sessionRate)))
+	}
+	if identityRate > 0 && s.identity != "" {
+		t = append(t, identityBuckets.get(dir+" "+s.identity, identityRate))
+	}
+	return t
+}
+
+// wait blocks until n more bytes are within every limit. A chunk larger
+// than the burst borrows from the future, so the average rate holds.
+func (t throttle) wait(n int) {
+	var longest time.Duration
+	for _, b := range t {
+		if d, _ := b.reserve(float64(n), math.MaxInt64); d > longest {
+			longest = d
+		}
+	}
+	if longest > 0 {
+		clk.Sleep(longest)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With TLS_CERT_FILE and TLS_KEY_FILE, or ACME_DOMAINS (see acme.go), the
+// proxy listeners serve TLS themselves, so clients can use wss:// without
+// an ingress in front. Admin listeners stay plain unless they set "tls".
+// Certificates are picked per handshake, so a renewed one is used for new
+// connections while open sessions keep theirs.
+var (
+	tlsCertFile = getEnv("TLS_CERT_FILE", "")
+	tlsKeyFile  = getEnv("TLS_KEY_FILE", "")
+
+	listenerTLS *tls.Config
+)
+
+// tlsReloadCheck is how often the certificate files are checked for
+// changes, at most; the check happens on a handshake.
+const tlsReloadCheck = 10 * time.Second
+
+func setupTLS() error {
+	for _, d := range strings.FieldsFunc(acmeDomainsSpec, func(c rune) bool { return c == ',' || c == ' ' }) {
+		acmeDomains = append(acmeDomains, strings.ToLower(strings.TrimSuffix(d, ".")))
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// WebSocket upgrades need HTTP/1.1.
+		NextProtos: []string{"http/1.1"},
+	}
+	switch {
+	case tlsCertFile != "" && len(acmeDomains) > 0:
+		return fmt.Errorf("TLS_CERT_FILE and ACME_DOMAINS are exclusive")
+	case tlsCertFile != "":
+		kp := &keyPairFiles{cert: tlsCertFile, key: tlsKeyFile}
+		if err := kp.load(); err != nil {
+			return err
+		}
+		cfg.GetCertificate = kp.get
+	case len(acmeDomains) > 0:
+		m, err := newACMEManager()
+		if err != nil {
+			return err
+		}
+		acmeMgr = m
+		cfg.GetCertificate = m.getCertificate
+		cfg.NextProtos = append(cfg.NextProtos, acmeALPNProto)
+	default:
+		return nil
+	}
+	listenerTLS = cfg
+	return nil
+}
+
+// keyPairFiles serves a certificate and key from PEM files, reloading them
+// when either changes. A pair that fails to load is logged and the last
+// good one kept.
+type keyPairFiles struct {
+	cert, key string
+
+	mu      sync.Mutex
+	current *tls.Certificate
+	checked time.Time
+	stamp   string // modification times and sizes of the files loaded
+}
+
+func (kp *keyPairFiles) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if time.Since(kp.checked) >= tlsReloadCheck {
+		kp.checked = time.Now()
+		if stamp, err := kp.fileStamp(); err == nil && stamp != kp.stamp {
+			if err := kp.loadLocked(); err != nil {
+				slog.Error("Failed to reload the TLS certificate, keeping the old one", "cert_file", kp.cert, "key_file", kp.key, "error", err)
+				// Try again on the next change rather than every check.
+				kp.stamp = stamp
+			}
+		}
+	}
+	return kp.current, nil
+}
+
+func (kp *keyPairFiles) load() error {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.checked = time.Now()
+	return kp.loadLocked()
+}
+
+func (kp *keyPairFiles) loadLocked() error {
+	stamp, err := kp.fileStamp()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(kp.cert, kp.key)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	if kp.current != nil {
+		slog.Info("Reloaded the TLS certificate", "cert_file", kp.cert, "names", certNames(cert.Leaf), "not_after", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	kp.current, kp.stamp = &cert, stamp
+	return nil
+}
+
+func (kp *keyPairFiles) fileStamp() (string, error) {
+	var stamp string
+	for _, name := range []string{kp.cert, kp.key} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	return stamp, nil
+}
+
+// certNames lists the names a certificate is for.
+func certNames(c *x509.Certificate) []string {
+	if len(c.DNSNames) > 0 {
+		return c.DNSNames
+	}
+	return []string{c.Subject.CommonName}
+}
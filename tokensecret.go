@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// kubeTokenSecret names a Secret holding the API token, as
+	// namespace/name#key; it is watched so rotations apply immediately.
+	kubeTokenSecret = getEnv("KUBE_TOKEN_SECRET", "")
+)
+
+type secretRef struct {
+	namespace, name, key string
+}
+
+func parseSecretRef(s string) (secretRef, error) {
+	nsName, key, ok := strings.Cut(s, "#")
+	ns, name, ok2 := strings.Cut(nsName, "/")
+	if !ok || !ok2 || ns == "" || name == "" || key == "" {
+		return secretRef{}, fmt.Errorf("invalid secret reference %q, want namespace/name#key", s)
+	}
+	return secretRef{ns, name, key}, nil
+}
+
+func (ref secretRef) String() string {
+	return ref.namespace + "/" + ref.name + "#" + ref.key
+}
+
+// kubeSecretObject is the part of a core/v1 Secret we read; data values
+// are base64 in JSON and decoded by encoding/json into []byte.
+type kubeSecretObject struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string][]byte `json:"data"`
+}
+
+// setupKubeTokenSecret reads KUBE_TOKEN_SECRET into the Kubernetes token
+// and keeps watching it.
+func setupKubeTokenSecret() error {
+	if kubeTokenSecret == "" {
+		return nil
+	}
+	ref, err := parseSecretRef(kubeTokenSecret)
+	if err != nil {
+		return err
+	}
+	rv, err := readTokenSecret(ref)
+	if err != nil {
+		return fmt.Errorf("KUBE_TOKEN_SECRET: %w", err)
+	}
+	go watchTokenSecret(ref, rv)
+	return nil
+}
+
+// readTokenSecret fetches the Secret and applies its token, returning the
+// Secret's resource version.
+func readTokenSecret(ref secretRef) (string, error) {
+	req, err := newKubeRequestAs(serviceAccountToken(), http.MethodGet,
+		fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(ref.namespace), url.PathEscape(ref.name)), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("K8s API returned %d: %s", resp.StatusCode, data)
+	}
+	var obj kubeSecretObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return "", err
+	}
+	if err := applyTokenSecret(ref, &obj); err != nil {
+		return "", err
+	}
+	return obj.Metadata.ResourceVersion, nil
+}
+
+func applyTokenSecret(ref secretRef, obj *kubeSecretObject) error {
+	token := strings.TrimSpace(string(obj.Data[ref.key]))
+	if token == "" {
+		return fmt.Errorf("secret %s has no key %q", ref, ref.key)
+	}
+	if kubeToken.set(token) {
+		slog.Info("Kubernetes API token updated from secret", "secret", ref.String())
+	}
+	return nil
+}
+
+func watchTokenSecret(ref secretRef, rv string) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets?fieldSelector=%s",
+		url.PathEscape(ref.namespace), url.QueryEscape("metadata.name="+ref.name))
+	for {
+		var err error
+		if rv == "" {
+			rv, err = readTokenSecret(ref)
+		}
+		if err == nil {
+			rv, err = watchKube(serviceAccountToken(), path, rv, func(ev kubeEvent) error {
+				if ev.Type != "ADDED" && ev.Type != "MODIFIED" {
+					if ev.Type == "DELETED" {
+						slog.Warn("Token secret was deleted; keeping the current token", "secret", ref.String())
+					}
+					return nil
+				}
+				var obj kubeSecretObject
+				if err := json.Unmarshal(ev.Object, &obj); err != nil {
+					return err
+				}
+				if err := applyTokenSecret(ref, &obj); err != nil {
+					slog.Error("Failed to apply the token secret", "secret", ref.String(), "error", err)
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			slog.Error("Watching KUBE_TOKEN_SECRET failed", "secret", ref.String(), "error", err)
+			rv = ""
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// upgradeDrainSeconds is how long a process replaced by an in-place
+	// upgrade keeps serving its open sessions before closing them.
+	upgradeDrainSeconds = getEnvAsInt("UPGRADE_DRAIN_SECONDS", 3600)
+	// pidFile is rewritten by whichever process is currently serving, so
+	// service managers can follow the proxy across upgrades.
+	pidFile = getEnv("PID_FILE", "")
+
+	// handoff lists the listeners passed on to an upgraded process, in the
+	// order it takes them back with listen.
+	handoff []namedListener
+
+	// upgrading is set while an in-place upgrade is under way and stays so
+	// once it succeeded; handedOff is set then, and leaves scaling to the
+	// new process while this one drains.
+	upgrading atomic.Bool
+	handedOff atomic.Bool
+)
+
+type namedListener struct {
+	name string
+	ln   net.Listener
+}
+
+// listen opens the listener called name on network ("tcp", "tcp4" or
+// "tcp6"), taking it over from the previous process after an in-place
+// upgrade.
+func listen(name, network, addr string) (net.Listener, error) {
+	ln, err := inheritedListener(name)
+	if err != nil {
+		return nil, err
+	}
+	if ln == nil {
+		if ln, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	} else {
+		slog.Info("Took over listener", "listener", name, "addr", ln.Addr().String())
+	}
+	handoff = append(handoff, namedListener{name, ln})
+	return ln, nil
+}
+
+// serving is called once all listeners are open: it tells a parent waiting
+// on an upgrade that it can stop, and records the PID.
+func serving() {
+	upgradeReady()
+	notifyServiceManager(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	if pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			slog.Error("Failed to write PID_FILE", "file", pidFile, "error", err)
+		}
+	}
+}
+
+// drain stops accepting connections and waits up to timeout for open
+// sessions to end, then closes the rest.
+func drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	shutdownServers(ctx)
+	for sessions.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	if n := sessions.closeAll("going_away"); n > 0 {
+		slog.Info("Closed sessions still open after draining", "sessions", n)
+	}
+}
@@ -0,0 +1,153 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment passed to the process started by an in-place upgrade: the
+// names of the inherited listeners, which start at fd 3, and the fd to
+// report readiness on.
+const (
+	upgradeListenersEnv = "WSPROXY_UPGRADE_LISTENERS"
+	upgradeReadyEnv     = "WSPROXY_UPGRADE_READY_FD"
+)
+
+func inheritedListener(name string) (net.Listener, error) {
+	names := os.Getenv(upgradeListenersEnv)
+	if names == "" {
+		return activatedListener(name)
+	}
+	for i, n := range strings.Split(names, ",") {
+		if n != name {
+			continue
+		}
+		f := os.NewFile(uintptr(3+i), name)
+		defer f.Close()
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("inherited %s listener: %w", name, err)
+		}
+		return ln, nil
+	}
+	return nil, nil
+}
+
+func upgradeReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	f.Write([]byte("ready"))
+	f.Close()
+	os.Unsetenv(upgradeListenersEnv)
+	os.Unsetenv(upgradeReadyEnv)
+}
+
+// setupUpgrades makes SIGUSR2 start the current binary with the listeners
+// passed on; once it is serving, this process drains and exits.
+func setupUpgrades() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			if !upgrading.CompareAndSwap(false, true) {
+				slog.Warn("Upgrade already in progress")
+				continue
+			}
+			if err := upgrade(); err != nil {
+				slog.Error("Upgrade failed, keeping the current process", "error", err)
+				upgrading.Store(false)
+				continue
+			}
+			handedOff.Store(true)
+			drain(time.Duration(upgradeDrainSeconds) * time.Second)
+			os.Exit(0)
+		}
+	}()
+}
+
+func upgrade() error {
+	// Resolve the binary by name rather than os.Executable, which points
+	// at the replaced file.
+	exe, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range handoff {
+		fl, ok := l.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s listener cannot be passed on", l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	env := append(os.Environ(),
+		upgradeListenersEnv+"="+strings.Join(names, ","),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)))
+	fds := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append(fds, readyW),
+	})
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	slog.Info("Started upgraded process, waiting for it to serve", "pid", proc.Pid)
+	go proc.Wait()
+
+	// The pipe reads EOF if the new process exits before reporting in.
+	ready.SetReadDeadline(time.Now().Add(30 * time.Second))
+	buf := make([]byte, 5)
+	if n, _ := ready.Read(buf); string(buf[:n]) != "ready" {
+		proc.Kill()
+		return fmt.Errorf("process %d did not become ready", proc.Pid)
+	}
+	slog.Info("Upgraded process took over, draining sessions", "pid", proc.Pid, "sessions", sessions.count())
+	return nil
+}
+
+// notifyServiceManager sends state to systemd when running as a
+// Type=notify service; MAINPID lets it follow the proxy across upgrades.
+func notifyServiceManager(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
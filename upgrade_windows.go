@@ -0,0 +1,14 @@
+package main
+
+import "net"
+
+// In-place upgrades rely on passing sockets to a child process, which the
+// proxy only does on Unix.
+
+func inheritedListener(name string) (net.Listener, error) { return nil, nil }
+
+func upgradeReady() {}
+
+func setupUpgrades() {}
+
+func notifyServiceManager(state string) {}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// usageReset clears per-identity usage at the start of each period:
+	// "monthly" (UTC) or "" to keep counting until reset through the API.
+	usageReset = getEnv("USAGE_RESET", "")
+
+	usage = &usageStore{m: make(map[string]*identityUsage)}
+)
+
+// identityUsage is the traffic of one authenticated identity: a basic auth
+// user, or "wake-token:<id>" for sessions opened with a wake token.
+type identityUsage struct {
+	Identity  string    `json:"identity"`
+	Sessions  int64     `json:"sessions"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type usageStore struct {
+	mu     sync.Mutex
+	period string // current reset period, e.g. "2026-10" for monthly resets
+	m      map[string]*identityUsage
+}
+
+func usagePeriod(t time.Time) string {
+	if usageReset == "monthly" {
+		return t.UTC().Format("2006-01")
+	}
+	return ""
+}
+
+// roll starts a new period if the current one is over. s.mu must be held.
+func (s *usageStore) roll(now time.Time) {
+	p := usagePeriod(now)
+	if p == s.period {
+		return
+	}
+	if len(s.m) > 0 {
+		slog.Info("Usage period ended, resetting", "period", s.period, "identities", len(s.m))
+	}
+	s.period = p
+	s.m = make(map[string]*identityUsage)
+}
+
+func (s *usageStore) record(identity string, up, down int64) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roll(now)
+	u, ok := s.m[identity]
+	if !ok {
+		u = &identityUsage{Identity: identity}
+		s.m[identity] = u
+	}
+	u.Sessions++
+	u.BytesUp += up
+	u.BytesDown += down
+	u.LastSeen = now
+}
+
+func (s *usageStore) list() (string, []identityUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roll(time.Now())
+	list := []identityUsage{}
+	for _, u := range s.m {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Identity < list[j].Identity })
+	return s.period, list
+}
+
+// reset forgets the usage of identity, or of everyone if identity is empty.
+func (s *usageStore) reset(identity string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if identity == "" {
+		s.m = make(map[string]*identityUsage)
+		return true
+	}
+	_, ok := s.m[identity]
+	delete(s.m, identity)
+	return ok
+}
+
+// handleUsage is the admin API for per-identity usage: GET lists it and
+// DELETE resets one identity (?identity=...) or all of them.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		period, list := usage.list()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Period     string          `json:"period,omitempty"`
+			Identities []identityUsage `json:"identities"`
+		}{period, list})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("identity")
+		if !usage.reset(id) {
+			http.Error(w, "no such identity", http.StatusNotFound)
+			return
+		}
+		audit(adminUser(r.Context()), "reset_usage", id, nil, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
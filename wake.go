@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+var (
+	// wakeOnConnect starts scaling up as soon as the main listener accepts
+	// a connection, before the client has sent its request or finished TLS.
+	wakeOnConnect = getEnvAsBool("WAKE_ON_CONNECT", false)
+
+	// wakeHookPath is a secret path on proxy listeners that wakes backends
+	// when hit, for routers or DNS log watchers that see a client coming
+	// before it connects.
+	wakeHookPath = getEnv("WAKE_HOOK_PATH", "")
+)
+
+// wakeRoute scales rt's backend up if it is down and reports whether it
+// had to.
+func wakeRoute(rt *route, cause string) bool {
+	if isBackendUp(rt) {
+		return false
+	}
+	lg := slog.With("route", rt.Name, "deployment", rt.scale.String(), "cause", cause)
+	lg.Info("Waking backend")
+	markBackendCold(rt)
+	if err := scaleDeployment(rt.scale, rt.scale.wakeReplicas(), cause); err != nil {
+		lg.Error("Failed to scale backend up", "error", err)
+	}
+	return true
+}
+
+// wakeListener wakes the backends of a listener's routes on every accepted
+// connection.
+type wakeListener struct {
+	net.Listener
+	l *listenerConfig
+}
+
+func (wl wakeListener) Accept() (net.Conn, error) {
+	c, err := wl.Listener.Accept()
+	if err == nil {
+		go wl.wake()
+	}
+	return c, err
+}
+
+func (wl wakeListener) wake() {
+	woken := make(map[*scaleTarget]bool)
+	for _, rt := range routing.Load().routes {
+		if woken[rt.scale] || (wl.l.routes != nil && !wl.l.routes[rt.Name]) {
+			continue
+		}
+		woken[rt.scale] = true
+		wakeRoute(rt, "connect")
+	}
+}
+
+// wakeTargets wakes the deployments of the routes r may use, or only of
+// the route named by its "route" parameter, and counts the wake as
+// traffic. It returns the deployments that were down.
+func wakeTargets(r *http.Request, cause string) ([]string, bool) {
+	t := routing.Load()
+	candidates := t.routes
+	if name := r.URL.Query().Get("route"); name != "" {
+		rt := t.byName(name)
+		if rt == nil || !listenerAllows(r, rt) {
+			return nil, false
+		}
+		candidates = []*route{rt}
+	}
+	woken := []string{}
+	seen := make(map[*scaleTarget]bool)
+	for _, rt := range candidates {
+		if seen[rt.scale] || !listenerAllows(r, rt) {
+			continue
+		}
+		seen[rt.scale] = true
+		recordActivity(rt)
+		if wakeRoute(rt, cause) {
+			woken = append(woken, rt.scale.String())
+		}
+	}
+	return woken, true
+}
+
+// handleWakeHook serves WAKE_HOOK_PATH. Any method works so the simplest
+// HTTP client can trigger it.
+func handleWakeHook(w http.ResponseWriter, r *http.Request) {
+	woken, ok := wakeTargets(r, "external")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeWoken(w, woken)
+}
+
+// handleWake is the admin API equivalent of WAKE_HOOK_PATH: POST
+// [?route=...] wakes backends.
+func handleWake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	woken, ok := wakeTargets(r, "external")
+	if !ok {
+		http.Error(w, "unknown route", http.StatusBadRequest)
+		return
+	}
+	audit(adminUser(r.Context()), "wake", r.URL.Query().Get("route"), map[string]interface{}{"woken": woken}, nil)
+	writeWoken(w, woken)
+}
+
+func writeWoken(w http.ResponseWriter, woken []string) {
+	w.Header().Set("Content-Type", "application/json")
+	status := http.StatusOK
+	if len(woken) > 0 {
+		status = http.StatusAccepted
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Woken []string `json:"woken"`
+	}{woken})
+}
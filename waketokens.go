@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// wakeTokenPath is where single-use wake tokens are presented, as
+	// <path><token>, in place of a route's own path.
+	wakeTokenPath = getEnv("WAKE_TOKEN_PATH", "/wake/")
+
+	wakeTokens = &wakeTokenStore{m: make(map[string]*wakeToken)}
+)
+
+// wakeToken grants exactly one connection (and with it a scale-up) to a
+// route until it expires, so access can be shared without handing out the
+// route's path.
+type wakeToken struct {
+	Token   string    `json:"token,omitempty"`
+	ID      string    `json:"id"` // token prefix, safe to list
+	Route   string    `json:"route"`
+	Expires time.Time `json:"expires"`
+	Creator string    `json:"creator"`
+}
+
+type wakeTokenStore struct {
+	mu sync.Mutex
+	m  map[string]*wakeToken
+}
+
+func (s *wakeTokenStore) create(route string, ttl time.Duration, creator string) *wakeToken {
+	b := make([]byte, 24)
+	rand.Read(b)
+	tok := base64.RawURLEncoding.EncodeToString(b)
+	t := &wakeToken{Token: tok, ID: tok[:8], Route: route, Expires: clk.Now().Add(ttl), Creator: creator}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	s.m[tok] = t
+	return t
+}
+
+// prune drops the tokens that expired without being redeemed. s.mu must be
+// held.
+func (s *wakeTokenStore) prune() {
+	now := clk.Now()
+	for tok, t := range s.m {
+		if now.After(t.Expires) {
+			delete(s.m, tok)
+		}
+	}
+}
+
+// redeem returns the route for a request on the wake token path, and the
+// identity its session is accounted to, and uses up the token. Requests
+// that could not use the route, such as a link preview fetching a
+// WebSocket URL, leave the token intact.
+func (s *wakeTokenStore) redeem(r *http.Request, ip string) (*route, string) {
+	tok, ok := strings.CutPrefix(r.URL.Path, wakeTokenPath)
+	if !ok || tok == "" {
+		return nil, ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.m[tok]
+	if !ok || clk.Now().After(t.Expires) {
+		delete(s.m, tok)
+		bans.strike(ip, "invalid wake tokens")
+		return nil, ""
+	}
+	rt := routing.Load().byName(t.Route)
+	if rt == nil || !listenerAllows(r, rt) || (rt.Kind == "websocket" && !isValidUpgrade(r)) {
+		return nil, ""
+	}
+	delete(s.m, tok)
+	slog.Info("Wake token redeemed", "token_id", t.ID, "client", ip, "route", t.Route, "request_id", requestID(r))
+	return rt, "wake-token:" + t.ID
+}
+
+// list returns the unexpired tokens without their secret part.
+func (s *wakeTokenStore) list() []wakeToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	list := []wakeToken{}
+	for _, t := range s.m {
+		c := *t
+		c.Token = ""
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	return list
+}
+
+func (s *wakeTokenStore) revoke(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tok, t := range s.m {
+		if t.ID == id {
+			delete(s.m, tok)
+			return true
+		}
+	}
+	return false
+}
+
+// handleWakeTokens is the admin API for wake tokens: GET lists them,
+// POST {"route": "...", "ttl_seconds": N} creates one and DELETE ?id=...
+// revokes one.
+func handleWakeTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wakeTokens.list())
+	case http.MethodPost:
+		var req struct {
+			Route      string `json:"route"`
+			TTLSeconds int    `json:"ttl_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t := routing.Load()
+		if req.Route == "" && len(t.routes) > 0 {
+			req.Route = t.routes[0].Name
+		}
+		if t.byName(req.Route) == nil {
+			http.Error(w, "unknown route", http.StatusBadRequest)
+			return
+		}
+		if req.TTLSeconds <= 0 {
+			req.TTLSeconds = 3600
+		}
+		user := adminUser(r.Context())
+		tok := wakeTokens.create(req.Route, time.Duration(req.TTLSeconds)*time.Second, user)
+		audit(user, "create_wake_token", req.Route, map[string]interface{}{"id": tok.ID, "ttl_seconds": req.TTLSeconds}, nil)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			*wakeToken
+			Path string `json:"path"`
+		}{tok, wakeTokenPath + tok.Token})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !wakeTokens.revoke(id) {
+			http.Error(w, "no such token", http.StatusNotFound)
+			return
+		}
+		audit(adminUser(r.Context()), "revoke_wake_token", id, nil, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
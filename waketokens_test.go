@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWakeTokenCreatePrunes(t *testing.T) {
+	s := &wakeTokenStore{m: make(map[string]*wakeToken)}
+	for i := 0; i < 3; i++ {
+		s.create("vmess", -time.Second, "admin-token")
+	}
+	live := s.create("vmess", time.Hour, "admin-token")
+	if len(s.m) != 1 || s.m[live.Token] == nil {
+		t.Fatalf("%d tokens after creating one past expired ones, want only the new one", len(s.m))
+	}
+}
+
+func TestWakeTokenExpiresOnTheClock(t *testing.T) {
+	c := useFakeClock(t)
+	s := &wakeTokenStore{m: make(map[string]*wakeToken)}
+	old := s.create("vmess", time.Minute, "admin-token")
+	c.Advance(time.Minute)
+	s.create("vmess", time.Minute, "admin-token")
+	if s.m[old.Token] == nil {
+		t.Fatal("token pruned when it was just due")
+	}
+	c.Advance(time.Second)
+	s.create("vmess", time.Minute, "admin-token")
+	if s.m[old.Token] != nil {
+		t.Fatal("token kept past its expiry")
+	}
+}
@@ -0,0 +1,9 @@
+module auto_scale
+
+go 1.25.0
+
+require (
+	github.com/tetratelabs/wazero v1.12.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.44.0
+)
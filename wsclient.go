@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// wsClient is a minimal WebSocket client used by the proxy's own tooling
+// (replay, probes); it does not handle extensions or fragmentation on send.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWS opens a WebSocket connection to rawURL (ws, wss, http or https).
+func dialWS(rawURL string, header http.Header, timeout time.Duration) (*wsClient, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	host := u.Host
+	secure := u.Scheme == "wss" || u.Scheme == "https"
+	if u.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key [16]byte
+	rand.Read(key[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:       u.Host,
+		Header:     http.Header{},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key[:]))
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, resp, fmt.Errorf("handshake failed: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsClient{conn: conn, br: br}, resp, nil
+}
+
+func (c *wsClient) writeFrame(opcode byte, payload []byte) error {
+	_, err := c.conn.Write(appendWSFrame(nil, opcode, payload, true))
+	return err
+}
+
+// readFrame reads one frame.
+func (c *wsClient) readFrame() (opcode byte, fin bool, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	opcode = hdr[0] & 0x0f
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	masked := hdr[1]&0x80 != 0
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+	if length > 64<<20 {
+		err = errBadFrame
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+	return
+}
+
+func (c *wsClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+var errBadFrame = errors.New("malformed websocket frame")
+
+type wsFrame struct {
+	fin    bool
+	rsv1   bool // set by permessage-deflate on compressed messages
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+
+	// wantPayload is set by frameStart when the handler wants the
+	// (unmasked) payload of this frame delivered to framePayload.
+	wantPayload bool
+}
+
+func (f *wsFrame) isControl() bool { return f.opcode&0x8 != 0 }
+
+// wsFrameHandler observes frames as a wsFrameParser walks a byte stream.
+type wsFrameHandler interface {
+	frameStart(f *wsFrame) error
+	framePayload(f *wsFrame, p []byte) error
+	frameEnd(f *wsFrame) error
+}
+
+// wsFrameParser incrementally decodes WebSocket frames from a relayed byte
+// stream without buffering whole messages. It never modifies the bytes it is
+// fed; the caller forwards them unchanged.
+type wsFrameParser struct {
+	h       wsFrameHandler
+	hdr     [14]byte
+	hdrLen  int
+	frame   wsFrame
+	left    uint64 // payload bytes left in the current frame
+	maskPos int
+	inBody  bool
+	scratch []byte
+}
+
+func newWSFrameParser(h wsFrameHandler) *wsFrameParser {
+	return &wsFrameParser{h: h}
+}
+
+// atBoundary reports whether the stream is between two frames, i.e. whether
+// a frame generated by the proxy can be spliced in without corrupting it.
+func (p *wsFrameParser) atBoundary() bool {
+	return p.hdrLen == 0 && !p.inBody
+}
+
+func wsHeaderSize(hdr []byte) int {
+	if len(hdr) < 2 {
+		return 2
+	}
+	size := 2
+	switch hdr[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if hdr[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func (p *wsFrameParser) feed(b []byte) error {
+	for len(b) > 0 {
+		if !p.inBody {
+			need := wsHeaderSize(p.hdr[:p.hdrLen])
+			n := copy(p.hdr[p.hdrLen:need], b)
+			p.hdrLen += n
+			b = b[n:]
+			if p.hdrLen < need || need != wsHeaderSize(p.hdr[:p.hdrLen]) {
+				continue
+			}
+			if err := p.startFrame(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		n := int(min(uint64(len(b)), p.left))
+		if p.frame.wantPayload {
+			if err := p.h.framePayload(&p.frame, p.unmask(b[:n])); err != nil {
+				return err
+			}
+		}
+		p.left -= uint64(n)
+		b = b[n:]
+		if p.left == 0 {
+			if err := p.endFrame(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *wsFrameParser) startFrame() error {
+	hdr := p.hdr[:p.hdrLen]
+	f := &p.frame
+	*f = wsFrame{
+		fin:    hdr[0]&0x80 != 0,
+		rsv1:   hdr[0]&0x40 != 0,
+		opcode: hdr[0] & 0x0f,
+		masked: hdr[1]&0x80 != 0,
+	}
+	pos := 2
+	switch l := hdr[1] & 0x7f; l {
+	case 126:
+		f.length = uint64(binary.BigEndian.Uint16(hdr[2:]))
+		pos = 4
+	case 127:
+		f.length = binary.BigEndian.Uint64(hdr[2:])
+		pos = 10
+		if f.length>>63 != 0 {
+			return errBadFrame
+		}
+	default:
+		f.length = uint64(l)
+	}
+	if f.masked {
+		copy(f.mask[:], hdr[pos:pos+4])
+	}
+	if f.isControl() && (!f.fin || f.length > 125) {
+		return errBadFrame
+	}
+
+	p.hdrLen = 0
+	p.left = f.length
+	p.maskPos = 0
+	p.inBody = true
+	if err := p.h.frameStart(f); err != nil {
+		return err
+	}
+	if f.length == 0 {
+		return p.endFrame()
+	}
+	return nil
+}
+
+func (p *wsFrameParser) endFrame() error {
+	p.inBody = false
+	return p.h.frameEnd(&p.frame)
+}
+
+// unmask returns the payload chunk with the client mask removed. Unmasked
+// chunks are returned as-is and must not be modified by the handler.
+func (p *wsFrameParser) unmask(chunk []byte) []byte {
+	if !p.frame.masked {
+		return chunk
+	}
+	if cap(p.scratch) < len(chunk) {
+		p.scratch = make([]byte, len(chunk))
+	}
+	out := p.scratch[:len(chunk)]
+	for i, c := range chunk {
+		out[i] = c ^ p.frame.mask[(p.maskPos+i)&3]
+	}
+	p.maskPos = (p.maskPos + len(chunk)) & 3
+	return out
+}
+
+// appendWSFrame appends a single unfragmented frame to dst. Frames sent
+// towards a server must be masked (RFC 6455 section 5.3).
+func appendWSFrame(dst []byte, opcode byte, payload []byte, masked bool) []byte {
+	dst = append(dst, 0x80|opcode)
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		dst = append(dst, maskBit|byte(n))
+	case n <= 0xffff:
+		dst = append(dst, maskBit|126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	default:
+		dst = append(dst, maskBit|127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(n))
+	}
+	if !masked {
+		return append(dst, payload...)
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	dst = append(dst, key[:]...)
+	for i, c := range payload {
+		dst = append(dst, c^key[i&3])
+	}
+	return dst
+}
+
+func opcodeName(op byte) string {
+	switch op {
+	case opContinuation:
+		return "continuation"
+	case opText:
+		return "text"
+	case opBinary:
+		return "binary"
+	case opClose:
+		return "close"
+	case opPing:
+		return "ping"
+	case opPong:
+		return "pong"
+	}
+	return "unknown"
+}
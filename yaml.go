@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML reads the block-style subset of YAML that kubeconfig files are
+// written in: nested mappings and sequences by indentation, plain scalars
+// (also wrapped onto more indented lines) and quoted ones, "|" blocks,
+// comments and flow collections of scalars.
+// Anchors, tags and multiple documents are not supported. Mappings come
+// back as map[string]any and sequences as []any; true, false and null are
+// typed, every other scalar is a string.
+func parseYAML(data []byte) (any, error) {
+	var lines []yamlLine
+	raws := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	for i, raw := range raws {
+		text := stripYAMLComment(raw)
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.TrimSpace(trimmed) == "" || trimmed == "---" || strings.HasPrefix(trimmed, "%") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: strings.TrimRight(trimmed, " \t")})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines, raw: raws}
+	v, err := p.node(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	raw   []string // every line, for blocks
+	pos   int
+}
+
+func (l yamlLine) isItem() bool {
+	return l.text == "-" || strings.HasPrefix(l.text, "- ")
+}
+
+// node parses the mapping or sequence whose lines start at indent.
+func (p *yamlParser) node(indent int) (any, error) {
+	if p.lines[p.pos].isItem() {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	items := []any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent != indent || !l.isItem() {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.child(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		// The item's content continues at the column it starts in.
+		col := indent + len(l.text) - len(rest)
+		if _, _, ok := splitYAMLKey(rest); ok || strings.HasPrefix(rest, "- ") {
+			p.lines[p.pos] = yamlLine{num: l.num, indent: col, text: rest}
+			v, err := p.node(col)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		p.pos++
+		v, err := yamlScalar(p.plain(indent, rest))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.num, err)
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		if l.isItem() {
+			// A sequence at the same indentation as the mapping only
+			// follows a key with no value, which child handles.
+			return nil, fmt.Errorf("line %d: unexpected sequence item", l.num)
+		}
+		key, value, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", l.num)
+		}
+		p.pos++
+		var v any
+		var err error
+		switch {
+		case value == "":
+			v, err = p.child(indent, true)
+		case value == "|" || value == "|-" || value == ">" || value == ">-":
+			v = p.block(indent, value)
+		default:
+			v, err = yamlScalar(p.plain(indent, value))
+			if err != nil {
+				err = fmt.Errorf("line %d: %w", l.num, err)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// child parses the value of a key or item with nothing after it: a nested
+// node if one follows, or null. In a mapping, a sequence may sit at the
+// key's own indentation.
+func (p *yamlParser) child(indent int, inMapping bool) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent || (inMapping && next.indent == indent && next.isItem()) {
+		return p.node(next.indent)
+	}
+	return nil, nil
+}
+
+// plain joins the lines a plain scalar is wrapped onto, which are indented
+// further than its key or item, as kubectl writes long values. Lines that
+// look like a key or an item are left for the caller to reject.
+func (p *yamlParser) plain(indent int, value string) string {
+	if strings.ContainsAny(value[:1], "\"'[{|>") {
+		return value
+	}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if _, _, ok := splitYAMLKey(l.text); ok || l.indent <= indent || l.isItem() {
+			break
+		}
+		value += " " + l.text
+		p.pos++
+	}
+	return value
+}
+
+// block reads a literal (|) or folded (>) block scalar.
+func (p *yamlParser) block(indent int, style string) string {
+	first, last, blockIndent := 0, 0, -1
+	for p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		l := p.lines[p.pos]
+		if blockIndent < 0 {
+			first, blockIndent = l.num, l.indent
+		}
+		last = l.num
+		p.pos++
+	}
+	if blockIndent < 0 {
+		return ""
+	}
+	// Comment and blank lines were dropped from p.lines, but within a
+	// block they are text, so it is read from the raw lines.
+	var parts []string
+	for _, raw := range p.raw[first-1 : last] {
+		text := strings.TrimRight(raw, " \t\r")
+		if len(text) > blockIndent {
+			text = text[blockIndent:]
+		} else {
+			text = strings.TrimLeft(text, " ")
+		}
+		parts = append(parts, text)
+	}
+	var s string
+	if strings.HasPrefix(style, ">") {
+		// Folded lines are joined by spaces, and a blank line is a
+		// line break.
+		for i, part := range parts {
+			switch {
+			case part == "":
+				s += "\n"
+			case i > 0 && parts[i-1] != "":
+				s += " " + part
+			default:
+				s += part
+			}
+		}
+	} else {
+		s = strings.Join(parts, "\n")
+	}
+	if !strings.HasSuffix(style, "-") {
+		s += "\n"
+	}
+	return s
+}
+
+// splitYAMLKey splits "key: value" (or "key:"), honouring a quoted key.
+func splitYAMLKey(text string) (key, value string, ok bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := closingQuote(text)
+		if end < 0 || end+1 >= len(text) || text[end+1] != ':' {
+			return "", "", false
+		}
+		k, err := yamlScalar(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return k.(string), strings.TrimSpace(text[end+2:]), true
+	}
+	if strings.HasPrefix(text, "- ") || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// closingQuote returns the index of the quote closing the string s starts
+// with, or -1.
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment removes a trailing "# comment" outside quotes.
+func stripYAMLComment(line string) string {
+	var q byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case q == 0 && (c == '"' || c == '\'') && (i == 0 || strings.ContainsRune(" :-[{,", rune(line[i-1]))):
+			q = c
+		case q == '"' && c == '\\', q == '\'' && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			i++
+		case q != 0 && c == q:
+			q = 0
+		case q == 0 && c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func yamlScalar(s string) (any, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case s[0] == '"':
+		if closingQuote(s) != len(s)-1 {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if closingQuote(s) != len(s)-1 {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s[0] == '[':
+		return yamlFlowSequence(s)
+	case s[0] == '{':
+		return yamlFlowMapping(s)
+	case s[0] == '&' || s[0] == '*' || s[0] == '!':
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	}
+	switch s {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	return s, nil
+}
+
+// yamlFlowSequence parses "[a, "b", c]" of scalars.
+func yamlFlowSequence(s string) (any, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated sequence %s", s)
+	}
+	parts, err := splitYAMLFlow(s[1 : len(s)-1])
+	if err != nil {
+		return nil, fmt.Errorf("%w in %s", err, s)
+	}
+	items := []any{}
+	for _, part := range parts {
+		v, err := yamlScalar(part)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+// yamlFlowMapping parses "{a: b, "c": d}" of scalars.
+func yamlFlowMapping(s string) (any, error) {
+	if !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("unterminated mapping %s", s)
+	}
+	parts, err := splitYAMLFlow(s[1 : len(s)-1])
+	if err != nil {
+		return nil, fmt.Errorf("%w in %s", err, s)
+	}
+	m := map[string]any{}
+	for _, part := range parts {
+		key, value, ok := splitYAMLKey(part)
+		if !ok {
+			return nil, fmt.Errorf("expected \"key: value\" in %s", s)
+		}
+		v, err := yamlScalar(value)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// splitYAMLFlow splits the body of a flow collection at commas outside
+// quotes, dropping empty entries.
+func splitYAMLFlow(body string) ([]string, error) {
+	var parts []string
+	start := 0
+	for i := 0; i <= len(body); i++ {
+		if i < len(body) && (body[i] == '"' || body[i] == '\'') && strings.TrimSpace(body[start:i]) == "" {
+			end := closingQuote(body[i:])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			i += end
+			continue
+		}
+		if i == len(body) || body[i] == ',' {
+			if part := strings.TrimSpace(body[start:i]); part != "" {
+				if strings.ContainsAny(part[:1], "[{") {
+					return nil, fmt.Errorf("nested flow collections are not supported")
+				}
+				parts = append(parts, part)
+			}
+			start = i + 1
+		}
+	}
+	return parts, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type (
+	ym = map[string]any
+	yl = []any
+)
+
+const kindKubeconfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCg==
+    server: https://127.0.0.1:40321
+  name: kind-kind
+contexts:
+- context:
+    cluster: kind-kind
+    user: kind-kind
+  name: kind-kind
+current-context: kind-kind
+kind: Config
+preferences: {}
+users:
+- name: kind-kind
+  user:
+    client-certificate-data: Y2VydA==
+    client-key-data: a2V5
+`
+
+const eksKubeconfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: Q0E=
+    server: https://0123456789ABCDEF.gr7.us-west-2.eks.amazonaws.com
+  name: arn:aws:eks:us-west-2:111122223333:cluster/prod
+contexts:
+- context:
+    cluster: arn:aws:eks:us-west-2:111122223333:cluster/prod
+    user: arn:aws:eks:us-west-2:111122223333:cluster/prod
+  name: arn:aws:eks:us-west-2:111122223333:cluster/prod
+current-context: arn:aws:eks:us-west-2:111122223333:cluster/prod
+kind: Config
+preferences: {}
+users:
+- name: arn:aws:eks:us-west-2:111122223333:cluster/prod
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      args:
+      - --region
+      - us-west-2
+      - eks
+      - get-token
+      - --cluster-name
+      - prod
+      command: aws
+      env:
+      - name: AWS_PROFILE
+        value: prod
+      interactiveMode: IfAvailable
+      provideClusterInfo: false
+`
+
+// kubectl wraps long plain values, here the installHint, onto a more
+// indented line.
+const gkeKubeconfig = `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: Q0E=
+    server: https://34.66.1.2
+  name: gke_proj_us-central1_web
+contexts:
+- context:
+    cluster: gke_proj_us-central1_web
+    user: gke_proj_us-central1_web
+  name: gke_proj_us-central1_web
+current-context: gke_proj_us-central1_web
+kind: Config
+preferences: {}
+users:
+- name: gke_proj_us-central1_web
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: gke-gcloud-auth-plugin
+      installHint: Install gke-gcloud-auth-plugin for use with kubectl by following
+        https://cloud.google.com/kubernetes-engine/docs/how-to/cluster-access-for-kubectl#install_plugin
+      provideClusterInfo: true
+`
+
+func TestParseYAML(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want any
+	}{
+		{"kind", kindKubeconfig, ym{
+			"apiVersion": "v1",
+			"clusters": yl{ym{
+				"cluster": ym{"certificate-authority-data": "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCg==", "server": "https://127.0.0.1:40321"},
+				"name":    "kind-kind",
+			}},
+			"contexts":        yl{ym{"context": ym{"cluster": "kind-kind", "user": "kind-kind"}, "name": "kind-kind"}},
+			"current-context": "kind-kind",
+			"kind":            "Config",
+			"preferences":     ym{},
+			"users": yl{ym{
+				"name": "kind-kind",
+				"user": ym{"client-certificate-data": "Y2VydA==", "client-key-data": "a2V5"},
+			}},
+		}},
+		{"eks", eksKubeconfig, ym{
+			"apiVersion": "v1",
+			"clusters": yl{ym{
+				"cluster": ym{"certificate-authority-data": "Q0E=", "server": "https://0123456789ABCDEF.gr7.us-west-2.eks.amazonaws.com"},
+				"name":    "arn:aws:eks:us-west-2:111122223333:cluster/prod",
+			}},
+			"contexts": yl{ym{
+				"context": ym{"cluster": "arn:aws:eks:us-west-2:111122223333:cluster/prod", "user": "arn:aws:eks:us-west-2:111122223333:cluster/prod"},
+				"name":    "arn:aws:eks:us-west-2:111122223333:cluster/prod",
+			}},
+			"current-context": "arn:aws:eks:us-west-2:111122223333:cluster/prod",
+			"kind":            "Config",
+			"preferences":     ym{},
+			"users": yl{ym{
+				"name": "arn:aws:eks:us-west-2:111122223333:cluster/prod",
+				"user": ym{"exec": ym{
+					"apiVersion":         "client.authentication.k8s.io/v1beta1",
+					"args":               yl{"--region", "us-west-2", "eks", "get-token", "--cluster-name", "prod"},
+					"command":            "aws",
+					"env":                yl{ym{"name": "AWS_PROFILE", "value": "prod"}},
+					"interactiveMode":    "IfAvailable",
+					"provideClusterInfo": false,
+				}},
+			}},
+		}},
+		{"gke", gkeKubeconfig, ym{
+			"apiVersion": "v1",
+			"clusters": yl{ym{
+				"cluster": ym{"certificate-authority-data": "Q0E=", "server": "https://34.66.1.2"},
+				"name":    "gke_proj_us-central1_web",
+			}},
+			"contexts":        yl{ym{"context": ym{"cluster": "gke_proj_us-central1_web", "user": "gke_proj_us-central1_web"}, "name": "gke_proj_us-central1_web"}},
+			"current-context": "gke_proj_us-central1_web",
+			"kind":            "Config",
+			"preferences":     ym{},
+			"users": yl{ym{
+				"name": "gke_proj_us-central1_web",
+				"user": ym{"exec": ym{
+					"apiVersion":         "client.authentication.k8s.io/v1beta1",
+					"command":            "gke-gcloud-auth-plugin",
+					"installHint":        "Install gke-gcloud-auth-plugin for use with kubectl by following https://cloud.google.com/kubernetes-engine/docs/how-to/cluster-access-for-kubectl#install_plugin",
+					"provideClusterInfo": true,
+				}},
+			}},
+		}},
+		{"empty", "# nothing\n---\n", nil},
+		{"comments and CRLF", "a: 1 # one\r\n# whole line\r\nb: x#y\r\n", ym{"a": "1", "b": "x#y"}},
+		{"literal block", "a: |\n  line1\n  # kept\n\n    indented\nb: 1\n", ym{"a": "line1\n# kept\n\n  indented\n", "b": "1"}},
+		{"literal block, stripped", "a: |-\n  one\n  two\n", ym{"a": "one\ntwo"}},
+		{"folded block", "a: >\n  one\n  two\n\n  three\n", ym{"a": "one two\nthree\n"}},
+		{"double quoted", `a: "x: y # not a comment\t\"q\" \u00e9"`, ym{"a": "x: y # not a comment\t\"q\" é"}},
+		{"single quoted", `a: 'it''s # here'`, ym{"a": "it's # here"}},
+		{"quoted key", `"a: b": 1`, ym{"a: b": "1"}},
+		{"null and booleans", "a: ~\nb: null\nc: true\nd: FALSE\ne:\n", ym{"a": nil, "b": nil, "c": true, "d": false, "e": nil}},
+		{"flow sequence", `a: [one, "two, three", 'four', ]`, ym{"a": yl{"one", "two, three", "four"}}},
+		{"flow mapping", `a: {b: 1, "c": two}`, ym{"a": ym{"b": "1", "c": "two"}}},
+		{"empty flow collections", "a: []\nb: {}\n", ym{"a": yl{}, "b": ym{}}},
+		{"sequence at the key's indentation", "a:\n- b\n- c: d\n  e: f\n", ym{"a": yl{"b", ym{"c": "d", "e": "f"}}}},
+		{"nested sequences", "- - a\n  - b\n-\n  - c\n", yl{yl{"a", "b"}, yl{"c"}}},
+		{"wrapped item", "- a long\n  item\n- b\n", yl{"a long item", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tc.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got  %#v\nwant %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"a: 1\n\tb: 2\n", "line 2: tabs"},
+		{"a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"  a: 1\nb: 2\n", "line 2: unexpected indentation"},
+		{"a:\n  - b\n  c: d\n", "line 3: unexpected indentation"},
+		{"- a\nb: 1\n", "line 2: unexpected indentation"},
+		{"a: 1\n- b\n", "line 2: unexpected sequence item"},
+		{"a: 1\nplain text\n", `line 2: expected "key: value"`},
+		{`a: "open`, "line 1: unterminated string"},
+		{`a: "x" y`, "line 1: unterminated string"},
+		{`a: 'open`, "line 1: unterminated string"},
+		{`a: "\q"`, "line 1: invalid string"},
+		{`- "open`, "line 1: unterminated string"},
+		{"a: [1, 2\n", "line 1: unterminated sequence"},
+		{"a: {b: 1\n", "line 1: unterminated mapping"},
+		{"a: {b}\n", `line 1: expected "key: value"`},
+		{"a: [[1]]\n", "line 1: nested flow collections"},
+		{`a: ["x, y]`, "line 1: unterminated string"},
+		{"a: &anchor 1\n", "line 1: anchors"},
+		{"a: *anchor\n", "line 1: anchors"},
+		{"a: !!str 1\n", "line 1: anchors"},
+	} {
+		v, err := parseYAML([]byte(tc.in))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseYAML(%q) = %#v, %v; want an error containing %q", tc.in, v, err, tc.want)
+		}
+	}
+}
+
+// Truncating a valid document anywhere must give a result or an error,
+// never a panic.
+func TestParseYAMLTruncated(t *testing.T) {
+	for _, doc := range []string{kindKubeconfig, eksKubeconfig, gkeKubeconfig, "a: \"x\"\nb: 'y'\nc: [1, \"2\"]\nd: {e: f}\ng: |\n  h\n"} {
+		for i := range doc {
+			parseYAML([]byte(doc[:i]))
+		}
+	}
+}